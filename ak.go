@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+)
+
+// akHandle is the persistent handle of the attestation key.
+const akHandle tpm2.Handle = 0x81010002
+
+// akTemplate is the template of the attestation key, a restricted RSA
+// signing key in the endorsement hierarchy.
+var akTemplate = tpm2.Public{
+	Type:    tpm2.ObjectTypeRSA,
+	NameAlg: tpm2.HashAlgorithmSHA256,
+	Attrs: tpm2.AttrFixedTPM | tpm2.AttrFixedParent | tpm2.AttrSensitiveDataOrigin |
+		tpm2.AttrUserWithAuth | tpm2.AttrRestricted | tpm2.AttrSign,
+	Params: &tpm2.PublicParamsU{
+		RSADetail: &tpm2.RSAParams{
+			Symmetric: tpm2.SymDefObject{Algorithm: tpm2.SymObjectAlgorithmNull},
+			Scheme: tpm2.RSAScheme{
+				Scheme: tpm2.RSASchemeRSASSA,
+				Details: &tpm2.AsymSchemeU{
+					RSASSA: &tpm2.SigSchemeRSASSA{HashAlg: tpm2.HashAlgorithmSHA256},
+				},
+			},
+			KeyBits: 2048,
+		},
+	},
+}
+
+// akResponse is the output of the create-ak operation, containing what a
+// privacy CA needs to create a credential for the attestation key.
+type akResponse struct {
+	Handle   uint32 `json:"handle"`
+	Name     string `json:"name"`
+	Public   string `json:"public"`
+	EKPublic string `json:"ek-public"`
+}
+
+type activateCredentialParams struct {
+	CredentialBlob string `json:"credential-blob"`
+	Secret         string `json:"secret"`
+}
+
+type activateCredentialResponse struct {
+	Credential string `json:"credential"`
+}
+
+// createAK creates the attestation key and persists it in the TPM, writing
+// its public area and the endorsement key public area to stdout.
+func createAK() error {
+	tpm, err := connectTPM()
+	if err != nil {
+		return fmt.Errorf("cannot connect to TPM: %v", err)
+	}
+	defer tpm.Close()
+
+	if _, err := tpm.CreateResourceContextFromTPM(akHandle); err == nil {
+		return fmt.Errorf("attestation key already exists")
+	}
+
+	if err := trackHandle(akHandle, handlePurposeAK); err != nil {
+		return err
+	}
+	ak, akPublic, _, _, _, err := tpm.CreatePrimary(tpm.EndorsementHandleContext(), nil, &akTemplate, nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("cannot create attestation key: %v", err)
+	}
+	defer tpm.FlushContext(ak)
+
+	if _, err := tpm.EvictControl(tpm.OwnerHandleContext(), ak, akHandle, nil); err != nil {
+		return fmt.Errorf("cannot persist attestation key: %v", err)
+	}
+
+	ek, err := tpm.EndorsementKey()
+	if err != nil {
+		return fmt.Errorf("cannot obtain endorsement key: %v", err)
+	}
+	ekPublic, _, _, err := tpm.ReadPublic(ek)
+	if err != nil {
+		return fmt.Errorf("cannot read endorsement key: %v", err)
+	}
+
+	akPublicData, err := mu.MarshalToBytes(akPublic)
+	if err != nil {
+		return err
+	}
+	ekPublicData, err := mu.MarshalToBytes(ekPublic)
+	if err != nil {
+		return err
+	}
+
+	resp := akResponse{
+		Handle:   uint32(akHandle),
+		Name:     hex.EncodeToString(ak.Name()),
+		Public:   base64.StdEncoding.EncodeToString(akPublicData),
+		EKPublic: base64.StdEncoding.EncodeToString(ekPublicData),
+	}
+	return writeResponse(&resp)
+}
+
+// activateCredential recovers the credential created by a privacy CA for
+// the attestation key, proving that the key resides in the same TPM as the
+// endorsement key.
+func activateCredential(p []byte) error {
+	var params activateCredentialParams
+	if err := json.Unmarshal(p, &params); err != nil {
+		return err
+	}
+	credentialBlob, err := base64.StdEncoding.DecodeString(params.CredentialBlob)
+	if err != nil {
+		return fmt.Errorf("invalid credential blob: %v", err)
+	}
+	secret, err := base64.StdEncoding.DecodeString(params.Secret)
+	if err != nil {
+		return fmt.Errorf("invalid secret: %v", err)
+	}
+
+	tpm, err := connectTPM()
+	if err != nil {
+		return fmt.Errorf("cannot connect to TPM: %v", err)
+	}
+	defer tpm.Close()
+
+	ak, err := tpm.CreateResourceContextFromTPM(akHandle)
+	if err != nil {
+		return fmt.Errorf("cannot find attestation key: %v", err)
+	}
+	ek, err := tpm.EndorsementKey()
+	if err != nil {
+		return fmt.Errorf("cannot obtain endorsement key: %v", err)
+	}
+
+	// the endorsement key requires the endorsement hierarchy authorization
+	session, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, tpm2.HashAlgorithmSHA256)
+	if err != nil {
+		return err
+	}
+	defer tpm.FlushContext(session)
+	if _, _, err := tpm.PolicySecret(tpm.EndorsementHandleContext(), session, nil, nil, 0, nil); err != nil {
+		return err
+	}
+
+	credential, err := tpm.ActivateCredential(ak, ek, credentialBlob, secret, nil, session)
+	if err != nil {
+		return fmt.Errorf("cannot activate credential: %v", err)
+	}
+
+	resp := activateCredentialResponse{
+		Credential: base64.StdEncoding.EncodeToString(credential),
+	}
+	return writeResponse(&resp)
+}
+
+// deleteAK removes the persistent attestation key from the TPM.
+func deleteAK() error {
+	tpm, err := connectTPM()
+	if err != nil {
+		return fmt.Errorf("cannot connect to TPM: %v", err)
+	}
+	defer tpm.Close()
+
+	ak, err := tpm.CreateResourceContextFromTPM(akHandle)
+	if err != nil {
+		return fmt.Errorf("cannot find attestation key: %v", err)
+	}
+	if _, err := tpm.EvictControl(tpm.OwnerHandleContext(), ak, akHandle, nil); err != nil {
+		return fmt.Errorf("cannot delete attestation key: %v", err)
+	}
+	return untrackHandle(akHandle)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/canonical/go-tpm2"
+	sb "github.com/snapcore/secboot"
+)
+
+// assetVersionCounterHandle is the NV counter storing the minimum version of
+// the boot assets the key can be sealed to.
+const assetVersionCounterHandle tpm2.Handle = 0x01880012
+
+// assetVersionBaseHandle is the NV index storing the value the boot asset
+// version counter had when it was defined: a new NV counter starts at the
+// highest value of any counter in the TPM. The index can only be written
+// once.
+const assetVersionBaseHandle tpm2.Handle = 0x01880014
+
+// defaultAssetVersionBaseFile is where older versions recorded the base of
+// the versions, it's moved to the TPM when found.
+const defaultAssetVersionBaseFile = "/run/mnt/ubuntu-boot/device/fde/asset-version-base"
+
+// maxAssetVersionIncrements limits the TPM writes made to raise the minimum
+// version at once.
+const maxAssetVersionIncrements = 1024
+
+// readAssetVersionBase returns the base of the versions stored in the TPM.
+func readAssetVersionBase(tpm *sb.TPMConnection) (uint64, error) {
+	index, err := tpm.CreateResourceContextFromTPM(assetVersionBaseHandle)
+	if tpm2.IsResourceUnavailableError(err, assetVersionBaseHandle) {
+		return migrateAssetVersionBase(tpm)
+	}
+	if err != nil {
+		return 0, err
+	}
+	data, err := tpm.NVRead(index, index, 8, 0, nil)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read boot asset version base: %v", err)
+	}
+	return binary.BigEndian.Uint64(data), nil
+}
+
+// migrateAssetVersionBase moves the base of the versions from the file
+// written by older versions to the TPM.
+func migrateAssetVersionBase(tpm *sb.TPMConnection) (uint64, error) {
+	data, err := ioutil.ReadFile(assetVersionBaseFile)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read boot asset version base: %v", err)
+	}
+	base, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid boot asset version base: %v", err)
+	}
+	if err := writeAssetVersionBase(tpm, base); err != nil {
+		return 0, err
+	}
+	if err := os.Remove(assetVersionBaseFile); err != nil {
+		warnf("cannot remove %s: %v", assetVersionBaseFile, err)
+	}
+	return base, nil
+}
+
+// writeAssetVersionBase stores the base of the versions in an NV index that
+// is locked for writing once written, so it can't be changed to lower the
+// minimum version.
+func writeAssetVersionBase(tpm *sb.TPMConnection, base uint64) error {
+	if err := trackHandle(assetVersionBaseHandle, handlePurposeAssetVersionBase); err != nil {
+		return err
+	}
+	pub := tpm2.NVPublic{
+		Index:   assetVersionBaseHandle,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVOwnerWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVWriteDefine | tpm2.AttrNVNoDA),
+		Size:    8,
+	}
+	index, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, &pub, tpm.HmacSession())
+	if err != nil {
+		return fmt.Errorf("cannot define boot asset version base index: %v", err)
+	}
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, base)
+	if err := tpm.NVWrite(tpm.OwnerHandleContext(), index, data, 0, tpm.HmacSession()); err != nil {
+		return fmt.Errorf("cannot write boot asset version base: %v", err)
+	}
+	if err := tpm.NVWriteLock(tpm.OwnerHandleContext(), index, tpm.HmacSession()); err != nil {
+		return fmt.Errorf("cannot lock boot asset version base: %v", err)
+	}
+	return nil
+}
+
+// readMinAssetVersion returns the minimum boot asset version recorded in the
+// TPM, and whether one was recorded.
+func readMinAssetVersion(tpm *sb.TPMConnection) (uint64, bool, error) {
+	index, err := tpm.CreateResourceContextFromTPM(assetVersionCounterHandle)
+	if tpm2.IsResourceUnavailableError(err, assetVersionCounterHandle) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	value, err := tpm.NVReadCounter(index, index, nil)
+	if err != nil {
+		return 0, false, fmt.Errorf("cannot read boot asset version counter: %v", err)
+	}
+	base, err := readAssetVersionBase(tpm)
+	if err != nil {
+		return 0, false, err
+	}
+	if value < base {
+		return 0, false, fmt.Errorf("boot asset version counter is below its base")
+	}
+	return value - base, true, nil
+}
+
+// defineAssetVersionCounter creates the boot asset version counter and
+// records its initial value as the base.
+func defineAssetVersionCounter(tpm *sb.TPMConnection) (tpm2.ResourceContext, error) {
+	if err := trackHandle(assetVersionCounterHandle, handlePurposeAssetVersion); err != nil {
+		return nil, err
+	}
+	pub := tpm2.NVPublic{
+		Index:   assetVersionCounterHandle,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVOwnerWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA),
+		Size:    8,
+	}
+	index, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, &pub, tpm.HmacSession())
+	if err != nil {
+		return nil, fmt.Errorf("cannot define boot asset version counter: %v", err)
+	}
+	// a counter can only be read after its first increment
+	if err := tpm.NVIncrement(tpm.OwnerHandleContext(), index, tpm.HmacSession()); err != nil {
+		return nil, fmt.Errorf("cannot initialize boot asset version counter: %v", err)
+	}
+	base, err := tpm.NVReadCounter(index, index, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read boot asset version counter: %v", err)
+	}
+	// the base of a removed counter doesn't apply
+	if err := evictTPMHandle(tpm, assetVersionBaseHandle); err != nil {
+		return nil, err
+	}
+	if err := writeAssetVersionBase(tpm, base); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// raiseMinAssetVersion raises the minimum boot asset version recorded in
+// the TPM to the given version, and returns whether it was raised. The
+// version is never lowered.
+func raiseMinAssetVersion(tpm *sb.TPMConnection, version uint64) (bool, error) {
+	index, err := tpm.CreateResourceContextFromTPM(assetVersionCounterHandle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, assetVersionCounterHandle):
+		if index, err = defineAssetVersionCounter(tpm); err != nil {
+			return false, err
+		}
+	case err != nil:
+		return false, err
+	}
+
+	current, _, err := readMinAssetVersion(tpm)
+	if err != nil {
+		return false, err
+	}
+	if version <= current {
+		return false, nil
+	}
+	if version-current > maxAssetVersionIncrements {
+		return false, fmt.Errorf("cannot raise minimum boot asset version from %d to %d at once", current, version)
+	}
+	for v := current; v < version; v++ {
+		if err := tpm.NVIncrement(tpm.OwnerHandleContext(), index, tpm.HmacSession()); err != nil {
+			return false, fmt.Errorf("cannot increment boot asset version counter: %v", err)
+		}
+	}
+	logf("minimum boot asset version raised to %d", version)
+	return true, nil
+}
+
+// checkAssetVersions verifies that every entry of the load chains has a
+// version, and that none is older than the minimum version.
+func checkAssetVersions(chains []*loadChain, min uint64) error {
+	for _, lc := range chains {
+		if lc.Version == 0 {
+			return fmt.Errorf("cannot seal to %s: it has no version and a minimum boot asset version is recorded", lc.name())
+		}
+		if lc.Version < min {
+			return fmt.Errorf("cannot seal to %s: version %d is below the minimum boot asset version %d",
+				lc.name(), lc.Version, min)
+		}
+		if err := checkAssetVersions(lc.Next, min); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enforceAssetVersions records the minimum boot asset version, if
+// specified, and once a minimum version is recorded refuses to build a
+// profile that includes older or unversioned assets, so downgraded assets
+// don't unseal the key. Raising the minimum version forces the key to be
+// resealed, which increments the PCR policy counter the policy of the key
+// depends on, revoking the keys sealed before to older assets, including
+// copies of them.
+func (bp *bootProfileParams) enforceAssetVersions(chains []*loadChain) error {
+	tpm, err := connectTPM()
+	if err != nil {
+		if bp.MinAssetVersion == nil && !hasAssetVersions(chains) {
+			// no minimum version can be recorded without the TPM
+			return nil
+		}
+		return fmt.Errorf("cannot connect to TPM: %v", err)
+	}
+	defer tpm.Close()
+
+	if bp.MinAssetVersion != nil {
+		raised, err := raiseMinAssetVersion(tpm, *bp.MinAssetVersion)
+		if err != nil {
+			return err
+		}
+		bp.assetVersionRaised = raised
+	}
+	min, recorded, err := readMinAssetVersion(tpm)
+	if err != nil || !recorded {
+		return err
+	}
+	return checkAssetVersions(chains, min)
+}
+
+func hasAssetVersions(chains []*loadChain) bool {
+	for _, lc := range chains {
+		if lc.Version != 0 || hasAssetVersions(lc.Next) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	sb "github.com/snapcore/secboot"
+)
+
+// The parameters of the last update of each key are kept, so the keys can
+// be resealed when the boot assets change without the caller providing
+// them again. They include the policy authorization key, if one was given,
+// and are kept in the encrypted data partition.
+const defaultAutoUpdateParamsFile = "/run/mnt/ubuntu-data/system-data/var/lib/snapd/device/fde/auto-update.json"
+
+// names of the units that reseal when the boot assets change
+const (
+	autoUpdateServiceName = "fde-helper-auto-update.service"
+	autoUpdatePathName    = "fde-helper-auto-update.path"
+)
+
+// autoUpdateParams maps the names of the sealed keys to the parameters of
+// their last update.
+type autoUpdateParams map[string]json.RawMessage
+
+func readAutoUpdateParams() (autoUpdateParams, error) {
+	params := autoUpdateParams{}
+	if _, err := os.Stat(autoUpdateParamsFile); os.IsNotExist(err) {
+		return params, nil
+	}
+	var data []byte
+	err := withTPM(func(tpm *sb.TPMConnection) error {
+		var err error
+		data, err = readStateFile(tpm, autoUpdateParamsFile)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot read auto-update parameters: %v", err)
+	}
+	if err := json.Unmarshal(data, &params); err != nil {
+		return nil, fmt.Errorf("cannot parse auto-update parameters: %v", err)
+	}
+	return params, nil
+}
+
+// saveAutoUpdateParams records the parameters of the last update of the
+// named key. They are protected by the TPM, as they can contain the policy
+// authorization key.
+func saveAutoUpdateParams(volumeKey string, p []byte) error {
+	if volumeKey == "" {
+		volumeKey = keyNameData
+	}
+	params, err := readAutoUpdateParams()
+	if err != nil {
+		// e.g. sealed under a storage root key that was replaced
+		warnf("discarding auto-update parameters: %v", err)
+		params = autoUpdateParams{}
+	}
+	params[volumeKey] = json.RawMessage(p)
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(autoUpdateParamsFile), 0700); err != nil {
+		return err
+	}
+	return withTPM(func(tpm *sb.TPMConnection) error {
+		return writeStateFile(tpm, autoUpdateParamsFile, data)
+	})
+}
+
+// autoUpdateResponse reports which keys were resealed.
+type autoUpdateResponse struct {
+	Resealed  []string `json:"resealed"`
+	Unchanged []string `json:"unchanged"`
+}
+
+// autoUpdate reseals the keys whose boot assets changed since their last
+// update, using the parameters of that update.
+func autoUpdate() error {
+	params, err := readAutoUpdateParams()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	resp := autoUpdateResponse{Resealed: []string{}, Unchanged: []string{}}
+	keyFile, counterHandle := sealedKeyFile, pcrPolicyCounterHandle
+	for _, name := range names {
+		var p updateParams
+		if err := json.Unmarshal(params[name], &p); err != nil {
+			return fmt.Errorf("cannot parse auto-update parameters of %q: %v", name, err)
+		}
+		ur, err := updatePolicy(&p)
+		// each update selects its own key
+		sealedKeyFile, pcrPolicyCounterHandle = keyFile, counterHandle
+		if err != nil {
+			return fmt.Errorf("cannot update %q: %v", name, err)
+		}
+		if ur.Unchanged {
+			resp.Unchanged = append(resp.Unchanged, name)
+		} else {
+			resp.Resealed = append(resp.Resealed, name)
+			logf("resealed %q after boot asset change", name)
+		}
+	}
+	return writeResponse(resp)
+}
+
+// writeAutoUpdateUnits writes the systemd units that run auto-update when
+// the boot assets of the last updates change to the given directory.
+func writeAutoUpdateUnits(dir string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	params, err := readAutoUpdateParams()
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	var paths []string
+	for _, raw := range params {
+		var p updateParams
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return err
+		}
+		if err := p.validate(); err != nil {
+			return err
+		}
+		for _, path := range loadChainFiles(p.loadChains()) {
+			if !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no boot assets to watch, update with load chains first")
+	}
+	sort.Strings(paths)
+
+	service := strings.Join([]string{
+		"[Unit]",
+		"Description=Reseal the disk encryption keys after boot asset changes",
+		"",
+		"[Service]",
+		"Type=oneshot",
+		"ExecStart=" + exe + " --auto-update",
+		"",
+	}, "\n")
+
+	pathUnit := []string{
+		"[Unit]",
+		"Description=Watch the boot assets the disk encryption keys are sealed to",
+		"",
+		"[Path]",
+	}
+	for _, path := range paths {
+		pathUnit = append(pathUnit, "PathChanged="+path)
+	}
+	pathUnit = append(pathUnit, "", "[Install]", "WantedBy=multi-user.target", "")
+
+	for name, content := range map[string]string{
+		autoUpdateServiceName: service,
+		autoUpdatePathName:    strings.Join(pathUnit, "\n"),
+	} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			return err
+		}
+		// files are created with a restrictive umask
+		if err := os.Chmod(path, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build !nofido2
+// +build !nofido2
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+)
+
+func init() {
+	compiledBackends[backendFIDO2] = probeFIDO2
+}
+
+// probeFIDO2 checks if a FIDO2 token is connected.
+func probeFIDO2() error {
+	output, err := exec.Command("fido2-token", "-L").Output()
+	if err != nil {
+		return fmt.Errorf("cannot list FIDO2 tokens: %v", err)
+	}
+	if len(bytes.TrimSpace(output)) == 0 {
+		return fmt.Errorf("no FIDO2 token found")
+	}
+	return nil
+}
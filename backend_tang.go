@@ -0,0 +1,32 @@
+//go:build !notang
+// +build !notang
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func init() {
+	compiledBackends[backendTang] = probeTang
+}
+
+// probeTang checks if the Tang server is reachable and advertises its keys.
+func probeTang() error {
+	if tangURL == "" {
+		return fmt.Errorf("no Tang server configured")
+	}
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(tangURL, "/") + "/adv")
+	if err != nil {
+		return fmt.Errorf("cannot reach Tang server: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Tang server returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// backends that can protect the disk keys
+const (
+	backendFIDO2 = "fido2"
+	backendOPTEE = "optee"
+	backendTang  = "tang"
+)
+
+// tangURL is the Tang server to probe, if any.
+var tangURL string
+
+// OP-TEE devices, present if the TEE driver is loaded
+var opteeDevices = []string{"/dev/tee0", "/dev/teepriv0"}
+
+// backendPreference lists the backends probed by --probe-backends, in order
+// of preference.
+var backendPreference = []string{backendTPM2, backendFIDO2, backendOPTEE, backendTang}
+
+// compiledBackends maps the backends built into the helper to their probes.
+// Heavy optional backends can be left out with build tags (nofido2,
+// notang) to reduce the size of the helper in the initramfs.
+var compiledBackends = map[string]func() error{
+	backendTPM2:  supported,
+	backendOPTEE: probeOPTEE,
+}
+
+type backendStatus struct {
+	Name   string `json:"name"`
+	Usable bool   `json:"usable"`
+	// Reason explains why the backend can't be used.
+	Reason string `json:"reason,omitempty"`
+}
+
+type probeBackendsResponse struct {
+	Backends []*backendStatus `json:"backends"`
+}
+
+// probeOPTEE checks if the OP-TEE driver is available.
+func probeOPTEE() error {
+	for _, dev := range opteeDevices {
+		if _, err := os.Stat(dev); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("no TEE device found")
+}
+
+// probeBackends reports which of the compiled backends are usable in this
+// system.
+func probeBackends() *probeBackendsResponse {
+	resp := &probeBackendsResponse{}
+	for _, name := range backendPreference {
+		probe, ok := compiledBackends[name]
+		if !ok {
+			continue
+		}
+		status := &backendStatus{Name: name, Usable: true}
+		if err := probe(); err != nil {
+			status.Usable = false
+			status.Reason = err.Error()
+		}
+		resp.Backends = append(resp.Backends, status)
+	}
+	return resp
+}
+
+type compiledBackendsResponse struct {
+	Compiled []string `json:"compiled"`
+	// Omitted lists the backends left out of this build.
+	Omitted []string `json:"omitted"`
+}
+
+// listCompiledBackends writes the backends built into the helper to stdout.
+func listCompiledBackends() error {
+	resp := compiledBackendsResponse{Compiled: []string{}, Omitted: []string{}}
+	for _, name := range backendPreference {
+		if _, ok := compiledBackends[name]; ok {
+			resp.Compiled = append(resp.Compiled, name)
+		} else {
+			resp.Omitted = append(resp.Omitted, name)
+		}
+	}
+	sort.Strings(resp.Compiled)
+	sort.Strings(resp.Omitted)
+	return writeResponse(&resp)
+}
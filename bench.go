@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"time"
+
+	sb "github.com/snapcore/secboot"
+)
+
+const (
+	defaultBenchIterations = 10
+	benchVolumeName        = "fde-helper-bench"
+)
+
+type benchParams struct {
+	Iterations int `json:"iterations,omitempty"`
+	// ScratchDevice, if set, is a LUKS2 volume that can be opened with
+	// the sealed key, used to also measure volume activation.
+	ScratchDevice string `json:"scratch-device,omitempty"`
+}
+
+// latencyStats contains latency statistics in seconds.
+type latencyStats struct {
+	Min float64 `json:"min"`
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	Max float64 `json:"max"`
+}
+
+type benchResponse struct {
+	Iterations int           `json:"iterations"`
+	Unseal     *latencyStats `json:"unseal"`
+	Activation *latencyStats `json:"activation,omitempty"`
+}
+
+// percentile returns the p-th percentile of the sorted samples using the
+// nearest-rank method.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func computeLatencyStats(samples []time.Duration) *latencyStats {
+	sorted := make([]time.Duration, len(samples))
+	copy(sorted, samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return &latencyStats{
+		Min: sorted[0].Seconds(),
+		P50: percentile(sorted, 50).Seconds(),
+		P95: percentile(sorted, 95).Seconds(),
+		Max: sorted[len(sorted)-1].Seconds(),
+	}
+}
+
+// bench measures the latency of unsealing the key and, optionally, of
+// activating a scratch volume, and writes the statistics to stdout.
+func bench(p []byte) error {
+	var params benchParams
+	if err := unmarshalOptionalParams(p, &params); err != nil {
+		return err
+	}
+	if params.Iterations == 0 {
+		params.Iterations = defaultBenchIterations
+	}
+	if params.Iterations < 0 {
+		return fmt.Errorf("invalid number of iterations %d", params.Iterations)
+	}
+
+	if err := checkFileSecure(sealedKeyFile); err != nil {
+		return err
+	}
+
+	tpm, err := connectTPM()
+	if err != nil {
+		return fmt.Errorf("cannot connect to TPM: %v", err)
+	}
+	defer tpm.Close()
+
+	k, err := readSealedKey(sealedKeyFile)
+	if err != nil {
+		return fmt.Errorf("cannot read the sealed key: %v", err)
+	}
+
+	unsealSamples := make([]time.Duration, 0, params.Iterations)
+	for i := 0; i < params.Iterations; i++ {
+		start := time.Now()
+		if _, _, err := k.UnsealFromTPM(tpm, ""); err != nil {
+			return fmt.Errorf("cannot unseal: %v", err)
+		}
+		unsealSamples = append(unsealSamples, time.Since(start))
+	}
+
+	resp := benchResponse{
+		Iterations: params.Iterations,
+		Unseal:     computeLatencyStats(unsealSamples),
+	}
+
+	if params.ScratchDevice != "" {
+		keyData, err := isKeyData(sealedKeyFile)
+		if err != nil {
+			return err
+		}
+		// secboot only activates volumes with sealed key objects
+		activate := func(options *sb.ActivateVolumeOptions) (bool, error) {
+			if !keyData {
+				return sb.ActivateVolumeWithTPMSealedKey(tpm, benchVolumeName, params.ScratchDevice, sealedKeyFile, nil, options)
+			}
+			key, _, err := k.UnsealFromTPM(tpm, "")
+			if err != nil {
+				return false, err
+			}
+			if err := sb.ActivateVolumeWithKey(benchVolumeName, params.ScratchDevice, key, options); err != nil {
+				return false, err
+			}
+			return true, nil
+		}
+		options := &sb.ActivateVolumeOptions{}
+		activationSamples := make([]time.Duration, 0, params.Iterations)
+		for i := 0; i < params.Iterations; i++ {
+			start := time.Now()
+			ok, err := activate(options)
+			if err != nil {
+				return fmt.Errorf("cannot activate scratch volume: %v", err)
+			}
+			if !ok {
+				return fmt.Errorf("scratch volume was not activated")
+			}
+			activationSamples = append(activationSamples, time.Since(start))
+
+			if output, err := exec.Command("cryptsetup", "close", benchVolumeName).CombinedOutput(); err != nil {
+				return fmt.Errorf("cannot close scratch volume: %s", output)
+			}
+		}
+		resp.Activation = computeLatencyStats(activationSamples)
+	}
+
+	return writeResponse(&resp)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+
+	sb "github.com/snapcore/secboot"
+)
+
+// ignoreTPMBlocklist is set when the user accepts the risk of using a TPM
+// with known firmware issues.
+var ignoreTPMBlocklist bool
+
+// blockedFirmware describes a range of TPM firmware versions with known
+// issues. Versions are compared using the major and minor numbers.
+type blockedFirmware struct {
+	manufacturer string
+	major        uint32
+	minMinor     uint32
+	maxMinor     uint32
+	reason       string
+	// refuse is set if the issue compromises the sealed keys, otherwise
+	// only a warning is shown
+	refuse bool
+}
+
+var tpmFirmwareBlocklist = []blockedFirmware{
+	{"IFX", 5, 0, 61, "weak RSA key generation (ROCA, CVE-2017-15361)", true},
+	{"IFX", 7, 0, 61, "weak RSA key generation (ROCA, CVE-2017-15361)", true},
+	{"STM", 73, 4, 7, "ECDSA timing leak (TPM-FAIL, CVE-2019-16863)", false},
+}
+
+// firmwareIssue returns the blocklist entry matching the TPM, if any.
+func firmwareIssue(inv *tpmInventory) *blockedFirmware {
+	var major, minor uint32
+	if _, err := fmt.Sscanf(inv.FirmwareVersion, "%d.%d.", &major, &minor); err != nil {
+		return nil
+	}
+	for i := range tpmFirmwareBlocklist {
+		b := &tpmFirmwareBlocklist[i]
+		if b.manufacturer == inv.Manufacturer && b.major == major && minor >= b.minMinor && minor <= b.maxMinor {
+			return b
+		}
+	}
+	return nil
+}
+
+// checkTPMBlocklist fails if the TPM firmware has known issues that make it
+// unsuitable to seal keys, unless the blocklist is ignored. Less severe
+// issues only cause a warning.
+func checkTPMBlocklist(tpm *sb.TPMConnection) error {
+	inv, err := readTPMInventory(tpm)
+	if err != nil {
+		return err
+	}
+	issue := firmwareIssue(inv)
+	if issue == nil {
+		return nil
+	}
+	msg := fmt.Sprintf("TPM %s firmware %s has a known issue: %s", inv.Manufacturer, inv.FirmwareVersion, issue.reason)
+	if issue.refuse && !ignoreTPMBlocklist {
+		return fmt.Errorf("%s (use --ignore-tpm-blocklist to override)", msg)
+	}
+	warnf("%s", msg)
+	return nil
+}
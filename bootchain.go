@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/canonical/go-tpm2"
+	sb "github.com/snapcore/secboot"
+)
+
+// boot chain models
+const (
+	bootChainUEFI  = "uefi"
+	bootChainUBoot = "uboot"
+)
+
+// bootChainModel adds the measurements made by the platform when booting
+// the load chains to a PCR profile. Platforms that measure their boot chain
+// differently are supported by adding a model.
+type bootChainModel interface {
+	addProfile(pcrProfile *sb.PCRProtectionProfile, bp *bootProfileParams, chains []*loadChain) error
+}
+
+var bootChainModels = map[string]bootChainModel{
+	bootChainUEFI:  uefiBootChain{},
+	bootChainUBoot: ubootBootChain{},
+}
+
+// roles of load chain entries measured by U-Boot
+const (
+	roleFDT    = "fdt"
+	roleInitrd = "initrd"
+)
+
+// roleCmdline is the pseudo-role used to set the PCR of the kernel command
+// line in the measurement PCRs.
+const roleCmdline = "cmdline"
+
+// ubootMeasurementPCRs are the PCRs used by the U-Boot measured boot.
+var ubootMeasurementPCRs = map[string]int{
+	roleKernel:         8,
+	roleRecoveryKernel: 8,
+	roleInitrd:         9,
+	roleFDT:            9,
+	roleCmdline:        1,
+}
+
+// ubootBootChain is the boot chain model of platforms without UEFI, where
+// U-Boot measures the kernel, initrd and device tree it loads, and the
+// kernel command line. The firmware stages before U-Boot are expected to be
+// verified by the platform secure boot.
+type ubootBootChain struct{}
+
+// measurement is a digest extended to a PCR.
+type measurement struct {
+	pcr    int
+	digest tpm2.Digest
+}
+
+// fileDigest returns the SHA-256 digest of the load chain entry contents.
+// The digest of an entry can't be given explicitly, as that is the
+// Authenticode digest measured by UEFI firmware, not the digest of the file
+// U-Boot measures.
+func (lc *loadChain) fileDigest() (tpm2.Digest, error) {
+	if lc.Path == "" {
+		return nil, fmt.Errorf("load chain entry %s must be specified by path with the %s boot chain model", lc.name(), bootChainUBoot)
+	}
+	data, err := ioutil.ReadFile(lc.Path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %v", lc.Path, err)
+	}
+	h := sha256.Sum256(data)
+	return h[:], nil
+}
+
+// measurementSequences returns the measurements of every path through the
+// load chains, in the order they are made.
+func measurementSequences(chains []*loadChain, pcrs map[string]int) ([][]measurement, error) {
+	var sequences [][]measurement
+	for _, lc := range chains {
+		pcr, ok := pcrs[lc.Role]
+		if !ok {
+			return nil, fmt.Errorf("load chain entry with role %q is not measured", lc.Role)
+		}
+		digest, err := lc.fileDigest()
+		if err != nil {
+			return nil, err
+		}
+		m := measurement{pcr: pcr, digest: digest}
+		if len(lc.Next) == 0 {
+			sequences = append(sequences, []measurement{m})
+			continue
+		}
+		next, err := measurementSequences(lc.Next, pcrs)
+		if err != nil {
+			return nil, err
+		}
+		for _, seq := range next {
+			sequences = append(sequences, append([]measurement{m}, seq...))
+		}
+	}
+	return sequences, nil
+}
+
+// measurementProfile creates a profile requiring the PCRs to contain exactly
+// the given measurements.
+func measurementProfile(seq []measurement) *sb.PCRProtectionProfile {
+	var pcrs []int
+	byPCR := map[int][]tpm2.Digest{}
+	for _, m := range seq {
+		if _, ok := byPCR[m.pcr]; !ok {
+			pcrs = append(pcrs, m.pcr)
+		}
+		byPCR[m.pcr] = append(byPCR[m.pcr], m.digest)
+	}
+	sort.Ints(pcrs)
+
+	profile := sb.NewPCRProtectionProfile()
+	for _, pcr := range pcrs {
+		profile.AddPCRValue(tpm2.HashAlgorithmSHA256, pcr, make(tpm2.Digest, sha256.Size))
+		for _, digest := range byPCR[pcr] {
+			profile.ExtendPCR(tpm2.HashAlgorithmSHA256, pcr, digest)
+		}
+	}
+	return profile
+}
+
+func (ubootBootChain) addProfile(pcrProfile *sb.PCRProtectionProfile, bp *bootProfileParams, chains []*loadChain) error {
+	if len(bp.SignatureDbUpdates) > 0 || len(bp.UKIPhases) > 0 || len(bp.UKICredentials) > 0 ||
+		len(bp.UKISysexts) > 0 || len(bp.LoaderEntries) > 0 {
+		return fmt.Errorf("boot profile parameters not supported by the %s boot chain model", bootChainUBoot)
+	}
+
+	pcrs := map[string]int{}
+	for role, pcr := range ubootMeasurementPCRs {
+		pcrs[role] = pcr
+	}
+	for role, pcr := range bp.MeasurementPCRs {
+		if pcr < 0 || pcr > 23 {
+			return fmt.Errorf("invalid PCR %d for role %q", pcr, role)
+		}
+		pcrs[role] = pcr
+	}
+
+	sequences, err := measurementSequences(chains, pcrs)
+	if err != nil {
+		return err
+	}
+
+	// U-Boot measures the command line after the images, including the
+	// terminating NUL
+	cmdlines := bp.kernelCmdlines()
+	var branches []*sb.PCRProtectionProfile
+	for _, seq := range sequences {
+		if len(cmdlines) == 0 {
+			branches = append(branches, measurementProfile(seq))
+			continue
+		}
+		for _, cmdline := range cmdlines {
+			h := sha256.Sum256(append([]byte(cmdline), 0))
+			withCmdline := append(append([]measurement(nil), seq...), measurement{pcr: pcrs[roleCmdline], digest: h[:]})
+			branches = append(branches, measurementProfile(withCmdline))
+		}
+	}
+	pcrProfile.AddProfileOR(branches...)
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// boot modes of Ubuntu Core, set by snapd on the kernel command line
+const (
+	bootModeRun          = "run"
+	bootModeRecover      = "recover"
+	bootModeInstall      = "install"
+	bootModeFactoryReset = "factory-reset"
+)
+
+const (
+	defaultKernelCmdlineFile = "/proc/cmdline"
+	// defaultBootModeFile can be written by the initramfs to set the
+	// boot mode when it's not on the kernel command line, e.g. when
+	// booting with a UKI that has a fixed command line.
+	defaultBootModeFile = "/run/fde-helper/boot-mode"
+)
+
+// kernelCmdlineParam returns the value of the given kernel command line
+// parameter, or an empty string if it's not set.
+func kernelCmdlineParam(name string) string {
+	data, err := ioutil.ReadFile(kernelCmdlineFile)
+	if err != nil {
+		return ""
+	}
+	for _, field := range strings.Fields(string(data)) {
+		if strings.HasPrefix(field, name+"=") {
+			return strings.TrimPrefix(field, name+"=")
+		}
+	}
+	return ""
+}
+
+// detectBootMode returns the mode the system was booted in, and the label of
+// the recovery system in recover mode.
+func detectBootMode() (mode, system string) {
+	if data, err := ioutil.ReadFile(bootModeFile); err == nil {
+		mode = strings.TrimSpace(string(data))
+	}
+	if mode == "" {
+		mode = kernelCmdlineParam("snapd_recovery_mode")
+	}
+	if mode == "" {
+		mode = bootModeRun
+	}
+	return mode, kernelCmdlineParam("snapd_recovery_system")
+}
+
+// recoverySystemLabels returns the labels of the recovery systems the
+// profile covers.
+func (bp *bootProfileParams) recoverySystemLabels() []string {
+	var labels []string
+	for _, rs := range bp.RecoverySystems {
+		labels = append(labels, rs.Label)
+	}
+	return labels
+}
+
+// sealedToRecoverySystem returns false if the key is known not to be
+// sealed to the recovery system with the given label.
+func (md *keyMetadata) sealedToRecoverySystem(label string) bool {
+	if len(md.RecoverySystems) == 0 || label == "" {
+		return true
+	}
+	for _, l := range md.RecoverySystems {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveBootMode sets the boot mode of the unlock parameters to the
+// detected mode if it wasn't specified, and adjusts the parameters to it.
+// In recover mode access to the sealed keys isn't locked when the volume
+// is open: the recovery system unlocks the save volume afterwards, and
+// snapd locks access itself once it's done.
+func (params *unlockParams) resolveBootMode() error {
+	var system string
+	switch params.BootMode {
+	case "":
+		params.BootMode, system = detectBootMode()
+	case bootModeRun, bootModeRecover, bootModeInstall, bootModeFactoryReset:
+		_, system = detectBootMode()
+	default:
+		return fmt.Errorf("invalid boot mode %q", params.BootMode)
+	}
+	params.recoverySystem = system
+	if params.BootMode == bootModeRecover && params.LockKeysOnFinish {
+		logf("recover mode, not locking access to the sealed keys")
+		params.LockKeysOnFinish = false
+	}
+	return nil
+}
+
+// activateInRecoverMode unlocks the volume with the recovery key without
+// using the TPM when booted in recover mode and the sealed key can't be
+// used: because the caller asked for the recovery key first, or because the
+// key wasn't sealed to the recovery system that was booted, so its policy
+// has no branch for the measured recovery chain. It returns nil if the
+// sealed key should be tried.
+func activateInRecoverMode(params *unlockParams, md *keyMetadata) (*unlockResponse, error) {
+	if params.BootMode != bootModeRecover {
+		return nil, nil
+	}
+	switch {
+	case params.RecoveryKeyFirst:
+		logf("recover mode, asking for the recovery key first")
+	case !md.sealedToRecoverySystem(params.recoverySystem):
+		warnf("key was not sealed to recovery system %q, using the recovery key", params.recoverySystem)
+	default:
+		return nil, nil
+	}
+	if _, err := activateWithRecoveryKey(params); err != nil {
+		return nil, err
+	}
+	return newUnlockResponse(unlockMethodRecoveryKey), nil
+}
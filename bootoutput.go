@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+const kmsgPath = "/dev/kmsg"
+
+// syslog priorities of the messages written to the kernel log
+const (
+	priorityCrit    = 2
+	priorityErr     = 3
+	priorityWarning = 4
+	priorityInfo    = 6
+)
+
+// The kernel log is rate limited, so a failure loop doesn't flood it.
+const (
+	kmsgBurst    = 20
+	kmsgInterval = 100 * time.Millisecond
+)
+
+// maxStatusLength is the maximum length of the console status line.
+const maxStatusLength = 72
+
+// bootOutput is set in boot output mode, used in the initrd. Only one status
+// line per operation is written to the console, and the messages are sent
+// to the kernel log, where they reach the journal.
+var bootOutput *kmsgWriter
+
+// kmsgWriter writes rate limited messages to the kernel log.
+type kmsgWriter struct {
+	mu         sync.Mutex
+	f          *os.File
+	operation  string
+	tokens     int
+	last       time.Time
+	suppressed int
+}
+
+// enableBootOutput switches to boot output mode for the operation with the
+// given name. If the kernel log can't be opened, messages are still written
+// to stderr.
+func enableBootOutput(operation string) {
+	w := &kmsgWriter{operation: operation, tokens: kmsgBurst, last: time.Now()}
+	f, err := os.OpenFile(kmsgPath, os.O_WRONLY, 0)
+	if err != nil {
+		warnf("cannot open kernel log: %v", err)
+	}
+	w.f = f
+	bootOutput = w
+}
+
+// operationName returns the name of the operation requested in the command
+// line, used in the status line.
+func operationName(args []string) string {
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--") {
+			return strings.SplitN(strings.TrimPrefix(arg, "--"), "=", 2)[0]
+		}
+	}
+	return "helper"
+}
+
+// log writes a message to the kernel log, one record per line, unless the
+// rate limit was exceeded. It returns false if the kernel log isn't
+// available.
+func (w *kmsgWriter) log(priority int, msg string) bool {
+	if w.f == nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// a token is added every interval since the last write, suppressed
+	// messages don't delay the next one
+	now := time.Now()
+	w.tokens += int(now.Sub(w.last) / kmsgInterval)
+	if w.tokens > kmsgBurst {
+		w.tokens = kmsgBurst
+	}
+	if w.tokens == 0 {
+		w.suppressed++
+		return true
+	}
+	w.tokens--
+	w.last = now
+	if w.suppressed > 0 {
+		fmt.Fprintf(w.f, "<%d>fde-helper[%d]: %d messages suppressed\n", priorityWarning, os.Getpid(), w.suppressed)
+		w.suppressed = 0
+	}
+	for _, line := range strings.Split(strings.TrimRight(msg, "\n"), "\n") {
+		fmt.Fprintf(w.f, "<%d>fde-helper[%d]: %s\n", priority, os.Getpid(), line)
+	}
+	return true
+}
+
+// status writes the one line status of the operation to the console, and
+// the full error to the kernel log.
+func (w *kmsgWriter) status(err error) {
+	if err == nil {
+		fmt.Fprintf(os.Stderr, "fde-helper %s: done\n", w.operation)
+		return
+	}
+	w.log(priorityErr, "error: "+err.Error())
+	summary := strings.SplitN(err.Error(), "\n", 2)[0]
+	if len(summary) > maxStatusLength {
+		summary = summary[:maxStatusLength-3] + "..."
+	}
+	fmt.Fprintf(os.Stderr, "fde-helper %s: failed: %s\n", w.operation, summary)
+}
+
+// reportPanic sends the stack of a panic to the kernel log and exits with
+// a concise error, instead of writing it to the console.
+func reportPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	msg := fmt.Sprintf("panic: %v\n%s", r, debug.Stack())
+	if !bootOutput.log(priorityCrit, msg) {
+		fmt.Fprint(os.Stderr, msg)
+	}
+	exit(fmt.Errorf("internal error: %v", r))
+}
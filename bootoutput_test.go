@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKmsgWriterRateLimit(t *testing.T) {
+	tests := []struct {
+		summary string
+		tokens  int
+		// lastAgo is how long ago the last message was written
+		lastAgo  time.Duration
+		messages int
+		// wait is the time before the last message is logged
+		wait       time.Duration
+		written    []string
+		suppressed int
+	}{
+		{
+			summary:  "within the burst",
+			tokens:   kmsgBurst,
+			messages: 3,
+			written:  []string{"message 0", "message 1", "message 2"},
+		}, {
+			summary:    "burst exceeded",
+			tokens:     2,
+			messages:   4,
+			written:    []string{"message 0", "message 1"},
+			suppressed: 2,
+		}, {
+			summary:  "refilled",
+			tokens:   0,
+			lastAgo:  2 * kmsgInterval,
+			messages: 3,
+			written:  []string{"message 0", "message 1"},
+			// the third message is suppressed
+			suppressed: 1,
+		}, {
+			summary:  "suppressed messages don't delay the refill",
+			tokens:   0,
+			lastAgo:  kmsgInterval * 9 / 10,
+			messages: 2,
+			wait:     kmsgInterval / 5,
+			written:  []string{"1 messages suppressed", "message 1"},
+		},
+	}
+	for _, tc := range tests {
+		f, err := ioutil.TempFile("", "fde-helper-kmsg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+
+		w := &kmsgWriter{f: f, tokens: tc.tokens, last: time.Now().Add(-tc.lastAgo)}
+		for i := 0; i < tc.messages; i++ {
+			if i == tc.messages-1 && tc.wait > 0 {
+				time.Sleep(tc.wait)
+			}
+			if !w.log(priorityInfo, fmt.Sprintf("message %d", i)) {
+				t.Fatalf("%s: kernel log not available", tc.summary)
+			}
+		}
+		f.Close()
+
+		data, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var written []string
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			if line == "" {
+				continue
+			}
+			// strip the priority and the process
+			written = append(written, line[strings.Index(line, ": ")+2:])
+		}
+		if strings.Join(written, "\n") != strings.Join(tc.written, "\n") {
+			t.Errorf("%s: expected %q, got %q", tc.summary, tc.written, written)
+		}
+		if w.suppressed != tc.suppressed {
+			t.Errorf("%s: expected %d suppressed, got %d", tc.summary, tc.suppressed, w.suppressed)
+		}
+	}
+}
+
+func TestKmsgWriterUnavailable(t *testing.T) {
+	w := &kmsgWriter{tokens: kmsgBurst, last: time.Now()}
+	if w.log(priorityInfo, "message") {
+		t.Fatal("expected the kernel log to be unavailable")
+	}
+}
+
+func TestOperationName(t *testing.T) {
+	tests := []struct {
+		args []string
+		name string
+	}{
+		{[]string{"--unlock"}, "unlock"},
+		{[]string{"-q", "--sleep-hook=pre", "--unlock"}, "sleep-hook"},
+		{[]string{"-q"}, "helper"},
+		{nil, "helper"},
+	}
+	for _, tc := range tests {
+		if name := operationName(tc.args); name != tc.name {
+			t.Errorf("%q: expected %s, got %s", tc.args, tc.name, name)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+	sb "github.com/snapcore/secboot"
+)
+
+// bootPhaseHandle is the NV index holding the boot phase pin. The pin is
+// part of the derived LUKS key, and reading it is locked until the next TPM
+// reset once the early boot is finished.
+const bootPhaseHandle tpm2.Handle = 0x01880013
+
+// bootPhasePinSize is the size of the boot phase pin.
+const bootPhasePinSize = 32
+
+// errBootPhaseAdvanced is returned when a key bound to the boot phase is
+// used after the early boot.
+var errBootPhaseAdvanced = errors.New("boot phase advanced, keys bound to the early boot can't be used until the next boot")
+
+// defineBootPhasePin creates the NV index with a new random boot phase pin,
+// replacing an existing one, and returns the pin.
+func defineBootPhasePin(tpm *sb.TPMConnection) ([]byte, error) {
+	pin := make([]byte, bootPhasePinSize)
+	if _, err := rand.Read(pin); err != nil {
+		return nil, fmt.Errorf("cannot create boot phase pin: %v", err)
+	}
+
+	if err := evictTPMHandle(tpm, bootPhaseHandle); err != nil {
+		return nil, err
+	}
+	if err := trackHandle(bootPhaseHandle, handlePurposeBootPhase); err != nil {
+		return nil, err
+	}
+	pub := tpm2.NVPublic{
+		Index:   bootPhaseHandle,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVOwnerWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVReadStClear | tpm2.AttrNVNoDA),
+		Size:    bootPhasePinSize,
+	}
+	index, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, &pub, tpm.HmacSession())
+	if err != nil {
+		return nil, fmt.Errorf("cannot define boot phase index: %v", err)
+	}
+	if err := tpm.NVWrite(tpm.OwnerHandleContext(), index, pin, 0, tpm.HmacSession()); err != nil {
+		return nil, fmt.Errorf("cannot write boot phase index: %v", err)
+	}
+	return pin, nil
+}
+
+// readBootPhasePin returns the boot phase pin, if the boot phase wasn't
+// advanced yet.
+func readBootPhasePin() ([]byte, error) {
+	tpm, err := connectTPM()
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to TPM: %v", err)
+	}
+	defer tpm.Close()
+
+	index, err := tpm.CreateResourceContextFromTPM(bootPhaseHandle)
+	if err != nil {
+		return nil, fmt.Errorf("cannot access boot phase index: %v", err)
+	}
+	pub, _, err := tpm.NVReadPublic(index)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read boot phase index: %v", err)
+	}
+	if pub.Attrs&tpm2.AttrNVReadLocked != 0 {
+		return nil, errBootPhaseAdvanced
+	}
+	pin, err := tpm.NVRead(index, index, bootPhasePinSize, 0, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read boot phase pin: %v", err)
+	}
+	return pin, nil
+}
+
+// advanceBootPhase locks reading the boot phase pin until the next boot, so
+// keys bound to the early boot can't be used from the running system.
+func advanceBootPhase() error {
+	tpm, err := connectTPM()
+	if err != nil {
+		return fmt.Errorf("cannot connect to TPM: %v", err)
+	}
+	defer tpm.Close()
+
+	if err := lockLockoutAuth(tpm); err != nil {
+		return err
+	}
+
+	index, err := tpm.CreateResourceContextFromTPM(bootPhaseHandle)
+	if tpm2.IsResourceUnavailableError(err, bootPhaseHandle) {
+		// no key is bound to the boot phase
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot access boot phase index: %v", err)
+	}
+	if err := tpm.NVReadLock(index, index, nil); err != nil {
+		return fmt.Errorf("cannot advance boot phase: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	sb "github.com/snapcore/secboot"
+)
+
+// breakGlassAlgorithm is how the volume key is wrapped in the bundle.
+const breakGlassAlgorithm = "rsa-oaep-sha256"
+
+// unlockMethodBreakGlass is reported when the volume is unlocked with a
+// break-glass bundle.
+const unlockMethodBreakGlass = "break-glass"
+
+// breakGlassBundle holds the key of a volume wrapped under an operator's
+// public key, so the volume can be unlocked if the TPM is lost.
+type breakGlassBundle struct {
+	Algorithm string `json:"algorithm"`
+	// KeyID is the SHA-256 digest of the public key the volume key is
+	// wrapped under.
+	KeyID      string    `json:"key-id"`
+	VolumeUUID string    `json:"volume-uuid,omitempty"`
+	Created    time.Time `json:"created"`
+	WrappedKey []byte    `json:"wrapped-key"`
+}
+
+type exportBreakGlassParams struct {
+	revealKeyParams
+
+	// PublicKeyFile is the PEM encoded RSA public key of the operator.
+	PublicKeyFile string `json:"public-key-file"`
+}
+
+// readPEMBlock reads the first PEM block of the given type from a file.
+func readPEMBlock(path, blockType string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("%s doesn't contain a %s", path, blockType)
+	}
+	return block.Bytes, nil
+}
+
+func readRSAPublicKey(path string) (*rsa.PublicKey, []byte, error) {
+	der, err := readPEMBlock(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read public key: %v", err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot parse public key: %v", err)
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("public key is not an RSA key")
+	}
+	return rsaPub, der, nil
+}
+
+func readRSAPrivateKey(path string) (*rsa.PrivateKey, error) {
+	der, err := readPEMBlock(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, fmt.Errorf("cannot read private key: %v", err)
+	}
+	priv, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse private key: %v", err)
+	}
+	rsaPriv, ok := priv.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is not an RSA key")
+	}
+	return rsaPriv, nil
+}
+
+// breakGlassLabel binds the wrapped key to its purpose.
+func breakGlassLabel(uuid string) []byte {
+	return []byte("fde-helper break-glass " + uuid)
+}
+
+// exportBreakGlass unseals the volume key and writes it wrapped under the
+// operator's public key. The plaintext key is never written.
+func exportBreakGlass(p []byte) error {
+	var params exportBreakGlassParams
+	if err := json.Unmarshal(p, &params); err != nil {
+		return err
+	}
+	if params.PublicKeyFile == "" {
+		return fmt.Errorf("public key file not specified")
+	}
+	pub, der, err := readRSAPublicKey(params.PublicKeyFile)
+	if err != nil {
+		return err
+	}
+
+	var uuid string
+	if params.Device != "" {
+		if uuid, err = volumeUUID(params.Device); err != nil {
+			return err
+		}
+	}
+
+	key, err := unsealNamedKey(&params.revealKeyParams)
+	if err != nil {
+		return err
+	}
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, breakGlassLabel(uuid))
+	if err != nil {
+		return fmt.Errorf("cannot wrap key: %v", err)
+	}
+
+	keyID := sha256.Sum256(der)
+	return writeResponse(&breakGlassBundle{
+		Algorithm:  breakGlassAlgorithm,
+		KeyID:      hex.EncodeToString(keyID[:]),
+		VolumeUUID: uuid,
+		Created:    time.Now().UTC(),
+		WrappedKey: wrapped,
+	})
+}
+
+type breakGlassUnlockParams struct {
+	VolumeName       string `json:"volume-name"`
+	SourceDevicePath string `json:"source-device-path"`
+	// BundleFile is the break-glass bundle of the volume.
+	BundleFile string `json:"bundle-file"`
+	// PrivateKeyFile is the PEM encoded PKCS #8 RSA private key the
+	// bundle was created for.
+	PrivateKeyFile string `json:"private-key-file"`
+
+	activationFlags
+}
+
+// unlockWithBreakGlass activates the volume with the key in a break-glass
+// bundle, without using the TPM.
+func unlockWithBreakGlass(p []byte) error {
+	var params breakGlassUnlockParams
+	if err := json.Unmarshal(p, &params); err != nil {
+		return err
+	}
+	if params.VolumeName == "" || params.SourceDevicePath == "" {
+		return fmt.Errorf("volume name and source device path must be specified")
+	}
+	if err := params.activationFlags.validate(); err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(params.BundleFile)
+	if err != nil {
+		return fmt.Errorf("cannot read break-glass bundle: %v", err)
+	}
+	var bundle breakGlassBundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return fmt.Errorf("cannot parse break-glass bundle: %v", err)
+	}
+	if bundle.Algorithm != breakGlassAlgorithm {
+		return fmt.Errorf("unsupported break-glass bundle algorithm %q", bundle.Algorithm)
+	}
+	if bundle.VolumeUUID != "" {
+		uuid, err := volumeUUID(params.SourceDevicePath)
+		if err != nil {
+			return err
+		}
+		if uuid != bundle.VolumeUUID {
+			return fmt.Errorf("break-glass bundle is for volume %s, not %s", bundle.VolumeUUID, uuid)
+		}
+	}
+
+	priv, err := readRSAPrivateKey(params.PrivateKeyFile)
+	if err != nil {
+		return err
+	}
+	key, err := rsa.DecryptOAEP(sha256.New(), nil, priv, bundle.WrappedKey, breakGlassLabel(bundle.VolumeUUID))
+	if err != nil {
+		return fmt.Errorf("cannot unwrap key: %v", err)
+	}
+
+	if err := sb.ActivateVolumeWithKey(params.VolumeName, params.SourceDevicePath, key, params.volumeOptions(nil)); err != nil {
+		return err
+	}
+	resp := newUnlockResponse(unlockMethodBreakGlass)
+	resp.Degraded = true
+	return writeResponse(resp)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/canonical/go-tpm2"
+)
+
+// cleanup undoes the creation of an artifact that is only useful once the
+// operation creating it completes.
+type cleanup struct {
+	what string
+	undo func() error
+}
+
+// pendingCleanups are the artifacts to roll back if the helper is
+// interrupted, in the order they were created.
+var pendingCleanups struct {
+	mu       sync.Mutex
+	cleanups []*cleanup
+}
+
+// addCleanup registers an artifact to roll back if the helper is
+// interrupted before the operation creating it completes.
+func addCleanup(what string, undo func() error) {
+	pendingCleanups.mu.Lock()
+	defer pendingCleanups.mu.Unlock()
+	pendingCleanups.cleanups = append(pendingCleanups.cleanups, &cleanup{what: what, undo: undo})
+}
+
+// rollBackOnInterrupt rolls back the pending cleanups and exits if SIGINT
+// or SIGTERM is received before the returned function is called.
+func rollBackOnInterrupt() (stop func()) {
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-ch:
+			exit(rollBack(sig))
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(done)
+		pendingCleanups.mu.Lock()
+		pendingCleanups.cleanups = nil
+		pendingCleanups.mu.Unlock()
+	}
+}
+
+// rollBack undoes the pending cleanups in reverse order and returns the
+// error reporting what was rolled back. The lock is kept, so the
+// interrupted operation can't register or keep artifacts meanwhile.
+func rollBack(sig os.Signal) error {
+	pendingCleanups.mu.Lock()
+	var rolledBack, failed []string
+	for i := len(pendingCleanups.cleanups) - 1; i >= 0; i-- {
+		c := pendingCleanups.cleanups[i]
+		if err := c.undo(); err != nil {
+			warnf("cannot roll back %s: %v", c.what, err)
+			failed = append(failed, c.what)
+			continue
+		}
+		logf("rolled back %s", c.what)
+		rolledBack = append(rolledBack, c.what)
+	}
+
+	msg := fmt.Sprintf("interrupted by %v", sig)
+	if len(rolledBack) > 0 {
+		msg += ", rolled back " + strings.Join(rolledBack, ", ")
+	}
+	if len(failed) > 0 {
+		msg += ", cannot roll back " + strings.Join(failed, ", ")
+	}
+	return &codedError{code: errorCodeInterrupted, err: fmt.Errorf("%s", msg)}
+}
+
+// keyslotCleanup removes a keyslot added to a volume.
+func keyslotCleanup(device string, slot int) func() error {
+	return func() error {
+		output, err := exec.Command("cryptsetup", "luksKillSlot", "--batch-mode", device, strconv.Itoa(slot)).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+}
+
+// nvIndexCleanup undefines an NV index using a new TPM connection, as the
+// one of the interrupted operation may be in use.
+func nvIndexCleanup(handle tpm2.Handle) func() error {
+	return func() error {
+		tpm, err := connectTPM()
+		if err != nil {
+			return err
+		}
+		defer tpm.Close()
+		if err := evictTPMHandle(tpm, handle); err != nil {
+			return err
+		}
+		return untrackHandle(handle)
+	}
+}
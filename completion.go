@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// completionOption describes a command line option for shell completion.
+type completionOption struct {
+	name        string
+	description string
+	takesValue  bool
+	valueName   string
+}
+
+// completionOptions returns the visible options of the helper, as defined in
+// the options struct.
+func completionOptions() []*completionOption {
+	var opts []*completionOption
+	t := reflect.TypeOf(options{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Tag.Get("long")
+		if name == "" || f.Tag.Get("hidden") != "" {
+			continue
+		}
+		opts = append(opts, &completionOption{
+			name:        name,
+			description: f.Tag.Get("description"),
+			takesValue:  f.Type.Kind() != reflect.Bool,
+			valueName:   f.Tag.Get("value-name"),
+		})
+	}
+	return opts
+}
+
+// completionFile returns whether the value of an option is a path.
+func (o *completionOption) completionFile() bool {
+	return o.valueName == "DIR"
+}
+
+func bashCompletion(opts []*completionOption) string {
+	var names, files, values []string
+	for _, o := range opts {
+		names = append(names, "--"+o.name)
+		if o.takesValue {
+			if o.completionFile() {
+				files = append(files, "--"+o.name)
+			} else {
+				values = append(values, "--"+o.name)
+			}
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "_fde_helper() {\n")
+	fmt.Fprintf(&b, "\tlocal cur prev\n")
+	fmt.Fprintf(&b, "\tcur=\"${COMP_WORDS[COMP_CWORD]}\"\n")
+	fmt.Fprintf(&b, "\tprev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+	fmt.Fprintf(&b, "\tcase \"$prev\" in\n")
+	if len(files) > 0 {
+		fmt.Fprintf(&b, "\t%s)\n\t\tCOMPREPLY=($(compgen -d -- \"$cur\"))\n\t\treturn\n\t\t;;\n", strings.Join(files, "|"))
+	}
+	if len(values) > 0 {
+		fmt.Fprintf(&b, "\t%s)\n\t\treturn\n\t\t;;\n", strings.Join(values, "|"))
+	}
+	fmt.Fprintf(&b, "\tesac\n")
+	fmt.Fprintf(&b, "\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(names, " "))
+	fmt.Fprintf(&b, "}\n")
+	fmt.Fprintf(&b, "complete -F _fde_helper %s\n", completionCommand())
+	return b.String()
+}
+
+func zshCompletion(opts []*completionOption) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "#compdef %s\n\n", completionCommand())
+	fmt.Fprintf(&b, "_arguments \\\n")
+	for _, o := range opts {
+		desc := strings.NewReplacer("[", "\\[", "]", "\\]", "'", "'\\''").Replace(o.description)
+		switch {
+		case !o.takesValue:
+			fmt.Fprintf(&b, "\t'--%s[%s]' \\\n", o.name, desc)
+		case o.completionFile():
+			fmt.Fprintf(&b, "\t'--%s=[%s]:%s:_files -/' \\\n", o.name, desc, strings.ToLower(o.valueName))
+		default:
+			fmt.Fprintf(&b, "\t'--%s=[%s]:value:' \\\n", o.name, desc)
+		}
+	}
+	fmt.Fprintf(&b, "\t&& return 0\n")
+	return b.String()
+}
+
+func fishCompletion(opts []*completionOption) string {
+	var b strings.Builder
+	cmd := completionCommand()
+	for _, o := range opts {
+		desc := strings.Replace(o.description, "'", "\\'", -1)
+		switch {
+		case !o.takesValue:
+			fmt.Fprintf(&b, "complete -c %s -f -l %s -d '%s'\n", cmd, o.name, desc)
+		case o.completionFile():
+			fmt.Fprintf(&b, "complete -c %s -l %s -r -a '(__fish_complete_directories)' -d '%s'\n", cmd, o.name, desc)
+		default:
+			fmt.Fprintf(&b, "complete -c %s -x -l %s -d '%s'\n", cmd, o.name, desc)
+		}
+	}
+	return b.String()
+}
+
+// completionCommand returns the name of the command to complete.
+func completionCommand() string {
+	name := os.Args[0]
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// printCompletion writes the completion script for the given shell to
+// stdout.
+func printCompletion(shell string) error {
+	opts := completionOptions()
+	var script string
+	switch shell {
+	case "bash":
+		script = bashCompletion(opts)
+	case "zsh":
+		script = zshCompletion(opts)
+	case "fish":
+		script = fishCompletion(opts)
+	default:
+		return fmt.Errorf("unsupported shell %q", shell)
+	}
+	_, err := fmt.Fprint(os.Stdout, script)
+	return err
+}
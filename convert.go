@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+)
+
+// convertParams are the parameters used to enroll TPM unlock on an existing
+// encrypted volume.
+type convertParams struct {
+	initialProvisionParams
+
+	// Device is the path to the existing LUKS2 volume.
+	Device string `json:"device"`
+	// Passphrase is an existing passphrase of the volume.
+	Passphrase string `json:"passphrase"`
+}
+
+type convertResponse struct {
+	// Keyslot is the LUKS keyslot of the new sealed key.
+	Keyslot *int `json:"keyslot,omitempty"`
+}
+
+// convert adds a new random key to an existing passphrase-encrypted volume
+// and seals it, so the volume can be unlocked with the TPM. The passphrase
+// keyslots are kept.
+func convert(p []byte) error {
+	var params convertParams
+	if err := json.Unmarshal(p, &params); err != nil {
+		return err
+	}
+	if params.Device == "" {
+		return fmt.Errorf("device not specified")
+	}
+	if params.Passphrase == "" {
+		return fmt.Errorf("passphrase not specified")
+	}
+	fstype, err := partitionType(params.Device)
+	if err != nil {
+		return err
+	}
+	if fstype != "crypto_LUKS" {
+		return fmt.Errorf("%s is not a LUKS volume", params.Device)
+	}
+	if err := checkFileSecure(sealedKeyFile); err == nil {
+		return fmt.Errorf("a sealed key already exists")
+	}
+
+	key := make([]byte, 64)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("cannot create key: %v", err)
+	}
+	if err := cryptsetupWithKeys([]byte(params.Passphrase), key, "luksAddKey", "--key-file=-", params.Device, "/dev/fd/3"); err != nil {
+		return fmt.Errorf("cannot add key to %s: %v", params.Device, err)
+	}
+
+	j, err := openJournal(journalFile)
+	if err != nil {
+		return err
+	}
+	if _, err := provision(&params.initialProvisionParams, key, j); err != nil {
+		// don't leave an unusable keyslot behind
+		if err := cryptsetupWithKeys(key, nil, "luksRemoveKey", "--key-file=-", params.Device); err != nil {
+			warnf("%v", err)
+		}
+		return err
+	}
+	if err := j.finish(); err != nil {
+		return err
+	}
+
+	var resp convertResponse
+	if slot, err := keyslotForKey(params.Device, key); err == nil {
+		resp.Keyslot = &slot
+	}
+	return writeResponse(&resp)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// what to do on unlock when the sealed key can't be read
+const (
+	// corruptKeyPolicyRecoveryKey asks for the recovery key, as if the
+	// key couldn't be unsealed.
+	corruptKeyPolicyRecoveryKey = "recovery-key"
+	// corruptKeyPolicyFail reports a corrupt-key error.
+	corruptKeyPolicyFail = "fail"
+	// corruptKeyPolicyBackup restores the backup of the sealed key made
+	// when it was last sealed, or its copy in the first backup directory
+	// that can be read, falling back to the recovery key if none can.
+	corruptKeyPolicyBackup = "backup"
+)
+
+// backupKeyFile returns the path of the backup of a sealed key file.
+func backupKeyFile(keyFile string) string {
+	return keyFile + ".backup"
+}
+
+// copyKeyFile atomically copies a sealed key file.
+func copyKeyFile(src, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	tmp := dst + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := secureFile(tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// backupSealedKeys keeps a copy of the sealed key files, so they can be
+// restored if they become unreadable, also in the backup directories. The
+// copies must be made whenever the keys are sealed or resealed, as older
+// policies are revoked.
+func backupSealedKeys() error {
+	for _, path := range sealedKeyFiles() {
+		if err := copyKeyFile(path, backupKeyFile(path)); err != nil {
+			return fmt.Errorf("cannot back up sealed key: %v", err)
+		}
+	}
+	copySealedKeysToBackupDirs()
+	return nil
+}
+
+// handleCorruptKey applies the corrupt key policy if the sealed key can't
+// be read. It returns the response if the volume was unlocked with the
+// recovery key, or nil if unlocking can proceed with the sealed key.
+func handleCorruptKey(params *unlockParams) (*unlockResponse, error) {
+	_, err := readSealedKey(sealedKeyFile)
+	if err == nil {
+		return nil, nil
+	}
+	err = fmt.Errorf("cannot read sealed key object: %v", err)
+
+	switch params.CorruptKeyPolicy {
+	case corruptKeyPolicyFail:
+		return nil, &codedError{code: errorCodeCorruptKey, err: err}
+	case corruptKeyPolicyBackup:
+		path, berr := restoreSealedKey(sealedKeyFile)
+		if berr == nil {
+			warnf("%v, restored the backup", err)
+			sealedKeyFile = path
+			return nil, nil
+		}
+		warnf("cannot restore the backup of the sealed key: %v", berr)
+	}
+
+	warnf("%v, falling back to the recovery key", err)
+	if _, err := activateWithRecoveryKey(params); err != nil {
+		return nil, err
+	}
+	resp := newUnlockResponse(unlockMethodRecoveryKey)
+	resp.CorruptKey = true
+	return resp, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errTPMTimeout is returned when the TPM doesn't respond before the unlock
+// deadline.
+var errTPMTimeout = errors.New("TPM did not respond before the unlock deadline")
+
+// tpmDeadline bounds the time spent waiting for the TPM while unlocking, so
+// a hung TPM (e.g. a broken firmware TPM after suspend) doesn't block the
+// boot forever.
+type tpmDeadline struct {
+	deadline time.Time
+	expired  bool
+
+	// mu serializes activating the volume with the deadline expiring, so
+	// an abandoned function can't activate the volume once the caller
+	// has fallen back to the recovery key
+	mu        sync.Mutex
+	activated bool
+}
+
+// newTPMDeadline creates a deadline the given number of seconds from now. No
+// deadline is enforced if seconds is not positive.
+func newTPMDeadline(seconds int) *tpmDeadline {
+	d := &tpmDeadline{}
+	if seconds > 0 {
+		d.deadline = time.Now().Add(time.Duration(seconds) * time.Second)
+	}
+	return d
+}
+
+// run calls f and returns its error, or errTPMTimeout if it doesn't return
+// before the deadline. In that case f is abandoned and keeps running in the
+// background, and must not share state read by the caller. The volume must
+// be activated by f through activate, so it isn't activated once f is
+// abandoned.
+func (d *tpmDeadline) run(f func() error) error {
+	if d.deadline.IsZero() {
+		return f()
+	}
+	d.mu.Lock()
+	remaining := time.Until(d.deadline)
+	if d.expired || remaining <= 0 {
+		d.expired = true
+		d.mu.Unlock()
+		return errTPMTimeout
+	}
+	d.activated = false
+	d.mu.Unlock()
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(remaining):
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.activated {
+			// the TPM responded and the volume was activated, what's
+			// left doesn't need the TPM
+			return <-done
+		}
+		d.expired = true
+		return errTPMTimeout
+	}
+}
+
+// activate calls f to activate the volume, unless the deadline expired
+// while the caller was waiting for the TPM, in which case errTPMTimeout is
+// returned without calling it.
+func (d *tpmDeadline) activate(f func() error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.expired {
+		return errTPMTimeout
+	}
+	err := f()
+	d.activated = err == nil
+	return err
+}
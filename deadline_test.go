@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTPMDeadlineAbandonedActivation(t *testing.T) {
+	d := newTPMDeadline(1)
+	d.deadline = time.Now().Add(10 * time.Millisecond)
+
+	unsealed := make(chan struct{})
+	result := make(chan error, 1)
+	activated := false
+	err := d.run(func() error {
+		// the TPM responds after the deadline
+		<-unsealed
+		err := d.activate(func() error {
+			activated = true
+			return nil
+		})
+		result <- err
+		return err
+	})
+	if err != errTPMTimeout {
+		t.Fatalf("expected %v, got %v", errTPMTimeout, err)
+	}
+	close(unsealed)
+	if err := <-result; err != errTPMTimeout {
+		t.Errorf("expected %v from the abandoned activation, got %v", errTPMTimeout, err)
+	}
+	if activated {
+		t.Error("volume activated after the deadline expired")
+	}
+	if err := d.run(func() error { return nil }); err != errTPMTimeout {
+		t.Errorf("expected %v once expired, got %v", errTPMTimeout, err)
+	}
+}
+
+func TestTPMDeadlineActivatedBeforeExpiring(t *testing.T) {
+	d := newTPMDeadline(1)
+	d.deadline = time.Now().Add(20 * time.Millisecond)
+
+	err := d.run(func() error {
+		err := d.activate(func() error { return nil })
+		// what's left after activating doesn't hit the deadline
+		time.Sleep(40 * time.Millisecond)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("expected the activation to succeed, got %v", err)
+	}
+	if d.expired {
+		t.Error("deadline expired after the volume was activated")
+	}
+}
+
+func TestTPMDeadlineNone(t *testing.T) {
+	d := newTPMDeadline(0)
+	called := false
+	if err := d.run(func() error {
+		return d.activate(func() error {
+			called = true
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !called {
+		t.Error("volume not activated without a deadline")
+	}
+}
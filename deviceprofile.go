@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/yaml.v2"
+)
+
+// defaultDeviceProfileFile is the declarative FDE configuration shipped by
+// the gadget snap, mounted here by snap-bootstrap.
+const defaultDeviceProfileFile = "/run/mnt/gadget/fde-profile.yaml"
+
+// deviceProfile lets device makers set defaults for the parameters given by
+// the callers, e.g.:
+//
+//	backend: tpm2
+//	pcrs:
+//	  boot-chain-model: uboot
+//	  measurement-pcrs:
+//	    kernel: 9
+//	retry:
+//	  retries: 3
+//	  initial-delay: 100
+//	recovery:
+//	  corrupt-key-policy: backup
+//	  recovery-key-first: true
+//	key-backup-dirs:
+//	  - /run/mnt/ubuntu-seed/device/fde
+type deviceProfile struct {
+	// Backend is the preferred backend reported by --probe-backends.
+	Backend  string                 `yaml:"backend"`
+	PCRs     *deviceProfilePCRs     `yaml:"pcrs"`
+	Retry    *deviceProfileRetry    `yaml:"retry"`
+	Recovery *deviceProfileRecovery `yaml:"recovery"`
+	// KeyBackupDirs are the directories holding copies of the sealed
+	// keys, unless given on the command line.
+	KeyBackupDirs []string `yaml:"key-backup-dirs"`
+}
+
+// deviceProfilePCRs are defaults for the operations sealing keys.
+type deviceProfilePCRs struct {
+	BootChainModel  string         `yaml:"boot-chain-model" json:"boot-chain-model,omitempty"`
+	MeasurementPCRs map[string]int `yaml:"measurement-pcrs" json:"measurement-pcrs,omitempty"`
+}
+
+// deviceProfileRetry is the default retry policy of unlock.
+type deviceProfileRetry struct {
+	Retries      int `yaml:"retries" json:"retries,omitempty"`
+	InitialDelay int `yaml:"initial-delay" json:"initial-delay,omitempty"`
+	MaxDelay     int `yaml:"max-delay" json:"max-delay,omitempty"`
+	// TPMTimeout is the default unlock tpm-timeout.
+	TPMTimeout int `yaml:"tpm-timeout" json:"-"`
+}
+
+// deviceProfileRecovery are defaults for the recovery behavior of unlock.
+type deviceProfileRecovery struct {
+	CorruptKeyPolicy string `yaml:"corrupt-key-policy" json:"corrupt-key-policy,omitempty"`
+	RecoveryKeyFirst bool   `yaml:"recovery-key-first" json:"recovery-key-first,omitempty"`
+}
+
+// readDeviceProfile reads the device profile of the gadget. An empty profile
+// is returned if the gadget has none.
+func readDeviceProfile() (*deviceProfile, error) {
+	var dp deviceProfile
+	data, err := ioutil.ReadFile(deviceProfileFile)
+	if os.IsNotExist(err) {
+		return &dp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(data, &dp); err != nil {
+		return nil, fmt.Errorf("cannot parse device profile: %v", err)
+	}
+	if dp.Backend != "" {
+		if _, ok := compiledBackends[dp.Backend]; !ok {
+			return nil, fmt.Errorf("device profile backend %q is not available", dp.Backend)
+		}
+	}
+	return &dp, nil
+}
+
+// preferBackend moves the backend of the profile to the front of the
+// backend preference.
+func (dp *deviceProfile) preferBackend() {
+	if dp.Backend == "" {
+		return
+	}
+	pref := []string{dp.Backend}
+	for _, name := range backendPreference {
+		if name != dp.Backend {
+			pref = append(pref, name)
+		}
+	}
+	backendPreference = pref
+}
+
+// defaults returns the parameters of the selected operation set by the
+// profile, by JSON name.
+func (dp *deviceProfile) defaults(opt *options) (map[string]interface{}, error) {
+	var sections []interface{}
+	defaults := map[string]interface{}{}
+	switch {
+	case opt.Init, opt.FactoryReset, opt.Update, opt.MigratePolicy:
+		sections = append(sections, dp.PCRs)
+	case opt.Unlock:
+		if dp.Retry != nil {
+			defaults["retry"] = dp.Retry
+			if dp.Retry.TPMTimeout > 0 {
+				defaults["tpm-timeout"] = dp.Retry.TPMTimeout
+			}
+		}
+		sections = append(sections, dp.Recovery)
+	}
+	for _, s := range sections {
+		data, err := json.Marshal(s)
+		if err != nil {
+			return nil, err
+		}
+		// absent sections are null
+		var m map[string]interface{}
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, err
+		}
+		for k, v := range m {
+			defaults[k] = v
+		}
+	}
+	return defaults, nil
+}
+
+// applyDeviceProfile merges the defaults of the profile under the parameters
+// given by the caller: parameters set by the caller are kept.
+func applyDeviceProfile(dp *deviceProfile, opt *options, p []byte) ([]byte, error) {
+	defaults, err := dp.defaults(opt)
+	if err != nil || len(defaults) == 0 {
+		return p, err
+	}
+	params := map[string]json.RawMessage{}
+	if len(bytes.TrimSpace(p)) > 0 {
+		if err := json.Unmarshal(p, &params); err != nil {
+			// leave the error to the operation
+			return p, nil
+		}
+	}
+	for k, v := range defaults {
+		if _, ok := params[k]; ok {
+			continue
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		params[k] = data
+	}
+	return json.Marshal(params)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+)
+
+const defaultDigestCacheFile = "/run/mnt/ubuntu-data/system-data/var/lib/snapd/device/fde/digest-cache.json"
+
+type digestCacheEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	// Digest is the SHA-256 digest of the file contents.
+	Digest string `json:"digest,omitempty"`
+	// Authenticode is the SHA-256 Authenticode digest of the file, for
+	// PE images.
+	Authenticode string `json:"authenticode,omitempty"`
+}
+
+// digestCache keeps the digests of boot assets keyed by path, size and
+// modification time, so unchanged assets don't need to be read again
+// across update runs.
+type digestCache struct {
+	path    string
+	Entries map[string]*digestCacheEntry `json:"entries"`
+	dirty   bool
+}
+
+// loadDigestCache reads the digest cache. A missing or unreadable cache is
+// treated as empty.
+func loadDigestCache(path string) *digestCache {
+	c := &digestCache{path: path}
+	if data, err := ioutil.ReadFile(path); err == nil {
+		json.Unmarshal(data, c)
+	}
+	if c.Entries == nil {
+		c.Entries = make(map[string]*digestCacheEntry)
+	}
+	return c
+}
+
+// entry returns the cache entry of the file in the given path, which is
+// emptied if the file size or modification time changed.
+func (c *digestCache) entry(path string) (*digestCacheEntry, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := c.Entries[path]; ok && e.Size == fi.Size() && e.ModTime.Equal(fi.ModTime()) {
+		return e, nil
+	}
+	e := &digestCacheEntry{
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}
+	c.Entries[path] = e
+	return e, nil
+}
+
+// digest returns the SHA-256 digest of the file in the given path, using the
+// cached value if the file size and modification time didn't change.
+func (c *digestCache) digest(path string) (string, error) {
+	e, err := c.entry(path)
+	if err != nil {
+		return "", err
+	}
+	if e.Digest != "" {
+		return e.Digest, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("cannot compute digest of %s: %v", path, err)
+	}
+
+	e.Digest = hex.EncodeToString(h.Sum(nil))
+	c.dirty = true
+	return e.Digest, nil
+}
+
+// authenticodeDigest returns the Authenticode digest of the PE image in the
+// given path, using the cached value if the file size and modification time
+// didn't change.
+func (c *digestCache) authenticodeDigest(path string) (tpm2.Digest, error) {
+	e, err := c.entry(path)
+	if err != nil {
+		return nil, err
+	}
+	if e.Authenticode != "" {
+		if digest, err := hex.DecodeString(e.Authenticode); err == nil && len(digest) == sha256.Size {
+			return digest, nil
+		}
+	}
+
+	digest, err := authenticodeDigest(path)
+	if err != nil {
+		return nil, err
+	}
+	e.Authenticode = hex.EncodeToString(digest)
+	c.dirty = true
+	return digest, nil
+}
+
+// save writes the cache to disk if it was modified.
+func (c *digestCache) save() error {
+	if !c.dirty {
+		return nil
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("cannot write digest cache: %v", err)
+	}
+	c.dirty = false
+	return os.Rename(tmp, c.path)
+}
+
+// invalidateDigestCache removes all cached digests.
+func invalidateDigestCache() error {
+	if err := os.Remove(digestCacheFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// loadChainFiles returns the paths of all files measured in the given load
+// chains. For assets inside snaps, the snap file itself is returned.
+func loadChainFiles(chains []*loadChain) []string {
+	seen := make(map[string]bool)
+	var walk func(chains []*loadChain)
+	walk = func(chains []*loadChain) {
+		for _, lc := range chains {
+			path := lc.Path
+			if lc.Snap != "" {
+				path = lc.Snap
+			}
+			if path != "" {
+				seen[path] = true
+			}
+			walk(lc.Next)
+		}
+	}
+	walk(chains)
+
+	files := make([]string, 0, len(seen))
+	for path := range seen {
+		files = append(files, path)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// inputsDigest computes a fingerprint of everything used to build the PCR
+// profile: the parameters and the contents of the files measured, e.g. the
+// boot assets in the load chains.
+func inputsDigest(cache *digestCache, params interface{}, files []string) (string, error) {
+	h := sha256.New()
+	if err := json.NewEncoder(h).Encode(params); err != nil {
+		return "", err
+	}
+	for _, path := range files {
+		digest, err := cache.digest(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s %s\n", path, digest)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	sb "github.com/snapcore/secboot"
+)
+
+// dmFlags maps the device-mapper flags that can be requested to the
+// systemd-cryptsetup options that set them.
+var dmFlags = map[string]string{
+	"allow-discards":         "discard",
+	"same-cpu-crypt":         "same-cpu-crypt",
+	"submit-from-crypt-cpus": "submit-from-crypt-cpus",
+	"no-read-workqueue":      "no-read-workqueue",
+	"no-write-workqueue":     "no-write-workqueue",
+}
+
+// activationFlags selects how the volume is activated.
+type activationFlags struct {
+	// ReadOnly activates the volume read-only, so it can be inspected
+	// without being modified.
+	ReadOnly bool `json:"read-only,omitempty"`
+	// DMFlags lists additional device-mapper flags, e.g.
+	// "allow-discards" or "no-read-workqueue".
+	DMFlags []string `json:"dm-flags,omitempty"`
+}
+
+func (f *activationFlags) validate() error {
+	for _, flag := range f.DMFlags {
+		if _, ok := dmFlags[flag]; !ok {
+			return fmt.Errorf("unsupported device-mapper flag %q", flag)
+		}
+	}
+	return nil
+}
+
+// cryptsetupFlagArgs maps the device-mapper flags to the cryptsetup options
+// that set them.
+var cryptsetupFlagArgs = map[string]string{
+	"allow-discards":         "--allow-discards",
+	"same-cpu-crypt":         "--perf-same_cpu_crypt",
+	"submit-from-crypt-cpus": "--perf-submit_from_crypt_cpus",
+	"no-read-workqueue":      "--perf-no_read_workqueue",
+	"no-write-workqueue":     "--perf-no_write_workqueue",
+}
+
+// cryptsetupArgs returns the cryptsetup command line options for the flags.
+func (f *activationFlags) cryptsetupArgs() []string {
+	var args []string
+	if f.ReadOnly {
+		args = append(args, "--readonly")
+	}
+	for _, flag := range f.DMFlags {
+		args = append(args, cryptsetupFlagArgs[flag])
+	}
+	return args
+}
+
+// cryptsetupOptions returns the systemd-cryptsetup options for the flags.
+func (f *activationFlags) cryptsetupOptions() []string {
+	var options []string
+	if f.ReadOnly {
+		options = append(options, "read-only")
+	}
+	for _, flag := range f.DMFlags {
+		options = append(options, dmFlags[flag])
+	}
+	return options
+}
+
+// volumeOptions adds the flags to the given activation options, which may
+// be nil.
+func (f *activationFlags) volumeOptions(options *sb.ActivateVolumeOptions) *sb.ActivateVolumeOptions {
+	cryptsetupOptions := f.cryptsetupOptions()
+	if len(cryptsetupOptions) == 0 {
+		return options
+	}
+	if options == nil {
+		options = &sb.ActivateVolumeOptions{}
+	}
+	options.ActivateOptions = append(options.ActivateOptions, cryptsetupOptions...)
+	return options
+}
+
+// systemdOptions returns the systemd-cryptsetup options string with the
+// flags added to the given options.
+func (f *activationFlags) systemdOptions(options string) string {
+	return strings.Join(append([]string{options}, f.cryptsetupOptions()...), ",")
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/canonical/go-tpm2"
+)
+
+// dryRun makes mutating operations write the actions they would perform
+// instead of performing them.
+var dryRun bool
+
+// kinds of planned actions
+const (
+	actionTPM        = "tpm"
+	actionCryptsetup = "cryptsetup"
+	actionFile       = "file"
+)
+
+// plannedAction is a change an operation would make.
+type plannedAction struct {
+	Kind   string `json:"kind"`
+	Action string `json:"action"`
+	Target string `json:"target"`
+}
+
+type dryRunResponse struct {
+	Operation string           `json:"operation"`
+	Actions   []*plannedAction `json:"actions"`
+}
+
+// plan collects the actions of an operation in the order they would be
+// performed.
+type plan struct {
+	operation string
+	actions   []*plannedAction
+}
+
+func newPlan(operation string) *plan {
+	return &plan{operation: operation, actions: []*plannedAction{}}
+}
+
+func (pl *plan) add(kind, action, target string) {
+	pl.actions = append(pl.actions, &plannedAction{Kind: kind, Action: action, Target: target})
+}
+
+func (pl *plan) write() error {
+	return writeResponse(&dryRunResponse{Operation: pl.operation, Actions: pl.actions})
+}
+
+func handleTarget(h tpm2.Handle) string {
+	return fmt.Sprintf("%#x", uint32(h))
+}
+
+// dryRunSupported returns true if the selected operation can be dry run.
+func (opt *options) dryRunSupported() bool {
+	return opt.Init || opt.Update || opt.Unenroll || opt.FactoryReset || opt.MigratePolicy
+}
+
+// provision adds the actions of provisioning with the given parameters,
+// skipping the steps already recorded in the journal.
+func (pl *plan) provision(params *initialProvisionParams, j *journal) {
+	if params.RecoveryKeyOnly {
+		if !j.done(stepKeySealed) {
+			pl.add(actionFile, "write key metadata", keyMetadataFile(sealedKeyFile))
+		}
+		return
+	}
+
+	if !j.done(stepTPMProvisioned) {
+		coexist := false
+		if tpm, err := connectTPM(); err == nil {
+			coexist, _ = ownerAuthSet(tpm)
+			tpm.Close()
+		}
+		if coexist {
+			pl.add(actionTPM, "use storage hierarchy owned by other software", "owner")
+		} else {
+			pl.add(actionTPM, "provision and set lockout authorization", "lockout")
+		}
+		if (params.SRK != nil && params.SRK.Handle == nil) || coexist {
+			pl.add(actionTPM, "create storage root key", handleTarget(srkHandle))
+		}
+		switch {
+		case coexist:
+		case params.LockoutAuthStorage == lockoutAuthStorageNV:
+			pl.add(actionTPM, "define lockout authorization index", handleTarget(lockoutAuthNVHandle))
+		default:
+			pl.add(actionFile, "write lockout authorization", lockoutAuthFile)
+		}
+	}
+	if j.done(stepKeySealed) {
+		return
+	}
+	if j.done(stepSealStarted) {
+		pl.add(actionFile, "remove sealed key of interrupted sealing", sealedKeyFile)
+		pl.add(actionTPM, "undefine PCR policy counter", handleTarget(pcrPolicyCounterHandle))
+	}
+
+	if params.DeriveKey {
+		if params.BootPhasePin {
+			pl.add(actionTPM, "define boot phase index", handleTarget(bootPhaseHandle))
+		}
+		pl.add(actionCryptsetup, "luksAddKey derived key", params.VolumeDevice)
+	}
+	if params.DeriveSaveKey {
+		pl.add(actionCryptsetup, "luksAddKey derived save key", params.SaveDevice)
+	}
+	pl.add(actionTPM, "define PCR policy counter", handleTarget(pcrPolicyCounterHandle))
+	pl.add(actionFile, "seal key", sealedKeyFile)
+	if params.SaveKey != "" && !params.DeriveSaveKey {
+		pl.add(actionFile, "seal save key", saveSealedKeyFile)
+	}
+	pl.add(actionFile, "write key metadata", keyMetadataFile(sealedKeyFile))
+	pl.add(actionFile, "back up sealed key", backupKeyFile(sealedKeyFile))
+}
+
+// planInitialProvision writes the actions of the initial provisioning.
+func planInitialProvision(params *initialProvisionParams, j *journal) error {
+	pl := newPlan("initial-provision")
+	if params.VolumeKey != "" && params.VolumeKey != keyNameData {
+		sealedKeyFile = volumeKeyFile(params.VolumeKey)
+		pl.add(actionTPM, "allocate PCR policy counter", params.VolumeKey)
+	}
+	pl.provision(params, j)
+	if params.VolumeKey != "" && params.VolumeKey != keyNameData {
+		pl.add(actionFile, "record volume key", volumeKeyIndexFile())
+	}
+	return pl.write()
+}
+
+// planUpdate writes the actions of updating the policy of the selected key.
+func planUpdate() error {
+	pl := newPlan("update")
+	pl.add(actionTPM, "increment PCR policy counter", handleTarget(pcrPolicyCounterHandle))
+	for _, path := range sealedKeyFiles() {
+		pl.add(actionFile, "update PCR policy", path)
+	}
+	pl.add(actionFile, "write key metadata", keyMetadataFile(sealedKeyFile))
+	pl.add(actionFile, "back up sealed key", backupKeyFile(sealedKeyFile))
+	return pl.write()
+}
+
+// planUnenroll writes the actions of removing the TPM unlock from a volume.
+func planUnenroll(params *unenrollParams) error {
+	pl := newPlan("unenroll")
+	if params.Keyslot != nil {
+		pl.add(actionCryptsetup, "luksKillSlot "+strconv.Itoa(*params.Keyslot), params.Device)
+	} else {
+		pl.add(actionCryptsetup, "luksRemoveKey sealed key", params.Device)
+	}
+	pl.rollbackSeal()
+	return pl.write()
+}
+
+// rollbackSeal adds the actions of removing the sealed key.
+func (pl *plan) rollbackSeal() {
+	for _, path := range []string{sealedKeyFile, saveSealedKeyFile, keyMetadataFile(sealedKeyFile), backupKeyFile(sealedKeyFile), backupKeyFile(saveSealedKeyFile)} {
+		if _, err := os.Lstat(path); err == nil {
+			pl.add(actionFile, "remove", path)
+		}
+	}
+	pl.add(actionTPM, "undefine PCR policy counter", handleTarget(pcrPolicyCounterHandle))
+}
+
+// planFactoryReset writes the actions of a factory reset.
+func planFactoryReset(params *factoryResetParams, md *keyMetadata) error {
+	pl := newPlan("factory-reset")
+	pl.add(actionCryptsetup, "luksFormat "+params.DataLabel, params.DataDevice)
+	pl.rollbackSeal()
+	// only whether there is a save key matters for the plan
+	pp := params.initialProvisionParams
+	pp.SaveKey = "save-key"
+	pp.SaveDevice = params.SaveDevice
+	pp.DeriveSaveKey = md.SaveKeyDerivation != nil
+	pl.provision(&pp, &journal{Steps: []string{stepTPMProvisioned}})
+	if md.SaveKeyDerivation != nil {
+		pl.add(actionCryptsetup, "luksRemoveKey old derived save key", params.SaveDevice)
+	}
+	return pl.write()
+}
+
+// planMigratePolicy writes the actions of sealing the key again.
+func planMigratePolicy() error {
+	pl := newPlan("migrate-policy")
+	pl.add(actionTPM, "undefine PCR policy counter", handleTarget(pcrPolicyCounterHandle))
+	pl.add(actionTPM, "define PCR policy counter", handleTarget(pcrPolicyCounterHandle))
+	for _, path := range sealedKeyFiles() {
+		pl.add(actionFile, "seal key again", path)
+	}
+	pl.add(actionFile, "write key metadata", keyMetadataFile(sealedKeyFile))
+	pl.add(actionFile, "back up sealed key", backupKeyFile(sealedKeyFile))
+	return pl.write()
+}
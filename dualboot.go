@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/canonical/go-tpm2"
+	sb "github.com/snapcore/secboot"
+)
+
+// range of the NV indices reserved for the owner, where operating systems
+// define their indices
+const (
+	ownerNVIndexFirst tpm2.Handle = 0x01800000
+	ownerNVIndexLast  tpm2.Handle = 0x01bfffff
+)
+
+// Windows boot manager in the EFI system partition, on Ubuntu Core and on
+// classic systems
+var defaultWindowsBootManagers = []string{
+	"/run/mnt/ubuntu-seed/EFI/Microsoft/Boot/bootmgfw.efi",
+	"/boot/efi/EFI/Microsoft/Boot/bootmgfw.efi",
+}
+
+var windowsBootManagers = defaultWindowsBootManagers
+
+// dualBootStatus reports the use of the TPM by another operating system.
+type dualBootStatus struct {
+	// WindowsDetected is set if the Windows boot manager was found, so
+	// BitLocker may have sealed keys with the TPM.
+	WindowsDetected bool `json:"windows-detected"`
+	// ForeignNVIndices lists the NV indices in the owner range not
+	// created by the helper.
+	ForeignNVIndices []uint32 `json:"foreign-nv-indices,omitempty"`
+	// SharedSRK is set if the storage root key wasn't created by the
+	// helper. Other software uses it as the parent of its keys too.
+	SharedSRK bool     `json:"shared-srk,omitempty"`
+	Notes     []string `json:"notes,omitempty"`
+}
+
+// windowsInstalled returns true if the Windows boot manager is installed.
+func windowsInstalled() bool {
+	for _, path := range windowsBootManagers {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// foreignHandle returns true if the handle exists in the TPM but wasn't
+// created by the helper.
+func foreignHandle(tpm *sb.TPMConnection, r *handleRegistry, handle tpm2.Handle) (bool, error) {
+	if r.find(handle) != nil {
+		return false, nil
+	}
+	_, err := tpm.CreateResourceContextFromTPM(handle)
+	if tpm2.IsResourceUnavailableError(err, handle) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("cannot access handle %#x: %v", uint32(handle), err)
+	}
+	return true, nil
+}
+
+// foreignNVIndices returns the NV indices in the owner range that weren't
+// created by the helper.
+func foreignNVIndices(tpm *sb.TPMConnection) ([]tpm2.Handle, error) {
+	r, err := readHandleRegistry()
+	if err != nil {
+		return nil, err
+	}
+	handles, err := tpm.GetCapabilityHandles(ownerNVIndexFirst, uint32(ownerNVIndexLast-ownerNVIndexFirst+1))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read NV indices: %v", err)
+	}
+	var foreign []tpm2.Handle
+	for _, h := range handles {
+		if h > ownerNVIndexLast {
+			break
+		}
+		if r.find(h) == nil {
+			foreign = append(foreign, h)
+		}
+	}
+	return foreign, nil
+}
+
+// checkHandleConflicts refuses to use handles that exist in the TPM but
+// weren't created by the helper, as replacing them would break the other
+// software, e.g. the BitLocker unlock of a dual-boot system.
+func checkHandleConflicts(tpm *sb.TPMConnection, handles ...tpm2.Handle) error {
+	r, err := readHandleRegistry()
+	if err != nil {
+		return err
+	}
+	for _, h := range handles {
+		foreign, err := foreignHandle(tpm, r, h)
+		if err != nil {
+			return err
+		}
+		if foreign {
+			return fmt.Errorf("handle %#x is used by other software", uint32(h))
+		}
+	}
+	return nil
+}
+
+// freeHandle returns the first handle from the given one that isn't used
+// by other software.
+func freeHandle(tpm *sb.TPMConnection, handle tpm2.Handle) (tpm2.Handle, error) {
+	r, err := readHandleRegistry()
+	if err != nil {
+		return 0, err
+	}
+	for ; handle <= ownerNVIndexLast; handle++ {
+		foreign, err := foreignHandle(tpm, r, handle)
+		if err != nil {
+			return 0, err
+		}
+		if !foreign {
+			return handle, nil
+		}
+	}
+	return 0, fmt.Errorf("no free NV index")
+}
+
+// readDualBootStatus returns how other software uses the TPM, or nil if
+// there are no signs of it.
+func readDualBootStatus(tpm *sb.TPMConnection) (*dualBootStatus, error) {
+	s := &dualBootStatus{WindowsDetected: windowsInstalled()}
+	foreign, err := foreignNVIndices(tpm)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range foreign {
+		s.ForeignNVIndices = append(s.ForeignNVIndices, uint32(h))
+	}
+	r, err := readHandleRegistry()
+	if err != nil {
+		return nil, err
+	}
+	if s.SharedSRK, err = foreignHandle(tpm, r, srkHandle); err != nil {
+		return nil, err
+	}
+	if !s.WindowsDetected && len(s.ForeignNVIndices) == 0 && !s.SharedSRK {
+		return nil, nil
+	}
+
+	if s.WindowsDetected {
+		// BitLocker seals to PCRs 7 and 11 with secure boot, or
+		// 0, 2, 4 and 11 otherwise
+		s.Notes = append(s.Notes,
+			"BitLocker may use the TPM: updating the secure boot signature databases or the firmware "+
+				"can make Windows ask for its recovery key, suspend BitLocker before updating them")
+	}
+	if s.SharedSRK {
+		s.Notes = append(s.Notes, "the storage root key is shared, it must not be replaced or evicted")
+	}
+	if len(s.ForeignNVIndices) > 0 {
+		s.Notes = append(s.Notes, "NV indices of other software are present, the helper doesn't use their handles")
+	}
+	return s, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	sb "github.com/snapcore/secboot"
+)
+
+// actions performed when the duress PIN is entered
+const (
+	duressActionErase = "erase"
+	duressActionDecoy = "decoy"
+)
+
+// the decoy volume key is not secret, it's kept in the boot partition
+const defaultDecoyKeyFile = "/run/mnt/ubuntu-boot/fde-decoy-key"
+
+// duressPINKDF identifies duress PIN digests derived with
+// PBKDF2-HMAC-SHA256. Older versions used iterated SHA-256 and recorded no
+// KDF.
+const duressPINKDF = "pbkdf2-sha256"
+
+// number of PBKDF2 iterations used to derive the duress PIN digest
+const duressPINIterations = 600000
+
+// number of SHA-256 iterations of the digests of older versions
+const legacyDuressPINIterations = 100000
+
+// duressParams configure a secondary PIN that, when entered instead of the
+// real PIN, erases the encrypted volume or unlocks a decoy volume.
+type duressParams struct {
+	PIN    string `json:"pin"`
+	Action string `json:"action"`
+	// DecoyDevice is the path to the decoy volume unlocked instead of
+	// the real one, with the decoy action.
+	DecoyDevice string `json:"decoy-device,omitempty"`
+	DecoyKey    []byte `json:"decoy-key,omitempty"`
+	// ConfirmationToken must be set to the wipe confirmation token to
+	// use the erase action.
+	ConfirmationToken string `json:"confirmation-token,omitempty"`
+}
+
+// duressMetadata is the duress configuration stored in the key metadata.
+type duressMetadata struct {
+	// KDF and Iterations describe how PINDigest is derived from the PIN
+	// and the salt.
+	KDF         string `json:"kdf,omitempty"`
+	Iterations  int    `json:"iterations,omitempty"`
+	Salt        string `json:"salt"`
+	PINDigest   string `json:"pin-digest"`
+	Action      string `json:"action"`
+	DecoyDevice string `json:"decoy-device,omitempty"`
+}
+
+// legacyDuressPINDigest computes the duress PIN digest of older versions.
+func legacyDuressPINDigest(salt []byte, pin string) []byte {
+	h := sha256.Sum256(append(salt, pin...))
+	for i := 1; i < legacyDuressPINIterations; i++ {
+		h = sha256.Sum256(h[:])
+	}
+	return h[:]
+}
+
+// pinDigest computes the digest of the given PIN as configured in the
+// metadata.
+func (dm *duressMetadata) pinDigest(salt []byte, pin string) ([]byte, error) {
+	switch dm.KDF {
+	case "":
+		return legacyDuressPINDigest(salt, pin), nil
+	case duressPINKDF:
+		if dm.Iterations <= 0 {
+			return nil, fmt.Errorf("invalid duress PIN iterations %d", dm.Iterations)
+		}
+		return pbkdf2SHA256([]byte(pin), salt, dm.Iterations, sha256.Size), nil
+	}
+	return nil, fmt.Errorf("unsupported duress PIN KDF %q", dm.KDF)
+}
+
+// metadata validates the duress parameters and returns the configuration to
+// store. The decoy key, if any, is written to the decoy key file.
+func (dp *duressParams) metadata() (*duressMetadata, error) {
+	if dp.PIN == "" {
+		return nil, fmt.Errorf("duress PIN not specified")
+	}
+	switch dp.Action {
+	case duressActionErase:
+		if dp.ConfirmationToken != wipeConfirmationToken {
+			return nil, fmt.Errorf("duress erase action requires the confirmation token %q", wipeConfirmationToken)
+		}
+	case duressActionDecoy:
+		if dp.DecoyDevice == "" || len(dp.DecoyKey) == 0 {
+			return nil, fmt.Errorf("duress decoy action requires the decoy device and key")
+		}
+		if err := os.MkdirAll(filepath.Dir(decoyKeyFile), 0755); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(decoyKeyFile, dp.DecoyKey, 0600); err != nil {
+			return nil, fmt.Errorf("cannot write decoy key: %v", err)
+		}
+		if err := secureFile(decoyKeyFile); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid duress action %q", dp.Action)
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("cannot create salt: %v", err)
+	}
+	return &duressMetadata{
+		KDF:         duressPINKDF,
+		Iterations:  duressPINIterations,
+		Salt:        hex.EncodeToString(salt),
+		PINDigest:   hex.EncodeToString(pbkdf2SHA256([]byte(dp.PIN), salt, duressPINIterations, sha256.Size)),
+		Action:      dp.Action,
+		DecoyDevice: dp.DecoyDevice,
+	}, nil
+}
+
+// matches returns true if the given PIN is the duress PIN.
+func (dm *duressMetadata) matches(pin string) bool {
+	salt, err := hex.DecodeString(dm.Salt)
+	if err != nil {
+		return false
+	}
+	digest, err := hex.DecodeString(dm.PINDigest)
+	if err != nil {
+		return false
+	}
+	computed, err := dm.pinDigest(salt, pin)
+	if err != nil {
+		warnf("%v", err)
+		return false
+	}
+	return subtle.ConstantTimeCompare(computed, digest) == 1
+}
+
+// trigger performs the duress action. To an observer, the result looks
+// like a failed or a successful PIN unlock.
+func (dm *duressMetadata) trigger(tpm *sb.TPMConnection, params *unlockParams) (*unlockResponse, error) {
+	switch dm.Action {
+	case duressActionErase:
+		if err := cryptoErase(params.SourceDevicePath); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("cannot activate volume")
+	case duressActionDecoy:
+		key, err := readStateFile(tpm, decoyKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot activate volume")
+		}
+		if err := sb.ActivateVolumeWithKey(params.VolumeName, dm.DecoyDevice, key, params.volumeOptions(nil)); err != nil {
+			return nil, err
+		}
+		return &unlockResponse{Method: unlockMethodSealedKeyPIN}, nil
+	}
+	return nil, fmt.Errorf("invalid duress action %q", dm.Action)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/sha256"
+	"debug/pe"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/canonical/go-tpm2"
+	sb "github.com/snapcore/secboot"
+)
+
+// PCR where the boot manager measures the EFI applications it loads.
+const bootManagerPCR = 4
+
+// Events measured to the boot manager PCR by the firmware before the first
+// EFI application is loaded.
+var (
+	callingEFIApplicationEvent = []byte("Calling EFI Application from Boot Option")
+	separatorEvent             = []byte{0, 0, 0, 0}
+)
+
+// imageDigest returns the Authenticode digest of the load chain entry, either
+// as given explicitly or computed from the image file. The digest of the
+// file is taken from the cache if given, unless the file is a temporary
+// copy of an asset in a snap.
+func (lc *loadChain) imageDigest(cache *digestCache) (tpm2.Digest, error) {
+	if lc.Digest != "" {
+		digest, err := hex.DecodeString(lc.Digest)
+		if err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("invalid digest %q", lc.Digest)
+		}
+		return digest, nil
+	}
+	if lc.Path == "" {
+		return nil, fmt.Errorf("load chain entry without path or digest")
+	}
+	if cache != nil && lc.origin == nil {
+		return cache.authenticodeDigest(lc.Path)
+	}
+	return authenticodeDigest(lc.Path)
+}
+
+// authenticodeDigest computes the SHA-256 Authenticode digest of a PE image,
+// which is what the firmware measures when loading it.
+func authenticodeDigest(path string) (tpm2.Digest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %v", path, err)
+	}
+	f, err := pe.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	if len(data) < 0x40 {
+		return nil, fmt.Errorf("%s is not a PE image", path)
+	}
+	optOffset := int(binary.LittleEndian.Uint32(data[0x3c:])) + 4 + 20
+	var sizeOfHeaders, certOffset, certSize uint32
+	var dirsOffset int
+	switch oh := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		sizeOfHeaders = oh.SizeOfHeaders
+		dirsOffset = optOffset + 96
+		if oh.NumberOfRvaAndSizes > pe.IMAGE_DIRECTORY_ENTRY_SECURITY {
+			certOffset = oh.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_SECURITY].VirtualAddress
+			certSize = oh.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_SECURITY].Size
+		}
+	case *pe.OptionalHeader64:
+		sizeOfHeaders = oh.SizeOfHeaders
+		dirsOffset = optOffset + 112
+		if oh.NumberOfRvaAndSizes > pe.IMAGE_DIRECTORY_ENTRY_SECURITY {
+			certOffset = oh.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_SECURITY].VirtualAddress
+			certSize = oh.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_SECURITY].Size
+		}
+	default:
+		return nil, fmt.Errorf("%s has no optional header", path)
+	}
+	checksumOffset := optOffset + 64
+	certDirOffset := dirsOffset + pe.IMAGE_DIRECTORY_ENTRY_SECURITY*8
+	if int(sizeOfHeaders) > len(data) || certDirOffset+8 > int(sizeOfHeaders) ||
+		uint64(certOffset)+uint64(certSize) > uint64(len(data)) {
+		return nil, fmt.Errorf("%s has invalid headers", path)
+	}
+
+	// the headers are hashed without the checksum and the certificate
+	// table entry
+	h := sha256.New()
+	h.Write(data[:checksumOffset])
+	h.Write(data[checksumOffset+4 : certDirOffset])
+	h.Write(data[certDirOffset+8 : sizeOfHeaders])
+
+	sections := append([]*pe.Section(nil), f.Sections...)
+	sort.Slice(sections, func(i, j int) bool { return sections[i].Offset < sections[j].Offset })
+	hashed := uint64(sizeOfHeaders)
+	for _, s := range sections {
+		if s.Size == 0 {
+			continue
+		}
+		end := uint64(s.Offset) + uint64(s.Size)
+		if end > uint64(len(data)) {
+			return nil, fmt.Errorf("section %s of %s is truncated", s.Name, path)
+		}
+		h.Write(data[s.Offset:end])
+		hashed += uint64(s.Size)
+	}
+
+	// trailing data, excluding the certificate table
+	end := uint64(len(data)) - uint64(certSize)
+	if hashed < end {
+		h.Write(data[hashed:end])
+	}
+	return h.Sum(nil), nil
+}
+
+// bootManagerSequences returns the Authenticode digests of the images in
+// every path through the load chains, in the order they are loaded.
+func bootManagerSequences(chains []*loadChain, cache *digestCache) ([][]tpm2.Digest, error) {
+	var sequences [][]tpm2.Digest
+	for _, lc := range chains {
+		digest, err := lc.imageDigest(cache)
+		if err != nil {
+			return nil, err
+		}
+		if len(lc.Next) == 0 {
+			sequences = append(sequences, []tpm2.Digest{digest})
+			continue
+		}
+		next, err := bootManagerSequences(lc.Next, cache)
+		if err != nil {
+			return nil, err
+		}
+		for _, seq := range next {
+			sequences = append(sequences, append([]tpm2.Digest{digest}, seq...))
+		}
+	}
+	return sequences, nil
+}
+
+// addBootManagerProfileFromDigests makes the profile require the boot
+// manager PCR to contain the measurements of one of the paths through the
+// load chains. Unlike sb.AddEFIBootManagerProfile, it doesn't need to read
+// images whose digest is given explicitly or cached.
+func addBootManagerProfileFromDigests(pcrProfile *sb.PCRProtectionProfile, chains []*loadChain, cache *digestCache) error {
+	sequences, err := bootManagerSequences(chains, cache)
+	if err != nil {
+		return err
+	}
+
+	action := sha256.Sum256(callingEFIApplicationEvent)
+	separator := sha256.Sum256(separatorEvent)
+	branches := make([]*sb.PCRProtectionProfile, 0, len(sequences))
+	for _, seq := range sequences {
+		branch := sb.NewPCRProtectionProfile().
+			AddPCRValue(tpm2.HashAlgorithmSHA256, bootManagerPCR, make(tpm2.Digest, sha256.Size)).
+			ExtendPCR(tpm2.HashAlgorithmSHA256, bootManagerPCR, action[:]).
+			ExtendPCR(tpm2.HashAlgorithmSHA256, bootManagerPCR, separator[:])
+		for _, digest := range seq {
+			branch.ExtendPCR(tpm2.HashAlgorithmSHA256, bootManagerPCR, digest)
+		}
+		branches = append(branches, branch)
+	}
+	pcrProfile.AddProfileOR(branches...)
+	return nil
+}
+
+// hasDigests returns whether any entry in the load chains is given by its
+// digest instead of its path.
+func hasDigests(chains []*loadChain) bool {
+	for _, lc := range chains {
+		if lc.Digest != "" || hasDigests(lc.Next) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// offsets in the test image built by testPEImage
+const (
+	testPEChecksumOffset = 0x58 + 64
+	testPESectionOffset  = 0x200
+	testPECertOffset     = 0x400
+)
+
+// testPEImage returns a minimal PE32+ image with one section and a
+// certificate table.
+func testPEImage(t *testing.T) []byte {
+	var buf bytes.Buffer
+	dos := make([]byte, 0x40)
+	copy(dos, "MZ")
+	binary.LittleEndian.PutUint32(dos[0x3c:], 0x40)
+	buf.Write(dos)
+	buf.WriteString("PE\x00\x00")
+
+	fh := pe.FileHeader{
+		Machine:              pe.IMAGE_FILE_MACHINE_AMD64,
+		NumberOfSections:     1,
+		SizeOfOptionalHeader: 240,
+		Characteristics:      pe.IMAGE_FILE_EXECUTABLE_IMAGE,
+	}
+	oh := pe.OptionalHeader64{
+		Magic:               0x20b,
+		SectionAlignment:    0x200,
+		FileAlignment:       0x200,
+		SizeOfImage:         0x400,
+		SizeOfHeaders:       0x200,
+		CheckSum:            0x12345678,
+		Subsystem:           pe.IMAGE_SUBSYSTEM_EFI_APPLICATION,
+		NumberOfRvaAndSizes: 16,
+	}
+	oh.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_SECURITY] = pe.DataDirectory{VirtualAddress: testPECertOffset, Size: 0x10}
+	sh := pe.SectionHeader32{
+		VirtualSize:      0x200,
+		VirtualAddress:   0x200,
+		SizeOfRawData:    0x200,
+		PointerToRawData: testPESectionOffset,
+	}
+	copy(sh.Name[:], ".text")
+	for _, v := range []interface{}{&fh, &oh, &sh} {
+		if err := binary.Write(&buf, binary.LittleEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	image := make([]byte, testPECertOffset+0x10)
+	copy(image, buf.Bytes())
+	for i := testPESectionOffset; i < testPECertOffset; i++ {
+		image[i] = byte(i)
+	}
+	copy(image[testPECertOffset:], "certificate data")
+	return image
+}
+
+func writeTestFile(t *testing.T, dir, name string, data []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAuthenticodeDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fde-helper-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := testPEImage(t)
+	digest, err := authenticodeDigest(writeTestFile(t, dir, "image.efi", image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(digest) != 32 {
+		t.Fatalf("unexpected digest size %d", len(digest))
+	}
+
+	tests := []struct {
+		summary string
+		offset  int
+		changed bool
+	}{
+		{summary: "checksum", offset: testPEChecksumOffset},
+		{summary: "certificate table", offset: testPECertOffset + 4},
+		{summary: "DOS stub", offset: 0x10, changed: true},
+		{summary: "section data", offset: testPESectionOffset + 0x10, changed: true},
+	}
+	for _, tc := range tests {
+		modified := append([]byte(nil), image...)
+		modified[tc.offset] ^= 0xff
+		d, err := authenticodeDigest(writeTestFile(t, dir, "modified.efi", modified))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.summary, err)
+			continue
+		}
+		if changed := !bytes.Equal(d, digest); changed != tc.changed {
+			t.Errorf("%s: expected digest changed %v, got %v", tc.summary, tc.changed, changed)
+		}
+	}
+}
+
+func TestAuthenticodeDigestInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fde-helper-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := testPEImage(t)
+	tests := []struct {
+		summary string
+		data    []byte
+	}{
+		{summary: "not a PE image", data: []byte("not an image")},
+		{summary: "truncated section", data: image[:testPESectionOffset+0x100]},
+		{summary: "missing", data: nil},
+	}
+	for _, tc := range tests {
+		path := filepath.Join(dir, "missing.efi")
+		if tc.data != nil {
+			path = writeTestFile(t, dir, "invalid.efi", tc.data)
+		}
+		if _, err := authenticodeDigest(path); err == nil {
+			t.Errorf("%s: expected error", tc.summary)
+		}
+	}
+}
+
+func TestImageDigest(t *testing.T) {
+	digest := "00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff"
+	tests := []struct {
+		summary string
+		lc      loadChain
+		err     string
+	}{
+		{summary: "explicit digest", lc: loadChain{Digest: digest}},
+		{summary: "short digest", lc: loadChain{Digest: "0011"}, err: `invalid digest "0011"`},
+		{summary: "invalid digest", lc: loadChain{Digest: "zz"}, err: `invalid digest "zz"`},
+		{summary: "no path", lc: loadChain{}, err: "load chain entry without path or digest"},
+	}
+	for _, tc := range tests {
+		d, err := tc.lc.imageDigest(nil)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: expected error %q, got %v", tc.summary, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.summary, err)
+			continue
+		}
+		if got := hex.EncodeToString(d); got != digest {
+			t.Errorf("%s: expected %s, got %s", tc.summary, digest, got)
+		}
+	}
+}
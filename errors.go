@@ -0,0 +1,47 @@
+package main
+
+import "fmt"
+
+// codes of the errors reported for conditions the caller can act upon
+const (
+	errorCodeTPMCleared          = "tpm-cleared"
+	errorCodeInterrupted         = "interrupted"
+	errorCodeCorruptKey          = "corrupt-key"
+	errorCodeOwnershipTaken      = "ownership-taken"
+	errorCodeBusy                = "busy"
+	errorCodeUnmeasuredComponent = "unmeasured-component"
+	errorCodeRebootRecommended   = "reboot-recommended"
+	errorCodeUnsupported         = "unsupported"
+)
+
+// exit statuses for the error codes, other errors exit with status 1
+var errorExitStatus = map[string]int{
+	errorCodeTPMCleared:          3,
+	errorCodeInterrupted:         4,
+	errorCodeCorruptKey:          5,
+	errorCodeOwnershipTaken:      6,
+	errorCodeBusy:                7,
+	errorCodeUnmeasuredComponent: 8,
+	errorCodeRebootRecommended:   9,
+	errorCodeUnsupported:         2,
+}
+
+// codedError is an error identifying a specific failure condition.
+type codedError struct {
+	code string
+	err  error
+}
+
+func (e *codedError) Error() string {
+	return fmt.Sprintf("%s: %v", e.code, e.err)
+}
+
+// exitStatus returns the exit status to use for the given error.
+func exitStatus(err error) int {
+	if e, ok := err.(*codedError); ok {
+		if status, ok := errorExitStatus[e.code]; ok {
+			return status
+		}
+	}
+	return 1
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/canonical/go-tpm2"
+)
+
+// defaultEventLogPath is the TCG event log of the firmware measurements.
+const defaultEventLogPath = "/sys/kernel/security/tpm0/binary_bios_measurements"
+
+// event types defined by the TCG PC Client Platform Firmware Profile
+const (
+	evPrebootCert             = 0x00000000
+	evPostCode                = 0x00000001
+	evNoAction                = 0x00000003
+	evSeparator               = 0x00000004
+	evAction                  = 0x00000005
+	evEventTag                = 0x00000006
+	evSCRTMContents           = 0x00000007
+	evSCRTMVersion            = 0x00000008
+	evCPUMicrocode            = 0x00000009
+	evPlatformConfigFlags     = 0x0000000a
+	evTableOfDevices          = 0x0000000b
+	evCompactHash             = 0x0000000c
+	evIPL                     = 0x0000000d
+	evIPLPartitionData        = 0x0000000e
+	evNonhostCode             = 0x0000000f
+	evNonhostConfig           = 0x00000010
+	evNonhostInfo             = 0x00000011
+	evOmitBootDeviceEvents    = 0x00000012
+	evEFIVariableDriverConfig = 0x80000001
+	evEFIVariableBoot         = 0x80000002
+	evEFIBootServicesApp      = 0x80000003
+	evEFIBootServicesDriver   = 0x80000004
+	evEFIRuntimeServicesDrv   = 0x80000005
+	evEFIGPTEvent             = 0x80000006
+	evEFIAction               = 0x80000007
+	evEFIPlatformFirmwareBlob = 0x80000008
+	evEFIHandoffTables        = 0x80000009
+	evEFIHCRTMEvent           = 0x80000010
+	evEFIVariableAuthority    = 0x800000e0
+)
+
+var eventTypeNames = map[uint32]string{
+	evPrebootCert:             "EV_PREBOOT_CERT",
+	evPostCode:                "EV_POST_CODE",
+	evNoAction:                "EV_NO_ACTION",
+	evSeparator:               "EV_SEPARATOR",
+	evAction:                  "EV_ACTION",
+	evEventTag:                "EV_EVENT_TAG",
+	evSCRTMContents:           "EV_S_CRTM_CONTENTS",
+	evSCRTMVersion:            "EV_S_CRTM_VERSION",
+	evCPUMicrocode:            "EV_CPU_MICROCODE",
+	evPlatformConfigFlags:     "EV_PLATFORM_CONFIG_FLAGS",
+	evTableOfDevices:          "EV_TABLE_OF_DEVICES",
+	evCompactHash:             "EV_COMPACT_HASH",
+	evIPL:                     "EV_IPL",
+	evIPLPartitionData:        "EV_IPL_PARTITION_DATA",
+	evNonhostCode:             "EV_NONHOST_CODE",
+	evNonhostConfig:           "EV_NONHOST_CONFIG",
+	evNonhostInfo:             "EV_NONHOST_INFO",
+	evOmitBootDeviceEvents:    "EV_OMIT_BOOT_DEVICE_EVENTS",
+	evEFIVariableDriverConfig: "EV_EFI_VARIABLE_DRIVER_CONFIG",
+	evEFIVariableBoot:         "EV_EFI_VARIABLE_BOOT",
+	evEFIBootServicesApp:      "EV_EFI_BOOT_SERVICES_APPLICATION",
+	evEFIBootServicesDriver:   "EV_EFI_BOOT_SERVICES_DRIVER",
+	evEFIRuntimeServicesDrv:   "EV_EFI_RUNTIME_SERVICES_DRIVER",
+	evEFIGPTEvent:             "EV_EFI_GPT_EVENT",
+	evEFIAction:               "EV_EFI_ACTION",
+	evEFIPlatformFirmwareBlob: "EV_EFI_PLATFORM_FIRMWARE_BLOB",
+	evEFIHandoffTables:        "EV_EFI_HANDOFF_TABLES",
+	evEFIHCRTMEvent:           "EV_EFI_HCRTM_EVENT",
+	evEFIVariableAuthority:    "EV_EFI_VARIABLE_AUTHORITY",
+}
+
+func eventTypeName(t uint32) string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("%#08x", t)
+}
+
+// specIDEventSignature identifies the first event of a crypto agile log.
+const specIDEventSignature = "Spec ID Event03\x00"
+
+// eventLog is a parsed TCG event log.
+type eventLog struct {
+	// Algorithms are the digest algorithms of the events.
+	Algorithms []tpm2.HashAlgorithmId
+	Events     []*logEvent
+}
+
+// logEvent is an event of the TCG event log.
+type logEvent struct {
+	PCR     uint32
+	Type    uint32
+	Digests map[tpm2.HashAlgorithmId]tpm2.Digest
+	Data    []byte
+}
+
+// logReader decodes the little-endian fields of an event log.
+type logReader struct {
+	*bytes.Reader
+	err error
+}
+
+func (r *logReader) read(v interface{}) {
+	if r.err == nil {
+		r.err = binary.Read(r.Reader, binary.LittleEndian, v)
+	}
+}
+
+func (r *logReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > r.Len() {
+		r.err = fmt.Errorf("truncated event")
+		return nil
+	}
+	b := make([]byte, n)
+	r.Read(b)
+	return b
+}
+
+// readEventLog reads and parses the event log at the given path.
+func readEventLog(path string) (*eventLog, []byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read event log: %v", err)
+	}
+	log, err := parseEventLog(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot parse event log: %v", err)
+	}
+	return log, data, nil
+}
+
+// parseEventLog parses an event log in the SHA-1 or in the crypto agile
+// format.
+func parseEventLog(data []byte) (*eventLog, error) {
+	r := &logReader{Reader: bytes.NewReader(data)}
+	log := &eventLog{Algorithms: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA1}}
+
+	// the first event is always in the SHA-1 format
+	var pcr, eventType, size uint32
+	r.read(&pcr)
+	r.read(&eventType)
+	digest := r.bytes(tpm2.HashAlgorithmSHA1.Size())
+	r.read(&size)
+	first := &logEvent{
+		PCR:     pcr,
+		Type:    eventType,
+		Digests: map[tpm2.HashAlgorithmId]tpm2.Digest{tpm2.HashAlgorithmSHA1: digest},
+		Data:    r.bytes(int(size)),
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	log.Events = append(log.Events, first)
+
+	digestSizes := map[tpm2.HashAlgorithmId]uint16{}
+	agile := eventType == evNoAction && bytes.HasPrefix(first.Data, []byte(specIDEventSignature))
+	if agile {
+		algs, err := parseSpecIDEvent(first.Data)
+		if err != nil {
+			return nil, err
+		}
+		log.Algorithms = nil
+		for _, a := range algs {
+			log.Algorithms = append(log.Algorithms, a.id)
+			digestSizes[a.id] = a.size
+		}
+	}
+
+	for r.Len() > 0 {
+		ev := &logEvent{Digests: map[tpm2.HashAlgorithmId]tpm2.Digest{}}
+		r.read(&ev.PCR)
+		r.read(&ev.Type)
+		if agile {
+			var count uint32
+			r.read(&count)
+			for i := uint32(0); i < count && r.err == nil; i++ {
+				var alg tpm2.HashAlgorithmId
+				r.read(&alg)
+				size, ok := digestSizes[alg]
+				if !ok {
+					return nil, fmt.Errorf("event %d has digest of unknown algorithm %v", len(log.Events), alg)
+				}
+				ev.Digests[alg] = r.bytes(int(size))
+			}
+		} else {
+			ev.Digests[tpm2.HashAlgorithmSHA1] = r.bytes(tpm2.HashAlgorithmSHA1.Size())
+		}
+		r.read(&size)
+		ev.Data = r.bytes(int(size))
+		if r.err != nil {
+			return nil, fmt.Errorf("event %d: %v", len(log.Events), r.err)
+		}
+		log.Events = append(log.Events, ev)
+	}
+	return log, nil
+}
+
+type specIDAlgorithm struct {
+	id   tpm2.HashAlgorithmId
+	size uint16
+}
+
+// parseSpecIDEvent returns the digest algorithms listed in the spec ID
+// event of a crypto agile log.
+func parseSpecIDEvent(data []byte) ([]specIDAlgorithm, error) {
+	r := &logReader{Reader: bytes.NewReader(data[len(specIDEventSignature):])}
+	var platformClass, count uint32
+	var versionMinor, versionMajor, errata, uintnSize uint8
+	r.read(&platformClass)
+	r.read(&versionMinor)
+	r.read(&versionMajor)
+	r.read(&errata)
+	r.read(&uintnSize)
+	r.read(&count)
+	algs := make([]specIDAlgorithm, 0, count)
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		var a specIDAlgorithm
+		r.read(&a.id)
+		r.read(&a.size)
+		algs = append(algs, a)
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("invalid spec ID event: %v", r.err)
+	}
+	return algs, nil
+}
+
+// decodeUTF16 decodes a little-endian UTF-16 string.
+func decodeUTF16(b []byte) string {
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		u = append(u, binary.LittleEndian.Uint16(b[i:]))
+	}
+	return strings.TrimRight(string(utf16.Decode(u)), "\x00")
+}
+
+// decodeGUID formats a GUID in its mixed-endian string form.
+func decodeGUID(b []byte) string {
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x", binary.LittleEndian.Uint32(b[0:4]),
+		binary.LittleEndian.Uint16(b[4:6]), binary.LittleEndian.Uint16(b[6:8]), b[8:10], b[10:16])
+}
+
+// printable returns the data as a string if it's printable ASCII.
+func printable(b []byte) (string, bool) {
+	s := strings.TrimRight(string(b), "\x00")
+	for _, c := range []byte(s) {
+		if c < 0x20 && c != '\t' && c != '\n' || c > 0x7e {
+			return "", false
+		}
+	}
+	return s, true
+}
+
+// description decodes the event data into a human readable string, for the
+// event types where it's meaningful.
+func (ev *logEvent) description() string {
+	switch ev.Type {
+	case evNoAction:
+		if s, ok := printable(bytes.SplitN(ev.Data, []byte{0}, 2)[0]); ok {
+			return s
+		}
+	case evSCRTMVersion:
+		return decodeUTF16(ev.Data)
+	case evEFIVariableDriverConfig, evEFIVariableBoot, evEFIVariableAuthority:
+		// UEFI_VARIABLE_DATA: GUID, name length, data length, name
+		if len(ev.Data) < 32 {
+			return ""
+		}
+		nameLen := binary.LittleEndian.Uint64(ev.Data[16:24])
+		if nameLen > uint64(len(ev.Data)-32)/2 {
+			return ""
+		}
+		return decodeGUID(ev.Data[:16]) + "-" + decodeUTF16(ev.Data[32:32+2*nameLen])
+	case evPostCode, evAction, evEFIAction, evIPL, evSeparator, evEventTag:
+		if s, ok := printable(ev.Data); ok {
+			return s
+		}
+	}
+	return ""
+}
+
+// exportEventLogParams are the optional parameters of export-eventlog.
+type exportEventLogParams struct {
+	// Path is the event log to export, by default the log of the
+	// firmware measurements.
+	Path string `json:"path,omitempty"`
+	// Copy, if set, is where to write a copy of the binary log.
+	Copy string `json:"copy,omitempty"`
+}
+
+type eventLogEntry struct {
+	PCR         uint32            `json:"pcr"`
+	Type        string            `json:"type"`
+	Digests     map[string]string `json:"digests"`
+	Description string            `json:"description,omitempty"`
+	Data        []byte            `json:"data,omitempty"`
+}
+
+type exportEventLogResponse struct {
+	Algorithms []string         `json:"algorithms"`
+	Events     []*eventLogEntry `json:"events"`
+}
+
+// digestAlgorithmName returns the name of a digest algorithm of the log,
+// including algorithms not supported for sealing.
+func digestAlgorithmName(alg tpm2.HashAlgorithmId) string {
+	if name, err := hashAlgorithmName(alg); err == nil {
+		return name
+	}
+	return fmt.Sprintf("%#04x", uint16(alg))
+}
+
+// exportEventLog writes the event log in a structured form to stdout.
+func exportEventLog(p []byte) error {
+	var params exportEventLogParams
+	if err := unmarshalOptionalParams(p, &params); err != nil {
+		return err
+	}
+	if params.Path == "" {
+		params.Path = defaultEventLogPath
+	}
+
+	log, data, err := readEventLog(params.Path)
+	if err != nil {
+		return err
+	}
+	if params.Copy != "" {
+		if err := ioutil.WriteFile(params.Copy, data, 0600); err != nil {
+			return fmt.Errorf("cannot copy event log: %v", err)
+		}
+	}
+
+	resp := exportEventLogResponse{Events: make([]*eventLogEntry, 0, len(log.Events))}
+	for _, alg := range log.Algorithms {
+		resp.Algorithms = append(resp.Algorithms, digestAlgorithmName(alg))
+	}
+	for _, ev := range log.Events {
+		entry := &eventLogEntry{
+			PCR:         ev.PCR,
+			Type:        eventTypeName(ev.Type),
+			Digests:     make(map[string]string, len(ev.Digests)),
+			Description: ev.description(),
+			Data:        ev.Data,
+		}
+		for alg, digest := range ev.Digests {
+			entry.Digests[digestAlgorithmName(alg)] = hex.EncodeToString(digest)
+		}
+		resp.Events = append(resp.Events, entry)
+	}
+	return writeResponse(resp)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+	sb "github.com/snapcore/secboot"
+)
+
+// PCRs that can be extended by applications: the debug PCR and the
+// application support PCR. Both are reset to zero on boot.
+const (
+	debugPCR       = 16
+	applicationPCR = 23
+)
+
+func checkApplicationPCR(pcr int) error {
+	if pcr != debugPCR && pcr != applicationPCR {
+		return fmt.Errorf("PCR %d cannot be used for application measurements", pcr)
+	}
+	return nil
+}
+
+// appMeasurement lists the digests measured by a device vendor component
+// into an application PCR, in the order they are extended.
+type appMeasurement struct {
+	PCR     int      `json:"pcr"`
+	Digests []string `json:"digests"`
+}
+
+// addAppMeasurementsToProfile makes the profile require the application
+// PCRs to contain the given measurements.
+func addAppMeasurementsToProfile(pcrProfile *sb.PCRProtectionProfile, measurements []*appMeasurement) error {
+	for _, m := range measurements {
+		if err := checkApplicationPCR(m.PCR); err != nil {
+			return err
+		}
+		pcrProfile.AddPCRValue(tpm2.HashAlgorithmSHA256, m.PCR, make(tpm2.Digest, sha256.Size))
+		for _, d := range m.Digests {
+			digest, err := hex.DecodeString(d)
+			if err != nil || len(digest) != sha256.Size {
+				return fmt.Errorf("invalid digest %q for PCR %d", d, m.PCR)
+			}
+			pcrProfile.ExtendPCR(tpm2.HashAlgorithmSHA256, m.PCR, digest)
+		}
+	}
+	return nil
+}
+
+// extendApplicationPCR extends the PCR with a SHA-256 digest.
+func extendApplicationPCR(tpm *sb.TPMConnection, pcr int, digest []byte) error {
+	digests := tpm2.TaggedHashList{{HashAlg: tpm2.HashAlgorithmSHA256, Digest: digest}}
+	if err := tpm.PCRExtend(tpm.PCRHandleContext(pcr), digests, nil); err != nil {
+		return fmt.Errorf("cannot extend PCR %d: %v", pcr, err)
+	}
+	return nil
+}
+
+type extendPCRParams struct {
+	// PCR defaults to the application support PCR.
+	PCR *int `json:"pcr,omitempty"`
+	// Data is the measured event data. Its SHA-256 digest is extended.
+	Data string `json:"data,omitempty"`
+	// Digest is a hex-encoded SHA-256 digest to extend, if no data is
+	// specified.
+	Digest string `json:"digest,omitempty"`
+}
+
+type extendPCRResponse struct {
+	PCR    int    `json:"pcr"`
+	Digest string `json:"digest"`
+}
+
+// extendPCR extends an application PCR with a measurement made by a device
+// vendor component, and writes the extended digest to stdout so it can be
+// included in the sealing profile.
+func extendPCR(p []byte) error {
+	var params extendPCRParams
+	if err := json.Unmarshal(p, &params); err != nil {
+		return err
+	}
+
+	pcr := applicationPCR
+	if params.PCR != nil {
+		pcr = *params.PCR
+	}
+	if err := checkApplicationPCR(pcr); err != nil {
+		return err
+	}
+
+	var digest []byte
+	switch {
+	case params.Data != "" && params.Digest != "":
+		return fmt.Errorf("cannot specify both data and digest")
+	case params.Data != "":
+		h := sha256.Sum256([]byte(params.Data))
+		digest = h[:]
+	case params.Digest != "":
+		var err error
+		digest, err = hex.DecodeString(params.Digest)
+		if err != nil || len(digest) != sha256.Size {
+			return fmt.Errorf("invalid digest %q", params.Digest)
+		}
+	default:
+		return fmt.Errorf("data or digest not specified")
+	}
+
+	tpm, err := connectTPM()
+	if err != nil {
+		return fmt.Errorf("cannot connect to TPM: %v", err)
+	}
+	defer tpm.Close()
+
+	if err := extendApplicationPCR(tpm, pcr, digest); err != nil {
+		return err
+	}
+
+	return writeResponse(&extendPCRResponse{PCR: pcr, Digest: hex.EncodeToString(digest)})
+}
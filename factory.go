@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+)
+
+// srkHandle is the persistent handle of the storage root key.
+const srkHandle tpm2.Handle = 0x81000001
+
+// provisioning phases recorded in the key metadata
+const (
+	phaseFactory = "factory"
+	phaseField   = "field"
+)
+
+// factoryArtifacts contains the public information exported after factory
+// provisioning. It contains no secrets in plaintext: the sealed key can only
+// be unsealed by the device TPM.
+type factoryArtifacts struct {
+	EKName                 string `json:"ek-name"`
+	EKPublic               string `json:"ek-public"`
+	SRKName                string `json:"srk-name,omitempty"`
+	PCRPolicyCounterHandle uint32 `json:"pcr-policy-counter-handle"`
+	SealedKey              string `json:"sealed-key"`
+}
+
+// exportFactoryArtifacts returns the factory provisioning artifacts and marks
+// the sealed key as pending field finalization.
+func exportFactoryArtifacts() (*factoryArtifacts, error) {
+	tpm, err := connectTPM()
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to TPM: %v", err)
+	}
+	defer tpm.Close()
+
+	ek, err := tpm.EndorsementKey()
+	if err != nil {
+		return nil, fmt.Errorf("cannot obtain endorsement key: %v", err)
+	}
+	ekPublic, ekName, _, err := tpm.ReadPublic(ek)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read endorsement key: %v", err)
+	}
+	ekPublicData, err := mu.MarshalToBytes(ekPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	sealedKey, err := ioutil.ReadFile(sealedKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the sealed key: %v", err)
+	}
+
+	artifacts := factoryArtifacts{
+		EKName:                 hex.EncodeToString(ekName),
+		EKPublic:               base64.StdEncoding.EncodeToString(ekPublicData),
+		PCRPolicyCounterHandle: uint32(pcrPolicyCounterHandle),
+		SealedKey:              base64.StdEncoding.EncodeToString(sealedKey),
+	}
+	if srk, err := tpm.CreateResourceContextFromTPM(srkHandle); err == nil {
+		artifacts.SRKName = hex.EncodeToString(srk.Name())
+	}
+
+	md, err := readKeyMetadata(sealedKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	md.Phase = phaseFactory
+	if err := writeKeyMetadata(sealedKeyFile, md); err != nil {
+		return nil, err
+	}
+
+	return &artifacts, nil
+}
+
+// fieldFinalize completes the binding of a key sealed in the factory by
+// resealing it to the final profile of the device.
+func fieldFinalize(p []byte) error {
+	var params updateParams
+	if err := json.Unmarshal(p, &params); err != nil {
+		return err
+	}
+
+	md, err := readKeyMetadata(sealedKeyFile)
+	if err != nil {
+		return err
+	}
+	if md.Phase != phaseFactory {
+		return fmt.Errorf("sealed key is not pending field finalization")
+	}
+
+	pcrProfile, err := params.buildPCRProtectionProfile()
+	if err != nil {
+		return err
+	}
+	if _, err := reseal(pcrProfile, nil, params.assetVersionRaised); err != nil {
+		return err
+	}
+
+	// reseal updates the metadata, read it again
+	md, err = readKeyMetadata(sealedKeyFile)
+	if err != nil {
+		return err
+	}
+	md.Phase = phaseField
+	return writeKeyMetadata(sealedKeyFile, md)
+}
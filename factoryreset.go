@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+
+	sb "github.com/snapcore/secboot"
+)
+
+// factoryResetParams are the parameters used to reset the data partition
+// while keeping the save partition.
+type factoryResetParams struct {
+	initialProvisionParams
+
+	// DataDevice is the path to the data partition to wipe and encrypt
+	// again.
+	DataDevice string `json:"data-device"`
+	// DataLabel is the label of the new LUKS2 container.
+	DataLabel string `json:"data-label,omitempty"`
+	// SaveDevice is the path to the encrypted save partition, which is
+	// kept and made accessible with the new key. SaveKey is its key, if
+	// it's neither sealed nor derived from the data key.
+	SaveDevice string `json:"save-device"`
+}
+
+// cryptsetupWithKeys runs cryptsetup with the existing key in stdin and the
+// new key, if any, in file descriptor 3.
+func cryptsetupWithKeys(existingKey, newKey []byte, args ...string) error {
+	cmd := exec.Command("cryptsetup", args...)
+	cmd.Stdin = bytes.NewReader(existingKey)
+	if newKey != nil {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		go func() {
+			w.Write(newKey)
+			w.Close()
+		}()
+		cmd.ExtraFiles = []*os.File{r}
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("cryptsetup %s failed: %v: %s", args[0], err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+// factory reset steps recorded in the journal, before the steps of the
+// provisioning of the new key
+const (
+	stepResetStarted    = "factory-reset-started"
+	stepResetKeyRemoved = "factory-reset-key-removed"
+)
+
+// resetSaveKey returns the key opening the save partition: the given save
+// key, the key derived from the old data key, or the sealed save key.
+func resetSaveKey(tpm *sb.TPMConnection, params *factoryResetParams, md *keyMetadata, oldKey []byte) ([]byte, error) {
+	switch {
+	case params.SaveKey != "":
+		key, err := base64.RawStdEncoding.DecodeString(params.SaveKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid save key: %v", err)
+		}
+		return key, nil
+	case md.SaveKeyDerivation != nil:
+		return md.SaveKeyDerivation.saveKey(oldKey), nil
+	}
+	k, err := readSealedKey(saveSealedKeyFile)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("save key not specified and not sealed")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read sealed save key object: %v", err)
+	}
+	key, _, err := k.UnsealFromTPM(tpm, "")
+	if err != nil {
+		return nil, fmt.Errorf("cannot unseal save key: %v", err)
+	}
+	return key, nil
+}
+
+// factoryReset wipes and encrypts the data partition with a new key, and
+// seals the new key. The save partition is kept: its key is sealed again
+// with the new key, or if it's derived from the data key, the key derived
+// from the new key replaces the old one. The TPM stays provisioned and the
+// lockout authorization is left where it's kept. If the reset is
+// interrupted after the old key is removed from the TPM, the save partition
+// must be unlocked with the recovery key.
+func factoryReset(p []byte) error {
+	var params factoryResetParams
+	if err := json.Unmarshal(p, &params); err != nil {
+		return err
+	}
+	if params.DataDevice == "" {
+		return fmt.Errorf("data device not specified")
+	}
+	if params.SaveDevice == "" {
+		return fmt.Errorf("save device not specified")
+	}
+	if params.DataLabel == "" {
+		params.DataLabel = "ubuntu-data-enc"
+	}
+
+	j, err := openJournal(journalFile)
+	if err != nil {
+		return err
+	}
+	switch {
+	case j.done(stepResetKeyRemoved):
+		return fmt.Errorf("a previous factory reset was interrupted after removing the old key, the save partition must be unlocked with the recovery key")
+	case j.inProgress() && !j.done(stepResetStarted):
+		return fmt.Errorf("cannot factory reset while provisioning is in progress")
+	}
+
+	if err := checkFileSecure(sealedKeyFile); err != nil {
+		return err
+	}
+	md, err := readKeyMetadata(sealedKeyFile)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		return planFactoryReset(&params, md)
+	}
+
+	tpm, err := connectTPM()
+	if err != nil {
+		return fmt.Errorf("cannot connect to TPM: %v", err)
+	}
+	defer tpm.Close()
+
+	k, err := readSealedKey(sealedKeyFile)
+	if err != nil {
+		return fmt.Errorf("cannot read sealed key object: %v", err)
+	}
+	oldKey, _, err := k.UnsealFromTPM(tpm, "")
+	if err != nil {
+		return fmt.Errorf("cannot unseal key: %v", err)
+	}
+	saveKey, err := resetSaveKey(tpm, &params, md, oldKey)
+	if err != nil {
+		return err
+	}
+	if err := cryptsetupWithKeys(saveKey, nil, "open", "--test-passphrase", "--key-file=-", params.SaveDevice); err != nil {
+		return fmt.Errorf("cannot open %s with the save key: %v", params.SaveDevice, err)
+	}
+
+	newKey := make([]byte, 64)
+	if _, err := rand.Read(newKey); err != nil {
+		return fmt.Errorf("cannot create key: %v", err)
+	}
+
+	if err := j.record(stepResetStarted); err != nil {
+		return err
+	}
+	if err := sb.InitializeLUKS2Container(params.DataDevice, params.DataLabel, newKey, nil); err != nil {
+		return fmt.Errorf("cannot encrypt %s: %v", params.DataDevice, err)
+	}
+
+	// the old keys share the PCR policy counter with the new ones, they
+	// are removed before sealing
+	if err := j.record(stepResetKeyRemoved); err != nil {
+		return err
+	}
+	if err := rollbackSeal(tpm); err != nil {
+		return fmt.Errorf("cannot remove old sealed key: %v", err)
+	}
+
+	// the save key is sealed again, or the key derived from the new key
+	// is added using the old derived key
+	pp := &params.initialProvisionParams
+	pp.SaveKey = base64.RawStdEncoding.EncodeToString(saveKey)
+	pp.SaveDevice = params.SaveDevice
+	pp.DeriveSaveKey = md.SaveKeyDerivation != nil
+	if err := j.record(stepTPMProvisioned); err != nil {
+		return err
+	}
+	if _, err := provision(pp, newKey, j); err != nil {
+		return err
+	}
+	if md.SaveKeyDerivation != nil {
+		if err := cryptsetupWithKeys(saveKey, nil, "luksRemoveKey", "--key-file=-", params.SaveDevice); err != nil {
+			return fmt.Errorf("cannot remove old derived key from %s: %v", params.SaveDevice, err)
+		}
+	}
+
+	return j.finish()
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+)
+
+// reports are queued in /run, which survives the switch from the initramfs
+// to the booted system, where the network is available to send them
+const defaultFailureReportsDir = "/run/fde-helper/failure-reports"
+
+// time the failure hook has to process a report
+const failureHookTimeout = 30 * time.Second
+
+// time the failure endpoint has to accept a report
+const failureURLTimeout = 10 * time.Second
+
+var (
+	// failureHook is the executable the failure reports are written
+	// to, if set.
+	failureHook string
+	// failureURL is the HTTPS endpoint the failure reports are posted
+	// to, if set.
+	failureURL string
+)
+
+// failureReport describes an unlock that fell back to the recovery key, so
+// fleets learn about policies broken by an update as soon as devices boot.
+type failureReport struct {
+	Time          time.Time `json:"time"`
+	HelperVersion string    `json:"helper-version"`
+	Volume        string    `json:"volume"`
+	Method        string    `json:"method"`
+	BootMode      string    `json:"boot-mode,omitempty"`
+	// Reason is why the sealed key couldn't be used, if known.
+	Reason     string `json:"reason,omitempty"`
+	TPMTimeout bool   `json:"tpm-timeout,omitempty"`
+	CorruptKey bool   `json:"corrupt-key,omitempty"`
+	// ProfileDigest and Models identify the policy the key was sealed
+	// to.
+	ProfileDigest string           `json:"profile-digest,omitempty"`
+	Models        []*modelIdentity `json:"models,omitempty"`
+	// PCRs are the SHA-256 values of the firmware PCRs in this boot,
+	// to find the component that changed.
+	PCRs map[int]string `json:"pcrs,omitempty"`
+}
+
+type sendFailureReportsResponse struct {
+	Sent    int `json:"sent"`
+	Pending int `json:"pending"`
+}
+
+// reportingFailures returns true if failure reports are delivered.
+func reportingFailures() bool {
+	return failureHook != "" || failureURL != ""
+}
+
+// newFailureReport creates the report of an unlock that fell back to the
+// recovery key.
+func newFailureReport(params *unlockParams, resp *unlockResponse) *failureReport {
+	r := &failureReport{
+		Time:          time.Now().UTC(),
+		HelperVersion: helperVersion,
+		Volume:        params.VolumeName,
+		Method:        resp.Method,
+		BootMode:      resp.BootMode,
+		Reason:        resp.failure,
+		TPMTimeout:    resp.TPMTimeout,
+		CorruptKey:    resp.CorruptKey,
+	}
+	if md, err := readKeyMetadata(sealedKeyFile); err == nil {
+		r.ProfileDigest = md.ProfileDigest
+		r.Models = md.Models
+	}
+	// don't wait for a TPM that already timed out
+	if resp.TPMTimeout {
+		return r
+	}
+	if tpm, err := connectTPM(); err == nil {
+		selection := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: firmwarePCRs}}
+		if _, values, err := tpm.PCRRead(selection); err == nil {
+			r.PCRs = map[int]string{}
+			for pcr, digest := range values[tpm2.HashAlgorithmSHA256] {
+				r.PCRs[pcr] = hex.EncodeToString(digest)
+			}
+		}
+		tpm.Close()
+	}
+	return r
+}
+
+// queueFailureReport stores the report until it's sent, and tries to send
+// the pending reports. Reports that can't be sent yet, e.g. because the
+// network isn't up in the initramfs, are sent by send-failure-reports.
+func queueFailureReport(r *failureReport) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(failureReportsDir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(failureReportsDir, fmt.Sprintf("%d.json", r.Time.UnixNano()))
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("cannot write failure report: %v", err)
+	}
+	if _, err := deliverFailureReports(); err != nil {
+		logf("failure report kept for later: %v", err)
+	}
+	return nil
+}
+
+// runFailureHook writes the report to the stdin of the failure hook.
+func runFailureHook(data []byte) error {
+	fi, err := os.Stat(failureHook)
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("refusing to run writable failure hook %s", failureHook)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(failureHook)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("cannot run failure hook: %v", err)
+	}
+	timer := time.AfterFunc(failureHookTimeout, func() { cmd.Process.Kill() })
+	err = cmd.Wait()
+	timer.Stop()
+	if err != nil {
+		return fmt.Errorf("failure hook failed: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
+
+// postFailureReport posts the report to the failure endpoint.
+func postFailureReport(data []byte) error {
+	u, err := url.Parse(failureURL)
+	if err != nil || u.Scheme != "https" {
+		return fmt.Errorf("invalid failure report URL %q: only https is allowed", failureURL)
+	}
+	client := &http.Client{Timeout: failureURLTimeout}
+	resp, err := client.Post(failureURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("cannot post failure report: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("cannot post failure report: %s", resp.Status)
+	}
+	return nil
+}
+
+// deliverFailureReports sends the queued reports in the order they were
+// created, removing the ones that were sent. It stops at the first report
+// that can't be sent, and returns the number of reports sent.
+func deliverFailureReports() (int, error) {
+	if !reportingFailures() {
+		return 0, nil
+	}
+	paths, err := filepath.Glob(filepath.Join(failureReportsDir, "*.json"))
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(paths)
+	sent := 0
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return sent, err
+		}
+		if failureHook != "" {
+			if err := runFailureHook(data); err != nil {
+				return sent, err
+			}
+		}
+		if failureURL != "" {
+			if err := postFailureReport(data); err != nil {
+				return sent, err
+			}
+		}
+		if err := os.Remove(path); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// sendFailureReports sends the reports queued by unlock, e.g. from a unit
+// started once the network is online.
+func sendFailureReports() error {
+	if !reportingFailures() {
+		return fmt.Errorf("neither a failure hook nor a failure URL was specified")
+	}
+	sent, err := deliverFailureReports()
+	if err != nil {
+		return err
+	}
+	pending, err := filepath.Glob(filepath.Join(failureReportsDir, "*.json"))
+	if err != nil {
+		return err
+	}
+	return writeResponse(&sendFailureReportsResponse{Sent: sent, Pending: len(pending)})
+}
+
+// reportFailure queues the report of an unlock that fell back to the
+// recovery key, if failure reporting is configured.
+func reportFailure(params *unlockParams, resp *unlockResponse) {
+	if !reportingFailures() || !resp.Degraded {
+		return
+	}
+	if err := queueFailureReport(newFailureReport(params, resp)); err != nil {
+		warnf("%v", err)
+	}
+}
@@ -2,12 +2,19 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/canonical/go-tpm2"
 	"github.com/jessevdk/go-flags"
 	sb "github.com/snapcore/secboot"
 	"github.com/snapcore/snapd/asserts"
@@ -15,10 +22,82 @@ import (
 )
 
 const (
-	sealedKeyFile   = "/run/mnt/ubuntu-boot/sealed-key"
-	lockoutAuthFile = "/run/mnt/ubuntu-data/system-data/var/lib/snapd/device/fde/tpm-lockout-auth"
+	defaultSealedKeyFile     = "/run/mnt/ubuntu-boot/sealed-key"
+	defaultSaveSealedKeyFile = "/run/mnt/ubuntu-boot/save-sealed-key"
+	defaultLockoutAuthFile   = "/run/mnt/ubuntu-data/system-data/var/lib/snapd/device/fde/tpm-lockout-auth"
 )
 
+// defaultPCRPolicyCounterHandle is the NV index of the PCR policy counter
+// used to revoke old policies of the global sealed key.
+const defaultPCRPolicyCounterHandle tpm2.Handle = 0x01880001
+
+// pcrPolicyCounterHandle is the PCR policy counter of the sealed key in use.
+var pcrPolicyCounterHandle = defaultPCRPolicyCounterHandle
+
+var (
+	sealedKeyFile        string
+	saveSealedKeyFile    string
+	lockoutAuthFile      string
+	firstBootParamsFile  string
+	firstBootDoneFile    string
+	policyUpdateKeyFile  string
+	policyRevisionFile   string
+	journalFile          string
+	recoveryFailuresFile string
+	unlockAttemptsFile   string
+	decoyKeyFile         string
+	digestCacheFile      string
+	unlockEventLogFile   string
+	volumeKeysDir        string
+	resumeCheckFile      string
+	handlesFile          string
+	assetVersionBaseFile string
+	autoUpdateParamsFile string
+	modelHooksDir        string
+	kernelCmdlineFile    string
+	bootModeFile         string
+	deviceProfileFile    string
+	instanceLockFile     string
+	failureReportsDir    string
+)
+
+// setRootDir sets the directory under which all files used by the helper
+// are resolved, so provisioning state can be staged in a target image.
+func setRootDir(root string) {
+	sealedKeyFile = filepath.Join(root, defaultSealedKeyFile)
+	saveSealedKeyFile = filepath.Join(root, defaultSaveSealedKeyFile)
+	lockoutAuthFile = filepath.Join(root, defaultLockoutAuthFile)
+	firstBootParamsFile = filepath.Join(root, defaultFirstBootParamsFile)
+	firstBootDoneFile = filepath.Join(root, defaultFirstBootDoneFile)
+	policyUpdateKeyFile = filepath.Join(root, defaultPolicyUpdateKeyFile)
+	policyRevisionFile = filepath.Join(root, defaultPolicyRevisionFile)
+	journalFile = filepath.Join(root, defaultJournalFile)
+	recoveryFailuresFile = filepath.Join(root, defaultRecoveryFailuresFile)
+	unlockAttemptsFile = filepath.Join(root, defaultUnlockAttemptsFile)
+	decoyKeyFile = filepath.Join(root, defaultDecoyKeyFile)
+	digestCacheFile = filepath.Join(root, defaultDigestCacheFile)
+	unlockEventLogFile = filepath.Join(root, defaultUnlockEventLogFile)
+	volumeKeysDir = filepath.Join(root, defaultVolumeKeysDir)
+	resumeCheckFile = filepath.Join(root, defaultResumeCheckFile)
+	handlesFile = filepath.Join(root, defaultHandlesFile)
+	assetVersionBaseFile = filepath.Join(root, defaultAssetVersionBaseFile)
+	autoUpdateParamsFile = filepath.Join(root, defaultAutoUpdateParamsFile)
+	modelHooksDir = filepath.Join(root, defaultModelHooksDir)
+	kernelCmdlineFile = filepath.Join(root, defaultKernelCmdlineFile)
+	bootModeFile = filepath.Join(root, defaultBootModeFile)
+	deviceProfileFile = filepath.Join(root, defaultDeviceProfileFile)
+	instanceLockFile = filepath.Join(root, defaultInstanceLockFile)
+	failureReportsDir = filepath.Join(root, defaultFailureReportsDir)
+	windowsBootManagers = nil
+	for _, path := range defaultWindowsBootManagers {
+		windowsBootManagers = append(windowsBootManagers, filepath.Join(root, path))
+	}
+}
+
+func init() {
+	setRootDir("/")
+}
+
 // supported verifies if secure full disk encryption is supported on this
 // system.
 func supported() error {
@@ -28,7 +107,7 @@ func supported() error {
 	//}
 
 	// check if TPM device available
-	tpm, err := sb.ConnectToDefaultTPM()
+	tpm, err := connectTPM()
 	if err != nil {
 		return err
 	}
@@ -39,14 +118,41 @@ func supported() error {
 		return fmt.Errorf("TPM device is not enabled")
 	}
 
+	// check if the TPM firmware has known issues
+	if err := checkTPMBlocklist(tpm); err != nil {
+		return err
+	}
+
+	// keys can still be sealed to expected PCR values
+	if err := verifyEventLog(tpm); err != nil {
+		warnf("%v", err)
+	}
+
 	return nil
 }
 
 type loadChain struct {
-	Path string       `json:"path"`
-	Snap string       `json:"snap"`
-	Role string       `json:"role"`
-	Next []*loadChain `json:"next"`
+	// Path is the path of the image, or the path inside Snap if the
+	// image is in a snap file, e.g. "kernel.efi" in the kernel snap.
+	Path string `json:"path"`
+	Snap string `json:"snap"`
+	// Role is what the entry is in the boot process, e.g. "shim",
+	// "run-mode" or "recovery" for boot loaders, "kernel" or
+	// "recovery-kernel". Entries with roles must be loaded in order,
+	// and the run and recovery paths get separate policy branches.
+	Role string `json:"role"`
+	// Digest is the hex-encoded SHA-256 Authenticode digest of the image,
+	// for images that can't be read when the profile is built. It's only
+	// supported by the UEFI boot chain model.
+	Digest string `json:"digest,omitempty"`
+	// Version is the version of the asset, if it's subject to the
+	// minimum boot asset version.
+	Version uint64       `json:"version,omitempty"`
+	Next    []*loadChain `json:"next"`
+
+	// origin is the entry in a snap that Path is a temporary copy of,
+	// if extracted.
+	origin *loadChain
 }
 
 type modelParams struct {
@@ -75,123 +181,1364 @@ func (p *modelParams) SignKeyID() string {
 	return p.ModelParams.SignKeyID
 }
 
+// unmarshalOptionalParams decodes the JSON parameters, if any were given.
+func unmarshalOptionalParams(p []byte, v interface{}) error {
+	if len(bytes.TrimSpace(p)) == 0 {
+		return nil
+	}
+	return json.Unmarshal(p, v)
+}
+
+// initialProvisionParams extends the initial provisioning parameters with
+// settings specific to this helper.
+type initialProvisionParams struct {
+	fdehelper.InitialProvisionParams
+
+	// ExpectedPCRs, if set, makes the key to be sealed against the given
+	// PCR values instead of the values of the current platform, so keys
+	// can be prepared in advance (e.g. during image build).
+	ExpectedPCRs []*expectedPCRValues `json:"expected-pcrs,omitempty"`
+
+	bootProfileParams
+
+	// AppMeasurements lists measurements made into application PCRs
+	// that must also be present to unseal the key.
+	AppMeasurements []*appMeasurement `json:"app-measurements,omitempty"`
+
+	// LockoutAuthStorage selects where the lockout authorization value
+	// is kept: "file" (the default) keeps it in the data partition, "nv"
+	// keeps it in a TPM NV index that is only readable in the early boot,
+	// where it's used to reset the dictionary attack lockout for keys
+	// without a PIN.
+	LockoutAuthStorage string `json:"lockout-auth-storage,omitempty"`
+
+	// SaveKey is the key of the save partition. If specified, it's sealed
+	// together with the data key, sharing the same policy.
+	SaveKey string `json:"save-key,omitempty"`
+
+	// DeriveSaveKey adds a key derived from the data key to the save
+	// volume in SaveDevice instead of sealing SaveKey, which is only used
+	// to add it. Unlocking the data volume then also opens the save
+	// volume.
+	DeriveSaveKey bool   `json:"derive-save-key,omitempty"`
+	SaveDevice    string `json:"save-device,omitempty"`
+
+	// ReturnAuthKey includes the policy authorization key in the
+	// response, so the caller can store it in the encrypted data
+	// partition and provide it on updates.
+	ReturnAuthKey bool `json:"return-auth-key,omitempty"`
+
+	// WipePolicy, if set, makes the key material of the encrypted volume
+	// be destroyed after a number of failed recovery key attempts.
+	WipePolicy *wipePolicy `json:"wipe-policy,omitempty"`
+
+	// Duress configures a duress PIN for keys protected by a PIN. Keys
+	// are sealed without a PIN, so it's currently rejected.
+	Duress *duressParams `json:"duress,omitempty"`
+
+	// VolumeKey, if set, seals the key to a per-volume key file with
+	// this name, e.g. the role of the volume, instead of the global
+	// sealed key. The UUID of the volume in VolumeDevice is recorded so
+	// the key is found when the volume is unlocked.
+	VolumeKey    string `json:"volume-key,omitempty"`
+	VolumeDevice string `json:"volume-device,omitempty"`
+
+	// RecoveryKeyOnly skips sealing, so volumes can only be unlocked
+	// with the recovery key. Only allowed for dangerous models.
+	RecoveryKeyOnly bool `json:"recovery-key-only,omitempty"`
+
+	// DeriveKey seals a new secret instead of the key, and adds the key
+	// derived from the secret and the UUID of VolumeDevice to the
+	// volume. The key is only used to add the derived key.
+	DeriveKey bool `json:"derive-key,omitempty"`
+
+	// SRK, if set, specifies the storage root key to use instead of
+	// the one created with the default template.
+	SRK *srkParams `json:"srk,omitempty"`
+
+	// EventLogCheck selects what happens when the event log doesn't
+	// reproduce the current PCR values: "enforce" (the default) refuses
+	// to seal, "warn" only reports it and "none" skips the check. The
+	// log isn't checked when sealing to expected PCR values.
+	EventLogCheck string `json:"event-log-check,omitempty"`
+
+	// BootPhasePin binds the derived key to the early boot: the key
+	// also depends on a pin in an NV index whose reading is locked by
+	// advance-boot-phase until the next boot. Requires DeriveKey.
+	BootPhasePin bool `json:"boot-phase-pin,omitempty"`
+
+	// SerialAssertion, if set, binds the key to the device serial of
+	// this serial assertion and to the TPM, so updates of a key moved to
+	// another device are refused. The stream must contain the account
+	// key assertions needed to verify it.
+	SerialAssertion string `json:"serial-assertion,omitempty"`
+
+	// SkipVerification skips unsealing the key after sealing it. By
+	// default provisioning fails if the key can't be unsealed while the
+	// current PCR values are allowed by the policy.
+	SkipVerification bool `json:"skip-verification,omitempty"`
+
+	// OwnerAuth is the base64 encoded storage hierarchy authorization,
+	// required if it was set by other software, e.g. another operating
+	// system. The TPM is then used as provisioned by that software.
+	OwnerAuth string `json:"owner-auth,omitempty"`
+}
+
+// provisionResponse is written after the initial provisioning, if there is
+// anything to report.
+type provisionResponse struct {
+	// factory provisioning artifacts, in factory mode
+	*factoryArtifacts
+
+	// AuthKey is the policy authorization key, if requested.
+	AuthKey []byte `json:"auth-key,omitempty"`
+}
+
+// buildPCRProtectionProfile creates the PCR profile to seal the key to.
+func (params *initialProvisionParams) buildPCRProtectionProfile() (*sb.PCRProtectionProfile, error) {
+	var pcrProfile *sb.PCRProtectionProfile
+	var err error
+	if len(params.ExpectedPCRs) > 0 {
+		pcrProfile, err = buildExpectedPCRProtectionProfile(params.ExpectedPCRs)
+	} else {
+		pcrProfile, err = params.bootProfileParams.buildPCRProtectionProfile(params.ModelParams)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := addAppMeasurementsToProfile(pcrProfile, params.AppMeasurements); err != nil {
+		return nil, err
+	}
+	return pcrProfile, nil
+}
+
+// readKeyFromFD reads the key from an inherited file descriptor (which can
+// also be a memfd), so the key doesn't have to be passed in the parameters.
+func readKeyFromFD(fd int) ([]byte, error) {
+	f := os.NewFile(uintptr(fd), "key-fd")
+	if f == nil {
+		return nil, fmt.Errorf("invalid key file descriptor %d", fd)
+	}
+	defer f.Close()
+
+	key, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read key from file descriptor %d: %v", fd, err)
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("no key data in file descriptor %d", fd)
+	}
+	return key, nil
+}
+
 // initialProvision initializes the key sealing system (e.g. provision the TPM
-// if TPM is used) and stores the key in a secure place.
-func initialProvision(p []byte) error {
-	var params fdehelper.InitialProvisionParams
+// if TPM is used) and stores the key in a secure place. If keyFD is not
+// negative, the key is read from that file descriptor instead of the
+// parameters. In factory mode, the public provisioning artifacts are written
+// to stdout and the key must later be finalized in the field.
+func initialProvision(p []byte, keyFD int, factory bool) error {
+	var params initialProvisionParams
 	if err := json.Unmarshal(p, &params); err != nil {
 		return err
 	}
 
-	key, err := base64.RawStdEncoding.DecodeString(params.Key)
+	var key []byte
+	var err error
+	if keyFD >= 0 {
+		if params.Key != "" {
+			return fmt.Errorf("key specified both in parameters and file descriptor")
+		}
+		key, err = readKeyFromFD(keyFD)
+	} else {
+		key, err = base64.RawStdEncoding.DecodeString(params.Key)
+	}
 	if err != nil {
 		return err
 	}
 
-	pcrProfile, err := buildPCRProtectionProfile(params.ModelParams)
+	if factory && params.ReturnAuthKey {
+		return fmt.Errorf("cannot return the policy authorization key in factory mode")
+	}
+
+	if dryRun {
+		j, err := openJournal(journalFile)
+		if err != nil {
+			return err
+		}
+		return planInitialProvision(&params, j)
+	}
+
+	recordVolumeKey := func() error { return nil }
+	if params.VolumeKey != "" {
+		if recordVolumeKey, err = prepareVolumeKey(params.VolumeKey, params.VolumeDevice); err != nil {
+			return err
+		}
+	} else if params.VolumeDevice != "" {
+		return fmt.Errorf("volume device requires a volume key name")
+	}
+
+	j, err := openJournal(journalFile)
 	if err != nil {
 		return err
 	}
+	authKey, err := provision(&params, key, j)
+	if err != nil {
+		return err
+	}
+	if err := j.finish(); err != nil {
+		return err
+	}
+	if err := recordVolumeKey(); err != nil {
+		return err
+	}
 
-	tpm, err := sb.ConnectToDefaultTPM()
+	var resp provisionResponse
+	if factory {
+		if resp.factoryArtifacts, err = exportFactoryArtifacts(); err != nil {
+			return err
+		}
+	}
+	if params.ReturnAuthKey {
+		if authKey == nil {
+			return fmt.Errorf("policy authorization key not available from resumed provisioning")
+		}
+		resp.AuthKey = authKey
+	}
+	if resp.factoryArtifacts == nil && resp.AuthKey == nil {
+		return nil
+	}
+	return writeResponse(&resp)
+}
+
+// provision seals the key according to the given parameters, provisioning
+// the TPM if needed, and returns the policy authorization key. Steps already
+// recorded in the journal are not repeated, and if the key was already
+// sealed no authorization key is returned. If interrupted by a signal, the
+// artifacts of an unfinished sealing are rolled back.
+func provision(params *initialProvisionParams, key []byte, j *journal) (sb.TPMPolicyAuthKey, error) {
+	defer rollBackOnInterrupt()()
+
+	switch params.LockoutAuthStorage {
+	case "", lockoutAuthStorageFile, lockoutAuthStorageNV:
+	default:
+		return nil, fmt.Errorf("invalid lockout authorization storage %q", params.LockoutAuthStorage)
+	}
+	md := &keyMetadata{}
+	if params.WipePolicy != nil {
+		if err := params.WipePolicy.validate(); err != nil {
+			return nil, err
+		}
+		md.WipeAfterFailures = params.WipePolicy.MaxFailures
+	}
+	if params.Duress != nil {
+		// the duress PIN is only checked at the prompt for the PIN of
+		// a PIN protected key, and the keys sealed here have no PIN,
+		// so it could never be entered
+		return nil, fmt.Errorf("cannot configure a duress PIN: the sealed key is not protected by a PIN")
+	}
+
+	// the model grade decides which settings are allowed
+	models, err := params.models(params.ModelParams)
 	if err != nil {
-		return fmt.Errorf("cannot connect to TPM: %v", err)
+		return nil, err
+	}
+	gp, err := gradePolicyForModels(models)
+	if err != nil {
+		return nil, err
+	}
+	if err := gp.checkProvision(params); err != nil {
+		return nil, err
+	}
+	if err := runModelHooks("initial-provision", models); err != nil {
+		return nil, err
+	}
+	md.Models = modelIdentities(models)
+	md.RecoverySystems = params.recoverySystemLabels()
+	if params.RecoveryKeyOnly {
+		if md.WipeAfterFailures > 0 && !j.done(stepKeySealed) {
+			// the failures are counted in the TPM
+			if err := withTPM(func(tpm *sb.TPMConnection) error {
+				return defineRecoveryFailures(tpm, md.WipeAfterFailures)
+			}); err != nil {
+				return nil, err
+			}
+		}
+		return nil, provisionRecoveryKeyOnly(md, j)
+	}
+
+	pcrProfile, err := params.buildPCRProtectionProfile()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range []string{sealedKeyFile, lockoutAuthFile} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	tpm, err := connectTPM()
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to TPM: %v", err)
 	}
 	defer tpm.Close()
 
+	if err := checkTPMBlocklist(tpm); err != nil {
+		return nil, err
+	}
+	if len(params.ExpectedPCRs) == 0 {
+		if err := checkEventLog(tpm, params.EventLogCheck); err != nil {
+			return nil, err
+		}
+		if err := checkMeasuredComponents(&params.bootProfileParams, params.EventLogCheck); err != nil {
+			return nil, err
+		}
+	}
+
+	coexist, err := useExistingOwnership(tpm, params.OwnerAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	// don't replace what other software, e.g. BitLocker on dual-boot
+	// systems, created in the TPM
+	handles := []tpm2.Handle{pcrPolicyCounterHandle}
+	if params.BootPhasePin {
+		handles = append(handles, bootPhaseHandle)
+	}
+	if params.LockoutAuthStorage == lockoutAuthStorageNV {
+		handles = append(handles, lockoutAuthNVHandle)
+	}
+	if err := checkHandleConflicts(tpm, handles...); err != nil {
+		return nil, err
+	}
+	if windowsInstalled() {
+		warnf("Windows is installed, secure boot database or firmware updates may require the BitLocker recovery key")
+	}
+
 	// provision the TPM
-	if err := tpmProvision(tpm, lockoutAuthFile); err != nil {
-		return err
+	if !j.done(stepTPMProvisioned) {
+		var srkTemplate *tpm2.Public
+		var srkName tpm2.Name
+		if params.SRK != nil {
+			if params.SRK.Handle != nil {
+				srkName, err = params.SRK.existingName(tpm)
+			} else {
+				srkTemplate, err = params.SRK.template()
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		r, err := readHandleRegistry()
+		if err != nil {
+			return nil, err
+		}
+		sharedSRK, err := foreignHandle(tpm, r, srkHandle)
+		if err != nil {
+			return nil, err
+		}
+		// a storage root key created by other software, e.g. another
+		// OS, isn't ours to evict
+		if !sharedSRK {
+			if err := trackHandle(srkHandle, handlePurposeSRK); err != nil {
+				return nil, err
+			}
+		}
+		if coexist {
+			// only the storage root key is needed, the other
+			// software keeps the lockout authorization
+			if srkTemplate == nil && srkName == nil {
+				if srkTemplate, err = storageTemplate(srkAlgorithmRSA2048, nil); err != nil {
+					return nil, err
+				}
+			}
+		} else {
+			// the TPM provisioning reads the lockout authorization
+			// of a previous provisioning in plain text
+			if err := unprotectStateFile(tpm, lockoutAuthFile); err != nil {
+				warnf("cannot unseal the lockout authorization file: %v", err)
+			}
+			if err := tpmProvision(tpm, lockoutAuthFile); err != nil {
+				return nil, err
+			}
+		}
+		if srkTemplate != nil {
+			if err := provisionSRK(tpm, srkTemplate, !sharedSRK); err != nil {
+				return nil, err
+			}
+		}
+		if srkName != nil {
+			if err := checkExistingSRK(tpm, srkName); err != nil {
+				return nil, err
+			}
+		}
+		switch {
+		case coexist:
+		case params.LockoutAuthStorage == "" || params.LockoutAuthStorage == lockoutAuthStorageFile:
+			if err := secureFile(lockoutAuthFile); err != nil {
+				return nil, fmt.Errorf("cannot secure the lockout authorization file: %v", err)
+			}
+		case params.LockoutAuthStorage == lockoutAuthStorageNV:
+			if err := storeLockoutAuthInNV(tpm); err != nil {
+				return nil, err
+			}
+		}
+		if err := j.record(stepTPMProvisioned); err != nil {
+			return nil, err
+		}
+	}
+	if err := protectStateFiles(tpm); err != nil {
+		return nil, err
+	}
+
+	if j.done(stepKeySealed) {
+		return nil, nil
+	}
+	if j.done(stepSealStarted) {
+		// a previous attempt was interrupted while sealing
+		if err := rollbackSeal(tpm); err != nil {
+			return nil, fmt.Errorf("cannot roll back interrupted sealing: %v", err)
+		}
+	}
+
+	if md.WipeAfterFailures > 0 {
+		if err := defineRecoveryFailures(tpm, md.WipeAfterFailures); err != nil {
+			return nil, err
+		}
+	}
+
+	if params.SerialAssertion != "" {
+		if md.Serial, err = bindSerial(tpm, params.SerialAssertion, md.Models); err != nil {
+			return nil, err
+		}
+	}
+
+	if params.BootPhasePin && !params.DeriveKey {
+		return nil, fmt.Errorf("the key must be derived to bind it to the boot phase")
+	}
+	if params.DeriveKey {
+		if params.VolumeDevice == "" {
+			return nil, fmt.Errorf("volume device required to derive the key")
+		}
+		if params.SaveKey != "" {
+			return nil, fmt.Errorf("cannot derive the key when sealing a save key")
+		}
+		var pin []byte
+		if params.BootPhasePin {
+			if pin, err = defineBootPhasePin(tpm); err != nil {
+				return nil, err
+			}
+			addCleanup("boot phase index", nvIndexCleanup(bootPhaseHandle))
+			md.BootPhasePin = true
+		}
+		before, err := readLUKSHeader(params.VolumeDevice)
+		if err != nil {
+			return nil, err
+		}
+		if key, err = enrollDerivedKey(key, params.VolumeDevice, pin); err != nil {
+			return nil, err
+		}
+		after, err := readLUKSHeader(params.VolumeDevice)
+		if err != nil {
+			return nil, err
+		}
+		if slot, ok := newKeyslot(before.Keyslots, after.Keyslots); ok {
+			addCleanup(fmt.Sprintf("keyslot %d of %s", slot, params.VolumeDevice), keyslotCleanup(params.VolumeDevice, slot))
+		}
+		md.KeyDerivation = keyDerivationHKDF
+	}
+
+	var saveKey []byte
+	if params.SaveKey != "" {
+		saveKey, err = base64.RawStdEncoding.DecodeString(params.SaveKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid save key: %v", err)
+		}
+	}
+	if params.DeriveSaveKey {
+		if saveKey == nil || params.SaveDevice == "" {
+			return nil, fmt.Errorf("save key and device required to derive the save key")
+		}
+		before, err := readLUKSHeader(params.SaveDevice)
+		if err != nil {
+			return nil, err
+		}
+		if md.SaveKeyDerivation, err = enrollDerivedSaveKey(saveKey, key, params.SaveDevice); err != nil {
+			return nil, err
+		}
+		after, err := readLUKSHeader(params.SaveDevice)
+		if err != nil {
+			return nil, err
+		}
+		if slot, ok := newKeyslot(before.Keyslots, after.Keyslots); ok {
+			addCleanup(fmt.Sprintf("keyslot %d of %s", slot, params.SaveDevice), keyslotCleanup(params.SaveDevice, slot))
+		}
+		// only the data key is sealed
+		saveKey = nil
 	}
 
 	creationParams := sb.KeyCreationParams{
 		PCRProfile:             pcrProfile,
-		PCRPolicyCounterHandle: 0x01880001,
+		PCRPolicyCounterHandle: pcrPolicyCounterHandle,
 	}
 
 	// seal the key
-	_, err = sb.SealKeyToTPM(tpm, key, sealedKeyFile, &creationParams)
+	if err := trackHandle(pcrPolicyCounterHandle, handlePurposePCRPolicyCounter); err != nil {
+		return nil, err
+	}
+	if err := j.record(stepSealStarted); err != nil {
+		return nil, err
+	}
+	addCleanup("sealed key files and PCR policy counter", func() error {
+		tpm, err := connectTPM()
+		if err != nil {
+			return err
+		}
+		defer tpm.Close()
+		return rollbackSeal(tpm)
+	})
+	var authKey sb.TPMPolicyAuthKey
+	if saveKey != nil {
+		// seal both keys at once so they share the policy
+		requests := []*sb.SealKeyRequest{
+			{Key: key, Path: sealedKeyFile},
+			{Key: saveKey, Path: saveSealedKeyFile},
+		}
+		authKey, err = sb.SealKeyToTPMMultiple(tpm, requests, &creationParams)
+	} else {
+		authKey, err = sb.SealKeyToTPM(tpm, key, sealedKeyFile, &creationParams)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range sealedKeyFiles() {
+		if err := secureFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if !params.SkipVerification {
+		if err := verifySealedKey(tpm, pcrProfile, key); err != nil {
+			return nil, err
+		}
+	}
+
+	digest, err := profileDigest(tpm, pcrProfile)
+	if err != nil {
+		return nil, err
+	}
+	md.ProfileDigest = digest
+	md.PolicyVersion = policyVersion
+	md.recordPolicy(tpm, "seal", pcrProfile, digest)
+	if err := writeKeyMetadata(sealedKeyFile, md); err != nil {
+		return nil, err
+	}
+	if err := backupSealedKeys(); err != nil {
+		return nil, err
+	}
 
-	return err
+	if err := j.record(stepKeySealed); err != nil {
+		return nil, err
+	}
+	return authKey, nil
+}
+
+// updateParams extends the update parameters with settings specific to this
+// helper.
+type updateParams struct {
+	fdehelper.UpdateParams
+
+	// If load chains are specified, the profile is not rebuilt when
+	// neither the parameters nor the boot assets changed since the last
+	// update.
+	bootProfileParams
+
+	// AppMeasurements lists measurements made into application PCRs
+	// that must also be present to unseal the key.
+	AppMeasurements []*appMeasurement `json:"app-measurements,omitempty"`
+
+	// AuthKey is the policy authorization key returned by the initial
+	// provisioning. If specified, the key doesn't need to be unsealed to
+	// update its policy.
+	AuthKey []byte `json:"auth-key,omitempty"`
+
+	// VolumeKey selects the per-volume key to update instead of the
+	// global sealed key.
+	VolumeKey string `json:"volume-key,omitempty"`
+
+	// SerialAssertion is the current serial assertion of the device. If
+	// the key is bound to a serial, it must match.
+	SerialAssertion string `json:"serial-assertion,omitempty"`
+}
+
+// buildPCRProtectionProfile creates the PCR profile to reseal the key to.
+func (params *updateParams) buildPCRProtectionProfile() (*sb.PCRProtectionProfile, error) {
+	pcrProfile, err := params.bootProfileParams.buildPCRProtectionProfile(params.ModelParams)
+	if err != nil {
+		return nil, err
+	}
+	if err := addAppMeasurementsToProfile(pcrProfile, params.AppMeasurements); err != nil {
+		return nil, err
+	}
+	return pcrProfile, nil
 }
 
 // update reseals or updates the stored key policies.
 func update(p []byte) error {
-	var params fdehelper.UpdateParams
+	var params updateParams
 	if err := json.Unmarshal(p, &params); err != nil {
 		return err
 	}
-
-	pcrProfile, err := buildPCRProtectionProfile(params.ModelParams)
+	if dryRun {
+		if err := selectVolumeKey(params.VolumeKey, ""); err != nil {
+			return err
+		}
+		return planUpdate()
+	}
+	resp, err := updatePolicy(&params)
 	if err != nil {
 		return err
 	}
+	// the boot assets can only be checked for changes if the load
+	// chains are given
+	if len(params.LoadChains) > 0 {
+		if err := saveAutoUpdateParams(params.VolumeKey, p); err != nil {
+			warnf("%v", err)
+		}
+	}
+	return writeResponse(resp)
+}
+
+// updatePolicy reseals the key selected in the parameters, unless neither
+// the parameters nor the boot assets changed since the last update.
+func updatePolicy(params *updateParams) (*updateResponse, error) {
+	if err := selectVolumeKey(params.VolumeKey, ""); err != nil {
+		return nil, err
+	}
+	md, err := readKeyMetadata(sealedKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSerialBinding(md, params.SerialAssertion); err != nil {
+		return nil, err
+	}
+
+	if err := params.bootProfileParams.validate(); err != nil {
+		return nil, err
+	}
+	var inputs string
+	if len(params.LoadChains) > 0 {
+		cache := loadDigestCache(digestCacheFile)
+		digest, err := inputsDigest(cache, []interface{}{params.ModelParams, params.bootProfileParams, params.AppMeasurements}, params.inputFiles())
+		if err != nil {
+			return nil, err
+		}
+		if md.InputsDigest == digest {
+			if err := cache.save(); err != nil {
+				return nil, err
+			}
+			return &updateResponse{Unchanged: true}, nil
+		}
+		inputs = digest
+		// the Authenticode digests of the images are cached too
+		params.bootProfileParams.digests = cache
+		defer func() {
+			if err := cache.save(); err != nil {
+				warnf("%v", err)
+			}
+		}()
+	}
+
+	models, err := params.models(params.ModelParams)
+	if err != nil {
+		return nil, err
+	}
+	if err := runModelHooks("update", models); err != nil {
+		return nil, err
+	}
+
+	pcrProfile, err := params.buildPCRProtectionProfile()
+	if err != nil {
+		return nil, err
+	}
 
-	tpm, err := sb.ConnectToDefaultTPM()
+	changed, err := reseal(pcrProfile, params.AuthKey, params.assetVersionRaised)
 	if err != nil {
-		return fmt.Errorf("cannot connect to TPM: %v", err)
+		return nil, err
+	}
+
+	if inputs != "" || changed {
+		md, err := readKeyMetadata(sealedKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if inputs != "" {
+			md.InputsDigest = inputs
+		}
+		if changed {
+			md.Models = modelIdentities(models)
+			md.RecoverySystems = params.recoverySystemLabels()
+		}
+		if err := writeKeyMetadata(sealedKeyFile, md); err != nil {
+			return nil, err
+		}
+	}
+
+	return &updateResponse{Unchanged: !changed}, nil
+}
+
+// updateResponse is the output of the update operation.
+type updateResponse struct {
+	// Unchanged is true if the policy was already up to date and the
+	// key was not resealed.
+	Unchanged bool `json:"unchanged"`
+}
+
+// sealedKeyFiles returns the sealed key files sharing the same policy: the
+// data key and, if it was sealed, the save key.
+func sealedKeyFiles() []string {
+	files := []string{sealedKeyFile}
+	if sealedKeyFile == saveSealedKeyFile {
+		return files
+	}
+	if _, err := os.Lstat(saveSealedKeyFile); err == nil {
+		files = append(files, saveSealedKeyFile)
+	}
+	return files
+}
+
+// reseal updates the policy of the sealed key to the given PCR profile. If
+// the profile is the same used in the last sealing the key is not updated
+// unless forced, and false is returned. Updating the policy increments the
+// PCR policy counter, revoking the policies of the keys sealed before. If
+// the policy authorization key is not given, it's obtained by unsealing the
+// key.
+func reseal(pcrProfile *sb.PCRProtectionProfile, authKey sb.TPMPolicyAuthKey, force bool) (bool, error) {
+	tpm, err := connectTPM()
+	if err != nil {
+		return false, fmt.Errorf("cannot connect to TPM: %v", err)
 	}
 	defer tpm.Close()
 
+	if err := checkFileSecure(sealedKeyFile); err != nil {
+		return false, err
+	}
+
+	// avoid unnecessary TPM writes if the profile didn't change
+	digest, err := profileDigest(tpm, pcrProfile)
+	if err != nil {
+		return false, err
+	}
+	md, err := readKeyMetadata(sealedKeyFile)
+	if err != nil {
+		return false, err
+	}
+	if md.ProfileDigest == digest && !force {
+		return false, nil
+	}
+
 	// obtain the update key
-	k, err := sb.ReadSealedKeyObject(sealedKeyFile)
+	if authKey == nil {
+		k, err := readSealedKey(sealedKeyFile)
+		if err != nil {
+			return false, fmt.Errorf("cannot read the sealed key: %v", err)
+		}
+		if _, authKey, err = k.UnsealFromTPM(tpm, ""); err != nil {
+			return false, fmt.Errorf("cannot unseal: %v", err)
+		}
+	}
+
+	// reseal the keys
+	if err := updateSealedKeysPolicy(tpm, md, authKey, pcrProfile); err != nil {
+		return false, err
+	}
+
+	md.ProfileDigest = digest
+	md.recordPolicy(tpm, "reseal", pcrProfile, digest)
+	if err := writeKeyMetadata(sealedKeyFile, md); err != nil {
+		return false, err
+	}
+	if err := backupSealedKeys(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// provisionRecoveryKeyOnly records that no key is sealed, so the volumes are
+// unlocked with the recovery key.
+func provisionRecoveryKeyOnly(md *keyMetadata, j *journal) error {
+	if j.done(stepKeySealed) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(sealedKeyFile), 0755); err != nil {
+		return err
+	}
+	md.RecoveryKeyOnly = true
+	now := time.Now().UTC()
+	md.Created = &now
+	md.HelperVersion = helperVersion
+	if err := writeKeyMetadata(sealedKeyFile, md); err != nil {
+		return err
+	}
+	return j.record(stepKeySealed)
+}
+
+// unlockParams extends the unlock parameters with settings specific to this
+// helper.
+type unlockParams struct {
+	fdehelper.UnlockParams
+
+	// RefuseNearLockout makes unlock fail instead of only warning when
+	// the TPM is one failed authorization away from lockout.
+	RefuseNearLockout bool `json:"refuse-near-lockout,omitempty"`
+
+	// CacheKey keeps the unsealed key in the user keyring for a short
+	// time, so the other volumes unlocked during the same boot don't
+	// need to unseal it again.
+	CacheKey bool `json:"cache-key,omitempty"`
+	// CacheTimeout is the time in seconds the key is cached for.
+	CacheTimeout int `json:"cache-timeout,omitempty"`
+
+	// ReprovisionIfCleared, if set, makes unlock ask for the recovery key
+	// when the TPM was cleared, and seal a new key with these parameters
+	// once the volume is open. Otherwise a tpm-cleared error is reported.
+	ReprovisionIfCleared *initialProvisionParams `json:"reprovision-if-cleared,omitempty"`
+
+	// Retry sets how unsealing is retried on transient TPM errors before
+	// falling back to the recovery key.
+	Retry *retryPolicy `json:"retry,omitempty"`
+
+	// MeasureUnlock, if set, extends a PCR with how the volume was
+	// unlocked once it's open.
+	MeasureUnlock *unlockMeasurement `json:"measure-unlock,omitempty"`
+
+	// VolumeKey selects the secret to unlock with by name, e.g. "save"
+	// or the name of a per-volume key. By default, the key recorded for
+	// the volume is used, or the global sealed key if there's none.
+	VolumeKey string `json:"volume-key,omitempty"`
+
+	// TPMTimeout is the time in seconds the TPM has to unseal the key
+	// before falling back to the recovery key. The time waiting for the
+	// PIN isn't counted. By default there's no timeout.
+	TPMTimeout int `json:"tpm-timeout,omitempty"`
+
+	// CorruptKeyPolicy sets what to do if the sealed key can't be read:
+	// "recovery-key" (the default), "fail" or "backup".
+	CorruptKeyPolicy string `json:"corrupt-key-policy,omitempty"`
+
+	// BootMode overrides the detected boot mode: "run", "recover",
+	// "install" or "factory-reset". In recover mode access to the sealed
+	// keys isn't locked on finish, and the recovery key is used directly
+	// if the key wasn't sealed to the booted recovery system.
+	BootMode string `json:"boot-mode,omitempty"`
+
+	// RecoveryKeyFirst asks for the recovery key before trying the
+	// sealed key when booted in recover mode, where the user may be
+	// recovering from a policy that no longer matches.
+	RecoveryKeyFirst bool `json:"recovery-key-first,omitempty"`
+
+	// SaveVolumeName and SaveDevicePath select the save volume opened
+	// with the key derived from the data key, if the save key is
+	// derived. By default "ubuntu-save" is opened from the device with
+	// the UUID recorded when the key was derived.
+	SaveVolumeName string `json:"save-volume-name,omitempty"`
+	SaveDevicePath string `json:"save-device-path,omitempty"`
+
+	// KeyringActivation activates the volume with the unsealed key placed
+	// in the kernel keyring, found by cryptsetup through a keyring token
+	// added to the volume, instead of passing the key to cryptsetup.
+	KeyringActivation bool `json:"keyring-activation,omitempty"`
+	// KeyringTokenID selects the keyring token to activate with. By
+	// default the first one is used, or one is added.
+	KeyringTokenID *int `json:"keyring-token-id,omitempty"`
+
+	// recoverySystem is the label of the booted recovery system.
+	recoverySystem string
+	// keyringTokenID is the ID of the keyring token the volume was
+	// activated with.
+	keyringTokenID *int
+	// keyslot is the keyslot the volume was activated with, if reported
+	// by the activation.
+	keyslot *int
+	// deadline bounds the time waiting for the TPM, see TPMTimeout.
+	deadline *tpmDeadline
+
+	activationFlags
+}
+
+// activateWithUnsealedKey unseals the key and activates the volume with it,
+// deriving the volume key if needed. If requested, the unsealed key is
+// stored in the user keyring. The key used to activate the volume is
+// returned, with the key added to the keyring, if any.
+func activateWithUnsealedKey(tpm *sb.TPMConnection, params *unlockParams, md *keyMetadata, pin string) ([]byte, *keyringKey, bool, error) {
+	k, err := readSealedKey(sealedKeyFile)
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("cannot read sealed key object: %v", err)
+	}
+	secret, _, err := k.UnsealFromTPM(tpm, pin)
 	if err != nil {
-		return fmt.Errorf("cannot read the sealed key: %v", err)
+		return nil, nil, false, err
 	}
-	_, authKey, err := k.UnsealFromTPM(tpm, "")
+	key, err := volumeKeyForDevice(md, secret, params.SourceDevicePath)
 	if err != nil {
-		return fmt.Errorf("cannot unseal: %v", err)
+		return nil, nil, false, err
+	}
+	if err := params.activateWithKey(key); err != nil {
+		return nil, nil, false, err
 	}
 
-	// reseal the key
-	return sb.UpdateKeyPCRProtectionPolicy(tpm, sealedKeyFile, authKey, pcrProfile)
+	if params.CacheKey {
+		timeout := params.CacheTimeout
+		if timeout <= 0 {
+			timeout = defaultKeyCacheTimeout
+		}
+		cached, err := cacheKey(sealedKeyFile, secret, timeout)
+		if err != nil {
+			warnf("%v", err)
+		}
+		return key, cached, true, nil
+	}
+	return key, nil, true, nil
 }
 
-// unlock unseals the key and unlock the encrypted volume.
+// unlock unseals the key and unlock the encrypted volume, and writes how
+// the volume was unlocked to stdout.
 func unlock(p []byte) error {
-	var params fdehelper.UnlockParams
+	var params unlockParams
 	if err := json.Unmarshal(p, &params); err != nil {
 		return err
 	}
 
+	start := time.Now()
+	resp, err := activateVolume(&params)
+	if merr := writeUnlockMetrics(params.VolumeName, start, resp); merr != nil {
+		warnf("%v", merr)
+	}
+	if err != nil {
+		return err
+	}
+	resp.BootMode = params.BootMode
+	resp.KeyringTokenID = params.keyringTokenID
+	resp.Keyslot = params.keyslot
+	reportFailure(&params, resp)
+
+	// the volume is open already, so a failed measurement is only a
+	// warning and shows as a missing event to the verifier
+	if params.MeasureUnlock != nil && !resp.TPMTimeout {
+		resp.Measurement, err = measureUnlock(params.MeasureUnlock, params.VolumeName, resp.Method)
+		if err != nil {
+			warnf("cannot measure unlock: %v", err)
+		}
+	}
+	return writeResponse(resp)
+}
+
+// activateVolume unlocks the encrypted volume with the sealed key, or with
+// the recovery key if the sealed key can't be used. If requested, access to
+// the sealed keys is locked when it returns, even if unlocking failed.
+func activateVolume(params *unlockParams) (resp *unlockResponse, err error) {
+	// the keys are locked however the unlock ends, including invalid
+	// parameters, unless the boot mode resolved below doesn't lock them
+	deadline := newTPMDeadline(params.TPMTimeout)
+	params.deadline = deadline
+	defer func() {
+		if !params.LockKeysOnFinish {
+			return
+		}
+		lockErr := errTPMTimeout
+		if !deadline.expired {
+			lockErr = lockAccess()
+		}
+		if lockErr != nil {
+			warnf("%v", lockErr)
+		}
+		if resp != nil {
+			locked := lockErr == nil
+			resp.KeysLocked = &locked
+		}
+	}()
+
 	if params.VolumeName == "" {
-		return fmt.Errorf("volume name not specified")
+		return nil, fmt.Errorf("volume name not specified")
 	}
 	if params.SourceDevicePath == "" {
-		return fmt.Errorf("source device path not specified")
+		return nil, fmt.Errorf("source device path not specified")
+	}
+	if params.MeasureUnlock != nil && params.MeasureUnlock.PCR != nil {
+		if err := checkApplicationPCR(*params.MeasureUnlock.PCR); err != nil {
+			return nil, err
+		}
+	}
+	if err := selectVolumeKey(params.VolumeKey, params.SourceDevicePath); err != nil {
+		return nil, err
+	}
+	if err := params.activationFlags.validate(); err != nil {
+		return nil, err
+	}
+	switch params.CorruptKeyPolicy {
+	case "", corruptKeyPolicyRecoveryKey, corruptKeyPolicyFail, corruptKeyPolicyBackup:
+	default:
+		return nil, fmt.Errorf("invalid corrupt key policy %q", params.CorruptKeyPolicy)
+	}
+	if err := params.resolveBootMode(); err != nil {
+		return nil, err
 	}
 
-	tpm, err := sb.ConnectToDefaultTPM()
+	if err := checkFileSecure(sealedKeyFile); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		// there's no sealed key for dangerous models provisioned to use
+		// the recovery key only
+		if md, merr := readKeyMetadata(sealedKeyFile); merr == nil && md.RecoveryKeyOnly {
+			if _, err := activateWithRecoveryKey(params); err != nil {
+				return nil, err
+			}
+			resp := newUnlockResponse(unlockMethodRecoveryKey)
+			// this is the expected method, not a fallback
+			resp.Degraded = false
+			return resp, nil
+		}
+		// the volume may have been enrolled by systemd-cryptenroll
+		if h, herr := readLUKSHeader(params.SourceDevicePath); herr == nil && h.hasToken(systemdTPM2TokenType) {
+			if err := activateWithSystemdToken(params); err != nil {
+				return nil, err
+			}
+			return newUnlockResponse(unlockMethodSystemdTPM2), nil
+		}
+		// the key may have been deleted, use one of its copies
+		path, rerr := restoreSealedKey(sealedKeyFile)
+		if rerr != nil {
+			return nil, err
+		}
+		warnf("%v, using a copy of the sealed key", err)
+		sealedKeyFile = path
+	}
+
+	md, err := readKeyMetadata(sealedKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.CacheKey {
+		if secret, cached, err := readCachedKey(sealedKeyFile); err == nil {
+			key, err := volumeKeyForDevice(md, secret, params.SourceDevicePath)
+			if err == nil {
+				err = params.activateWithKey(key)
+			}
+			if err == nil {
+				resp := newUnlockResponse(unlockMethodCachedKey)
+				resp.KeyringKeys = []*keyringKey{cached}
+				resp.SaveVolume = activateDerivedSave(params, md, key)
+				return resp, nil
+			}
+			warnf("cannot activate volume with cached key: %v", err)
+		}
+	}
+
+	if resp, err := handleCorruptKey(params); resp != nil || err != nil {
+		return resp, err
+	}
+	if resp, err := activateInRecoverMode(params, md); resp != nil || err != nil {
+		return resp, err
+	}
+
+	var tpm *sb.TPMConnection
+	err = deadline.run(func() error {
+		t, err := connectToTPM(params.Retry)
+		tpm = t
+		return err
+	})
+	if err == errTPMTimeout {
+		return activateAfterTPMTimeout(params)
+	}
 	if err != nil {
-		return fmt.Errorf("cannot connect to TPM: %v", err)
+		return nil, err
 	}
 	defer tpm.Close()
 
-	options := &sb.ActivateVolumeOptions{
-		PassphraseTries:  1,
-		RecoveryKeyTries: 3,
-		LockSealedKeys:   params.LockKeysOnFinish,
+	// the key can't be unsealed if the TPM was cleared after sealing
+	if tpmCleared(tpm) {
+		if params.ReprovisionIfCleared == nil {
+			return nil, &codedError{code: errorCodeTPMCleared, err: fmt.Errorf("storage root key or PCR policy counter not found")}
+		}
+		if err := recoverFromClearedTPM(params); err != nil {
+			return nil, err
+		}
+		return newUnlockResponse(unlockMethodRecoveryKey), nil
 	}
-	ok, err := sb.ActivateVolumeWithTPMSealedKey(tpm, params.VolumeName, params.SourceDevicePath, sealedKeyFile, nil, options)
+
+	// a PIN entered at the prompt must stay subject to the dictionary
+	// attack protection, so the lockout is never reset automatically for
+	// PIN protected keys
+	k, err := readSealedKey(sealedKeyFile)
+	pinProtected := err == nil && k.AuthMode2F() != sb.AuthModeNone
+
+	// don't let an automated retry loop lock the TPM out
+	da, err := readDAStatus(tpm)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	lockoutReset := false
+	if da.InLockout && !pinProtected && lockoutAuthAvailable(tpm) {
+		if err := resetDALockout(tpm); err != nil {
+			return nil, err
+		}
+		lockoutReset = true
+		if da, err = readDAStatus(tpm); err != nil {
+			return nil, err
+		}
+	}
+	if da.remainingTries() <= 1 {
+		if params.RefuseNearLockout {
+			return nil, fmt.Errorf("TPM is %d failed attempts away from lockout (counter %d of %d)",
+				da.remainingTries(), da.LockoutCounter, da.MaxAuthFail)
+		}
+		warnf("TPM is %d failed attempts away from lockout (counter %d of %d)",
+			da.remainingTries(), da.LockoutCounter, da.MaxAuthFail)
+	}
+
+	// PIN attempts are delayed after failures like recovery key attempts
+	var attempts *attemptState
+	var pin *string
+	if pinProtected {
+		attempts = loadAttemptState()
+
+		// the PIN must be checked against the duress PIN before it's
+		// used
+		if md.Duress != nil {
+			attempts.wait()
+			s, err := askPassword(params.SourceDevicePath, "Please enter the PIN for disk "+params.SourceDevicePath)
+			if err != nil {
+				return nil, fmt.Errorf("cannot ask for PIN: %v", err)
+			}
+			if md.Duress.matches(s) {
+				return md.Duress.trigger(tpm, params)
+			}
+			pin = &s
+		}
+	}
+
+	// the unsealed key is only known if it's unsealed here instead of
+	// by secboot, which only activates volumes with sealed key objects.
+	// With a TPM timeout the key is unsealed here too, so the volume
+	// isn't activated once unsealing was abandoned.
+	var key []byte
+	var cached *keyringKey
+	activateOnce := func() (bool, error) {
+		if params.CacheKey || params.KeyringActivation || md.KeyDerivation != "" || md.SaveKeyDerivation != nil || md.Format == keyDataFormat || params.TPMTimeout > 0 {
+			var s string
+			if attempts != nil {
+				if pin != nil {
+					s = *pin
+				} else {
+					attempts.wait()
+					var err error
+					if s, err = askPassword(params.SourceDevicePath, "Please enter the PIN for disk "+params.SourceDevicePath); err != nil {
+						return false, fmt.Errorf("cannot ask for PIN: %v", err)
+					}
+				}
+			}
+			var ok bool
+			var err error
+			key, cached, ok, err = activateWithUnsealedKey(tpm, params, md, s)
+			// an abandoned unseal isn't a failed attempt, and must
+			// leave the attempts to the recovery key fallback
+			if attempts != nil && err != errTPMTimeout {
+				if err != nil {
+					attempts.failed()
+				} else {
+					attempts.succeeded()
+				}
+			}
+			return ok, err
+		}
+		// the recovery key is asked for by the helper
+		options := params.volumeOptions(&sb.ActivateVolumeOptions{
+			PassphraseTries: 1,
+		})
+		if attempts == nil {
+			return sb.ActivateVolumeWithTPMSealedKey(tpm, params.VolumeName, params.SourceDevicePath, sealedKeyFile, nil, options)
+		}
+		var pinReader io.Reader
+		if pin != nil {
+			pinReader = strings.NewReader(*pin + "\n")
+		} else {
+			attempts.wait()
+		}
+		ok, err := sb.ActivateVolumeWithTPMSealedKey(tpm, params.VolumeName, params.SourceDevicePath, sealedKeyFile, pinReader, options)
+		if err != nil {
+			attempts.failed()
+		} else {
+			attempts.succeeded()
+		}
+		return ok, err
+	}
+	activate := func() (bool, error) {
+		var ok bool
+		retry := func() error {
+			return params.Retry.do(func() error {
+				var err error
+				ok, err = activateOnce()
+				return err
+			})
+		}
+		// the PIN prompt must not be interrupted
+		if attempts != nil && pin == nil {
+			err := retry()
+			return ok, err
+		}
+		if err := deadline.run(retry); err != nil {
+			return false, err
+		}
+		return ok, nil
+	}
+	ok, err := activate()
+	if isLockoutError(err) && !lockoutReset && !pinProtected && lockoutAuthAvailable(tpm) {
+		// recover transparently and retry once
+		if err := resetDALockout(tpm); err != nil {
+			return nil, err
+		}
+		ok, err = activate()
+	}
+	if err == errTPMTimeout {
+		return activateAfterTPMTimeout(params)
+	}
+	if err != nil {
+		logf("cannot activate volume with sealed key: %v", err)
+		failure := err.Error()
+		if _, err := activateWithRecoveryKey(params); err != nil {
+			return nil, err
+		}
+		resp = newUnlockResponse(unlockMethodRecoveryKey)
+		resp.failure = failure
+		return resp, nil
 	}
 	// XXX: check if this can happen
 	if !ok {
-		return fmt.Errorf("volume was not activated")
+		return nil, fmt.Errorf("volume was not activated")
 	}
-	return nil
+
+	method := unlockMethodSealedKey
+	if k, err := readSealedKey(sealedKeyFile); err == nil && k.AuthMode2F() != sb.AuthModeNone {
+		method = unlockMethodSealedKeyPIN
+	}
+	resp = newUnlockResponse(method)
+	if cached != nil {
+		resp.KeyringKeys = []*keyringKey{cached}
+	}
+	resp.SaveVolume = activateDerivedSave(params, md, key)
+	return resp, nil
+}
+
+// activateAfterTPMTimeout unlocks the volume with the recovery key when the
+// TPM didn't respond in time.
+func activateAfterTPMTimeout(params *unlockParams) (*unlockResponse, error) {
+	warnf("%v, falling back to the recovery key", errTPMTimeout)
+	if _, err := activateWithRecoveryKey(params); err != nil {
+		return nil, err
+	}
+	resp := newUnlockResponse(unlockMethodRecoveryKey)
+	resp.TPMTimeout = true
+	return resp, nil
 }
 
 type options struct {
 	// XXX: all descriptions are placeholders
-	Supported bool `long:"supported" description:"Check if fde available"`
-	Init      bool `long:"initial-provision" description:"Provision TPM and seal"`
-	Update    bool `long:"update" description:"Reseal (update the policy) in the TPM case"`
-	Unlock    bool `long:"unlock" description:"Unseal and unlock"`
+	Supported      bool `long:"supported" description:"Check if fde available"`
+	ProbeBackends  bool `long:"probe-backends" description:"Report which protection backends are usable"`
+	Init           bool `long:"initial-provision" description:"Provision TPM and seal"`
+	Update         bool `long:"update" description:"Reseal (update the policy) in the TPM case"`
+	Unlock         bool `long:"unlock" description:"Unseal and unlock"`
+	FixPermissions bool `long:"fix-permissions" description:"Repair ownership and permissions of key files"`
+	FirstBoot      bool `long:"first-boot" description:"Encrypt and provision the data partition if not done yet"`
+	ExportPolicy   bool `long:"export-policy-update" description:"Create a signed policy update bundle"`
+	ApplyPolicy    bool `long:"apply-policy-update" description:"Reseal using a signed policy update bundle"`
+	Schema         bool `long:"schema" description:"Print the JSON schema of all operations"`
+	Status         bool `long:"status" description:"Show the state of the TPM"`
+	TestHarness    bool `long:"test-harness" description:"Run the end-to-end test cycle using swtpm" hidden:"yes"`
+	Bench          bool `long:"bench" description:"Measure unseal and activation latency"`
+	CreateAK       bool `long:"create-ak" description:"Create and persist the attestation key"`
+	ActivateCred   bool `long:"activate-credential" description:"Activate a credential for the attestation key"`
+	DeleteAK       bool `long:"delete-ak" description:"Delete the attestation key"`
+	ExtendPCR      bool `long:"extend-pcr" description:"Extend an application PCR with a measurement"`
+	UnlockWithKey  bool `long:"unlock-with-key" description:"Unlock using a key provided by the caller"`
+	FactoryReset   bool `long:"factory-reset" description:"Encrypt the data partition again keeping the save partition"`
+	UpgradeKeyData bool `long:"upgrade-keydata" description:"Rewrite the sealed key in the current key data format"`
+	Convert        bool `long:"convert" description:"Enroll TPM unlock on an existing passphrase-encrypted volume"`
+	Unenroll       bool `long:"unenroll" description:"Remove TPM unlock from a volume keeping its passphrases"`
+	List           bool `long:"list" description:"List encrypted volumes and sealed keys"`
+	Features       bool `long:"features" description:"Show the operations and capabilities supported by the helper"`
+	Lock           bool `long:"lock" description:"Lock access to the sealed keys until the next boot"`
+	RevealKey      bool `long:"reveal-key" description:"Unseal and print the key without unlocking"`
+	SystemdToken   bool `long:"export-systemd-token" description:"Enroll a systemd-cryptenroll TPM2 token using the sealed key"`
+	ListHandles    bool `long:"list-handles" description:"List the persistent TPM handles created by the helper"`
+	ListBackends   bool `long:"list-compiled-backends" description:"List the backends built into the helper"`
+	EvictHandle    bool `long:"evict-handle" description:"Remove persistent TPM handles created by the helper"`
+	ExportEventLog bool `long:"export-eventlog" description:"Export the TPM event log in JSON format"`
+	AdvanceBoot    bool `long:"advance-boot-phase" description:"Lock keys bound to the early boot until the next boot"`
+	AutoUpdate     bool `long:"auto-update" description:"Reseal if the boot assets changed since the last update"`
+	ExportBreak    bool `long:"export-break-glass" description:"Write the volume key wrapped under an operator public key"`
+	EnrollRecovery bool `long:"enroll-recovery-key" description:"Add a labeled recovery key to a volume"`
+	ListRecovery   bool `long:"list-recovery-keys" description:"List the labeled recovery keys of a volume"`
+	RevokeRecovery bool `long:"revoke-recovery-key" description:"Remove the recovery key with the given label"`
+	RemoveToken    bool `long:"remove-token" description:"Remove a LUKS2 token written by the helper"`
+	UpdateToken    bool `long:"update-token" description:"Change a LUKS2 token written by the helper"`
+	MigratePolicy  bool `long:"migrate-policy" description:"Seal the key again using the current policy constructs"`
+	TrialPolicy    bool `long:"trial-policy" description:"Compute the policy digest of PCR values in a trial session"`
+	SendReports    bool `long:"send-failure-reports" description:"Send the pending reports of unlocks that fell back to the recovery key"`
+
+	GenerateFirstBootUnit string `long:"generate-first-boot-unit" description:"Write the first boot systemd unit" value-name:"DIR"`
+	GenerateAutoUpdate    string `long:"generate-auto-update-units" description:"Write the systemd units that reseal on boot asset changes" value-name:"DIR"`
+	Validate              string `long:"validate" description:"Validate parameters of an operation without executing it" value-name:"OPERATION"`
+	SleepHook             string `long:"sleep-hook" description:"Check the TPM and suspend or resume volumes around system sleep" value-name:"PHASE" choice:"pre" choice:"post"`
+	Completion            string `long:"completion" description:"Print the shell completion script" value-name:"SHELL" choice:"bash" choice:"zsh" choice:"fish"`
+
+	KeyFD      int    `long:"key-fd" description:"Read the key to seal or to unlock with, or write the revealed key, using this file descriptor" default:"-1"`
+	ResponseFD int    `long:"response-fd" description:"Write the response to this file descriptor instead of stdout" default:"-1"`
+	Root       string `long:"root" description:"Resolve all paths under this directory" value-name:"DIR"`
+
+	InvalidateDigestCache bool     `long:"invalidate-digest-cache" description:"Discard cached boot asset digests"`
+	Factory               bool     `long:"factory" description:"Provision in the factory and export public artifacts"`
+	FieldFinalize         bool     `long:"field-finalize" description:"Finalize a factory provisioning in the field"`
+	BreakGlass            bool     `long:"break-glass" description:"Unlock with a break-glass bundle instead of the TPM"`
+	IgnoreTPMBlocklist    bool     `long:"ignore-tpm-blocklist" description:"Use TPMs with firmware known to have issues"`
+	TCTI                  string   `long:"tcti" description:"TPM connection, e.g. device:/dev/tpm0" value-name:"TCTI"`
+	KeyBackupDirs         []string `long:"key-backup-dir" description:"Keep copies of the sealed keys in this directory, tried in order if the sealed key can't be read" value-name:"DIR" env:"FDE_HELPER_KEY_BACKUP_DIRS" env-delim:":"`
+	MetricsDir            string   `long:"metrics-dir" description:"Write unlock metrics for the node_exporter textfile collector" value-name:"DIR"`
+	TangURL               string   `long:"tang-url" description:"Tang server to probe with --probe-backends" value-name:"URL"`
+	FailureHook           string   `long:"failure-hook" description:"Run this executable with the report of unlocks that fell back to the recovery key" value-name:"PATH" env:"FDE_HELPER_FAILURE_HOOK"`
+	FailureURL            string   `long:"failure-url" description:"Post the report of unlocks that fell back to the recovery key to this HTTPS endpoint" value-name:"URL" env:"FDE_HELPER_FAILURE_URL"`
+	Quiet                 bool     `long:"quiet" description:"Don't show messages other than errors"`
+	NoWait                bool     `long:"no-wait" description:"Fail instead of waiting if another instance is running"`
+	WaitTimeout           int      `long:"wait-timeout" description:"Seconds to wait for another instance to finish" value-name:"SECONDS" default:"60"`
+	Watchdog              string   `long:"watchdog" description:"Keep this watchdog alive while the operation runs" value-name:"WATCHDOG" choice:"none" choice:"systemd" choice:"hardware" default:"none" env:"FDE_HELPER_WATCHDOG"`
+	Deadline              int      `long:"deadline" description:"Abort with a reboot-recommended error if the operation takes longer than this" value-name:"SECONDS" env:"FDE_HELPER_DEADLINE"`
+	DryRun                bool     `long:"dry-run" description:"Write the TPM and cryptsetup actions of the operation instead of performing them"`
+	DropPrivileges        bool     `long:"drop-privileges" description:"Keep only the capabilities needed by the operation" env:"FDE_HELPER_DROP_PRIVILEGES"`
+	BootOutput            bool     `long:"boot-output" description:"Write one status line to the console and the messages to the kernel log" env:"FDE_HELPER_BOOT_OUTPUT"`
+	Format                string   `long:"format" description:"Output format of responses" value-name:"FORMAT" choice:"json" choice:"text" default:"json"`
+	Prompt                string   `long:"prompt" description:"How to ask for PINs and recovery keys" value-name:"PROVIDER" choice:"ask-password" choice:"tty" choice:"plymouth" choice:"none" default:"ask-password" env:"FDE_HELPER_PROMPT"`
+}
+
+// exit terminates the helper, reporting the error if it's not nil.
+func exit(err error) {
+	stopWatchdog()
+	if bootOutput != nil {
+		bootOutput.status(err)
+		os.Exit(exitStatus(err))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(exitStatus(err))
+	}
+	os.Exit(0)
 }
 
 func main() {
+	// files we create must not be accessible by group or others
+	syscall.Umask(0077)
+
 	var opt options
 	parser := flags.NewParser(&opt, flags.Default)
 	if _, err := parser.Parse(); err != nil {
@@ -207,33 +1554,199 @@ func main() {
 		}
 	}
 
+	if opt.Root != "" {
+		setRootDir(opt.Root)
+	}
+
+	ignoreTPMBlocklist = opt.IgnoreTPMBlocklist
+	tctiString = opt.TCTI
+	quiet = opt.Quiet
+	if opt.BootOutput {
+		enableBootOutput(operationName(os.Args[1:]))
+		defer reportPanic()
+	}
+	metricsDir = opt.MetricsDir
+	tangURL = opt.TangURL
+	failureHook = opt.FailureHook
+	failureURL = opt.FailureURL
+	outputFormat = opt.Format
+	if opt.ResponseFD >= 0 {
+		if opt.ResponseFD == opt.KeyFD {
+			exit(fmt.Errorf("the response and the key must use different file descriptors"))
+		}
+		if err := setResponseFD(opt.ResponseFD); err != nil {
+			exit(err)
+		}
+	}
+	if err := setPrompter(opt.Prompt); err != nil {
+		exit(err)
+	}
+	if opt.DryRun {
+		if !opt.dryRunSupported() {
+			exit(fmt.Errorf("dry run is not supported by this operation"))
+		}
+		dryRun = true
+	}
+	if err := startWatchdog(opt.Watchdog, opt.Deadline); err != nil {
+		exit(err)
+	}
+	if opt.lockingNeeded() {
+		timeout := opt.WaitTimeout
+		if opt.NoWait {
+			timeout = 0
+		}
+		if err := lockInstance(timeout); err != nil {
+			exit(err)
+		}
+	}
+	if opt.DropPrivileges {
+		if err := dropPrivileges(&opt); err != nil {
+			exit(err)
+		}
+	}
+
+	if opt.InvalidateDigestCache {
+		if err := invalidateDigestCache(); err != nil {
+			exit(fmt.Errorf("cannot invalidate digest cache: %v", err))
+		}
+	}
+
+	// a broken device profile must not prevent unlocking
+	dp, err := readDeviceProfile()
+	if err != nil {
+		warnf("ignoring device profile: %v", err)
+		dp = &deviceProfile{}
+	}
+	dp.preferBackend()
+	keyBackupDirs = opt.KeyBackupDirs
+	if len(keyBackupDirs) == 0 {
+		keyBackupDirs = dp.KeyBackupDirs
+	}
+
+	// callers parse the result from stdout
 	if opt.Supported {
 		if err := supported(); err != nil {
 			fmt.Printf("secure fde unsupported: %v\n", err)
-			os.Exit(2)
+			exit(&codedError{errorCodeUnsupported, err})
 		}
-		os.Exit(0)
+		exit(nil)
+	}
+	// all backends are probed, but sealing is only supported with the
+	// TPM
+	if opt.ProbeBackends {
+		exit(writeResponse(probeBackends()))
+	}
+
+	// operations that don't take parameters
+	switch {
+	case opt.FixPermissions:
+		exit(fixPermissions())
+	case opt.FirstBoot:
+		exit(firstBoot())
+	case opt.GenerateFirstBootUnit != "":
+		exit(writeFirstBootUnit(opt.GenerateFirstBootUnit))
+	case opt.GenerateAutoUpdate != "":
+		exit(writeAutoUpdateUnits(opt.GenerateAutoUpdate))
+	case opt.Schema:
+		exit(printSchema())
+	case opt.Status:
+		exit(status())
+	case opt.CreateAK:
+		exit(createAK())
+	case opt.DeleteAK:
+		exit(deleteAK())
+	case opt.UpgradeKeyData:
+		exit(upgradeKeyData())
+	case opt.Features:
+		exit(features())
+	case opt.Lock:
+		exit(lockAccess())
+	case opt.ListHandles:
+		exit(listHandles())
+	case opt.ListBackends:
+		exit(listCompiledBackends())
+	case opt.SendReports:
+		exit(sendFailureReports())
+	case opt.AdvanceBoot:
+		exit(advanceBootPhase())
+	case opt.AutoUpdate:
+		exit(autoUpdate())
+	case opt.Completion != "":
+		exit(printCompletion(opt.Completion))
 	}
 
 	// read JSON-formated parameters from stdin
 	reader := bufio.NewReader(os.Stdin)
 	p, err := reader.ReadBytes('\n')
 	if err != nil && err != io.EOF {
-		fmt.Fprintf(os.Stderr, "error: %v\n", err)
-		os.Exit(1)
+		exit(err)
+	}
+	if p, err = applyDeviceProfile(dp, &opt, p); err != nil {
+		exit(err)
 	}
 
 	switch {
+	case opt.Init && opt.FieldFinalize:
+		err = fieldFinalize(p)
 	case opt.Init:
-		err = initialProvision(p)
+		err = initialProvision(p, opt.KeyFD, opt.Factory)
 	case opt.Update:
 		err = update(p)
+	case opt.Unlock && opt.BreakGlass:
+		err = unlockWithBreakGlass(p)
 	case opt.Unlock:
 		err = unlock(p)
+	case opt.ExportPolicy:
+		err = exportPolicyUpdate(p)
+	case opt.ApplyPolicy:
+		err = applyPolicyUpdate(p)
+	case opt.Validate != "":
+		err = validate(opt.Validate, p)
+	case opt.TestHarness:
+		err = runTestHarness(p)
+	case opt.Bench:
+		err = bench(p)
+	case opt.ActivateCred:
+		err = activateCredential(p)
+	case opt.ExtendPCR:
+		err = extendPCR(p)
+	case opt.UnlockWithKey:
+		err = unlockWithKey(p, opt.KeyFD)
+	case opt.FactoryReset:
+		err = factoryReset(p)
+	case opt.Convert:
+		err = convert(p)
+	case opt.Unenroll:
+		err = unenroll(p)
+	case opt.List:
+		err = list(p)
+	case opt.SystemdToken:
+		err = exportSystemdToken(p)
+	case opt.RevealKey:
+		err = revealKey(p, opt.KeyFD)
+	case opt.SleepHook != "":
+		err = sleepHook(opt.SleepHook, p)
+	case opt.EvictHandle:
+		err = evictHandle(p)
+	case opt.ExportEventLog:
+		err = exportEventLog(p)
+	case opt.ExportBreak:
+		err = exportBreakGlass(p)
+	case opt.EnrollRecovery:
+		err = enrollRecoveryKey(p)
+	case opt.ListRecovery:
+		err = listRecoveryKeys(p)
+	case opt.RevokeRecovery:
+		err = revokeRecoveryKey(p)
+	case opt.RemoveToken:
+		err = removeToken(p)
+	case opt.UpdateToken:
+		err = updateToken(p)
+	case opt.MigratePolicy:
+		err = migratePolicy(p)
+	case opt.TrialPolicy:
+		err = trialPolicy(p)
 	}
 
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: %v\n", err)
-		os.Exit(1)
-	}
+	exit(err)
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestReadKeyFromFD(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{name: "key", data: "secret key"},
+		{name: "binary key", data: "\x00\x01\xfe\xff"},
+		{name: "empty", data: "", err: "no key data in file descriptor"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "fde-helper-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "key")
+			if err := ioutil.WriteFile(path, []byte(tc.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// readKeyFromFD closes the descriptor
+			fd, err := syscall.Dup(int(f.Fd()))
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			key, err := readKeyFromFD(fd)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(key) != tc.data {
+				t.Fatalf("expected key %q, got %q", tc.data, key)
+			}
+		})
+	}
+}
+
+func TestReadKeyFromFDInvalid(t *testing.T) {
+	if _, err := readKeyFromFD(-1); err == nil || !strings.Contains(err.Error(), "invalid key file descriptor") {
+		t.Fatalf("expected invalid descriptor error, got %v", err)
+	}
+}
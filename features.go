@@ -0,0 +1,82 @@
+package main
+
+import (
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// protocolVersions lists the versions of the JSON protocol understood by the
+// helper. The version must be increased on incompatible changes.
+var protocolVersions = []int{1}
+
+// pcrBank lists the PCRs allocated in a TPM bank.
+type pcrBank struct {
+	Algorithm string `json:"algorithm"`
+	PCRs      []int  `json:"pcrs"`
+}
+
+type featuresResponse struct {
+	ProtocolVersions []int    `json:"protocol-versions"`
+	Operations       []string `json:"operations"`
+	Backends         []string `json:"backends"`
+	// PCRBanks are the PCR banks of the TPM, if one is available.
+	PCRBanks []*pcrBank `json:"pcr-banks,omitempty"`
+	// CompileOptions describe how the helper was built.
+	CompileOptions map[string]string `json:"compile-options"`
+}
+
+// readPCRBanks returns the PCR banks allocated in the TPM.
+func readPCRBanks() ([]*pcrBank, error) {
+	tpm, err := connectTPM()
+	if err != nil {
+		return nil, err
+	}
+	defer tpm.Close()
+
+	selections, err := tpm.GetCapabilityPCRs()
+	if err != nil {
+		return nil, err
+	}
+	var banks []*pcrBank
+	for _, s := range selections {
+		name, err := hashAlgorithmName(s.Hash)
+		if err != nil || len(s.Select) == 0 {
+			continue
+		}
+		pcrs := append([]int(nil), s.Select...)
+		sort.Ints(pcrs)
+		banks = append(banks, &pcrBank{Algorithm: name, PCRs: pcrs})
+	}
+	return banks, nil
+}
+
+// features writes the capabilities of the helper to stdout, so callers can
+// adapt to it without parsing version strings. It works without a TPM, in
+// which case no PCR banks are reported.
+func features() error {
+	resp := featuresResponse{
+		ProtocolVersions: protocolVersions,
+		Backends:         []string{backendTPM2, systemdTPM2TokenType},
+		CompileOptions: map[string]string{
+			"go-version":      runtime.Version(),
+			"key-data-format": keyDataFormat,
+		},
+	}
+	var compiled []string
+	for name := range compiledBackends {
+		compiled = append(compiled, name)
+	}
+	sort.Strings(compiled)
+	resp.CompileOptions["backends"] = strings.Join(compiled, ",")
+	for op := range protocolTypes {
+		resp.Operations = append(resp.Operations, op)
+	}
+	sort.Strings(resp.Operations)
+
+	if banks, err := readPCRBanks(); err == nil {
+		resp.PCRBanks = banks
+	}
+
+	return writeResponse(&resp)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// checkFileSecure verifies that the file in the given path is a regular file
+// owned by root and not accessible by group or others, so it can be trusted.
+func checkFileSecure(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	perm := fi.Mode().Perm()
+	if perm&0002 != 0 {
+		return fmt.Errorf("refusing to use world-writable file %s", path)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && (st.Uid != 0 || st.Gid != 0) {
+		return fmt.Errorf("%s is not owned by root (use --fix-permissions to repair)", path)
+	}
+	if perm&^0600 != 0 {
+		return fmt.Errorf("%s has insecure permissions %04o (use --fix-permissions to repair)", path, perm)
+	}
+	return nil
+}
+
+// secureFile sets root ownership and 0600 permissions to the file in the
+// given path.
+func secureFile(path string) error {
+	if err := os.Chown(path, 0, 0); err != nil {
+		return err
+	}
+	return os.Chmod(path, 0600)
+}
+
+// fixPermissions repairs the ownership and permissions of the files managed
+// by the helper, if they exist.
+func fixPermissions() error {
+	paths := []string{sealedKeyFile, saveSealedKeyFile, keyMetadataFile(sealedKeyFile), backupKeyFile(sealedKeyFile), backupKeyFile(saveSealedKeyFile), lockoutAuthFile, decoyKeyFile}
+	volumeKeys, err := filepath.Glob(filepath.Join(volumeKeysDir, "*"))
+	if err != nil {
+		return err
+	}
+	paths = append(paths, volumeKeys...)
+	for _, path := range paths {
+		fi, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a regular file", path)
+		}
+		if err := secureFile(path); err != nil {
+			return fmt.Errorf("cannot fix permissions of %s: %v", path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	sb "github.com/snapcore/secboot"
+)
+
+const (
+	defaultFirstBootParamsFile = "/run/mnt/gadget/fde-first-boot.json"
+	defaultFirstBootDoneFile   = "/run/mnt/ubuntu-boot/fde-first-boot-done"
+
+	firstBootUnitName = "fde-helper-first-boot.service"
+)
+
+// firstBootParams are the gadget-provided parameters used to encrypt and
+// provision the data partition on first boot.
+type firstBootParams struct {
+	initialProvisionParams
+
+	// Device is the path to the partition to encrypt.
+	Device string `json:"device"`
+	// Label is the label of the new LUKS2 container.
+	Label string `json:"label"`
+	// OverwriteFilesystem allows the partition to be encrypted even if
+	// it already contains a filesystem.
+	OverwriteFilesystem bool `json:"overwrite-filesystem"`
+}
+
+// partitionType returns the type of the content of the given block device
+// as reported by blkid, or an empty string if the device has no recognized
+// content.
+func partitionType(device string) (string, error) {
+	output, err := exec.Command("blkid", "-p", "-s", "TYPE", "-o", "value", device).Output()
+	if err != nil {
+		// blkid exits with status 2 if no content was detected
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 2 {
+			return "", nil
+		}
+		return "", fmt.Errorf("cannot probe %s: %v", device, err)
+	}
+	return string(bytes.TrimSpace(output)), nil
+}
+
+// firstBoot encrypts the data partition and seals its key if it's still
+// unencrypted, and marks the first boot provisioning as completed.
+func firstBoot() error {
+	if _, err := os.Stat(firstBootDoneFile); err == nil {
+		return nil
+	}
+
+	p, err := ioutil.ReadFile(firstBootParamsFile)
+	if err != nil {
+		return fmt.Errorf("cannot read first boot parameters: %v", err)
+	}
+	var params firstBootParams
+	if err := json.Unmarshal(p, &params); err != nil {
+		return fmt.Errorf("cannot parse first boot parameters: %v", err)
+	}
+	if params.Device == "" {
+		return fmt.Errorf("device not specified in first boot parameters")
+	}
+	if params.Label == "" {
+		params.Label = "ubuntu-data-enc"
+	}
+
+	j, err := openJournal(journalFile)
+	if err != nil {
+		return err
+	}
+
+	fstype, err := partitionType(params.Device)
+	if err != nil {
+		return err
+	}
+	switch fstype {
+	case "crypto_LUKS":
+		// the container was created by a provisioning that was
+		// interrupted before its key was sealed, the key is lost and
+		// provisioning starts over; if the key was sealed only the
+		// done file is missing
+		if j.done(stepLUKSFormatted) && !j.done(stepKeySealed) {
+			j.Steps = nil
+			if err := encryptAndProvision(&params, j); err != nil {
+				return err
+			}
+		}
+		// otherwise already encrypted, nothing to do
+	case "":
+		if err := encryptAndProvision(&params, j); err != nil {
+			return err
+		}
+	default:
+		if !params.OverwriteFilesystem {
+			return fmt.Errorf("%s contains a %s filesystem, refusing to overwrite", params.Device, fstype)
+		}
+		if err := encryptAndProvision(&params, j); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(firstBootDoneFile), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(firstBootDoneFile, nil, 0600); err != nil {
+		return err
+	}
+	return j.finish()
+}
+
+// encryptAndProvision creates a LUKS2 container in the device using a new
+// random key, and seals that key.
+func encryptAndProvision(params *firstBootParams, j *journal) error {
+	key := make([]byte, 64)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("cannot create key: %v", err)
+	}
+
+	if err := sb.InitializeLUKS2Container(params.Device, params.Label, key, nil); err != nil {
+		return fmt.Errorf("cannot encrypt %s: %v", params.Device, err)
+	}
+	if err := j.record(stepLUKSFormatted); err != nil {
+		return err
+	}
+
+	_, err := provision(&params.initialProvisionParams, key, j)
+	return err
+}
+
+// writeFirstBootUnit writes the systemd unit that runs the first boot
+// provisioning to the given directory.
+func writeFirstBootUnit(dir string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	unit := strings.Join([]string{
+		"[Unit]",
+		"Description=Encrypt and provision the data partition on first boot",
+		"DefaultDependencies=no",
+		"ConditionPathExists=!" + defaultFirstBootDoneFile,
+		"ConditionPathExists=" + defaultFirstBootParamsFile,
+		"After=systemd-udev-settle.service",
+		"Before=initrd-fs.target",
+		"",
+		"[Service]",
+		"Type=oneshot",
+		"RemainAfterExit=yes",
+		"ExecStart=" + exe + " --first-boot",
+		"",
+		"[Install]",
+		"WantedBy=initrd.target",
+		"",
+	}, "\n")
+
+	path := filepath.Join(dir, firstBootUnitName)
+	if err := ioutil.WriteFile(path, []byte(unit), 0644); err != nil {
+		return err
+	}
+	// files are created with a restrictive umask
+	return os.Chmod(path, 0644)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/snapcore/snapd/fdehelper"
+)
+
+// model grades, from the least to the most strict
+const (
+	gradeDangerous = "dangerous"
+	gradeSigned    = "signed"
+	gradeSecured   = "secured"
+)
+
+// the EFI variable with the secure boot state
+const secureBootVar = "/sys/firmware/efi/efivars/SecureBoot-8be4df61-93ca-11d2-aa0d-00e098032b8c"
+
+// gradePolicy is the behavior enforced by the helper for a model grade.
+type gradePolicy struct {
+	grade string
+	// requireSecureBoot refuses sealing on UEFI platforms without
+	// secure boot enabled.
+	requireSecureBoot bool
+	// allowOverrides permits settings that weaken the protection, like
+	// using TPMs with known firmware issues or sealing to PCR values
+	// provided by the caller.
+	allowOverrides bool
+	// allowRecoveryKeyOnly permits provisioning without a sealed key,
+	// so volumes are unlocked with the recovery key.
+	allowRecoveryKeyOnly bool
+}
+
+var gradePolicies = []*gradePolicy{
+	{grade: gradeDangerous, allowOverrides: true, allowRecoveryKeyOnly: true},
+	{grade: gradeSigned, requireSecureBoot: true, allowOverrides: true},
+	{grade: gradeSecured, requireSecureBoot: true},
+}
+
+// gradePolicyForModels returns the policy of the most strict grade of the
+// given models. Models without grade are handled as signed.
+func gradePolicyForModels(models []*fdehelper.ModelParams) (*gradePolicy, error) {
+	policy := 0
+	if len(models) == 0 {
+		policy = 1
+	}
+	for _, m := range models {
+		grade := string(m.Grade)
+		if grade == "" {
+			grade = gradeSigned
+		}
+		found := false
+		for i, gp := range gradePolicies {
+			if gp.grade == grade {
+				if i > policy {
+					policy = i
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown model grade %q", grade)
+		}
+	}
+	return gradePolicies[policy], nil
+}
+
+// checkSecureBootEnabled returns an error if the firmware doesn't report
+// secure boot as enabled.
+func checkSecureBootEnabled() error {
+	data, err := ioutil.ReadFile(secureBootVar)
+	if err != nil {
+		return fmt.Errorf("cannot read secure boot state: %v", err)
+	}
+	// the variable data follows the 4-byte attributes
+	if len(data) < 5 || data[4] != 1 {
+		return fmt.Errorf("secure boot is not enabled")
+	}
+	return nil
+}
+
+// checkProvision verifies that the provisioning parameters are allowed by
+// the grade policy.
+func (gp *gradePolicy) checkProvision(params *initialProvisionParams) error {
+	if !gp.allowOverrides {
+		if ignoreTPMBlocklist {
+			return fmt.Errorf("cannot ignore the TPM blocklist for %s models", gp.grade)
+		}
+		if len(params.ExpectedPCRs) > 0 {
+			return fmt.Errorf("cannot seal to expected PCR values for %s models", gp.grade)
+		}
+	}
+	if params.RecoveryKeyOnly && !gp.allowRecoveryKeyOnly {
+		return fmt.Errorf("cannot provision without a sealed key for %s models", gp.grade)
+	}
+	if gp.requireSecureBoot && !params.RecoveryKeyOnly && (params.BootChainModel == "" || params.BootChainModel == bootChainUEFI) {
+		if err := checkSecureBootEnabled(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
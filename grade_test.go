@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/fdehelper"
+)
+
+func TestGradePolicyForModels(t *testing.T) {
+	tests := []struct {
+		summary string
+		grades  []asserts.ModelGrade
+		grade   string
+		err     string
+	}{
+		{summary: "no models", grade: gradeSigned},
+		{summary: "model without grade", grades: []asserts.ModelGrade{""}, grade: gradeSigned},
+		{summary: "dangerous", grades: []asserts.ModelGrade{"dangerous"}, grade: gradeDangerous},
+		{summary: "secured", grades: []asserts.ModelGrade{"secured"}, grade: gradeSecured},
+		{summary: "most strict grade", grades: []asserts.ModelGrade{"dangerous", "secured", "signed"}, grade: gradeSecured},
+		{summary: "unknown grade", grades: []asserts.ModelGrade{"signed", "bogus"}, err: `unknown model grade "bogus"`},
+	}
+	for _, tc := range tests {
+		var models []*fdehelper.ModelParams
+		for _, g := range tc.grades {
+			models = append(models, &fdehelper.ModelParams{Model: "test", Grade: g})
+		}
+		gp, err := gradePolicyForModels(models)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: expected error %q, got %v", tc.summary, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.summary, err)
+			continue
+		}
+		if gp.grade != tc.grade {
+			t.Errorf("%s: expected grade %s, got %s", tc.summary, tc.grade, gp.grade)
+		}
+	}
+}
+
+func TestGradePolicyCheckProvision(t *testing.T) {
+	tests := []struct {
+		summary string
+		grade   string
+		params  initialProvisionParams
+		err     string
+	}{
+		{
+			summary: "recovery key only for dangerous models",
+			grade:   gradeDangerous,
+			params:  initialProvisionParams{RecoveryKeyOnly: true},
+		}, {
+			summary: "recovery key only for signed models",
+			grade:   gradeSigned,
+			params:  initialProvisionParams{RecoveryKeyOnly: true},
+			err:     "cannot provision without a sealed key for signed models",
+		}, {
+			summary: "expected PCR values for dangerous models",
+			grade:   gradeDangerous,
+			params:  initialProvisionParams{ExpectedPCRs: []*expectedPCRValues{{}}},
+		}, {
+			summary: "expected PCR values for secured models",
+			grade:   gradeSecured,
+			params:  initialProvisionParams{ExpectedPCRs: []*expectedPCRValues{{}}},
+			err:     "cannot seal to expected PCR values for secured models",
+		}, {
+			summary: "no secure boot check without UEFI",
+			grade:   gradeSecured,
+			params:  initialProvisionParams{bootProfileParams: bootProfileParams{BootChainModel: bootChainUBoot}},
+		},
+	}
+	for _, tc := range tests {
+		var gp *gradePolicy
+		for _, p := range gradePolicies {
+			if p.grade == tc.grade {
+				gp = p
+			}
+		}
+		err := gp.checkProvision(&tc.params)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: expected error %q, got %v", tc.summary, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.summary, err)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/canonical/go-tpm2"
+	sb "github.com/snapcore/secboot"
+)
+
+// defaultHandlesFile records the persistent handles created by the helper.
+const defaultHandlesFile = "/run/mnt/ubuntu-boot/device/fde/handles.json"
+
+// purposes of the persistent handles created by the helper
+const (
+	handlePurposeSRK              = "srk"
+	handlePurposeAK               = "attestation-key"
+	handlePurposeLockoutAuth      = "lockout-auth"
+	handlePurposePCRPolicyCounter = "pcr-policy-counter"
+	handlePurposeAssetVersion     = "asset-version-counter"
+	handlePurposeAssetVersionBase = "asset-version-base"
+	handlePurposeBootPhase        = "boot-phase"
+	handlePurposePolicyRevision   = "policy-revision"
+	handlePurposeRecoveryFailures = "recovery-failures"
+)
+
+// trackedHandle is a persistent object or NV index created by the helper.
+type trackedHandle struct {
+	Handle  tpm2.Handle `json:"handle"`
+	Purpose string      `json:"purpose"`
+}
+
+// handleRegistry lists the persistent handles created by the helper, so
+// they can be found and removed when no longer used.
+type handleRegistry struct {
+	Handles []*trackedHandle `json:"handles"`
+}
+
+func readHandleRegistry() (*handleRegistry, error) {
+	r := &handleRegistry{}
+	data, err := ioutil.ReadFile(handlesFile)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read handle registry: %v", err)
+	}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("cannot parse handle registry: %v", err)
+	}
+	return r, nil
+}
+
+func (r *handleRegistry) write() error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(handlesFile), 0700); err != nil {
+		return err
+	}
+	tmp := handlesFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("cannot write handle registry: %v", err)
+	}
+	return os.Rename(tmp, handlesFile)
+}
+
+func (r *handleRegistry) find(handle tpm2.Handle) *trackedHandle {
+	for _, th := range r.Handles {
+		if th.Handle == handle {
+			return th
+		}
+	}
+	return nil
+}
+
+// trackHandle records a persistent handle created by the helper. It must be
+// called before the handle is created, so handles left behind by a failed
+// operation are known.
+func trackHandle(handle tpm2.Handle, purpose string) error {
+	r, err := readHandleRegistry()
+	if err != nil {
+		return err
+	}
+	if th := r.find(handle); th != nil {
+		if th.Purpose == purpose {
+			return nil
+		}
+		th.Purpose = purpose
+	} else {
+		r.Handles = append(r.Handles, &trackedHandle{Handle: handle, Purpose: purpose})
+	}
+	return r.write()
+}
+
+// untrackHandle removes a persistent handle from the registry.
+func untrackHandle(handle tpm2.Handle) error {
+	r, err := readHandleRegistry()
+	if err != nil {
+		return err
+	}
+	for i, th := range r.Handles {
+		if th.Handle == handle {
+			r.Handles = append(r.Handles[:i], r.Handles[i+1:]...)
+			return r.write()
+		}
+	}
+	return nil
+}
+
+// counterKeyFile returns the sealed key using the given PCR policy counter.
+func counterKeyFile(handle tpm2.Handle) (string, error) {
+	if handle == defaultPCRPolicyCounterHandle {
+		return sealedKeyFile, nil
+	}
+	idx, err := readVolumeKeyIndex()
+	if err != nil {
+		return "", err
+	}
+	for name, e := range idx.Keys {
+		if e.PCRPolicyCounterHandle == handle {
+			return volumeKeyFile(name), nil
+		}
+	}
+	return "", nil
+}
+
+// orphaned returns true if nothing uses the handle anymore, e.g. a PCR
+// policy counter left behind by a failed provisioning.
+func (th *trackedHandle) orphaned() (bool, error) {
+	if th.Purpose != handlePurposePCRPolicyCounter {
+		return false, nil
+	}
+	path, err := counterKeyFile(th.Handle)
+	if err != nil {
+		return false, err
+	}
+	if path == "" {
+		return true, nil
+	}
+	_, err = os.Stat(path)
+	return os.IsNotExist(err), nil
+}
+
+// handleInfo describes a persistent handle created by the helper.
+type handleInfo struct {
+	Handle  uint32 `json:"handle"`
+	Purpose string `json:"purpose"`
+	// Present is false if the handle no longer exists in the TPM.
+	Present  bool `json:"present"`
+	Orphaned bool `json:"orphaned,omitempty"`
+}
+
+type listHandlesResponse struct {
+	Handles []*handleInfo `json:"handles"`
+	// PersistentAvailable is the number of persistent objects that can
+	// still be created in the TPM.
+	PersistentAvailable uint32 `json:"persistent-available"`
+}
+
+// handleInfos returns the state of the handles in the registry.
+func handleInfos(tpm *sb.TPMConnection, r *handleRegistry) ([]*handleInfo, error) {
+	infos := make([]*handleInfo, 0, len(r.Handles))
+	for _, th := range r.Handles {
+		info := &handleInfo{Handle: uint32(th.Handle), Purpose: th.Purpose}
+		_, err := tpm.CreateResourceContextFromTPM(th.Handle)
+		switch {
+		case tpm2.IsResourceUnavailableError(err, th.Handle):
+		case err != nil:
+			return nil, fmt.Errorf("cannot access handle %#x: %v", uint32(th.Handle), err)
+		default:
+			info.Present = true
+		}
+		if info.Present {
+			if info.Orphaned, err = th.orphaned(); err != nil {
+				return nil, err
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// listHandles writes the persistent handles created by the helper to stdout.
+func listHandles() error {
+	r, err := readHandleRegistry()
+	if err != nil {
+		return err
+	}
+
+	tpm, err := connectTPM()
+	if err != nil {
+		return fmt.Errorf("cannot connect to TPM: %v", err)
+	}
+	defer tpm.Close()
+
+	var resp listHandlesResponse
+	if resp.Handles, err = handleInfos(tpm, r); err != nil {
+		return err
+	}
+	if resp.PersistentAvailable, err = tpm.GetCapabilityTPMProperty(tpm2.PropertyHRPersistentAvail); err != nil {
+		return fmt.Errorf("cannot read available persistent handles: %v", err)
+	}
+	return writeResponse(resp)
+}
+
+type evictHandleParams struct {
+	// Handle is the handle to remove. It must have been created by the
+	// helper.
+	Handle *uint32 `json:"handle,omitempty"`
+	// Orphaned removes all handles no longer in use instead.
+	Orphaned bool `json:"orphaned,omitempty"`
+	// Force allows removing a handle that is still in use.
+	Force bool `json:"force,omitempty"`
+}
+
+// evictTPMHandle removes a persistent object or undefines an NV index.
+func evictTPMHandle(tpm *sb.TPMConnection, handle tpm2.Handle) error {
+	rc, err := tpm.CreateResourceContextFromTPM(handle)
+	if tpm2.IsResourceUnavailableError(err, handle) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot access handle %#x: %v", uint32(handle), err)
+	}
+	if handle.Type() == tpm2.HandleTypeNVIndex {
+		err = tpm.NVUndefineSpace(tpm.OwnerHandleContext(), rc, tpm.HmacSession())
+	} else {
+		_, err = tpm.EvictControl(tpm.OwnerHandleContext(), rc, handle, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot evict handle %#x: %v", uint32(handle), err)
+	}
+	return nil
+}
+
+// evictHandle removes persistent handles created by the helper.
+func evictHandle(p []byte) error {
+	var params evictHandleParams
+	if err := json.Unmarshal(p, &params); err != nil {
+		return err
+	}
+	if (params.Handle == nil) == !params.Orphaned {
+		return fmt.Errorf("either a handle or orphaned handles must be specified")
+	}
+
+	r, err := readHandleRegistry()
+	if err != nil {
+		return err
+	}
+
+	tpm, err := connectTPM()
+	if err != nil {
+		return fmt.Errorf("cannot connect to TPM: %v", err)
+	}
+	defer tpm.Close()
+
+	var handles []*trackedHandle
+	if params.Handle != nil {
+		th := r.find(tpm2.Handle(*params.Handle))
+		if th == nil {
+			return fmt.Errorf("handle %#x was not created by the helper", *params.Handle)
+		}
+		orphaned, err := th.orphaned()
+		if err != nil {
+			return err
+		}
+		if !orphaned && !params.Force {
+			return fmt.Errorf("handle %#x is in use as %s", *params.Handle, th.Purpose)
+		}
+		handles = append(handles, th)
+	} else {
+		for _, th := range r.Handles {
+			orphaned, err := th.orphaned()
+			if err != nil {
+				return err
+			}
+			if orphaned {
+				handles = append(handles, th)
+			}
+		}
+	}
+
+	for _, th := range handles {
+		if err := evictTPMHandle(tpm, th.Handle); err != nil {
+			return err
+		}
+		if err := untrackHandle(th.Handle); err != nil {
+			return err
+		}
+		logf("evicted %s handle %#x", th.Purpose, uint32(th.Handle))
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	sb "github.com/snapcore/secboot"
+)
+
+const (
+	harnessTPMDevice  = "/dev/tpm0"
+	harnessVolumeName = "fde-helper-harness"
+	harnessImageSize  = 64 * 1024 * 1024
+)
+
+// harnessResult is the outcome of a test harness step.
+type harnessResult struct {
+	Step  string `json:"step"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	// Response is the response of the operation run by the step, if
+	// any.
+	Response json.RawMessage `json:"response,omitempty"`
+}
+
+// harness runs the full provision, update and unlock cycle against a
+// swtpm instance and a loopback-backed LUKS2 volume.
+type harness struct {
+	dir     string
+	swtpm   *exec.Cmd
+	loopDev string
+	results []harnessResult
+	// response is the response captured by the running step.
+	response json.RawMessage
+}
+
+func (h *harness) run(step string, f func() error) error {
+	h.response = nil
+	err := f()
+	res := harnessResult{Step: step, OK: err == nil, Response: h.response}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	h.results = append(h.results, res)
+	return err
+}
+
+// captureResponse runs f with the responses written in JSON to a buffer
+// instead of the response output, so the response of an operation run by
+// a step doesn't end up in the middle of the harness results.
+func (h *harness) captureResponse(f func() error) error {
+	var buf bytes.Buffer
+	output, format := responseOutput, outputFormat
+	responseOutput, outputFormat = &buf, formatJSON
+	defer func() {
+		responseOutput, outputFormat = output, format
+	}()
+	err := f()
+	if r := bytes.TrimSpace(buf.Bytes()); len(r) > 0 {
+		h.response = json.RawMessage(r)
+	}
+	return err
+}
+
+// startSWTPM starts a swtpm instance exposed by the kernel through a vTPM
+// proxy device, so it can be used as the default TPM.
+func (h *harness) startSWTPM() error {
+	if _, err := os.Stat(harnessTPMDevice); err == nil {
+		return fmt.Errorf("%s already exists, refusing to run on a system with a TPM", harnessTPMDevice)
+	}
+
+	stateDir := filepath.Join(h.dir, "swtpm")
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return err
+	}
+	h.swtpm = exec.Command("swtpm", "chardev", "--vtpm-proxy", "--tpm2",
+		"--tpmstate", "dir="+stateDir, "--flags", "not-need-init,startup-clear")
+	h.swtpm.Stderr = os.Stderr
+	if err := h.swtpm.Start(); err != nil {
+		return fmt.Errorf("cannot start swtpm: %v", err)
+	}
+
+	for i := 0; i < 50; i++ {
+		if _, err := os.Stat(harnessTPMDevice); err == nil {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("timeout waiting for %s", harnessTPMDevice)
+}
+
+func (h *harness) setupLoopDevice() error {
+	image := filepath.Join(h.dir, "volume.img")
+	f, err := os.Create(image)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(harnessImageSize)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	output, err := exec.Command("losetup", "--find", "--show", image).Output()
+	if err != nil {
+		return fmt.Errorf("cannot set up loop device: %v", err)
+	}
+	h.loopDev = strings.TrimSpace(string(output))
+	return nil
+}
+
+func (h *harness) cleanup() {
+	exec.Command("cryptsetup", "close", harnessVolumeName).Run()
+	if h.loopDev != "" {
+		exec.Command("losetup", "-d", h.loopDev).Run()
+	}
+	if h.swtpm != nil && h.swtpm.Process != nil {
+		h.swtpm.Process.Kill()
+		h.swtpm.Wait()
+	}
+	os.RemoveAll(h.dir)
+}
+
+// runTestHarness runs the end-to-end test cycle and writes the results to
+// stdout. If no PCR profile is given in the parameters, the key is sealed
+// to the initial value of PCR 7.
+func runTestHarness(p []byte) error {
+	var params initialProvisionParams
+	if err := unmarshalOptionalParams(p, &params); err != nil {
+		return err
+	}
+	if len(params.ExpectedPCRs) == 0 {
+		params.ExpectedPCRs = []*expectedPCRValues{
+			{Values: map[int]string{7: hex.EncodeToString(make([]byte, 32))}},
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "fde-helper-harness")
+	if err != nil {
+		return err
+	}
+	h := &harness{dir: dir}
+	defer h.cleanup()
+	setRootDir(filepath.Join(dir, "root"))
+
+	key := make([]byte, 64)
+	steps := []struct {
+		name string
+		f    func() error
+	}{
+		{"start-swtpm", h.startSWTPM},
+		{"setup-loop-device", h.setupLoopDevice},
+		{"create-volume", func() error {
+			if _, err := rand.Read(key); err != nil {
+				return err
+			}
+			return sb.InitializeLUKS2Container(h.loopDev, harnessVolumeName, key, nil)
+		}},
+		{"initial-provision", func() error {
+			j, err := openJournal(journalFile)
+			if err != nil {
+				return err
+			}
+			if _, err := provision(&params, key, j); err != nil {
+				return err
+			}
+			return j.finish()
+		}},
+		{"update", func() error {
+			// the update adds a branch, so the key is really resealed
+			// and the unlock uses the new policy
+			sets := append([]*expectedPCRValues{
+				{Values: map[int]string{7: hex.EncodeToString(bytes.Repeat([]byte{0xff}, 32))}},
+			}, params.ExpectedPCRs...)
+			pcrProfile, err := buildExpectedPCRProtectionProfile(sets)
+			if err != nil {
+				return err
+			}
+			changed, err := reseal(pcrProfile, nil, false)
+			if err != nil {
+				return err
+			}
+			if !changed {
+				return fmt.Errorf("the key was not resealed")
+			}
+			return nil
+		}},
+		{"unlock", func() error {
+			var params unlockParams
+			params.VolumeName = harnessVolumeName
+			params.SourceDevicePath = h.loopDev
+			p, err := json.Marshal(&params)
+			if err != nil {
+				return err
+			}
+			return h.captureResponse(func() error {
+				return unlock(p)
+			})
+		}},
+	}
+
+	var failed error
+	for _, step := range steps {
+		if failed = h.run(step.name, step.f); failed != nil {
+			break
+		}
+	}
+
+	if err := writeResponse(h.results); err != nil {
+		return err
+	}
+	if failed != nil {
+		return fmt.Errorf("test harness failed")
+	}
+	return nil
+}
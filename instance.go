@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// defaultInstanceLockFile is locked by the running instance, so operations
+// don't compete for the TPM device or see the files of the helper while
+// another operation changes them.
+const defaultInstanceLockFile = "/run/fde-helper/lock"
+
+// instanceLockInterval is how often the lock is tried while waiting.
+const instanceLockInterval = 100 * time.Millisecond
+
+// instanceLock keeps the lock file open, the lock is released when the
+// helper exits.
+var instanceLock *os.File
+
+// lockingNeeded returns true if the selected operation must not run
+// concurrently with other instances.
+func (opt *options) lockingNeeded() bool {
+	return opt.privileges() != privilegesNone && !opt.ListBackends
+}
+
+// lockInstance waits until no other instance of the helper is running, for
+// up to the given number of seconds, or fails immediately if the timeout
+// is zero.
+func lockInstance(timeout int) error {
+	if err := os.MkdirAll(filepath.Dir(instanceLockFile), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(instanceLockFile, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot open lock file: %v", err)
+	}
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+	waiting := false
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return fmt.Errorf("cannot lock %s: %v", instanceLockFile, err)
+		}
+		if !time.Now().Before(deadline) {
+			f.Close()
+			return &codedError{code: errorCodeBusy, err: fmt.Errorf("another instance%s is running", lockHolder(instanceLockFile))}
+		}
+		if !waiting {
+			logf("waiting for another instance%s to finish", lockHolder(instanceLockFile))
+			waiting = true
+		}
+		time.Sleep(instanceLockInterval)
+	}
+
+	// record the holder for the messages of waiting instances
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	}
+	instanceLock = f
+	return nil
+}
+
+// lockHolder describes the process holding the lock, if known.
+func lockHolder(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	pid := string(bytes.TrimSpace(data))
+	if pid == "" {
+		return ""
+	}
+	return " (pid " + pid + ")"
+}
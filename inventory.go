@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/canonical/go-tpm2"
+	sb "github.com/snapcore/secboot"
+)
+
+// kinds of TPM implementations
+const (
+	tpmTypeDiscrete = "discrete"
+	tpmTypeFirmware = "firmware"
+	tpmTypeVirtual  = "virtual"
+	tpmTypeUnknown  = "unknown"
+)
+
+// tpmTypesByManufacturer maps TCG vendor IDs to the kind of TPM they
+// manufacture.
+var tpmTypesByManufacturer = map[string]string{
+	"AMD":  tpmTypeFirmware,
+	"INTC": tpmTypeFirmware,
+	"QCOM": tpmTypeFirmware,
+	"MSFT": tpmTypeFirmware,
+	"IFX":  tpmTypeDiscrete,
+	"STM":  tpmTypeDiscrete,
+	"NTC":  tpmTypeDiscrete,
+	"NTZ":  tpmTypeDiscrete,
+	"ATML": tpmTypeDiscrete,
+	"BRCM": tpmTypeDiscrete,
+	"IBM":  tpmTypeVirtual,
+	"GOOG": tpmTypeVirtual,
+}
+
+// tpmInventory describes the TPM hardware and firmware.
+type tpmInventory struct {
+	Manufacturer    string `json:"manufacturer"`
+	VendorString    string `json:"vendor-string"`
+	FirmwareVersion string `json:"firmware-version"`
+	SpecFamily      string `json:"spec-family"`
+	SpecLevel       uint32 `json:"spec-level"`
+	SpecRevision    string `json:"spec-revision"`
+	Type            string `json:"type"`
+}
+
+// propertyString decodes a TPM property containing up to 4 ASCII characters.
+func propertyString(value uint32) string {
+	b := []byte{byte(value >> 24), byte(value >> 16), byte(value >> 8), byte(value)}
+	return strings.TrimRight(string(b), "\x00 ")
+}
+
+// readTPMInventory queries the fixed properties that identify the TPM.
+func readTPMInventory(tpm *sb.TPMConnection) (*tpmInventory, error) {
+	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyFamilyIndicator, uint32(tpm2.PropertyFirmwareVersion2-tpm2.PropertyFamilyIndicator+1))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read TPM properties: %v", err)
+	}
+
+	values := make(map[tpm2.Property]uint32, len(props))
+	for _, prop := range props {
+		values[prop.Property] = prop.Value
+	}
+
+	var vendor strings.Builder
+	for p := tpm2.PropertyVendorString1; p <= tpm2.PropertyVendorString4; p++ {
+		vendor.WriteString(propertyString(values[p]))
+	}
+	fw1, fw2 := values[tpm2.PropertyFirmwareVersion1], values[tpm2.PropertyFirmwareVersion2]
+	revision := values[tpm2.PropertyRevision]
+
+	inv := &tpmInventory{
+		Manufacturer:    propertyString(values[tpm2.PropertyManufacturer]),
+		VendorString:    vendor.String(),
+		FirmwareVersion: fmt.Sprintf("%d.%d.%d.%d", fw1>>16, fw1&0xffff, fw2>>16, fw2&0xffff),
+		SpecFamily:      propertyString(values[tpm2.PropertyFamilyIndicator]),
+		SpecLevel:       values[tpm2.PropertyLevel],
+		SpecRevision:    fmt.Sprintf("%d.%02d", revision/100, revision%100),
+		Type:            tpmTypeUnknown,
+	}
+	if t, ok := tpmTypesByManufacturer[inv.Manufacturer]; ok {
+		inv.Type = t
+	}
+	return inv, nil
+}
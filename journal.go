@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/canonical/go-tpm2"
+	sb "github.com/snapcore/secboot"
+)
+
+const defaultJournalFile = "/run/mnt/ubuntu-boot/fde-provision-journal"
+
+// provisioning steps recorded in the journal
+const (
+	stepLUKSFormatted  = "luks-formatted"
+	stepTPMProvisioned = "tpm-provisioned"
+	stepSealStarted    = "seal-started"
+	stepKeySealed      = "key-sealed"
+)
+
+// journal records the provisioning steps already performed, so an
+// interrupted provisioning can be resumed or rolled back.
+type journal struct {
+	path  string
+	Steps []string `json:"steps"`
+}
+
+// openJournal loads the provisioning journal, or creates an empty one if it
+// doesn't exist.
+func openJournal(path string) (*journal, error) {
+	j := &journal{path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read provisioning journal: %v", err)
+	}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, fmt.Errorf("cannot parse provisioning journal: %v", err)
+	}
+	return j, nil
+}
+
+// inProgress returns true if a previous provisioning was interrupted.
+func (j *journal) inProgress() bool {
+	return len(j.Steps) > 0
+}
+
+// done returns true if the given step was already performed.
+func (j *journal) done(step string) bool {
+	for _, s := range j.Steps {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+// record adds the given step to the journal and writes it to disk.
+func (j *journal) record(step string) error {
+	if j.done(step) {
+		return nil
+	}
+	j.Steps = append(j.Steps, step)
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0755); err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("cannot write provisioning journal: %v", err)
+	}
+	return os.Rename(tmp, j.path)
+}
+
+// finish removes the journal after a successful provisioning.
+func (j *journal) finish() error {
+	j.Steps = nil
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// rollbackSeal removes the artifacts of an interrupted key sealing: the
+// partially written sealed key files and metadata and the PCR policy
+// counter.
+func rollbackSeal(tpm *sb.TPMConnection) error {
+	for _, path := range []string{sealedKeyFile, saveSealedKeyFile, keyMetadataFile(sealedKeyFile), backupKeyFile(sealedKeyFile), backupKeyFile(saveSealedKeyFile)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	index, err := tpm.CreateResourceContextFromTPM(pcrPolicyCounterHandle)
+	if tpm2.IsResourceUnavailableError(err, pcrPolicyCounterHandle) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, tpm.HmacSession()); err != nil {
+		return fmt.Errorf("cannot undefine PCR policy counter: %v", err)
+	}
+	return untrackHandle(pcrPolicyCounterHandle)
+}
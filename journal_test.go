@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestJournalReplay(t *testing.T) {
+	tests := []struct {
+		summary string
+		record  []string
+		done    []string
+		pending []string
+	}{
+		{
+			summary: "nothing recorded",
+			pending: []string{stepLUKSFormatted, stepTPMProvisioned, stepSealStarted, stepKeySealed},
+		}, {
+			summary: "interrupted while sealing",
+			record:  []string{stepLUKSFormatted, stepTPMProvisioned, stepSealStarted},
+			done:    []string{stepLUKSFormatted, stepTPMProvisioned, stepSealStarted},
+			pending: []string{stepKeySealed},
+		}, {
+			summary: "steps recorded twice",
+			record:  []string{stepTPMProvisioned, stepTPMProvisioned},
+			done:    []string{stepTPMProvisioned},
+			pending: []string{stepLUKSFormatted, stepSealStarted, stepKeySealed},
+		},
+	}
+	for _, tc := range tests {
+		dir, err := ioutil.TempDir("", "fde-helper-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "run", "journal")
+
+		j, err := openJournal(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, step := range tc.record {
+			if err := j.record(step); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// a new run sees the steps of the interrupted one
+		replayed, err := openJournal(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if replayed.inProgress() != (len(tc.done) > 0) {
+			t.Errorf("%s: unexpected in progress state %v", tc.summary, replayed.inProgress())
+		}
+		if len(tc.done) > 0 && !reflect.DeepEqual(replayed.Steps, tc.done) {
+			t.Errorf("%s: expected steps %v, got %v", tc.summary, tc.done, replayed.Steps)
+		}
+		for _, step := range tc.done {
+			if !replayed.done(step) {
+				t.Errorf("%s: step %s not done", tc.summary, step)
+			}
+		}
+		for _, step := range tc.pending {
+			if replayed.done(step) {
+				t.Errorf("%s: step %s unexpectedly done", tc.summary, step)
+			}
+		}
+
+		if err := replayed.finish(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s: journal not removed: %v", tc.summary, err)
+		}
+		finished, err := openJournal(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if finished.inProgress() {
+			t.Errorf("%s: journal still in progress after finishing", tc.summary)
+		}
+	}
+}
+
+func TestOpenJournalInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fde-helper-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+	if err := ioutil.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openJournal(path); err == nil {
+		t.Fatal("expected error parsing a broken journal")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+)
+
+// keyDerivationHKDF derives the LUKS key from the sealed secret with
+// HKDF-SHA256, using the volume UUID as salt.
+const keyDerivationHKDF = "hkdf-sha256"
+
+// context of the derived LUKS keys
+const volumeKeyInfo = "fde-helper luks2 keyslot key"
+
+// hkdfSHA256 derives a key of the given size from the secret, as specified
+// in RFC 5869.
+func hkdfSHA256(secret, salt, info []byte, size int) []byte {
+	extractor := hmac.New(sha256.New, salt)
+	extractor.Write(secret)
+	prk := extractor.Sum(nil)
+
+	var out, t []byte
+	for i := byte(1); len(out) < size; i++ {
+		expander := hmac.New(sha256.New, prk)
+		expander.Write(t)
+		expander.Write(info)
+		expander.Write([]byte{i})
+		t = expander.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:size]
+}
+
+// pbkdf2SHA256 derives a key of the given size from the password with the
+// given number of iterations, as specified in RFC 8018.
+func pbkdf2SHA256(password, salt []byte, iterations, size int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var out []byte
+	for block := uint32(1); len(out) < size; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		out = append(out, t...)
+	}
+	return out[:size]
+}
+
+// deriveVolumeKey returns the LUKS key of the volume with the given UUID.
+// Each volume gets a different key, so the sealed secret of one volume
+// can't be used to open another.
+func deriveVolumeKey(secret []byte, uuid string) []byte {
+	return hkdfSHA256(secret, []byte(uuid), []byte(volumeKeyInfo), 64)
+}
+
+// volumeKeyForDevice returns the key to open the volume in the device with
+// the secret unsealed from a key with the given metadata.
+func volumeKeyForDevice(md *keyMetadata, secret []byte, device string) ([]byte, error) {
+	switch md.KeyDerivation {
+	case "":
+		return secret, nil
+	case keyDerivationHKDF:
+		if device == "" {
+			return nil, fmt.Errorf("device required to derive the volume key")
+		}
+		uuid, err := volumeUUID(device)
+		if err != nil {
+			return nil, err
+		}
+		if md.BootPhasePin {
+			pin, err := readBootPhasePin()
+			if err != nil {
+				return nil, err
+			}
+			secret = append(secret[:len(secret):len(secret)], pin...)
+		}
+		return deriveVolumeKey(secret, uuid), nil
+	}
+	return nil, fmt.Errorf("unsupported key derivation %q", md.KeyDerivation)
+}
+
+// enrollDerivedKey creates a new secret and adds the key derived from it and
+// the boot phase pin, if any, to the volume in the device, using the
+// existing key. The secret is returned to be sealed instead of the LUKS key.
+func enrollDerivedKey(existingKey []byte, device string, pin []byte) ([]byte, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("cannot create secret: %v", err)
+	}
+	uuid, err := volumeUUID(device)
+	if err != nil {
+		return nil, err
+	}
+	if uuid == "" {
+		return nil, fmt.Errorf("%s has no UUID", device)
+	}
+	key := deriveVolumeKey(append(secret[:len(secret):len(secret)], pin...), uuid)
+	if err := cryptsetupWithKeys(existingKey, key, "luksAddKey", "--key-file=-", device, "/dev/fd/3"); err != nil {
+		return nil, fmt.Errorf("cannot add derived key to %s: %v", device, err)
+	}
+	return secret, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// keyBackupDirs are the directories, e.g. in ubuntu-seed or the ESP, that
+// hold additional copies of the sealed keys and their metadata, so losing
+// the partition with the sealed keys doesn't require the recovery key.
+var keyBackupDirs []string
+
+// keyCopyFile returns the path of the copy of a sealed key file in the
+// given backup directory.
+func keyCopyFile(dir, keyFile string) string {
+	return filepath.Join(dir, filepath.Base(keyFile))
+}
+
+// copySealedKeysToBackupDirs copies the sealed key files and the metadata to
+// the backup directories. The directories may be on media that isn't
+// always writable, so failures are only reported.
+func copySealedKeysToBackupDirs() {
+	for _, dir := range keyBackupDirs {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			warnf("cannot copy sealed keys to %s: %v", dir, err)
+			continue
+		}
+		files := append(sealedKeyFiles(), keyMetadataFile(sealedKeyFile))
+		for _, path := range files {
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				continue
+			}
+			if err := copyKeyFile(path, keyCopyFile(dir, path)); err != nil {
+				warnf("cannot copy %s to %s: %v", path, dir, err)
+			}
+		}
+	}
+}
+
+// sealedKeyCopies returns the copies of a sealed key file in the order they
+// are tried: the backup next to it, then the copies in the backup
+// directories.
+func sealedKeyCopies(keyFile string) []string {
+	copies := []string{backupKeyFile(keyFile)}
+	for _, dir := range keyBackupDirs {
+		copies = append(copies, keyCopyFile(dir, keyFile))
+	}
+	return copies
+}
+
+// restoreSealedKey replaces an unreadable or missing sealed key file with
+// the first readable copy, and returns the path of the key file to use. If
+// the key file can't be written, e.g. because its partition is damaged, the
+// copy is used where it is.
+func restoreSealedKey(keyFile string) (string, error) {
+	var errs []string
+	for _, c := range sealedKeyCopies(keyFile) {
+		if _, err := readSealedKey(c); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", c, err))
+			continue
+		}
+		if err := copyKeyFile(c, keyFile); err != nil {
+			warnf("cannot restore %s: %v, using %s", keyFile, err, c)
+			return c, nil
+		}
+		// the backup next to the key shares its metadata
+		if md := keyMetadataFile(c); c != backupKeyFile(keyFile) {
+			if _, err := os.Stat(md); err == nil {
+				if err := copyKeyFile(md, keyMetadataFile(keyFile)); err != nil {
+					warnf("cannot restore the metadata of %s: %v", keyFile, err)
+				}
+			}
+		}
+		logf("restored %s from %s", keyFile, c)
+		return keyFile, nil
+	}
+	return "", fmt.Errorf("no readable copy of the sealed key: %s", strings.Join(errs, "; "))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	sb "github.com/snapcore/secboot"
+)
+
+// keyDataFormat identifies sealed keys converted to the key data format of
+// the current secboot version by upgradeKeyData. Keys sealed or resealed by
+// the path based secboot functions are sealed key objects, and have no
+// format in their metadata.
+const keyDataFormat = "secboot-key-data"
+
+// sealedKeyObjectMagic is the magic number at the start of files in the
+// legacy sealed key object format.
+const sealedKeyObjectMagic uint32 = 0x55534b24
+
+type upgradeKeyDataResponse struct {
+	// Upgraded is false if the sealed key was already in the current
+	// format.
+	Upgraded bool `json:"upgraded"`
+}
+
+// isKeyData returns true if the sealed key file is in the key data format
+// instead of the legacy sealed key object format.
+func isKeyData(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	var magic uint32
+	if err := binary.Read(f, binary.BigEndian, &magic); err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	return magic != sealedKeyObjectMagic, nil
+}
+
+// readKeyData reads a sealed key file in the key data format.
+func readKeyData(path string) (*sb.KeyData, error) {
+	r, err := sb.NewFileKeyDataReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return sb.ReadKeyData(r)
+}
+
+// readSealedKey reads a sealed key file in either format. All readers of
+// sealed keys must use it, as keys may have been upgraded to the key data
+// format.
+func readSealedKey(path string) (*sb.SealedKeyObject, error) {
+	kd, err := isKeyData(path)
+	if err != nil {
+		return nil, err
+	}
+	if !kd {
+		return sb.ReadSealedKeyObject(path)
+	}
+	d, err := readKeyData(path)
+	if err != nil {
+		return nil, err
+	}
+	return sb.NewSealedKeyObjectFromKeyData(d)
+}
+
+// convertToKeyData rewrites the sealed key files still in the sealed key
+// object format in the key data format, and returns whether any file was
+// converted.
+func convertToKeyData() (bool, error) {
+	converted := false
+	for _, path := range sealedKeyFiles() {
+		kd, err := isKeyData(path)
+		if err != nil {
+			return false, err
+		}
+		if kd {
+			continue
+		}
+		d, err := sb.NewKeyDataFromSealedKeyObjectFile(path)
+		if err != nil {
+			return false, fmt.Errorf("cannot convert %s: %v", path, err)
+		}
+		if err := d.WriteAtomic(sb.NewFileKeyDataWriter(path)); err != nil {
+			return false, fmt.Errorf("cannot write key data: %v", err)
+		}
+		if err := secureFile(path); err != nil {
+			return false, err
+		}
+		converted = true
+	}
+	return converted, nil
+}
+
+// updateSealedKeysPolicy updates the PCR policy of the sealed keys, keeping
+// the format recorded in the metadata.
+func updateSealedKeysPolicy(tpm *sb.TPMConnection, md *keyMetadata, authKey sb.TPMPolicyAuthKey, pcrProfile *sb.PCRProtectionProfile) error {
+	if md.Format != keyDataFormat {
+		return sb.UpdateKeyPCRProtectionPolicyMultiple(tpm, sealedKeyFiles(), authKey, pcrProfile)
+	}
+
+	paths := sealedKeyFiles()
+	keys := make([]*sb.KeyData, 0, len(paths))
+	for _, path := range paths {
+		d, err := readKeyData(path)
+		if err != nil {
+			return fmt.Errorf("cannot read key data: %v", err)
+		}
+		keys = append(keys, d)
+	}
+	if err := sb.UpdateKeyDataPCRProtectionPolicy(tpm, authKey, pcrProfile, keys...); err != nil {
+		return err
+	}
+	for i, path := range paths {
+		if err := keys[i].WriteAtomic(sb.NewFileKeyDataWriter(path)); err != nil {
+			return fmt.Errorf("cannot write key data: %v", err)
+		}
+	}
+	return nil
+}
+
+// upgradeKeyData rewrites legacy sealed key objects in the current secboot
+// key data format.
+func upgradeKeyData() error {
+	if err := checkFileSecure(sealedKeyFile); err != nil {
+		return err
+	}
+	md, err := readKeyMetadata(sealedKeyFile)
+	if err != nil {
+		return err
+	}
+
+	converted, err := convertToKeyData()
+	if err != nil {
+		return err
+	}
+	if md.Format == keyDataFormat && !converted {
+		return writeResponse(&upgradeKeyDataResponse{Upgraded: false})
+	}
+
+	md.Format = keyDataFormat
+	if err := writeKeyMetadata(sealedKeyFile, md); err != nil {
+		return err
+	}
+	if err := backupSealedKeys(); err != nil {
+		return err
+	}
+	return writeResponse(&upgradeKeyDataResponse{Upgraded: true})
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+	sb "github.com/snapcore/secboot"
+	"github.com/snapcore/snapd/fdehelper"
+)
+
+// helperVersion is the version of the helper, set at build time with
+// -ldflags "-X main.helperVersion=<version>".
+var helperVersion = "unknown"
+
+// maximum number of policy changes kept in the key metadata
+const maxPolicyHistory = 32
+
+// modelIdentity identifies a model the key is sealed to.
+type modelIdentity struct {
+	BrandID string `json:"brand-id"`
+	Model   string `json:"model"`
+	Grade   string `json:"grade,omitempty"`
+}
+
+// policyRecord describes a change of the PCR policy of a sealed key.
+type policyRecord struct {
+	Time          time.Time `json:"time"`
+	Operation     string    `json:"operation"`
+	HelperVersion string    `json:"helper-version"`
+	ProfileDigest string    `json:"profile-digest"`
+	// PolicyCounter is the value of the PCR policy counter after the
+	// change, if it could be read.
+	PolicyCounter *uint64 `json:"policy-counter,omitempty"`
+}
+
+// keyProvenance records how a sealed key was created and how its policy
+// changed since, for status reports and forensic review.
+type keyProvenance struct {
+	Created       *time.Time `json:"created,omitempty"`
+	HelperVersion string     `json:"helper-version,omitempty"`
+	// Models are the models the key is currently sealed to, if known.
+	Models []*modelIdentity `json:"models,omitempty"`
+	// PCRs lists the PCRs of the current policy, by bank.
+	PCRs map[string][]int `json:"pcrs,omitempty"`
+	// History lists the most recent policy changes, oldest first.
+	History []*policyRecord `json:"history,omitempty"`
+}
+
+// keyMetadata contains information about a sealed key, stored next to it.
+type keyMetadata struct {
+	// ProfileDigest is the fingerprint of the PCR profile the key was
+	// last sealed to.
+	ProfileDigest string `json:"profile-digest,omitempty"`
+	// InputsDigest is the fingerprint of the model parameters and boot
+	// assets used to build that profile.
+	InputsDigest string `json:"inputs-digest,omitempty"`
+	// Phase is set when the key was provisioned using the factory and
+	// field split workflow.
+	Phase string `json:"phase,omitempty"`
+	// Format is the format of the sealed key file.
+	Format string `json:"format,omitempty"`
+	// WipeAfterFailures is the number of failed recovery key attempts
+	// after which the encrypted volume is erased, if set. The policy
+	// enforced is the one recorded in the TPM with the failure count.
+	WipeAfterFailures int `json:"wipe-after-failures,omitempty"`
+	// Duress is the duress PIN configuration, if set.
+	Duress *duressMetadata `json:"duress,omitempty"`
+	// RecoveryKeyOnly is set if no key was sealed, and volumes are
+	// unlocked with the recovery key.
+	RecoveryKeyOnly bool `json:"recovery-key-only,omitempty"`
+	// KeyDerivation is set if the sealed key is a secret the LUKS key
+	// is derived from, instead of the LUKS key itself.
+	KeyDerivation string `json:"key-derivation,omitempty"`
+	// SaveKeyDerivation is set if the key of the save volume is derived
+	// from the data key instead of being sealed.
+	SaveKeyDerivation *saveKeyDerivation `json:"save-key-derivation,omitempty"`
+	// BootPhasePin is set if the derived LUKS key also depends on the
+	// boot phase pin, which can only be read in the early boot.
+	BootPhasePin bool `json:"boot-phase-pin,omitempty"`
+	// Serial is the device identity the key is bound to, if any.
+	Serial *deviceSerial `json:"serial,omitempty"`
+	// PolicyVersion is the version of the policy constructs the key
+	// was sealed with.
+	PolicyVersion int `json:"policy-version,omitempty"`
+	// RecoverySystems lists the labels of the recovery systems the key
+	// is sealed to, if they were given.
+	RecoverySystems []string `json:"recovery-systems,omitempty"`
+
+	keyProvenance
+}
+
+// keyMetadataFile returns the path of the metadata file of a sealed key.
+func keyMetadataFile(keyFile string) string {
+	return keyFile + ".json"
+}
+
+// readKeyMetadata reads the metadata of the given sealed key. An empty
+// metadata is returned if the metadata file doesn't exist.
+func readKeyMetadata(keyFile string) (*keyMetadata, error) {
+	path := keyMetadataFile(keyFile)
+	var md keyMetadata
+	if err := checkFileSecure(path); err != nil {
+		if os.IsNotExist(err) {
+			return &md, nil
+		}
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &md); err != nil {
+		return nil, fmt.Errorf("cannot parse key metadata: %v", err)
+	}
+	return &md, nil
+}
+
+// writeKeyMetadata writes the metadata of the given sealed key.
+func writeKeyMetadata(keyFile string, md *keyMetadata) error {
+	data, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+	path := keyMetadataFile(keyFile)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("cannot write key metadata: %v", err)
+	}
+	if err := secureFile(tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// modelIdentities returns the identities of the given models.
+func modelIdentities(models []*fdehelper.ModelParams) []*modelIdentity {
+	ids := make([]*modelIdentity, 0, len(models))
+	for _, m := range models {
+		ids = append(ids, &modelIdentity{BrandID: m.BrandID, Model: m.Model, Grade: string(m.Grade)})
+	}
+	return ids
+}
+
+// recordPolicy records a change of the policy of the sealed key to the given
+// profile. The creation is recorded for the seal operation.
+func (md *keyMetadata) recordPolicy(tpm *sb.TPMConnection, operation string, pcrProfile *sb.PCRProtectionProfile, digest string) {
+	now := time.Now().UTC()
+	if md.Created == nil {
+		md.Created = &now
+	}
+	md.HelperVersion = helperVersion
+
+	if pcrs, _, err := pcrProfile.ComputePCRDigests(tpm.TPMContext, tpm2.HashAlgorithmSHA256); err == nil {
+		md.PCRs = map[string][]int{}
+		for _, s := range pcrs {
+			if name, err := hashAlgorithmName(s.Hash); err == nil {
+				md.PCRs[name] = s.Select
+			}
+		}
+	}
+
+	record := &policyRecord{
+		Time:          now,
+		Operation:     operation,
+		HelperVersion: helperVersion,
+		ProfileDigest: digest,
+	}
+	if index, err := tpm.CreateResourceContextFromTPM(pcrPolicyCounterHandle); err == nil {
+		if value, err := tpm.NVReadCounter(index, index, nil); err == nil {
+			record.PolicyCounter = &value
+		}
+	}
+	md.History = append(md.History, record)
+	if len(md.History) > maxPolicyHistory {
+		md.History = md.History[len(md.History)-maxPolicyHistory:]
+	}
+}
+
+// profileDigest computes a fingerprint of the PCR profile, based on the PCR
+// selection and the digests of the values it allows.
+func profileDigest(tpm *sb.TPMConnection, pcrProfile *sb.PCRProtectionProfile) (string, error) {
+	pcrs, digests, err := pcrProfile.ComputePCRDigests(tpm.TPMContext, tpm2.HashAlgorithmSHA256)
+	if err != nil {
+		return "", fmt.Errorf("cannot compute PCR digests: %v", err)
+	}
+	data, err := mu.MarshalToBytes(pcrs, digests)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:]), nil
+}
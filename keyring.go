@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// prefix of the descriptions of the keys cached in the kernel keyring
+	keyringDescriptionPrefix = "fde-helper:"
+
+	// default time in seconds a cached key is kept in the keyring
+	defaultKeyCacheTimeout = 60
+
+	// possessor can do everything, user can view, read and search
+	cachedKeyPerm = 0x3f0b0000
+)
+
+// keyringKey identifies a key placed in the kernel keyring, so callers can
+// manage its lifetime, e.g. revoke it with keyctl once all volumes are
+// unlocked.
+type keyringKey struct {
+	// ID is the serial number of the key.
+	ID          int    `json:"id"`
+	Keyring     string `json:"keyring"`
+	Description string `json:"description"`
+	// Timeout is the number of seconds until the key expires, if it
+	// was just added.
+	Timeout int `json:"timeout,omitempty"`
+}
+
+func keyringDescription(keyFile string) string {
+	return keyringDescriptionPrefix + keyFile
+}
+
+// cacheKey stores the key unsealed from the given key file in the user
+// keyring, so other volumes can be activated without unsealing it again.
+// The key expires after the given number of seconds.
+func cacheKey(keyFile string, key []byte, timeout int) (*keyringKey, error) {
+	description := keyringDescription(keyFile)
+	id, err := unix.AddKey("user", description, key, unix.KEY_SPEC_USER_KEYRING)
+	if err != nil {
+		return nil, fmt.Errorf("cannot add key to keyring: %v", err)
+	}
+	// the key is reported even if setting it up fails, so the caller
+	// can revoke it
+	k := &keyringKey{ID: id, Keyring: "user", Description: description}
+	if _, err := unix.KeyctlInt(unix.KEYCTL_SET_TIMEOUT, id, timeout, 0, 0); err != nil {
+		return k, fmt.Errorf("cannot set timeout of cached key: %v", err)
+	}
+	k.Timeout = timeout
+	if err := unix.KeyctlSetperm(id, cachedKeyPerm); err != nil {
+		return k, fmt.Errorf("cannot set permissions of cached key: %v", err)
+	}
+	return k, nil
+}
+
+// readCachedKey returns the key unsealed from the given key file, if it is
+// still in the user keyring.
+func readCachedKey(keyFile string) ([]byte, *keyringKey, error) {
+	description := keyringDescription(keyFile)
+	id, err := unix.KeyctlSearch(unix.KEY_SPEC_USER_KEYRING, "user", description, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot find cached key: %v", err)
+	}
+	size, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, nil, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read cached key: %v", err)
+	}
+	key := make([]byte, size)
+	if _, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, key, 0); err != nil {
+		return nil, nil, fmt.Errorf("cannot read cached key: %v", err)
+	}
+	return key, &keyringKey{ID: id, Keyring: "user", Description: description}, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+
+	sb "github.com/snapcore/secboot"
+	"golang.org/x/sys/unix"
+)
+
+// keyringTokenType is the type of the LUKS2 token built into cryptsetup
+// that reads the passphrase of a keyslot from the kernel keyring.
+const keyringTokenType = "luks2-keyring"
+
+// time in seconds the activation key stays in the keyring if it can't be
+// removed
+const activationKeyTimeout = 10
+
+// activationKeyDescription returns the description of the key activating
+// the volume with the given UUID, which is stored in its keyring token.
+func activationKeyDescription(uuid string) string {
+	return keyringDescriptionPrefix + "luks:" + uuid
+}
+
+// addKeyringToken adds a keyring token for the keyslot opened by the key,
+// so the volume can be activated by key description, and returns its ID.
+func addKeyringToken(devicePath string, key []byte, description string) (int, error) {
+	slot, err := keyslotForKey(devicePath, key)
+	if err != nil {
+		return 0, err
+	}
+	output, err := exec.Command("cryptsetup", "token", "add", "--key-description", description,
+		"--key-slot", fmt.Sprint(slot), devicePath).CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("cannot add %s token to %s: %v: %s", keyringTokenType, devicePath, err, bytes.TrimSpace(output))
+	}
+	h, err := readLUKSHeader(devicePath)
+	if err != nil {
+		return 0, err
+	}
+	t := h.tokenOfType(keyringTokenType)
+	if t == nil {
+		return 0, fmt.Errorf("cannot find the %s token of %s", keyringTokenType, devicePath)
+	}
+	return t.ID, nil
+}
+
+// activateWithKeyring activates the volume by placing the key in the
+// session keyring and letting cryptsetup find it by description through
+// the keyring token of the volume, which is added if needed. The key isn't
+// passed through pipes or command lines, and is removed from the keyring
+// once the volume is active. The ID of the token used is recorded in the
+// parameters, with the keyslot it opened.
+func activateWithKeyring(params *unlockParams, key []byte) error {
+	uuid, err := volumeUUID(params.SourceDevicePath)
+	if err != nil {
+		return err
+	}
+	if uuid == "" {
+		return fmt.Errorf("%s has no UUID", params.SourceDevicePath)
+	}
+	description := activationKeyDescription(uuid)
+
+	h, err := readLUKSHeader(params.SourceDevicePath)
+	if err != nil {
+		return err
+	}
+	var token *luksToken
+	if params.KeyringTokenID != nil {
+		if token = h.findToken(*params.KeyringTokenID); token == nil || token.Type != keyringTokenType {
+			return fmt.Errorf("%s has no %s token %d", params.SourceDevicePath, keyringTokenType, *params.KeyringTokenID)
+		}
+	} else {
+		token = h.tokenOfType(keyringTokenType)
+	}
+	var id int
+	if token != nil {
+		id = token.ID
+	} else if id, err = addKeyringToken(params.SourceDevicePath, key, description); err != nil {
+		return err
+	}
+	params.keyringTokenID = &id
+
+	// the session keyring is inherited by cryptsetup
+	keyID, err := unix.AddKey("user", description, key, unix.KEY_SPEC_SESSION_KEYRING)
+	if err != nil {
+		return fmt.Errorf("cannot add key to keyring: %v", err)
+	}
+	defer unix.KeyctlInt(unix.KEYCTL_REVOKE, keyID, 0, 0, 0)
+	if _, err := unix.KeyctlInt(unix.KEYCTL_SET_TIMEOUT, keyID, activationKeyTimeout, 0, 0); err != nil {
+		return fmt.Errorf("cannot set timeout of activation key: %v", err)
+	}
+
+	args := append([]string{"open", "--verbose", "--token-only", "--token-id", strconv.Itoa(id)}, params.cryptsetupArgs()...)
+	args = append(args, params.SourceDevicePath, params.VolumeName)
+	output, err := exec.Command("cryptsetup", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cannot activate volume with %s token: %v: %s", keyringTokenType, err, bytes.TrimSpace(output))
+	}
+	if m := keyslotUnlockedRegexp.FindSubmatch(output); m != nil {
+		if slot, err := strconv.Atoi(string(m[1])); err == nil {
+			params.keyslot = &slot
+		}
+	}
+	return nil
+}
+
+// activateWithKey activates the volume with the given key, by key
+// description if requested.
+func (params *unlockParams) activateWithKey(key []byte) error {
+	activate := func() error {
+		if params.KeyringActivation {
+			return activateWithKeyring(params, key)
+		}
+		return sb.ActivateVolumeWithKey(params.VolumeName, params.SourceDevicePath, key, params.volumeOptions(nil))
+	}
+	if params.deadline == nil {
+		return activate()
+	}
+	return params.deadline.activate(activate)
+}
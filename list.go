@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// backend used to protect the keys managed by the helper
+const backendTPM2 = "tpm2"
+
+type listParams struct {
+	// Devices lists the devices to report. If not specified, all LUKS
+	// volumes are reported.
+	Devices []string `json:"devices,omitempty"`
+}
+
+// volumeInfo describes the encryption state of a block device.
+type volumeInfo struct {
+	Device string      `json:"device"`
+	LUKS   bool        `json:"luks"`
+	Header *luksHeader `json:"header,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// enrollmentInfo describes a key sealed by the helper.
+type enrollmentInfo struct {
+	// Name addresses the secret in other operations.
+	Name      string `json:"name"`
+	SealedKey string `json:"sealed-key"`
+	// VolumeKey and UUID are set for per-volume keys.
+	VolumeKey      string `json:"volume-key,omitempty"`
+	UUID           string `json:"uuid,omitempty"`
+	Backend        string `json:"backend"`
+	PolicyRevision uint64 `json:"policy-revision"`
+}
+
+type listResponse struct {
+	Volumes     []*volumeInfo     `json:"volumes"`
+	Enrollments []*enrollmentInfo `json:"enrollments"`
+}
+
+// luksDevices returns all block devices containing a LUKS volume.
+func luksDevices() ([]string, error) {
+	output, err := exec.Command("blkid", "-t", "TYPE=crypto_LUKS", "-o", "device").Output()
+	if err != nil {
+		// blkid exits with status 2 if no device matches
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 2 {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cannot list LUKS devices: %v", err)
+	}
+	return strings.Fields(string(output)), nil
+}
+
+// list reports the LUKS volumes and the keys sealed by the helper.
+func list(p []byte) error {
+	var params listParams
+	if err := unmarshalOptionalParams(p, &params); err != nil {
+		return err
+	}
+
+	devices := params.Devices
+	if len(devices) == 0 {
+		var err error
+		if devices, err = luksDevices(); err != nil {
+			return err
+		}
+	}
+
+	resp := listResponse{
+		Volumes:     []*volumeInfo{},
+		Enrollments: []*enrollmentInfo{},
+	}
+	for _, device := range devices {
+		info := &volumeInfo{Device: device}
+		resp.Volumes = append(resp.Volumes, info)
+		fstype, err := partitionType(device)
+		if err != nil {
+			info.Error = err.Error()
+			continue
+		}
+		if info.LUKS = fstype == "crypto_LUKS"; !info.LUKS {
+			continue
+		}
+		if info.Header, err = readLUKSHeader(device); err != nil {
+			info.Error = err.Error()
+		}
+	}
+
+	// the revision is recorded in the TPM, the enrollments are listed
+	// without it if the TPM isn't available
+	var revision uint64
+	if tpm, err := connectTPM(); err == nil {
+		revision, err = readPolicyRevision(tpm)
+		tpm.Close()
+		if err != nil {
+			return err
+		}
+	}
+	secrets, err := listSecrets()
+	if err != nil {
+		return err
+	}
+	for _, s := range secrets {
+		info := &enrollmentInfo{
+			Name:      s.Name,
+			SealedKey: s.KeyFile,
+			Backend:   s.Backend,
+		}
+		if s.entry != nil {
+			info.VolumeKey = s.Name
+			info.UUID = s.entry.UUID
+		} else {
+			// the policy revision is only recorded for the
+			// global sealed key
+			if _, err := os.Stat(s.KeyFile); err != nil {
+				continue
+			}
+			info.PolicyRevision = revision
+		}
+		resp.Enrollments = append(resp.Enrollments, info)
+	}
+
+	return writeResponse(&resp)
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+
+	sb "github.com/snapcore/secboot"
+)
+
+// lockAccess locks access to the sealed keys and the lockout authorization
+// until the next boot, so they can't be used after the early boot stage is
+// finished.
+func lockAccess() error {
+	tpm, err := connectTPM()
+	if err != nil {
+		return fmt.Errorf("cannot connect to TPM: %v", err)
+	}
+	defer tpm.Close()
+
+	if err := sb.LockAccessToSealedKeys(tpm); err != nil {
+		return fmt.Errorf("cannot lock access to sealed keys: %v", err)
+	}
+	return lockLockoutAuth(tpm)
+}
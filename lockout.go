@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/canonical/go-tpm2"
+	sb "github.com/snapcore/secboot"
+)
+
+// lockoutAuthNVHandle is the NV index used to store the lockout
+// authorization value when it's not kept in the data partition.
+const lockoutAuthNVHandle tpm2.Handle = 0x01880011
+
+// lockout authorization storage modes
+const (
+	lockoutAuthStorageFile = "file"
+	lockoutAuthStorageNV   = "nv"
+)
+
+// isLockoutError returns true if the activation failed because the TPM is
+// in dictionary attack lockout mode.
+func isLockoutError(err error) bool {
+	if e, ok := err.(*sb.ActivateWithTPMSealedKeyError); ok {
+		return e.TPMErr == sb.ErrTPMLockout
+	}
+	return err == sb.ErrTPMLockout
+}
+
+// errLockoutAuthLocked is returned when the lockout authorization index is
+// read after the early boot.
+var errLockoutAuthLocked = errors.New("lockout authorization index is locked until the next boot")
+
+// policyDigestUpdate returns the policy digest after running the policy
+// command with the given parameters, computed like the TPM does.
+func policyDigestUpdate(digest tpm2.Digest, code tpm2.CommandCode, params ...[]byte) tpm2.Digest {
+	h := sha256.New()
+	h.Write(digest)
+	binary.Write(h, binary.BigEndian, code)
+	for _, p := range params {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// lockoutAuthPolicyBranches returns the branches of the authorization
+// policy of the lockout authorization index: the lockout hierarchy can do
+// anything with it, and anyone can read it or lock reading it until the
+// next boot. Reading isn't bound to PCR 7: the policy of the index can't be
+// changed without the value, which is locked when the policy of the sealed
+// keys is updated for a new secure boot configuration, so any db or dbx
+// update would make it unreadable for good.
+func lockoutAuthPolicyBranches(tpm *sb.TPMConnection) tpm2.DigestList {
+	code := func(c tpm2.CommandCode) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(c))
+		return b
+	}
+	zero := make(tpm2.Digest, sha256.Size)
+	// TPM2_PolicySecret hashes the policy reference in a second step
+	secret := policyDigestUpdate(zero, tpm2.CommandPolicySecret, tpm.LockoutHandleContext().Name())
+	h := sha256.Sum256(secret)
+	secret = h[:]
+	read := policyDigestUpdate(zero, tpm2.CommandPolicyCommandCode, code(tpm2.CommandNVRead))
+	lock := policyDigestUpdate(zero, tpm2.CommandPolicyCommandCode, code(tpm2.CommandNVReadLock))
+	return tpm2.DigestList{secret, read, lock}
+}
+
+// lockoutAuthPolicy returns the authorization policy of the lockout
+// authorization index and its branches.
+func lockoutAuthPolicy(tpm *sb.TPMConnection) (tpm2.Digest, tpm2.DigestList) {
+	branches := lockoutAuthPolicyBranches(tpm)
+	var all []byte
+	for _, b := range branches {
+		all = append(all, b...)
+	}
+	return policyDigestUpdate(make(tpm2.Digest, sha256.Size), tpm2.CommandPolicyOR, all), branches
+}
+
+// lockoutAuthSession starts a policy session for the lockout authorization
+// index, running the given policy commands before the TPM2_PolicyOR.
+func lockoutAuthSession(tpm *sb.TPMConnection, branches tpm2.DigestList, run func(session tpm2.SessionContext) error) (tpm2.SessionContext, error) {
+	session, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, tpm2.HashAlgorithmSHA256)
+	if err != nil {
+		return nil, fmt.Errorf("cannot start policy session: %v", err)
+	}
+	if err := run(session); err != nil {
+		tpm.FlushContext(session)
+		return nil, err
+	}
+	if err := tpm.PolicyOR(session, branches); err != nil {
+		tpm.FlushContext(session)
+		return nil, fmt.Errorf("cannot run TPM2_PolicyOR: %v", err)
+	}
+	return session, nil
+}
+
+// storeLockoutAuthInNV moves the lockout authorization value from the file
+// written during TPM provisioning to an NV index. The index isn't readable
+// with the owner authorization: its policy only allows reading it in the
+// early boot, and it survives the data partition being wiped or re-imaged.
+func storeLockoutAuthInNV(tpm *sb.TPMConnection) error {
+	auth, err := readStateFile(tpm, lockoutAuthFile)
+	if err != nil {
+		return fmt.Errorf("cannot read lockout authorization: %v", err)
+	}
+	policy, branches := lockoutAuthPolicy(tpm)
+
+	// remove a previously defined index
+	index, err := tpm.CreateResourceContextFromTPM(lockoutAuthNVHandle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, lockoutAuthNVHandle):
+	case err != nil:
+		return err
+	default:
+		if err := tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, tpm.HmacSession()); err != nil {
+			return fmt.Errorf("cannot remove old lockout authorization index: %v", err)
+		}
+	}
+
+	if err := trackHandle(lockoutAuthNVHandle, handlePurposeLockoutAuth); err != nil {
+		return err
+	}
+	pub := tpm2.NVPublic{
+		Index:      lockoutAuthNVHandle,
+		NameAlg:    tpm2.HashAlgorithmSHA256,
+		Attrs:      tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVPolicyRead | tpm2.AttrNVReadStClear | tpm2.AttrNVNoDA),
+		AuthPolicy: policy,
+		Size:       uint16(len(auth)),
+	}
+	index, err = tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, &pub, tpm.HmacSession())
+	if err != nil {
+		return fmt.Errorf("cannot define lockout authorization index: %v", err)
+	}
+
+	lockout := tpm.LockoutHandleContext()
+	lockout.SetAuthValue(auth)
+	defer lockout.SetAuthValue(nil)
+	session, err := lockoutAuthSession(tpm, branches, func(session tpm2.SessionContext) error {
+		if _, _, err := tpm.PolicySecret(lockout, session, nil, nil, 0, tpm.HmacSession()); err != nil {
+			return fmt.Errorf("cannot run TPM2_PolicySecret: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	defer tpm.FlushContext(session)
+	if err := tpm.NVWrite(index, index, auth, 0, session); err != nil {
+		return fmt.Errorf("cannot write lockout authorization index: %v", err)
+	}
+
+	return os.Remove(lockoutAuthFile)
+}
+
+// lockoutAuthIndex returns the lockout authorization index and its public
+// area. Indexes readable with the owner authorization, written by older
+// versions, aren't used.
+func lockoutAuthIndex(tpm *sb.TPMConnection) (tpm2.ResourceContext, *tpm2.NVPublic, error) {
+	index, err := tpm.CreateResourceContextFromTPM(lockoutAuthNVHandle)
+	if err != nil {
+		return nil, nil, fmt.Errorf("lockout authorization not available")
+	}
+	pub, _, err := tpm.NVReadPublic(index)
+	if err != nil {
+		return nil, nil, err
+	}
+	if pub.Attrs&tpm2.AttrNVPolicyRead == 0 {
+		return nil, nil, fmt.Errorf("lockout authorization index isn't protected by a policy")
+	}
+	return index, pub, nil
+}
+
+// readLockoutAuth returns the lockout authorization value, either from the
+// lockout authorization file, if its partition is unlocked already, or from
+// the NV index, which is only readable in the early boot.
+func readLockoutAuth(tpm *sb.TPMConnection) ([]byte, error) {
+	if err := checkFileSecure(lockoutAuthFile); err == nil {
+		return readStateFile(tpm, lockoutAuthFile)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	index, pub, err := lockoutAuthIndex(tpm)
+	if err != nil {
+		return nil, err
+	}
+	if pub.Attrs&tpm2.AttrNVReadLocked != 0 {
+		return nil, errLockoutAuthLocked
+	}
+	_, branches := lockoutAuthPolicy(tpm)
+	session, err := lockoutAuthSession(tpm, branches, func(session tpm2.SessionContext) error {
+		if err := tpm.PolicyCommandCode(session, tpm2.CommandNVRead); err != nil {
+			return fmt.Errorf("cannot run TPM2_PolicyCommandCode: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer tpm.FlushContext(session)
+	return tpm.NVRead(index, index, pub.Size, 0, session)
+}
+
+// lockLockoutAuth locks reading the lockout authorization index until the
+// next boot, so it can't be read from the running system.
+func lockLockoutAuth(tpm *sb.TPMConnection) error {
+	index, pub, err := lockoutAuthIndex(tpm)
+	if err != nil || pub.Attrs&tpm2.AttrNVReadLocked != 0 {
+		// nothing to lock
+		return nil
+	}
+	_, branches := lockoutAuthPolicy(tpm)
+	session, err := lockoutAuthSession(tpm, branches, func(session tpm2.SessionContext) error {
+		if err := tpm.PolicyCommandCode(session, tpm2.CommandNVReadLock); err != nil {
+			return fmt.Errorf("cannot run TPM2_PolicyCommandCode: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	defer tpm.FlushContext(session)
+	if err := tpm.NVReadLock(index, index, session); err != nil {
+		return fmt.Errorf("cannot lock lockout authorization index: %v", err)
+	}
+	return nil
+}
+
+// lockoutAuthAvailable returns true if the lockout authorization can be
+// read to reset the dictionary attack lockout automatically, e.g. when the
+// partition containing the lockout authorization file is already unlocked,
+// or in the early boot when it's stored in the TPM.
+func lockoutAuthAvailable(tpm *sb.TPMConnection) bool {
+	if checkFileSecure(lockoutAuthFile) == nil {
+		return true
+	}
+	_, pub, err := lockoutAuthIndex(tpm)
+	return err == nil && pub.Attrs&tpm2.AttrNVReadLocked == 0
+}
+
+// resetDALockout resets the TPM dictionary attack lockout using the stored
+// lockout authorization value.
+func resetDALockout(tpm *sb.TPMConnection) error {
+	auth, err := readLockoutAuth(tpm)
+	if err != nil {
+		return fmt.Errorf("cannot read lockout authorization: %v", err)
+	}
+
+	lockout := tpm.LockoutHandleContext()
+	lockout.SetAuthValue(auth)
+	defer lockout.SetAuthValue(nil)
+
+	if err := tpm.DictionaryAttackLockReset(lockout, tpm.HmacSession()); err != nil {
+		return fmt.Errorf("cannot reset dictionary attack lockout: %v", err)
+	}
+
+	logf("TPM dictionary attack lockout was reset")
+	return nil
+}
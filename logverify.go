@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/canonical/go-tpm2"
+	sb "github.com/snapcore/secboot"
+)
+
+// firmwarePCRs are the PCRs only extended through the event log. Other PCRs
+// may be extended by the OS without a log entry.
+var firmwarePCRs = []int{0, 1, 2, 3, 4, 5, 6, 7}
+
+// event log checks performed before sealing
+const (
+	eventLogCheckEnforce = "enforce"
+	eventLogCheckWarn    = "warn"
+	eventLogCheckNone    = "none"
+)
+
+// startupLocalitySignature identifies the event recording the locality
+// PCR 0 was initialized from.
+const startupLocalitySignature = "StartupLocality\x00"
+
+// replay computes the values of the firmware PCRs from the events in the
+// log, for each of the digest algorithms of the log that can be computed.
+func (log *eventLog) replay() tpm2.PCRValues {
+	values := tpm2.PCRValues{}
+	for _, alg := range log.Algorithms {
+		if !alg.Available() {
+			continue
+		}
+		values[alg] = map[int]tpm2.Digest{}
+		for _, pcr := range firmwarePCRs {
+			values[alg][pcr] = make(tpm2.Digest, alg.Size())
+		}
+	}
+
+	for _, ev := range log.Events {
+		if ev.Type == evNoAction {
+			if ev.PCR == 0 && bytes.HasPrefix(ev.Data, []byte(startupLocalitySignature)) &&
+				len(ev.Data) > len(startupLocalitySignature) {
+				locality := ev.Data[len(startupLocalitySignature)]
+				for alg := range values {
+					values[alg][0][alg.Size()-1] = locality
+				}
+			}
+			continue
+		}
+		for alg, pcrs := range values {
+			current, ok := pcrs[int(ev.PCR)]
+			if !ok {
+				continue
+			}
+			h := alg.NewHash()
+			h.Write(current)
+			h.Write(ev.Digests[alg])
+			pcrs[int(ev.PCR)] = h.Sum(nil)
+		}
+	}
+	return values
+}
+
+// verifyEventLog replays the event log and checks that it reproduces the
+// current values of the firmware PCRs. A truncated or inconsistent log
+// makes the policies sealed on this platform impossible to diagnose.
+func verifyEventLog(tpm *sb.TPMConnection) error {
+	log, _, err := readEventLog(defaultEventLogPath)
+	if err != nil {
+		return err
+	}
+	replayed := log.replay()
+
+	selection := make(tpm2.PCRSelectionList, 0, len(replayed))
+	for alg := range replayed {
+		selection = append(selection, tpm2.PCRSelection{Hash: alg, Select: firmwarePCRs})
+	}
+	_, current, err := tpm.PCRRead(selection)
+	if err != nil {
+		return fmt.Errorf("cannot read PCR values: %v", err)
+	}
+
+	var mismatches []string
+	for alg, pcrs := range replayed {
+		for _, pcr := range firmwarePCRs {
+			value, ok := current[alg][pcr]
+			if !ok {
+				// the bank isn't allocated
+				continue
+			}
+			if !bytes.Equal(value, pcrs[pcr]) {
+				mismatches = append(mismatches, fmt.Sprintf("%d (%s)", pcr, digestAlgorithmName(alg)))
+			}
+		}
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("event log doesn't reproduce the value of PCR %s", strings.Join(mismatches, ", "))
+	}
+	return nil
+}
+
+// checkEventLog verifies the event log before sealing according to the
+// given check mode.
+func checkEventLog(tpm *sb.TPMConnection, mode string) error {
+	switch mode {
+	case "", eventLogCheckEnforce, eventLogCheckWarn:
+	case eventLogCheckNone:
+		return nil
+	default:
+		return fmt.Errorf("invalid event log check %q", mode)
+	}
+	err := verifyEventLog(tpm)
+	if err != nil && mode == eventLogCheckWarn {
+		warnf("%v", err)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// luksToken is a token in the LUKS2 header.
+type luksToken struct {
+	ID       int    `json:"id"`
+	Type     string `json:"type"`
+	Keyslots []int  `json:"keyslots,omitempty"`
+}
+
+// luksHeader contains the information of a LUKS header relevant to the
+// helper, as reported by cryptsetup luksDump.
+type luksHeader struct {
+	Version  int          `json:"version"`
+	Keyslots []int        `json:"keyslots"`
+	Tokens   []*luksToken `json:"tokens,omitempty"`
+}
+
+var (
+	luksSectionEntryRegexp = regexp.MustCompile(`^\s+([0-9]+): (\S+)`)
+	luksTokenKeyslotRegexp = regexp.MustCompile(`^\s+Keyslot:\s+([0-9]+)`)
+)
+
+// readLUKSHeader reads the header of the LUKS volume in the given device.
+func readLUKSHeader(devicePath string) (*luksHeader, error) {
+	output, err := exec.Command("cryptsetup", "luksDump", devicePath).Output()
+	if err != nil {
+		return nil, fmt.Errorf("cannot dump LUKS header of %s: %v", devicePath, err)
+	}
+
+	var h luksHeader
+	var section string
+	var token *luksToken
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) > 0 && line[0] != ' ' && line[0] != '\t' {
+			section = strings.TrimSuffix(line, ":")
+			if strings.HasPrefix(line, "Version:") {
+				h.Version, _ = strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "Version:")))
+			}
+			continue
+		}
+		switch section {
+		case "Keyslots":
+			if m := luksSectionEntryRegexp.FindStringSubmatch(line); m != nil {
+				slot, _ := strconv.Atoi(m[1])
+				h.Keyslots = append(h.Keyslots, slot)
+			}
+		case "Tokens":
+			if m := luksSectionEntryRegexp.FindStringSubmatch(line); m != nil {
+				id, _ := strconv.Atoi(m[1])
+				token = &luksToken{ID: id, Type: m[2]}
+				h.Tokens = append(h.Tokens, token)
+			} else if m := luksTokenKeyslotRegexp.FindStringSubmatch(line); m != nil && token != nil {
+				slot, _ := strconv.Atoi(m[1])
+				token.Keyslots = append(token.Keyslots, slot)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
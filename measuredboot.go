@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+)
+
+// measuredApplications returns the SHA-256 digests of the EFI applications
+// measured to the boot manager PCR, in the order they were loaded.
+func (log *eventLog) measuredApplications() []tpm2.Digest {
+	var digests []tpm2.Digest
+	for _, ev := range log.Events {
+		if ev.PCR == bootManagerPCR && ev.Type == evEFIBootServicesApp {
+			digests = append(digests, ev.Digests[tpm2.HashAlgorithmSHA256])
+		}
+	}
+	return digests
+}
+
+// loadPaths returns every path through the load chains, in load order.
+func loadPaths(chains []*loadChain) [][]*loadChain {
+	var paths [][]*loadChain
+	for _, lc := range chains {
+		if len(lc.Next) == 0 {
+			paths = append(paths, []*loadChain{lc})
+			continue
+		}
+		for _, next := range loadPaths(lc.Next) {
+			paths = append(paths, append([]*loadChain{lc}, next...))
+		}
+	}
+	return paths
+}
+
+// unmeasuredComponent returns the first component of the booted path through
+// the load chains that doesn't appear in the event log, e.g. a kernel loaded
+// by a boot loader built without TPM support. The booted path is the one
+// whose components match the measured applications, nil is returned if
+// there's none, as the check can't be made.
+func unmeasuredComponent(chains []*loadChain, measured []tpm2.Digest) *loadChain {
+	var unmeasured *loadChain
+	for _, path := range loadPaths(chains) {
+		booted := true
+		for i, lc := range path {
+			if i >= len(measured) {
+				break
+			}
+			digest, err := lc.imageDigest(nil)
+			if err != nil || !bytes.Equal(digest, measured[i]) {
+				booted = false
+				break
+			}
+		}
+		if !booted {
+			continue
+		}
+		if len(path) <= len(measured) {
+			return nil
+		}
+		if unmeasured == nil {
+			unmeasured = path[len(measured)]
+		}
+	}
+	return unmeasured
+}
+
+// checkMeasuredComponents verifies that the boot loaders measure the
+// components of the load chains, according to the given event log check
+// mode. A policy including components that aren't measured can never be
+// satisfied, so the key would only be usable with the recovery key.
+func checkMeasuredComponents(bp *bootProfileParams, mode string) error {
+	if mode == eventLogCheckNone || (bp.BootChainModel != "" && bp.BootChainModel != bootChainUEFI) {
+		return nil
+	}
+	chains, cleanup, err := extractSnapAssets(bp.loadChains())
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if len(chains) == 0 {
+		return nil
+	}
+	log, _, err := readEventLog(defaultEventLogPath)
+	if err != nil {
+		return err
+	}
+	lc := unmeasuredComponent(chains, log.measuredApplications())
+	if lc == nil {
+		return nil
+	}
+	err = &codedError{
+		code: errorCodeUnmeasuredComponent,
+		err:  fmt.Errorf("%s is loaded but not measured by the boot loader", lc.name()),
+	}
+	if mode == eventLogCheckWarn {
+		warnf("%v", err)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// metricsFileName is the name of the node_exporter textfile collector file
+// written after unlocking.
+const metricsFileName = "fde_helper.prom"
+
+// metricsDir is the directory to write unlock metrics to, if set.
+var metricsDir string
+
+// unlockMetrics describes the outcome of an unlock.
+type unlockMetrics struct {
+	volume   string
+	duration time.Duration
+	// method is empty if the unlock failed
+	method string
+	da     *daStatus
+}
+
+// promLabel escapes a Prometheus label value.
+func promLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func (m *unlockMetrics) text() string {
+	var b strings.Builder
+	volume := promLabel(m.volume)
+	metric := func(name, help, labels string, value interface{}) {
+		fmt.Fprintf(&b, "# HELP fde_helper_%s %s\n", name, help)
+		fmt.Fprintf(&b, "# TYPE fde_helper_%s gauge\n", name)
+		fmt.Fprintf(&b, "fde_helper_%s{%s} %v\n", name, labels, value)
+	}
+	success := 0
+	if m.method != "" {
+		success = 1
+	}
+	metric("unlock_success", "Whether the last unlock succeeded.", fmt.Sprintf(`volume="%s"`, volume), success)
+	metric("unlock_duration_seconds", "Time taken by the last unlock.", fmt.Sprintf(`volume="%s"`, volume),
+		m.duration.Seconds())
+	metric("unlock_timestamp_seconds", "Time of the last unlock.", fmt.Sprintf(`volume="%s"`, volume),
+		time.Now().Unix())
+	if m.method != "" {
+		metric("unlock_method", "Method used in the last unlock.",
+			fmt.Sprintf(`volume="%s",method="%s"`, volume, promLabel(m.method)), 1)
+	}
+	if m.da != nil {
+		metric("da_counter", "TPM dictionary attack lockout counter.", "", m.da.LockoutCounter)
+		metric("da_max_auth_fail", "TPM failed authorizations before lockout.", "", m.da.MaxAuthFail)
+	}
+	return b.String()
+}
+
+// writeUnlockMetrics writes the unlock metrics to the metrics directory, if
+// configured. The DA counter is read from the TPM if it is available.
+func writeUnlockMetrics(volume string, start time.Time, resp *unlockResponse) error {
+	if metricsDir == "" {
+		return nil
+	}
+	m := &unlockMetrics{
+		volume:   volume,
+		duration: time.Since(start),
+	}
+	if resp != nil {
+		m.method = resp.Method
+	}
+	// don't wait for a TPM that already timed out
+	if resp == nil || !resp.TPMTimeout {
+		if tpm, err := connectTPM(); err == nil {
+			m.da, _ = readDAStatus(tpm)
+			tpm.Close()
+		}
+	}
+
+	if err := os.MkdirAll(metricsDir, 0755); err != nil {
+		return err
+	}
+	// the collector may read the file at any time
+	path := filepath.Join(metricsDir, metricsFileName)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(m.text()), 0644); err != nil {
+		return fmt.Errorf("cannot write metrics: %v", err)
+	}
+	// files are created with a restrictive umask
+	if err := os.Chmod(tmp, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
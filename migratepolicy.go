@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	sb "github.com/snapcore/secboot"
+)
+
+// policyVersion identifies the policy constructs used by the helper when
+// sealing keys. It must be increased when keys need to be sealed again to
+// benefit from new policy features. Keys sealed before the version was
+// recorded have version 1.
+const policyVersion = 2
+
+type migratePolicyParams struct {
+	// The key is sealed again to the PCR profile built from the update
+	// parameters.
+	updateParams
+
+	// Force seals the key again even if it uses the current policy
+	// version.
+	Force bool `json:"force,omitempty"`
+}
+
+type migratePolicyResponse struct {
+	// Migrated is false if the key already used the current policy
+	// version.
+	Migrated      bool `json:"migrated"`
+	PolicyVersion int  `json:"policy-version"`
+}
+
+// policyAuthPrivateKey returns the policy authorization key as an ECDSA
+// key, so the key sealed again keeps the authorization key of the callers.
+func policyAuthPrivateKey(authKey sb.TPMPolicyAuthKey) *ecdsa.PrivateKey {
+	curve := elliptic.P256()
+	priv := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(authKey)}
+	priv.PublicKey.Curve = curve
+	priv.PublicKey.X, priv.PublicKey.Y = curve.ScalarBaseMult(authKey)
+	return priv
+}
+
+// migratePolicy seals the key again using the current policy constructs,
+// e.g. a new PCR policy counter, keeping the key itself and the policy
+// authorization key, so the volume doesn't need to be encrypted again.
+func migratePolicy(p []byte) error {
+	var params migratePolicyParams
+	if err := json.Unmarshal(p, &params); err != nil {
+		return err
+	}
+	if err := selectVolumeKey(params.VolumeKey, ""); err != nil {
+		return err
+	}
+	if err := checkFileSecure(sealedKeyFile); err != nil {
+		return err
+	}
+	md, err := readKeyMetadata(sealedKeyFile)
+	if err != nil {
+		return err
+	}
+	if err := checkSerialBinding(md, params.SerialAssertion); err != nil {
+		return err
+	}
+	version := md.PolicyVersion
+	if version == 0 {
+		version = 1
+	}
+	if version >= policyVersion && !params.Force {
+		return writeResponse(&migratePolicyResponse{PolicyVersion: version})
+	}
+	if dryRun {
+		return planMigratePolicy()
+	}
+
+	pcrProfile, err := params.buildPCRProtectionProfile()
+	if err != nil {
+		return err
+	}
+
+	tpm, err := connectTPM()
+	if err != nil {
+		return fmt.Errorf("cannot connect to TPM: %v", err)
+	}
+	defer tpm.Close()
+
+	// the data and save keys share the policy, so they are sealed again
+	// together
+	var requests []*sb.SealKeyRequest
+	var authKey sb.TPMPolicyAuthKey
+	for _, path := range sealedKeyFiles() {
+		k, err := readSealedKey(path)
+		if err != nil {
+			return fmt.Errorf("cannot read sealed key object: %v", err)
+		}
+		if k.AuthMode2F() != sb.AuthModeNone {
+			return fmt.Errorf("cannot migrate the policy of a PIN protected key")
+		}
+		key, ak, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			return fmt.Errorf("cannot unseal: %v", err)
+		}
+		authKey = ak
+		requests = append(requests, &sb.SealKeyRequest{Key: key, Path: path + ".migrate"})
+	}
+
+	// the old key can't be unsealed once its counter is removed, don't
+	// let the migration be interrupted until the new key is in place
+	signal.Ignore(syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+
+	if err := evictTPMHandle(tpm, pcrPolicyCounterHandle); err != nil {
+		return err
+	}
+	creationParams := sb.KeyCreationParams{
+		PCRProfile:             pcrProfile,
+		PCRPolicyCounterHandle: pcrPolicyCounterHandle,
+		AuthKey:                policyAuthPrivateKey(authKey),
+	}
+	if _, err := sb.SealKeyToTPMMultiple(tpm, requests, &creationParams); err != nil {
+		return fmt.Errorf("cannot seal key: %v", err)
+	}
+	for _, r := range requests {
+		if err := secureFile(r.Path); err != nil {
+			return err
+		}
+		if err := os.Rename(r.Path, strings.TrimSuffix(r.Path, ".migrate")); err != nil {
+			return err
+		}
+	}
+
+	digest, err := profileDigest(tpm, pcrProfile)
+	if err != nil {
+		return err
+	}
+	// the keys are sealed again as sealed key objects
+	if md.Format == keyDataFormat {
+		if _, err := convertToKeyData(); err != nil {
+			return err
+		}
+	}
+	md.ProfileDigest = digest
+	md.PolicyVersion = policyVersion
+	md.recordPolicy(tpm, "migrate", pcrProfile, digest)
+	if err := writeKeyMetadata(sealedKeyFile, md); err != nil {
+		return err
+	}
+	if err := backupSealedKeys(); err != nil {
+		return err
+	}
+	return writeResponse(&migratePolicyResponse{Migrated: true, PolicyVersion: policyVersion})
+}
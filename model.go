@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/asserts/sysdb"
+	"github.com/snapcore/snapd/fdehelper"
+)
+
+// order in which assertion types are added to the database, so each
+// assertion can be verified with the ones added before it
+var assertionTypeOrder = []*asserts.AssertionType{
+	asserts.AccountType,
+	asserts.AccountKeyType,
+	asserts.ModelType,
+	asserts.SerialType,
+}
+
+// verifyAssertions decodes a stream of assertions and returns them once
+// verified against the trusted account keys. The stream must contain the
+// account and account-key assertions needed to verify the signatures.
+func verifyAssertions(stream string) ([]asserts.Assertion, error) {
+	db, err := asserts.OpenDatabase(&asserts.DatabaseConfig{
+		Backstore: asserts.NewMemoryBackstore(),
+		Trusted:   sysdb.Trusted(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot open assertion database: %v", err)
+	}
+
+	byType := make(map[*asserts.AssertionType][]asserts.Assertion)
+	dec := asserts.NewDecoder(strings.NewReader(stream))
+	for {
+		a, err := dec.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode assertion: %v", err)
+		}
+		byType[a.Type()] = append(byType[a.Type()], a)
+	}
+
+	var verified []asserts.Assertion
+	for _, t := range assertionTypeOrder {
+		for _, a := range byType[t] {
+			if err := db.Add(a); err != nil && !asserts.IsUnaccceptedUpdate(err) {
+				return nil, fmt.Errorf("cannot verify %s assertion: %v", t.Name, err)
+			}
+			verified = append(verified, a)
+		}
+	}
+	return verified, nil
+}
+
+// verifyModelAssertions decodes a stream of assertions and returns the
+// parameters of the model assertions it contains. The stream must also
+// contain the account and account-key assertions needed to verify the
+// model signatures against the trusted account keys.
+func verifyModelAssertions(stream string) ([]*fdehelper.ModelParams, error) {
+	verified, err := verifyAssertions(stream)
+	if err != nil {
+		return nil, err
+	}
+	var models []*fdehelper.ModelParams
+	for _, a := range verified {
+		if m, ok := a.(*asserts.Model); ok {
+			models = append(models, &fdehelper.ModelParams{
+				Series:    m.Series(),
+				BrandID:   m.BrandID(),
+				Model:     m.Model(),
+				Grade:     m.Grade(),
+				SignKeyID: m.SignKeyID(),
+			})
+		}
+	}
+	if len(models) == 0 {
+		return nil, fmt.Errorf("no model assertion found")
+	}
+	return models, nil
+}
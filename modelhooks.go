@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/snapcore/snapd/fdehelper"
+)
+
+// defaultModelHooksDir holds the OEM model verification hooks. Hooks are
+// executables rather than Go plugins, which would have to be built with the
+// same toolchain and dependencies as the helper.
+const defaultModelHooksDir = "/usr/lib/fde-helper/model-hooks.d"
+
+// modelHookTimeout is the time each hook has to decide.
+const modelHookTimeout = 30 * time.Second
+
+// modelHookInput is written to the stdin of the hooks.
+type modelHookInput struct {
+	// Operation is the operation sealing the key, "initial-provision"
+	// or "update".
+	Operation string                   `json:"operation"`
+	Models    []*fdehelper.ModelParams `json:"models"`
+}
+
+// runModelHooks runs the model verification hooks in lexical order before
+// the key is sealed for the given models. Sealing is refused if any hook
+// exits with an error, and what it wrote to stderr is reported.
+func runModelHooks(operation string, models []*fdehelper.ModelParams) error {
+	entries, err := ioutil.ReadDir(modelHooksDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read model hooks: %v", err)
+	}
+	input, err := json.Marshal(&modelHookInput{Operation: operation, Models: models})
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range entries {
+		if !fi.Mode().IsRegular() || fi.Mode().Perm()&0111 == 0 {
+			continue
+		}
+		path := filepath.Join(modelHooksDir, fi.Name())
+		// the hooks decide what is sealed, so they must be as protected
+		// as the helper
+		if fi.Mode().Perm()&0022 != 0 {
+			return fmt.Errorf("refusing to run writable model hook %s", path)
+		}
+		var stderr bytes.Buffer
+		cmd := exec.Command(path)
+		cmd.Stdin = bytes.NewReader(input)
+		cmd.Stderr = &stderr
+		if err := cmd.Start(); err != nil {
+			return fmt.Errorf("cannot run model hook %s: %v", fi.Name(), err)
+		}
+		timer := time.AfterFunc(modelHookTimeout, func() { cmd.Process.Kill() })
+		err := cmd.Wait()
+		timer.Stop()
+		if err != nil {
+			return fmt.Errorf("model rejected by hook %s: %v: %s", fi.Name(), err, bytes.TrimSpace(stderr.Bytes()))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// output formats of the responses
+const (
+	formatJSON = "json"
+	formatText = "text"
+)
+
+var (
+	// quiet suppresses all messages that are not errors
+	quiet bool
+	// outputFormat is the format used to write responses
+	outputFormat = formatJSON
+	// responseOutput is where responses are written, stdout unless a
+	// response descriptor was given
+	responseOutput io.Writer = os.Stdout
+)
+
+// setResponseFD makes responses be written to the given file descriptor
+// instead of stdout, which then only carries output of libraries and
+// programs run by the helper that callers don't parse.
+func setResponseFD(fd int) error {
+	f := os.NewFile(uintptr(fd), "response-fd")
+	if f == nil {
+		return fmt.Errorf("invalid response file descriptor %d", fd)
+	}
+	if _, err := f.Stat(); err != nil {
+		return fmt.Errorf("invalid response file descriptor %d: %v", fd, err)
+	}
+	responseOutput = f
+	return nil
+}
+
+// logf writes an informational message to stderr, unless in quiet mode.
+func logf(format string, args ...interface{}) {
+	writeMessage(priorityInfo, fmt.Sprintf(format, args...))
+}
+
+// warnf writes a warning to stderr, unless in quiet mode.
+func warnf(format string, args ...interface{}) {
+	writeMessage(priorityWarning, "warning: "+fmt.Sprintf(format, args...))
+}
+
+// writeMessage writes a message to stderr, or to the kernel log in boot
+// output mode.
+func writeMessage(priority int, msg string) {
+	if quiet {
+		return
+	}
+	if bootOutput != nil && bootOutput.log(priority, msg) {
+		return
+	}
+	fmt.Fprintln(os.Stderr, msg)
+}
+
+// writeResponse writes the response of an operation to the response output
+// in the selected output format.
+func writeResponse(v interface{}) error {
+	if outputFormat != formatText {
+		return json.NewEncoder(responseOutput).Encode(v)
+	}
+
+	// the text format is derived from the JSON encoding, so both use the
+	// same field names
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var generic interface{}
+	if err := dec.Decode(&generic); err != nil {
+		return err
+	}
+	writeText(responseOutput, "", generic)
+	return nil
+}
+
+// writeText writes a decoded JSON value as one "key: value" line per scalar,
+// with the keys of nested values joined by dots.
+func writeText(w io.Writer, prefix string, v interface{}) {
+	key := func(k string) string {
+		if prefix == "" {
+			return k
+		}
+		return prefix + "." + k
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			writeText(w, key(k), v[k])
+		}
+	case []interface{}:
+		for i, e := range v {
+			writeText(w, key(strconv.Itoa(i)), e)
+		}
+	case nil:
+	default:
+		fmt.Fprintf(w, "%s: %v\n", prefix, v)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+type testResponse struct {
+	Name   string         `json:"name"`
+	Count  int            `json:"count"`
+	Nested map[string]int `json:"nested,omitempty"`
+	List   []string       `json:"list,omitempty"`
+	Empty  *string        `json:"empty"`
+}
+
+func TestWriteResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		response interface{}
+		output   string
+	}{
+		{
+			name:     "json",
+			format:   formatJSON,
+			response: &testResponse{Name: "key", Count: 2},
+			output:   `{"name":"key","count":2,"empty":null}` + "\n",
+		}, {
+			name:     "text",
+			format:   formatText,
+			response: &testResponse{Name: "key", Count: 2},
+			output:   "count: 2\nname: key\n",
+		}, {
+			name:   "text nested",
+			format: formatText,
+			response: &testResponse{
+				Name:   "key",
+				Nested: map[string]int{"b": 2, "a": 1},
+				List:   []string{"x", "y"},
+			},
+			output: "count: 0\nlist.0: x\nlist.1: y\nname: key\nnested.a: 1\nnested.b: 2\n",
+		},
+	}
+	output, format := responseOutput, outputFormat
+	defer func() {
+		responseOutput, outputFormat = output, format
+	}()
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			responseOutput, outputFormat = &buf, tc.format
+			if err := writeResponse(tc.response); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tc.output {
+				t.Errorf("expected %q, got %q", tc.output, buf.String())
+			}
+		})
+	}
+}
+
+func TestSetResponseFD(t *testing.T) {
+	output, format := responseOutput, outputFormat
+	defer func() {
+		responseOutput, outputFormat = output, format
+	}()
+
+	dir, err := ioutil.TempDir("", "fde-helper-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "response")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := setResponseFD(fd); err != nil {
+		t.Fatal(err)
+	}
+	outputFormat = formatJSON
+	if err := writeResponse(&testResponse{Name: "key"}); err != nil {
+		t.Fatal(err)
+	}
+	responseOutput.(*os.File).Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"name":"key","count":0,"empty":null}` + "\n"
+	if string(data) != expected {
+		t.Errorf("expected %q, got %q", expected, data)
+	}
+}
+
+func TestSetResponseFDInvalid(t *testing.T) {
+	output := responseOutput
+	defer func() { responseOutput = output }()
+
+	// a descriptor that is certainly not open
+	if err := setResponseFD(1 << 20); err == nil {
+		t.Fatal("expected an error")
+	}
+	if responseOutput != output {
+		t.Error("response output changed on error")
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+	sb "github.com/snapcore/secboot"
+)
+
+// errOwnershipTaken is reported when the storage hierarchy authorization
+// was set by other software and wasn't specified.
+var errOwnershipTaken = fmt.Errorf("storage hierarchy authorization was set by other software, " +
+	"specify it with owner-auth to coexist")
+
+// ownerAuthSet returns true if the storage hierarchy has an authorization
+// value, e.g. because another operating system took ownership of the TPM.
+func ownerAuthSet(tpm *sb.TPMConnection) (bool, error) {
+	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1)
+	if err != nil || len(props) == 0 {
+		return false, fmt.Errorf("cannot read TPM properties: %v", err)
+	}
+	return tpm2.PermanentAttributes(props[0].Value)&tpm2.AttrOwnerAuthSet != 0, nil
+}
+
+// useExistingOwnership checks whether other software owns the TPM. If it
+// does, the given base64 encoded storage hierarchy authorization is used
+// for the commands that need it, and true is returned: the TPM is not
+// provisioned again, as that would clear or take over the hierarchies
+// the other software relies on.
+func useExistingOwnership(tpm *sb.TPMConnection, ownerAuth string) (bool, error) {
+	set, err := ownerAuthSet(tpm)
+	if err != nil {
+		return false, err
+	}
+	if !set {
+		if ownerAuth != "" {
+			warnf("owner authorization specified, but the storage hierarchy has none")
+		}
+		return false, nil
+	}
+	if ownerAuth == "" {
+		return false, &codedError{code: errorCodeOwnershipTaken, err: errOwnershipTaken}
+	}
+	auth, err := base64.RawStdEncoding.DecodeString(ownerAuth)
+	if err != nil {
+		return false, fmt.Errorf("invalid owner authorization: %v", err)
+	}
+	tpm.OwnerHandleContext().SetAuthValue(auth)
+	return true, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"github.com/canonical/go-tpm2"
+	sb "github.com/snapcore/secboot"
+)
+
+// expectedPCRValues is a set of PCR values the platform is expected to have
+// when the sealed key is unsealed, as produced by tools such as compute-pcrs
+// or listed in vendor manifests.
+type expectedPCRValues struct {
+	Algorithm string         `json:"algorithm"`
+	Values    map[int]string `json:"values"`
+}
+
+// hashAlgorithm returns the TPM hash algorithm identified by name. The
+// default algorithm is SHA-256.
+func hashAlgorithm(name string) (tpm2.HashAlgorithmId, error) {
+	switch name {
+	case "", "sha256":
+		return tpm2.HashAlgorithmSHA256, nil
+	case "sha1":
+		return tpm2.HashAlgorithmSHA1, nil
+	case "sha384":
+		return tpm2.HashAlgorithmSHA384, nil
+	case "sha512":
+		return tpm2.HashAlgorithmSHA512, nil
+	}
+	return tpm2.HashAlgorithmNull, fmt.Errorf("unsupported hash algorithm %q", name)
+}
+
+// hashAlgorithmName returns the name of the given TPM hash algorithm.
+func hashAlgorithmName(alg tpm2.HashAlgorithmId) (string, error) {
+	switch alg {
+	case tpm2.HashAlgorithmSHA1:
+		return "sha1", nil
+	case tpm2.HashAlgorithmSHA256:
+		return "sha256", nil
+	case tpm2.HashAlgorithmSHA384:
+		return "sha384", nil
+	case tpm2.HashAlgorithmSHA512:
+		return "sha512", nil
+	}
+	return "", fmt.Errorf("unsupported hash algorithm %v", alg)
+}
+
+// expectedPCRBranch is a set of PCR values, in one or more PCR banks, that
+// must all match to unseal the key, e.g. the values of one boot state.
+type expectedPCRBranch []*expectedPCRValues
+
+// addExpectedPCRValues adds the PCR values of the set to the profile.
+func addExpectedPCRValues(pcrProfile *sb.PCRProtectionProfile, set *expectedPCRValues) error {
+	alg, err := hashAlgorithm(set.Algorithm)
+	if err != nil {
+		return err
+	}
+	if len(set.Values) == 0 {
+		return fmt.Errorf("empty set of expected PCR values")
+	}
+
+	pcrs := make([]int, 0, len(set.Values))
+	for pcr := range set.Values {
+		pcrs = append(pcrs, pcr)
+	}
+	sort.Ints(pcrs)
+
+	for _, pcr := range pcrs {
+		if pcr < 0 || pcr > 23 {
+			return fmt.Errorf("invalid PCR index %d", pcr)
+		}
+		digest, err := hex.DecodeString(set.Values[pcr])
+		if err != nil {
+			return fmt.Errorf("invalid value for PCR %d: %v", pcr, err)
+		}
+		if len(digest) != alg.Size() {
+			return fmt.Errorf("invalid %v digest size for PCR %d", alg, pcr)
+		}
+		pcrProfile.AddPCRValue(alg, pcr, digest)
+	}
+	return nil
+}
+
+// buildExpectedPCRProtectionProfile creates a PCR protection profile from
+// explicitly provided PCR values instead of the values measured in the live
+// platform. Each set of values is an alternative branch of the profile.
+func buildExpectedPCRProtectionProfile(sets []*expectedPCRValues) (*sb.PCRProtectionProfile, error) {
+	branches := make([]expectedPCRBranch, 0, len(sets))
+	for _, set := range sets {
+		branches = append(branches, expectedPCRBranch{set})
+	}
+	return buildExpectedPCRBranchesProfile(branches)
+}
+
+// buildExpectedPCRBranchesProfile creates a PCR protection profile with a
+// branch for each set of expected PCR values, where the values of all banks
+// of a branch must match together.
+func buildExpectedPCRBranchesProfile(branches []expectedPCRBranch) (*sb.PCRProtectionProfile, error) {
+	if len(branches) == 0 {
+		return nil, fmt.Errorf("no expected PCR values specified")
+	}
+
+	profiles := make([]*sb.PCRProtectionProfile, 0, len(branches))
+	for _, b := range branches {
+		if len(b) == 0 {
+			return nil, fmt.Errorf("empty branch of expected PCR values")
+		}
+		branch := sb.NewPCRProtectionProfile()
+		for _, set := range b {
+			if err := addExpectedPCRValues(branch, set); err != nil {
+				return nil, err
+			}
+		}
+		profiles = append(profiles, branch)
+	}
+
+	return sb.NewPCRProtectionProfile().AddProfileOR(profiles...), nil
+}
+
+// computeExpectedPCRValues computes the branches of PCR values that satisfy
+// the given profile, with the values of all PCR banks of a boot state in
+// the same branch. The profile must not depend on values read from the TPM.
+func computeExpectedPCRValues(profile *sb.PCRProtectionProfile) ([]expectedPCRBranch, error) {
+	pcrValues, err := profile.ComputePCRValues(nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot compute PCR values: %v", err)
+	}
+
+	branches := make([]expectedPCRBranch, 0, len(pcrValues))
+	for _, values := range pcrValues {
+		algs := make([]tpm2.HashAlgorithmId, 0, len(values))
+		for alg := range values {
+			algs = append(algs, alg)
+		}
+		sort.Slice(algs, func(i, j int) bool { return algs[i] < algs[j] })
+
+		var branch expectedPCRBranch
+		for _, alg := range algs {
+			name, err := hashAlgorithmName(alg)
+			if err != nil {
+				return nil, err
+			}
+			set := &expectedPCRValues{
+				Algorithm: name,
+				Values:    make(map[int]string, len(values[alg])),
+			}
+			for pcr, digest := range values[alg] {
+				set.Values[pcr] = hex.EncodeToString(digest)
+			}
+			branch = append(branch, set)
+		}
+		branches = append(branches, branch)
+	}
+	return branches, nil
+}
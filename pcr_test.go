@@ -0,0 +1,144 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+)
+
+func TestHashAlgorithm(t *testing.T) {
+	tests := []struct {
+		name string
+		alg  tpm2.HashAlgorithmId
+		err  string
+	}{
+		{name: "", alg: tpm2.HashAlgorithmSHA256},
+		{name: "sha1", alg: tpm2.HashAlgorithmSHA1},
+		{name: "sha256", alg: tpm2.HashAlgorithmSHA256},
+		{name: "sha384", alg: tpm2.HashAlgorithmSHA384},
+		{name: "sha512", alg: tpm2.HashAlgorithmSHA512},
+		{name: "md5", err: `unsupported hash algorithm "md5"`},
+	}
+	for _, tc := range tests {
+		alg, err := hashAlgorithm(tc.name)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%q: expected error %q, got %v", tc.name, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if alg != tc.alg {
+			t.Errorf("%q: expected %v, got %v", tc.name, tc.alg, alg)
+		}
+		if tc.name == "" {
+			continue
+		}
+		name, err := hashAlgorithmName(alg)
+		if err != nil || name != tc.name {
+			t.Errorf("%v: expected name %q, got %q (%v)", alg, tc.name, name, err)
+		}
+	}
+}
+
+func TestBuildExpectedPCRProtectionProfile(t *testing.T) {
+	sha256Value := strings.Repeat("00", 32)
+	tests := []struct {
+		summary string
+		sets    []*expectedPCRValues
+		err     string
+	}{
+		{
+			summary: "single set",
+			sets:    []*expectedPCRValues{{Values: map[int]string{7: sha256Value}}},
+		}, {
+			summary: "several sets and algorithms",
+			sets: []*expectedPCRValues{
+				{Algorithm: "sha256", Values: map[int]string{4: sha256Value, 7: sha256Value}},
+				{Algorithm: "sha1", Values: map[int]string{7: strings.Repeat("00", 20)}},
+			},
+		}, {
+			summary: "no sets",
+			err:     "no expected PCR values specified",
+		}, {
+			summary: "unknown algorithm",
+			sets:    []*expectedPCRValues{{Algorithm: "md5", Values: map[int]string{7: sha256Value}}},
+			err:     `unsupported hash algorithm "md5"`,
+		}, {
+			summary: "empty set",
+			sets:    []*expectedPCRValues{{Values: map[int]string{}}},
+			err:     "empty set of expected PCR values",
+		}, {
+			summary: "invalid PCR",
+			sets:    []*expectedPCRValues{{Values: map[int]string{24: sha256Value}}},
+			err:     "invalid PCR index 24",
+		}, {
+			summary: "invalid hex",
+			sets:    []*expectedPCRValues{{Values: map[int]string{7: "zz"}}},
+			err:     "invalid value for PCR 7",
+		}, {
+			summary: "wrong digest size",
+			sets:    []*expectedPCRValues{{Algorithm: "sha384", Values: map[int]string{7: sha256Value}}},
+			err:     "digest size for PCR 7",
+		},
+	}
+	for _, tc := range tests {
+		_, err := buildExpectedPCRProtectionProfile(tc.sets)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: expected error %q, got %v", tc.summary, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.summary, err)
+		}
+	}
+}
+
+func TestBuildExpectedPCRBranchesProfile(t *testing.T) {
+	sha256Value := strings.Repeat("00", 32)
+	tests := []struct {
+		summary  string
+		branches []expectedPCRBranch
+		err      string
+	}{
+		{
+			summary: "banks combined in a branch",
+			branches: []expectedPCRBranch{{
+				{Algorithm: "sha256", Values: map[int]string{7: sha256Value}},
+				{Algorithm: "sha1", Values: map[int]string{7: strings.Repeat("00", 20)}},
+			}},
+		}, {
+			summary: "no branches",
+			err:     "no expected PCR values specified",
+		}, {
+			summary:  "empty branch",
+			branches: []expectedPCRBranch{{}},
+			err:      "empty branch of expected PCR values",
+		}, {
+			summary: "invalid bank",
+			branches: []expectedPCRBranch{{
+				{Algorithm: "sha256", Values: map[int]string{7: sha256Value}},
+				{Algorithm: "sha1", Values: map[int]string{7: sha256Value}},
+			}},
+			err: "digest size for PCR 7",
+		},
+	}
+	for _, tc := range tests {
+		_, err := buildExpectedPCRBranchesProfile(tc.branches)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: expected error %q, got %v", tc.summary, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.summary, err)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/canonical/go-tpm2"
+	sb "github.com/snapcore/secboot"
+)
+
+const (
+	defaultPolicyUpdateKeyFile = "/run/mnt/ubuntu-data/system-data/var/lib/snapd/device/fde/policy-update-key.pub"
+	// defaultPolicyRevisionFile is where older versions recorded the
+	// revision of the last applied bundle, it's moved to the TPM when
+	// found.
+	defaultPolicyRevisionFile = "/run/mnt/ubuntu-data/system-data/var/lib/snapd/device/fde/policy-revision"
+)
+
+// policyRevisionHandle is the NV index storing the revision of the last
+// applied policy update bundle.
+const policyRevisionHandle tpm2.Handle = 0x01880015
+
+// policyUpdateBundle contains the precomputed PCR values used to reseal
+// the key in a set of identical devices.
+type policyUpdateBundle struct {
+	// Revision must be increased in every update, and bundles with a
+	// revision not higher than the last applied one are rejected.
+	Revision uint64 `json:"revision"`
+	// ExpectedPCRs are the alternative branches of PCR values, each with
+	// the values of all PCR banks in one boot state.
+	ExpectedPCRs []expectedPCRBranch `json:"expected-pcrs"`
+	// Signature is the base64-encoded ed25519 signature of the bundle
+	// encoded with an empty signature.
+	Signature string `json:"signature,omitempty"`
+}
+
+func (b *policyUpdateBundle) signedData() ([]byte, error) {
+	unsigned := *b
+	unsigned.Signature = ""
+	return json.Marshal(&unsigned)
+}
+
+type exportPolicyUpdateParams struct {
+	updateParams
+
+	Revision       uint64 `json:"revision"`
+	SigningKeyFile string `json:"signing-key-file"`
+}
+
+// readBase64File reads a file containing base64-encoded data.
+func readBase64File(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+}
+
+// exportPolicyUpdate computes the PCR profile for the given model parameters
+// and writes it to stdout as a signed policy update bundle.
+func exportPolicyUpdate(p []byte) error {
+	var params exportPolicyUpdateParams
+	if err := json.Unmarshal(p, &params); err != nil {
+		return err
+	}
+	if params.Revision == 0 {
+		return fmt.Errorf("policy revision not specified")
+	}
+	if params.SigningKeyFile == "" {
+		return fmt.Errorf("signing key file not specified")
+	}
+
+	seed, err := readBase64File(params.SigningKeyFile)
+	if err != nil {
+		return fmt.Errorf("cannot read signing key: %v", err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return fmt.Errorf("invalid signing key size")
+	}
+
+	pcrProfile, err := params.buildPCRProtectionProfile()
+	if err != nil {
+		return err
+	}
+	expected, err := computeExpectedPCRValues(pcrProfile)
+	if err != nil {
+		return err
+	}
+
+	bundle := &policyUpdateBundle{
+		Revision:     params.Revision,
+		ExpectedPCRs: expected,
+	}
+	data, err := bundle.signedData()
+	if err != nil {
+		return err
+	}
+	sig := ed25519.Sign(ed25519.NewKeyFromSeed(seed), data)
+	bundle.Signature = base64.StdEncoding.EncodeToString(sig)
+
+	return writeResponse(bundle)
+}
+
+// readPolicyRevision returns the revision of the last applied policy update
+// bundle, or zero if no bundles were applied.
+func readPolicyRevision(tpm *sb.TPMConnection) (uint64, error) {
+	index, err := tpm.CreateResourceContextFromTPM(policyRevisionHandle)
+	if tpm2.IsResourceUnavailableError(err, policyRevisionHandle) {
+		return readLegacyPolicyRevision()
+	}
+	if err != nil {
+		return 0, err
+	}
+	data, err := tpm.NVRead(index, index, 8, 0, nil)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read policy revision: %v", err)
+	}
+	return binary.BigEndian.Uint64(data), nil
+}
+
+// readLegacyPolicyRevision returns the revision recorded by older versions,
+// or zero if none was recorded.
+func readLegacyPolicyRevision() (uint64, error) {
+	data, err := ioutil.ReadFile(policyRevisionFile)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// writePolicyRevision records the revision of the applied policy update
+// bundle in the TPM, where it can only be changed with the owner
+// authorization.
+func writePolicyRevision(tpm *sb.TPMConnection, revision uint64) error {
+	index, err := tpm.CreateResourceContextFromTPM(policyRevisionHandle)
+	if tpm2.IsResourceUnavailableError(err, policyRevisionHandle) {
+		if err := trackHandle(policyRevisionHandle, handlePurposePolicyRevision); err != nil {
+			return err
+		}
+		pub := tpm2.NVPublic{
+			Index:   policyRevisionHandle,
+			NameAlg: tpm2.HashAlgorithmSHA256,
+			Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVOwnerWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA),
+			Size:    8,
+		}
+		if index, err = tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, &pub, tpm.HmacSession()); err != nil {
+			return fmt.Errorf("cannot define policy revision index: %v", err)
+		}
+	} else if err != nil {
+		return err
+	}
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, revision)
+	if err := tpm.NVWrite(tpm.OwnerHandleContext(), index, data, 0, tpm.HmacSession()); err != nil {
+		return fmt.Errorf("cannot write policy revision: %v", err)
+	}
+	if err := os.Remove(policyRevisionFile); err != nil && !os.IsNotExist(err) {
+		warnf("cannot remove %s: %v", policyRevisionFile, err)
+	}
+	return nil
+}
+
+// applyPolicyUpdate verifies a signed policy update bundle and reseals the
+// key using the PCR values it contains. Resealing increments the PCR policy
+// counter, so keys sealed with the policy of an earlier bundle, including
+// copies of them, can't be unsealed anymore.
+func applyPolicyUpdate(p []byte) error {
+	var bundle policyUpdateBundle
+	if err := json.Unmarshal(p, &bundle); err != nil {
+		return err
+	}
+
+	if err := checkFileSecure(policyUpdateKeyFile); err != nil {
+		return err
+	}
+	pubKey, err := readBase64File(policyUpdateKeyFile)
+	if err != nil {
+		return fmt.Errorf("cannot read policy update key: %v", err)
+	}
+	if len(pubKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid policy update key size")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(bundle.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid bundle signature: %v", err)
+	}
+	data, err := bundle.signedData()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pubKey), data, sig) {
+		return fmt.Errorf("bundle signature verification failed")
+	}
+
+	var revision uint64
+	if err := withTPM(func(tpm *sb.TPMConnection) error {
+		revision, err = readPolicyRevision(tpm)
+		return err
+	}); err != nil {
+		return fmt.Errorf("cannot read current policy revision: %v", err)
+	}
+	if bundle.Revision <= revision {
+		return fmt.Errorf("bundle revision %d is not newer than current revision %d", bundle.Revision, revision)
+	}
+
+	pcrProfile, err := buildExpectedPCRBranchesProfile(bundle.ExpectedPCRs)
+	if err != nil {
+		return err
+	}
+	if _, err := reseal(pcrProfile, nil, true); err != nil {
+		return err
+	}
+
+	return withTPM(func(tpm *sb.TPMConnection) error {
+		return writePolicyRevision(tpm, bundle.Revision)
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// capabilities kept by the helper
+const (
+	capChown    = 0
+	capFowner   = 3
+	capIPCLock  = 14
+	capSysAdmin = 21
+	// capLast is higher than the last capability known by any kernel,
+	// dropping unknown ones fails with EINVAL
+	capLast = 63
+)
+
+// linuxCapabilityVersion3 selects 64 bit capability sets in capset.
+const linuxCapabilityVersion3 = 0x20080522
+
+// unprivilegedUser runs the operations that need no privileges. If it
+// doesn't exist, e.g. in the initramfs, nobody is used.
+const unprivilegedUser = "fde-helper"
+
+const nobodyID = 65534
+
+// privilege levels of the operations
+const (
+	// privilegesNone is for operations that only handle JSON and
+	// write to stdout.
+	privilegesNone = iota
+	// privilegesFiles is for operations that use the TPM and the files
+	// of the helper, which belong to root.
+	privilegesFiles
+	// privilegesDeviceMapper is for operations that open or change
+	// encrypted volumes.
+	privilegesDeviceMapper
+)
+
+// privileges returns the privilege level needed by the selected operation.
+func (opt *options) privileges() int {
+	switch {
+	case opt.Schema, opt.Completion != "", opt.Validate != "":
+		return privilegesNone
+	case opt.Unlock, opt.UnlockWithKey, opt.FirstBoot, opt.FactoryReset, opt.Convert,
+		opt.Unenroll, opt.Init, opt.SleepHook != "", opt.SystemdToken, opt.EnrollRecovery,
+		opt.RevokeRecovery, opt.RemoveToken, opt.UpdateToken, opt.TestHarness, opt.Bench:
+		return privilegesDeviceMapper
+	}
+	return privilegesFiles
+}
+
+type capUserHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capUserData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+// dropCapabilities removes all but the given capabilities from all threads,
+// including the bounding set, so programs executed by the helper can't
+// regain them.
+func dropCapabilities(keep ...uint) error {
+	var mask uint64
+	for _, c := range keep {
+		mask |= 1 << c
+	}
+	for c := uintptr(0); c <= capLast; c++ {
+		if mask&(1<<c) != 0 {
+			continue
+		}
+		_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, syscall.PR_CAPBSET_DROP, c, 0)
+		if errno != 0 && errno != syscall.EINVAL {
+			return fmt.Errorf("cannot drop capability %d: %v", c, errno)
+		}
+	}
+
+	hdr := capUserHeader{version: linuxCapabilityVersion3}
+	data := [2]capUserData{
+		{effective: uint32(mask), permitted: uint32(mask)},
+		{effective: uint32(mask >> 32), permitted: uint32(mask >> 32)},
+	}
+	_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if errno != 0 {
+		return fmt.Errorf("cannot set capabilities: %v", errno)
+	}
+	return nil
+}
+
+// switchToUnprivilegedUser makes the helper run as the unprivileged user
+// with no capabilities.
+func switchToUnprivilegedUser() error {
+	uid, gid := nobodyID, nobodyID
+	if u, err := user.Lookup(unprivilegedUser); err == nil {
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+	if err := syscall.Setgroups(nil); err != nil {
+		return fmt.Errorf("cannot drop supplementary groups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("cannot switch group: %v", err)
+	}
+	// switching from root clears the capabilities
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("cannot switch user: %v", err)
+	}
+	return nil
+}
+
+// dropPrivileges keeps only the privileges needed by the selected
+// operation, before its parameters are parsed, to reduce the impact of a
+// bug in their handling.
+func dropPrivileges(opt *options) error {
+	switch opt.privileges() {
+	case privilegesNone:
+		return switchToUnprivilegedUser()
+	case privilegesFiles:
+		// the files of the helper are secured by setting their owner
+		return dropCapabilities(capChown, capFowner)
+	default:
+		// dm-crypt needs CAP_SYS_ADMIN, and cryptsetup locks the
+		// keys in memory
+		return dropCapabilities(capChown, capFowner, capIPCLock, capSysAdmin)
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+	sb "github.com/snapcore/secboot"
+	"github.com/snapcore/snapd/fdehelper"
+)
+
+// PCR used by the systemd EFI stub and for the snap model measurements.
+const kernelPCR = 12
+
+// bootProfileParams describes the boot chains to build the PCR profile
+// from, when provided explicitly by the caller.
+type bootProfileParams struct {
+	// LoadChains lists the boot assets in the order they are loaded.
+	LoadChains []*loadChain `json:"load-chains,omitempty"`
+	// KernelCmdlines lists the kernel command lines measured by the
+	// systemd EFI stub.
+	KernelCmdlines []string `json:"kernel-cmdlines,omitempty"`
+	// SignatureDbUpdates lists directories containing pending secure
+	// boot db/dbx updates. The profile is made valid both before and
+	// after the updates are applied.
+	SignatureDbUpdates []string `json:"signature-db-updates,omitempty"`
+	// UKIPhases lists the boot phases measured by systemd-pcrphase
+	// into the UKI PCR before the key is unsealed, e.g. "enter-initrd".
+	UKIPhases []string `json:"uki-phases,omitempty"`
+	// UKICredentials lists the credential files passed by systemd-stub
+	// to the kernel of the unified kernel images, which it measures
+	// after the command line. They must be in the order systemd-stub
+	// reads them: sorted by name, the credentials in the directory of
+	// the image before the global ones.
+	UKICredentials []string `json:"uki-credentials,omitempty"`
+	// UKISysexts lists the system extension images passed by
+	// systemd-stub to the kernel of the unified kernel images, in the
+	// order systemd-stub reads them.
+	UKISysexts []string `json:"uki-sysexts,omitempty"`
+	// LoaderEntries lists the systemd-boot loader entry files that can
+	// be booted. The command lines they specify are measured.
+	LoaderEntries []string `json:"loader-entries,omitempty"`
+	// KernelSlots lists the kernels that can be booted in place of each
+	// load chain entry with the kernel role, e.g. the current and the
+	// try or previous kernel, so a kernel refresh that reverts still
+	// unlocks without a reseal.
+	KernelSlots []*loadChain `json:"kernel-slots,omitempty"`
+	// RecoverySystems lists the recovery systems whose kernels replace
+	// the load chain entries with the recovery-kernel role, so every
+	// bootable recovery path is covered.
+	RecoverySystems []*recoverySystem `json:"recovery-systems,omitempty"`
+	// ModelAssertions is a stream of signed model assertions, together
+	// with the account and account-key assertions needed to verify them.
+	// The models to seal to are derived from the verified assertions
+	// instead of being taken from the model parameters.
+	ModelAssertions string `json:"model-assertions,omitempty"`
+	// BootChainModel is how the platform measures the load chains, by
+	// default "uefi".
+	BootChainModel string `json:"boot-chain-model,omitempty"`
+	// MeasurementPCRs overrides the PCR each load chain role is measured
+	// to, for boot chain models that allow it.
+	MeasurementPCRs map[string]int `json:"measurement-pcrs,omitempty"`
+	// MinAssetVersion raises the minimum version of the boot assets
+	// recorded in the TPM. Load chain entries with a lower version can't
+	// be sealed to, so booting older assets doesn't unlock. The recorded
+	// version is never lowered. Once a minimum version is recorded, all
+	// load chain entries must have a version.
+	MinAssetVersion *uint64 `json:"min-asset-version,omitempty"`
+
+	// assetVersionRaised is set if building the profile raised the
+	// minimum version, so the key must be resealed.
+	assetVersionRaised bool
+	// digests caches the digests of the boot assets across runs, if
+	// set.
+	digests *digestCache
+}
+
+// inputFiles returns the files whose contents the profile is built from:
+// the boot assets in the load chains and the files measured with them.
+func (bp *bootProfileParams) inputFiles() []string {
+	files := loadChainFiles(bp.loadChains())
+	files = append(files, bp.LoaderEntries...)
+	files = append(files, bp.UKICredentials...)
+	return append(files, bp.UKISysexts...)
+}
+
+// roles of load chain entries that are kernels
+const (
+	roleKernel         = "kernel"
+	roleRecoveryKernel = "recovery-kernel"
+)
+
+// recoverySystem describes a recovery system that can be booted.
+type recoverySystem struct {
+	Label  string     `json:"label"`
+	Kernel *loadChain `json:"kernel"`
+	// KernelCmdlines lists the command lines used to boot the recovery
+	// system. By default, the recover mode command line for the system
+	// label is used.
+	KernelCmdlines []string `json:"kernel-cmdlines,omitempty"`
+}
+
+func (rs *recoverySystem) cmdlines() []string {
+	if len(rs.KernelCmdlines) > 0 {
+		return rs.KernelCmdlines
+	}
+	return []string{"snapd_recovery_mode=recover snapd_recovery_system=" + rs.Label}
+}
+
+// replaceRole returns a copy of the load chains where entries with the given
+// role are replaced by each of the given replacements.
+func replaceRole(chains []*loadChain, role string, replacements []*loadChain) []*loadChain {
+	replaced := make([]*loadChain, 0, len(chains))
+	for _, lc := range chains {
+		if lc.Role == role && len(replacements) > 0 {
+			for _, r := range replacements {
+				if r == nil {
+					continue
+				}
+				c := *r
+				if c.Role == "" {
+					c.Role = role
+				}
+				replaced = append(replaced, &c)
+			}
+			continue
+		}
+		c := *lc
+		c.Next = replaceRole(lc.Next, role, replacements)
+		replaced = append(replaced, &c)
+	}
+	return replaced
+}
+
+// hasNullEntry returns true if any entry of the load chains is null.
+func hasNullEntry(chains []*loadChain) bool {
+	for _, lc := range chains {
+		if lc == nil || hasNullEntry(lc.Next) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the load chains, kernel slots and recovery systems before
+// the load chains are expanded.
+func (bp *bootProfileParams) validate() error {
+	for _, rs := range bp.RecoverySystems {
+		if rs == nil || rs.Label == "" || rs.Kernel == nil {
+			return fmt.Errorf("recovery system must specify label and kernel")
+		}
+		if hasNullEntry(rs.Kernel.Next) {
+			return fmt.Errorf("load chain entries cannot be null")
+		}
+	}
+	if hasNullEntry(bp.LoadChains) || hasNullEntry(bp.KernelSlots) {
+		return fmt.Errorf("load chain entries cannot be null")
+	}
+	return nil
+}
+
+// loadChains returns the load chains with the kernel slots and recovery
+// system kernels expanded. The parameters must have been validated.
+func (bp *bootProfileParams) loadChains() []*loadChain {
+	chains := bp.LoadChains
+	if len(bp.KernelSlots) > 0 {
+		chains = replaceRole(chains, roleKernel, bp.KernelSlots)
+	}
+	if len(bp.RecoverySystems) > 0 {
+		kernels := make([]*loadChain, 0, len(bp.RecoverySystems))
+		for _, rs := range bp.RecoverySystems {
+			kernels = append(kernels, rs.Kernel)
+		}
+		chains = replaceRole(chains, roleRecoveryKernel, kernels)
+	}
+	return chains
+}
+
+// kernelCmdlines returns all command lines that can be measured when
+// booting the run and recovery systems.
+func (bp *bootProfileParams) kernelCmdlines() []string {
+	cmdlines := append([]string(nil), bp.KernelCmdlines...)
+	for _, rs := range bp.RecoverySystems {
+		cmdlines = append(cmdlines, rs.cmdlines()...)
+	}
+	return cmdlines
+}
+
+// loadEvents converts a load chain to the image load events used by the
+// secboot profile functions. An image given by digest can't be checked
+// against the signature databases, and must be signed by an authority that
+// verified an earlier image in the chain, so it has no event of its own: the
+// events of the images it loads are returned instead, to be attached to the
+// closest image given by path.
+func (lc *loadChain) loadEvents(source sb.ImageLoadEventSource) ([]*sb.EFIImageLoadEvent, error) {
+	if lc.Snap != "" {
+		return nil, fmt.Errorf("cannot use %s: the assets of %s were not extracted", lc.Path, lc.Snap)
+	}
+	if lc.Path == "" && lc.Digest == "" {
+		return nil, fmt.Errorf("load chain entry without path")
+	}
+
+	// images loaded by systemd-boot are verified by the firmware, other
+	// images after the first are verified through the shim
+	nextSource := sb.Shim
+	if lc.Role == roleSystemdBoot {
+		nextSource = sb.Firmware
+	}
+	var next []*sb.EFIImageLoadEvent
+	for _, n := range lc.Next {
+		evs, err := n.loadEvents(nextSource)
+		if err != nil {
+			return nil, err
+		}
+		next = append(next, evs...)
+	}
+	if lc.Path == "" {
+		return next, nil
+	}
+	return []*sb.EFIImageLoadEvent{{
+		Source: source,
+		Image:  sb.FileEFIImage(lc.Path),
+		Next:   next,
+	}}, nil
+}
+
+// models returns the given models, or the models of the model assertions if
+// specified.
+func (bp *bootProfileParams) models(models []*fdehelper.ModelParams) ([]*fdehelper.ModelParams, error) {
+	if bp.ModelAssertions == "" {
+		return models, nil
+	}
+	if len(models) > 0 {
+		return nil, fmt.Errorf("cannot use both model parameters and model assertions")
+	}
+	return verifyModelAssertions(bp.ModelAssertions)
+}
+
+// buildPCRProtectionProfile creates the PCR profile for the given models, or
+// for the models of the model assertions if specified. If no load chains
+// were specified, the profile is built from the models alone.
+func (bp *bootProfileParams) buildPCRProtectionProfile(models []*fdehelper.ModelParams) (*sb.PCRProtectionProfile, error) {
+	models, err := bp.models(models)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(bp.LoadChains) == 0 {
+		if len(bp.SignatureDbUpdates) > 0 || len(bp.KernelCmdlines) > 0 || len(bp.UKIPhases) > 0 ||
+			len(bp.UKICredentials) > 0 || len(bp.UKISysexts) > 0 || len(bp.LoaderEntries) > 0 || len(bp.KernelSlots) > 0 || len(bp.RecoverySystems) > 0 ||
+			bp.MinAssetVersion != nil {
+			return nil, fmt.Errorf("load chains must be specified to use boot profile parameters")
+		}
+		return buildPCRProtectionProfile(models)
+	}
+
+	if err := bp.validate(); err != nil {
+		return nil, err
+	}
+	chains, cleanup, err := extractSnapAssets(bp.loadChains())
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	if err := validateLoadChains(chains); err != nil {
+		return nil, err
+	}
+	if err := bp.enforceAssetVersions(chains); err != nil {
+		return nil, err
+	}
+
+	name := bp.BootChainModel
+	if name == "" {
+		name = bootChainUEFI
+	}
+	model, ok := bootChainModels[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown boot chain model %q", name)
+	}
+
+	pcrProfile := sb.NewPCRProtectionProfile()
+	if err := addRoleBranches(pcrProfile, model, bp, chains); err != nil {
+		return nil, err
+	}
+
+	// model, PCR 12
+	if len(models) > 0 {
+		snapModels := make([]sb.SnapModel, 0, len(models))
+		for _, m := range models {
+			snapModels = append(snapModels, &modelParams{*m})
+		}
+		modelProfileParams := sb.SnapModelProfileParams{
+			PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+			PCRIndex:     kernelPCR,
+			Models:       snapModels,
+		}
+		if err := sb.AddSnapModelProfile(pcrProfile, &modelProfileParams); err != nil {
+			return nil, fmt.Errorf("cannot add snap model profile: %v", err)
+		}
+	}
+
+	return pcrProfile, nil
+}
+
+// uefiBootChain is the boot chain model of UEFI platforms, where the firmware
+// measures the images it loads and the secure boot configuration.
+type uefiBootChain struct{}
+
+func (uefiBootChain) addProfile(pcrProfile *sb.PCRProtectionProfile, bp *bootProfileParams, chains []*loadChain) error {
+	loadSequences := make([]*sb.EFIImageLoadEvent, 0, len(chains))
+	for _, lc := range chains {
+		if lc.Path == "" {
+			return fmt.Errorf("the first image of a load chain must be specified by path")
+		}
+		evs, err := lc.loadEvents(sb.Firmware)
+		if err != nil {
+			return err
+		}
+		loadSequences = append(loadSequences, evs...)
+	}
+
+	// secure boot policy, PCR 7
+	sbpParams := sb.EFISecureBootPolicyProfileParams{
+		PCRAlgorithm:               tpm2.HashAlgorithmSHA256,
+		LoadSequences:              loadSequences,
+		SignatureDbUpdateKeystores: bp.SignatureDbUpdates,
+	}
+	if err := sb.AddEFISecureBootPolicyProfile(pcrProfile, &sbpParams); err != nil {
+		return fmt.Errorf("cannot add secure boot policy profile: %v", err)
+	}
+
+	// boot manager code, PCR 4
+	if hasDigests(chains) || bp.digests != nil {
+		if err := addBootManagerProfileFromDigests(pcrProfile, chains, bp.digests); err != nil {
+			return fmt.Errorf("cannot add boot manager profile: %v", err)
+		}
+	} else {
+		bmParams := sb.EFIBootManagerProfileParams{
+			PCRAlgorithm:  tpm2.HashAlgorithmSHA256,
+			LoadSequences: loadSequences,
+		}
+		if err := sb.AddEFIBootManagerProfile(pcrProfile, &bmParams); err != nil {
+			return fmt.Errorf("cannot add boot manager profile: %v", err)
+		}
+	}
+
+	// unified kernel image sections, PCR 11
+	if err := addUKIProfile(pcrProfile, chains, bp.UKIPhases); err != nil {
+		return err
+	}
+
+	// kernel command line, PCR 12
+	cmdlines := bp.kernelCmdlines()
+	if len(bp.LoaderEntries) > 0 {
+		entriesCmdlines, err := loaderEntriesCmdlines(bp.LoaderEntries)
+		if err != nil {
+			return err
+		}
+		cmdlines = append(append([]string(nil), cmdlines...), entriesCmdlines...)
+	}
+	if len(cmdlines) > 0 {
+		// systemd-boot and systemd-stub measure the command line in
+		// the same way
+		stubParams := sb.SystemdEFIStubProfileParams{
+			PCRAlgorithm:   tpm2.HashAlgorithmSHA256,
+			PCRIndex:       kernelPCR,
+			KernelCmdlines: cmdlines,
+		}
+		if err := sb.AddSystemdEFIStubProfile(pcrProfile, &stubParams); err != nil {
+			return fmt.Errorf("cannot add systemd EFI stub profile: %v", err)
+		}
+	}
+
+	// unified kernel image credentials and system extensions, PCRs 12
+	// and 13
+	return addUKIFilesProfile(pcrProfile, chains, len(cmdlines) > 0, bp.UKICredentials, bp.UKISysexts)
+}
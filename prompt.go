@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// prompter asks the user for a secret, such as a PIN or a recovery key.
+type prompter interface {
+	// ask prompts for the secret identified by id, e.g. the device it
+	// unlocks.
+	ask(id, prompt string) (string, error)
+}
+
+// prompt providers
+const (
+	prompterAskPassword = "ask-password"
+	prompterTTY         = "tty"
+	prompterPlymouth    = "plymouth"
+	prompterNone        = "none"
+)
+
+var prompters = map[string]prompter{
+	prompterAskPassword: askPasswordPrompter{},
+	prompterTTY:         ttyPrompter{},
+	prompterPlymouth:    plymouthPrompter{},
+	prompterNone:        noPrompter{},
+}
+
+// activePrompter is the prompt provider used for interactive input.
+var activePrompter prompter = askPasswordPrompter{}
+
+// errNoPrompt is returned when input is required but prompts are disabled.
+var errNoPrompt = errors.New("interactive input required but prompts are disabled")
+
+// setPrompter selects the prompt provider by name.
+func setPrompter(name string) error {
+	p, ok := prompters[name]
+	if !ok {
+		return fmt.Errorf("unknown prompt provider %q", name)
+	}
+	activePrompter = p
+	return nil
+}
+
+// trimNewline removes the line ending of the entered secret. Other
+// whitespace is kept, as it may be part of a PIN or passphrase.
+func trimNewline(s string) string {
+	s = strings.TrimSuffix(s, "\n")
+	return strings.TrimSuffix(s, "\r")
+}
+
+// askPasswordPrompter asks using systemd-ask-password, which forwards the
+// prompt to the agents running on the system.
+type askPasswordPrompter struct{}
+
+func (askPasswordPrompter) ask(id, prompt string) (string, error) {
+	output, err := exec.Command("systemd-ask-password", "--icon", "drive-harddisk", "--id", "fde-helper:"+id,
+		prompt).Output()
+	if err != nil {
+		return "", err
+	}
+	return trimNewline(string(output)), nil
+}
+
+// ttyPrompter asks in the controlling terminal, with echo disabled.
+type ttyPrompter struct{}
+
+func (ttyPrompter) ask(id, prompt string) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("cannot open terminal: %v", err)
+	}
+	defer tty.Close()
+
+	fd := int(tty.Fd())
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return "", fmt.Errorf("cannot get terminal attributes: %v", err)
+	}
+	noEcho := *termios
+	noEcho.Lflag &^= unix.ECHO
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &noEcho); err != nil {
+		return "", fmt.Errorf("cannot disable terminal echo: %v", err)
+	}
+	defer func() {
+		unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+		fmt.Fprintln(tty)
+	}()
+
+	fmt.Fprintf(tty, "%s: ", prompt)
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return trimNewline(line), nil
+}
+
+// plymouthPrompter asks using the plymouth boot splash.
+type plymouthPrompter struct{}
+
+func (plymouthPrompter) ask(id, prompt string) (string, error) {
+	output, err := exec.Command("plymouth", "ask-for-password", "--prompt="+prompt).Output()
+	if err != nil {
+		return "", err
+	}
+	return trimNewline(string(output)), nil
+}
+
+// noPrompter fails immediately, so headless systems never block waiting for
+// input.
+type noPrompter struct{}
+
+func (noPrompter) ask(id, prompt string) (string, error) {
+	return "", errNoPrompt
+}
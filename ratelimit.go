@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// the state is kept in /run so delays apply across invocations in the same
+// boot
+const defaultUnlockAttemptsFile = "/run/fde-helper/unlock-attempts"
+
+// delays between interactive unlock attempts after failures, doubling with
+// each failure
+const (
+	attemptBaseDelay = 2 * time.Second
+	attemptMaxDelay  = 5 * time.Minute
+)
+
+// attemptState tracks failed interactive unlock attempts (PIN or recovery
+// key), to slow down brute force attempts on the console.
+type attemptState struct {
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last-failure"`
+}
+
+func loadAttemptState() *attemptState {
+	var s attemptState
+	data, err := ioutil.ReadFile(unlockAttemptsFile)
+	if err != nil {
+		return &s
+	}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return &attemptState{}
+	}
+	return &s
+}
+
+func (s *attemptState) save() error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(unlockAttemptsFile), 0700); err != nil {
+		return err
+	}
+	tmp := unlockAttemptsFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("cannot write unlock attempts state: %v", err)
+	}
+	return os.Rename(tmp, unlockAttemptsFile)
+}
+
+// delay returns the time to wait after the last failure before the next
+// attempt is allowed.
+func (s *attemptState) delay() time.Duration {
+	if s.Failures == 0 {
+		return 0
+	}
+	delay := attemptBaseDelay
+	for i := 1; i < s.Failures && delay < attemptMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > attemptMaxDelay {
+		delay = attemptMaxDelay
+	}
+	return delay
+}
+
+// wait blocks until the next attempt is allowed.
+func (s *attemptState) wait() {
+	remaining := time.Until(s.LastFailure.Add(s.delay()))
+	if remaining <= 0 {
+		return
+	}
+	logf("waiting %v before the next unlock attempt", remaining.Round(time.Second))
+	time.Sleep(remaining)
+}
+
+// failed records a failed attempt.
+func (s *attemptState) failed() {
+	s.Failures++
+	s.LastFailure = time.Now()
+	if err := s.save(); err != nil {
+		warnf("%v", err)
+	}
+}
+
+// succeeded clears the failed attempts.
+func (s *attemptState) succeeded() {
+	if s.Failures == 0 {
+		return
+	}
+	s.Failures = 0
+	if err := s.save(); err != nil {
+		warnf("%v", err)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/canonical/go-tpm2"
+	sb "github.com/snapcore/secboot"
+)
+
+const (
+	// number of recovery key attempts in each unlock
+	recoveryKeyTries = 3
+
+	// defaultRecoveryFailuresFile is where older versions counted the
+	// failures, the count is moved to the TPM when found
+	defaultRecoveryFailuresFile = "/run/mnt/ubuntu-boot/fde-recovery-failures"
+
+	// wipeConfirmationToken must be given to enable the wipe policy, to
+	// make sure it's not enabled by mistake
+	wipeConfirmationToken = "erase-data-after-failed-recovery"
+)
+
+// recoveryFailuresHandle is the NV index holding the wipe policy and the
+// number of consecutive failed recovery key attempts, which can't be
+// changed without the owner authorization, unlike files in the boot
+// partition.
+const recoveryFailuresHandle tpm2.Handle = 0x01880016
+
+// wipePolicy makes the helper destroy the key material of the encrypted
+// volume after a number of consecutive failed recovery key attempts.
+type wipePolicy struct {
+	MaxFailures       int    `json:"max-failures"`
+	ConfirmationToken string `json:"confirmation-token"`
+}
+
+func (wp *wipePolicy) validate() error {
+	if wp.ConfirmationToken != wipeConfirmationToken {
+		return fmt.Errorf("wipe policy requires the confirmation token %q", wipeConfirmationToken)
+	}
+	if wp.MaxFailures <= 0 {
+		return fmt.Errorf("invalid maximum number of failures %d", wp.MaxFailures)
+	}
+	return nil
+}
+
+// recoveryFailures is the content of the recovery failures index.
+type recoveryFailures struct {
+	// max is the number of failures after which the volume is erased.
+	max uint32
+	// count is the number of consecutive failures.
+	count uint32
+}
+
+// defineRecoveryFailures creates the recovery failures index with the
+// given wipe policy and no failures, replacing an existing one.
+func defineRecoveryFailures(tpm *sb.TPMConnection, max int) error {
+	if err := evictTPMHandle(tpm, recoveryFailuresHandle); err != nil {
+		return err
+	}
+	if err := trackHandle(recoveryFailuresHandle, handlePurposeRecoveryFailures); err != nil {
+		return err
+	}
+	pub := tpm2.NVPublic{
+		Index:   recoveryFailuresHandle,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVOwnerWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA),
+		Size:    8,
+	}
+	if _, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, &pub, tpm.HmacSession()); err != nil {
+		return fmt.Errorf("cannot define recovery failures index: %v", err)
+	}
+	return writeRecoveryFailures(tpm, &recoveryFailures{max: uint32(max)})
+}
+
+// readRecoveryFailures returns the wipe policy and the number of failed
+// recovery key attempts recorded in the TPM. A policy in the metadata of
+// an older version is moved to the TPM, and nil is returned if there's no
+// policy.
+func readRecoveryFailures(tpm *sb.TPMConnection, md *keyMetadata) (*recoveryFailures, error) {
+	index, err := tpm.CreateResourceContextFromTPM(recoveryFailuresHandle)
+	if tpm2.IsResourceUnavailableError(err, recoveryFailuresHandle) {
+		if md.WipeAfterFailures <= 0 {
+			return nil, nil
+		}
+		return migrateRecoveryFailures(tpm, md.WipeAfterFailures)
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := tpm.NVRead(index, index, 8, 0, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read recovery failures index: %v", err)
+	}
+	return &recoveryFailures{
+		max:   binary.BigEndian.Uint32(data),
+		count: binary.BigEndian.Uint32(data[4:]),
+	}, nil
+}
+
+// migrateRecoveryFailures moves the wipe policy and the failure counter of
+// older versions to the TPM.
+func migrateRecoveryFailures(tpm *sb.TPMConnection, max int) (*recoveryFailures, error) {
+	f := &recoveryFailures{max: uint32(max)}
+	if data, err := ioutil.ReadFile(recoveryFailuresFile); err == nil {
+		if n, err := strconv.ParseUint(string(bytes.TrimSpace(data)), 10, 32); err == nil {
+			f.count = uint32(n)
+		}
+	}
+	if err := defineRecoveryFailures(tpm, max); err != nil {
+		return nil, err
+	}
+	if err := writeRecoveryFailures(tpm, f); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(recoveryFailuresFile); err != nil && !os.IsNotExist(err) {
+		warnf("cannot remove %s: %v", recoveryFailuresFile, err)
+	}
+	return f, nil
+}
+
+func writeRecoveryFailures(tpm *sb.TPMConnection, f *recoveryFailures) error {
+	index, err := tpm.CreateResourceContextFromTPM(recoveryFailuresHandle)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data, f.max)
+	binary.BigEndian.PutUint32(data[4:], f.count)
+	if err := tpm.NVWrite(tpm.OwnerHandleContext(), index, data, 0, tpm.HmacSession()); err != nil {
+		return fmt.Errorf("cannot write recovery failure counter: %v", err)
+	}
+	return nil
+}
+
+// cryptoErase destroys all key slots of the LUKS container and the sealed
+// keys, making the data in the device unrecoverable.
+func cryptoErase(devicePath string) error {
+	output, err := exec.Command("cryptsetup", "luksErase", "--batch-mode", devicePath).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cannot erase %s: %v: %s", devicePath, err, bytes.TrimSpace(output))
+	}
+	for _, path := range []string{sealedKeyFile, saveSealedKeyFile} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// askPassword prompts the user for a secret related to the given device,
+// using the selected prompt provider.
+func askPassword(devicePath, prompt string) (string, error) {
+	return activePrompter.ask(devicePath, prompt)
+}
+
+// askRecoveryKey prompts the user for the recovery key of the given device.
+func askRecoveryKey(devicePath string) (string, error) {
+	s, err := askPassword(devicePath, "Please enter the recovery key for disk "+devicePath)
+	if err != nil {
+		return "", fmt.Errorf("cannot ask for recovery key: %v", err)
+	}
+	// unlike PINs, recovery keys never contain whitespace
+	return strings.TrimSpace(s), nil
+}
+
+// activateWithRecoveryKey prompts for the recovery key and activates the
+// volume with it, and returns the recovery key used. Failed attempts are
+// counted across invocations, and if a wipe policy was provisioned the
+// volume is erased once the limit is reached. Input that isn't a recovery
+// key isn't counted. Attempts are delayed after failures.
+func activateWithRecoveryKey(params *unlockParams) (sb.RecoveryKey, error) {
+	md, err := readKeyMetadata(sealedKeyFile)
+	if err != nil {
+		return sb.RecoveryKey{}, err
+	}
+
+	// with a wipe policy, recovery keys can't be tried without counting
+	// the failures, unless the TPM didn't respond while unlocking, as
+	// the counter can't be read without waiting for it again
+	var tpm *sb.TPMConnection
+	var failures *recoveryFailures
+	if params.deadline != nil && params.deadline.expired {
+		if md.WipeAfterFailures > 0 {
+			warnf("TPM not responding, failed recovery attempts are not counted")
+		}
+	} else if tpm, err = connectTPM(); err == nil {
+		defer tpm.Close()
+		if failures, err = readRecoveryFailures(tpm, md); err != nil {
+			return sb.RecoveryKey{}, err
+		}
+	} else if md.WipeAfterFailures > 0 {
+		return sb.RecoveryKey{}, fmt.Errorf("cannot count failed recovery attempts: cannot connect to TPM: %v", err)
+	}
+
+	attempts := loadAttemptState()
+	for try := 0; try < recoveryKeyTries; try++ {
+		attempts.wait()
+		s, err := askRecoveryKey(params.SourceDevicePath)
+		if err != nil {
+			return sb.RecoveryKey{}, err
+		}
+		recoveryKey, err := sb.ParseRecoveryKey(s)
+		if err != nil {
+			logf("invalid recovery key: %v", err)
+			continue
+		}
+		options := params.volumeOptions(&sb.ActivateVolumeOptions{RecoveryKeyTries: 1})
+		err = sb.ActivateVolumeWithRecoveryKey(params.VolumeName, params.SourceDevicePath,
+			strings.NewReader(recoveryKey.String()+"\n"), options)
+		if err == nil {
+			attempts.succeeded()
+			if failures != nil && failures.count > 0 {
+				failures.count = 0
+				if err := writeRecoveryFailures(tpm, failures); err != nil {
+					warnf("%v", err)
+				}
+			}
+			return recoveryKey, nil
+		}
+		logf("cannot activate volume with recovery key: %v", err)
+		attempts.failed()
+
+		if failures == nil {
+			continue
+		}
+		failures.count++
+		if err := writeRecoveryFailures(tpm, failures); err != nil {
+			return sb.RecoveryKey{}, err
+		}
+		if failures.count >= failures.max {
+			if err := cryptoErase(params.SourceDevicePath); err != nil {
+				return sb.RecoveryKey{}, err
+			}
+			return sb.RecoveryKey{}, fmt.Errorf("key material of %s destroyed after %d failed recovery attempts",
+				params.SourceDevicePath, failures.count)
+		}
+	}
+	return sb.RecoveryKey{}, fmt.Errorf("cannot activate volume with recovery key after %d attempts", recoveryKeyTries)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+
+	sb "github.com/snapcore/secboot"
+)
+
+// recoveryKeyTokenType is the type of the LUKS2 tokens recording the label
+// of each recovery keyslot enrolled by the helper.
+const recoveryKeyTokenType = "fde-helper-recovery"
+
+var recoveryKeyLabelRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// recoveryKeyToken is the LUKS2 token of a labeled recovery key.
+type recoveryKeyToken struct {
+	Type     string   `json:"type"`
+	Keyslots []string `json:"keyslots"`
+	Label    string   `json:"label"`
+}
+
+// recoveryKeyInfo describes a labeled recovery key of a volume.
+type recoveryKeyInfo struct {
+	Label   string `json:"label"`
+	Keyslot int    `json:"keyslot"`
+	TokenID int    `json:"token-id"`
+}
+
+// labeledRecoveryKeys returns the labeled recovery keys of the volume in
+// the given device.
+func labeledRecoveryKeys(device string) ([]*recoveryKeyInfo, error) {
+	h, err := readLUKSHeader(device)
+	if err != nil {
+		return nil, err
+	}
+	var keys []*recoveryKeyInfo
+	for _, t := range h.Tokens {
+		if t.Type != recoveryKeyTokenType {
+			continue
+		}
+		output, err := exec.Command("cryptsetup", "token", "export", "--token-id", strconv.Itoa(t.ID), device).Output()
+		if err != nil {
+			return nil, fmt.Errorf("cannot export token %d of %s: %v", t.ID, device, err)
+		}
+		var token recoveryKeyToken
+		if err := json.Unmarshal(output, &token); err != nil {
+			return nil, fmt.Errorf("cannot parse token %d of %s: %v", t.ID, device, err)
+		}
+		if len(token.Keyslots) != 1 {
+			return nil, fmt.Errorf("invalid recovery key token %d of %s", t.ID, device)
+		}
+		slot, err := strconv.Atoi(token.Keyslots[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid keyslot in recovery key token %d of %s", t.ID, device)
+		}
+		keys = append(keys, &recoveryKeyInfo{Label: token.Label, Keyslot: slot, TokenID: t.ID})
+	}
+	return keys, nil
+}
+
+type enrollRecoveryKeyParams struct {
+	// revealKeyParams select the sealed key used to authorize adding the
+	// recovery key. Device is the volume to enroll.
+	revealKeyParams
+
+	// Label identifies the holder of the recovery key, e.g. "owner".
+	Label string `json:"label"`
+}
+
+type enrollRecoveryKeyResponse struct {
+	recoveryKeyInfo
+	RecoveryKey string `json:"recovery-key"`
+}
+
+// newKeyslot returns the keyslot in after that isn't in before.
+func newKeyslot(before, after []int) (int, bool) {
+	existing := make(map[int]bool, len(before))
+	for _, slot := range before {
+		existing[slot] = true
+	}
+	for _, slot := range after {
+		if !existing[slot] {
+			return slot, true
+		}
+	}
+	return 0, false
+}
+
+// enrollRecoveryKey adds a new recovery key with the given label to a
+// volume, in its own keyslot, and writes it to stdout.
+func enrollRecoveryKey(p []byte) error {
+	var params enrollRecoveryKeyParams
+	if err := json.Unmarshal(p, &params); err != nil {
+		return err
+	}
+	if params.Device == "" {
+		return fmt.Errorf("device not specified")
+	}
+	if !recoveryKeyLabelRegexp.MatchString(params.Label) {
+		return fmt.Errorf("invalid recovery key label %q", params.Label)
+	}
+	keys, err := labeledRecoveryKeys(params.Device)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if k.Label == params.Label {
+			return fmt.Errorf("%s already has a recovery key labeled %q", params.Device, params.Label)
+		}
+	}
+
+	key, err := unsealNamedKey(&params.revealKeyParams)
+	if err != nil {
+		return err
+	}
+
+	var recoveryKey sb.RecoveryKey
+	if _, err := rand.Read(recoveryKey[:]); err != nil {
+		return fmt.Errorf("cannot create recovery key: %v", err)
+	}
+	before, err := readLUKSHeader(params.Device)
+	if err != nil {
+		return err
+	}
+	if err := sb.AddRecoveryKeyToLUKS2Container(params.Device, key, recoveryKey, nil); err != nil {
+		return fmt.Errorf("cannot add recovery key to %s: %v", params.Device, err)
+	}
+	after, err := readLUKSHeader(params.Device)
+	if err != nil {
+		return err
+	}
+	slot, ok := newKeyslot(before.Keyslots, after.Keyslots)
+	if !ok {
+		return fmt.Errorf("cannot find the keyslot of the new recovery key")
+	}
+
+	token, err := json.Marshal(&recoveryKeyToken{
+		Type:     recoveryKeyTokenType,
+		Keyslots: []string{strconv.Itoa(slot)},
+		Label:    params.Label,
+	})
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("cryptsetup", "token", "import", params.Device)
+	cmd.Stdin = bytes.NewReader(token)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("cannot label recovery key: %v: %s", err, bytes.TrimSpace(output))
+	}
+
+	keys, err = labeledRecoveryKeys(params.Device)
+	if err != nil {
+		return err
+	}
+	resp := &enrollRecoveryKeyResponse{RecoveryKey: recoveryKey.String()}
+	for _, k := range keys {
+		if k.Label == params.Label {
+			resp.recoveryKeyInfo = *k
+		}
+	}
+	return writeResponse(resp)
+}
+
+type recoveryKeysParams struct {
+	// Device is the volume the recovery keys are enrolled in.
+	Device string `json:"device"`
+	// Label or TokenID select the recovery key to revoke.
+	Label   string `json:"label,omitempty"`
+	TokenID *int   `json:"token-id,omitempty"`
+}
+
+type listRecoveryKeysResponse struct {
+	RecoveryKeys []*recoveryKeyInfo `json:"recovery-keys"`
+}
+
+// listRecoveryKeys writes the labeled recovery keys of a volume to stdout.
+func listRecoveryKeys(p []byte) error {
+	var params recoveryKeysParams
+	if err := json.Unmarshal(p, &params); err != nil {
+		return err
+	}
+	if params.Device == "" {
+		return fmt.Errorf("device not specified")
+	}
+	keys, err := labeledRecoveryKeys(params.Device)
+	if err != nil {
+		return err
+	}
+	if keys == nil {
+		keys = []*recoveryKeyInfo{}
+	}
+	return writeResponse(&listRecoveryKeysResponse{RecoveryKeys: keys})
+}
+
+// revokeRecoveryKey removes the keyslot of the recovery key with the given
+// label and its token, keeping the other keys of the volume.
+func revokeRecoveryKey(p []byte) error {
+	var params recoveryKeysParams
+	if err := json.Unmarshal(p, &params); err != nil {
+		return err
+	}
+	if params.Device == "" || (params.Label == "" && params.TokenID == nil) {
+		return fmt.Errorf("device and label or token ID must be specified")
+	}
+	keys, err := labeledRecoveryKeys(params.Device)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if (params.TokenID != nil && k.TokenID != *params.TokenID) || (params.Label != "" && k.Label != params.Label) {
+			continue
+		}
+		output, err := exec.Command("cryptsetup", "luksKillSlot", "--batch-mode", params.Device, strconv.Itoa(k.Keyslot)).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("cannot remove keyslot %d of %s: %v: %s", k.Keyslot, params.Device, err, bytes.TrimSpace(output))
+		}
+		if err := removeLUKSToken(params.Device, k.TokenID); err != nil {
+			return err
+		}
+		logf("revoked recovery key %q of %s", k.Label, params.Device)
+		return nil
+	}
+	if params.TokenID != nil {
+		return fmt.Errorf("%s has no recovery key token %d", params.Device, *params.TokenID)
+	}
+	return fmt.Errorf("%s has no recovery key labeled %q", params.Device, params.Label)
+}
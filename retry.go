@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+	sb "github.com/snapcore/secboot"
+)
+
+const (
+	defaultRetryInitialDelay = 100 * time.Millisecond
+	defaultRetryMaxDelay     = 2 * time.Second
+)
+
+// TPM warnings indicating the command can succeed if repeated later
+var transientTPMWarnings = []tpm2.WarningCode{
+	tpm2.WarningRetry,
+	tpm2.WarningYielded,
+	tpm2.WarningTesting,
+	tpm2.WarningObjectMemory,
+	tpm2.WarningSessionMemory,
+	tpm2.WarningContextGap,
+}
+
+// isTransientTPMError returns true if the error is caused by the TPM or the
+// resource manager being temporarily busy, as opposed to an authorization
+// failure.
+func isTransientTPMError(err error) bool {
+	if e, ok := err.(*sb.ActivateWithTPMSealedKeyError); ok {
+		err = e.TPMErr
+	}
+	for _, code := range transientTPMWarnings {
+		if tpm2.IsTPMWarning(err, code, tpm2.AnyCommandCode) {
+			return true
+		}
+	}
+	var errno syscall.Errno
+	return errors.As(err, &errno) && (errno == syscall.EBUSY || errno == syscall.EAGAIN)
+}
+
+// retryPolicy sets how operations failing with transient TPM errors are
+// retried. Delays are in milliseconds and double after each attempt.
+type retryPolicy struct {
+	Retries      int `json:"retries,omitempty"`
+	InitialDelay int `json:"initial-delay,omitempty"`
+	MaxDelay     int `json:"max-delay,omitempty"`
+}
+
+// do calls f until it succeeds, fails with an error that is not transient,
+// or the retries are exhausted.
+func (rp *retryPolicy) do(f func() error) error {
+	if rp == nil {
+		return f()
+	}
+	delay := defaultRetryInitialDelay
+	if rp.InitialDelay > 0 {
+		delay = time.Duration(rp.InitialDelay) * time.Millisecond
+	}
+	maxDelay := defaultRetryMaxDelay
+	if rp.MaxDelay > 0 {
+		maxDelay = time.Duration(rp.MaxDelay) * time.Millisecond
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= rp.Retries || !isTransientTPMError(err) {
+			return err
+		}
+		warnf("transient TPM error, retrying in %v: %v", delay, err)
+		time.Sleep(delay)
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+// connectToTPM connects to the default TPM, retrying if the device is busy.
+func connectToTPM(rp *retryPolicy) (*sb.TPMConnection, error) {
+	var tpm *sb.TPMConnection
+	err := rp.do(func() error {
+		var err error
+		tpm, err = connectTPM()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to TPM: %v", err)
+	}
+	return tpm, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	sb "github.com/snapcore/secboot"
+)
+
+// names of the built-in secrets
+const (
+	keyNameData = "data"
+	keyNameSave = "save"
+)
+
+type revealKeyParams struct {
+	// KeyName selects the secret to reveal, "data" by default.
+	KeyName string `json:"key-name,omitempty"`
+	// Device is the volume the key is for, needed if the volume key is
+	// derived from the sealed key.
+	Device string `json:"device,omitempty"`
+	// Retry sets how unsealing is retried on transient TPM errors.
+	Retry *retryPolicy `json:"retry,omitempty"`
+}
+
+type revealKeyResponse struct {
+	// Key is the unsealed key, unless it was written to a file
+	// descriptor.
+	Key []byte `json:"key,omitempty"`
+}
+
+// writeKeyToFD writes the key to the given file descriptor and closes it.
+func writeKeyToFD(fd int, key []byte) error {
+	f := os.NewFile(uintptr(fd), "key-fd")
+	if f == nil {
+		return fmt.Errorf("invalid key file descriptor %d", fd)
+	}
+	defer f.Close()
+	if _, err := f.Write(key); err != nil {
+		return fmt.Errorf("cannot write key to file descriptor %d: %v", fd, err)
+	}
+	return nil
+}
+
+// revealKey unseals the key and writes it to stdout or to the given file
+// descriptor without activating any volume, like fde-reveal-key hooks do,
+// so the caller can run cryptsetup itself.
+func revealKey(p []byte, keyFD int) error {
+	var params revealKeyParams
+	if err := unmarshalOptionalParams(p, &params); err != nil {
+		return err
+	}
+
+	key, err := unsealNamedKey(&params)
+	if err != nil {
+		return err
+	}
+
+	if keyFD >= 0 {
+		if err := writeKeyToFD(keyFD, key); err != nil {
+			return err
+		}
+		return writeResponse(&revealKeyResponse{})
+	}
+	return writeResponse(&revealKeyResponse{Key: key})
+}
+
+// unsealNamedKey unseals the secret selected by the parameters and returns
+// the key of the volume, asking for the PIN if needed.
+func unsealNamedKey(params *revealKeyParams) ([]byte, error) {
+	if params.KeyName == "" {
+		params.KeyName = keyNameData
+	}
+	// a derived save key isn't sealed
+	if params.KeyName == keyNameSave {
+		if md, err := readKeyMetadata(sealedKeyFile); err == nil && md.SaveKeyDerivation != nil {
+			dataParams := *params
+			dataParams.KeyName = keyNameData
+			dataKey, err := unsealNamedKey(&dataParams)
+			if err != nil {
+				return nil, err
+			}
+			return md.SaveKeyDerivation.saveKey(dataKey), nil
+		}
+	}
+	named, err := lookupSecret(params.KeyName)
+	if err != nil {
+		return nil, err
+	}
+	keyFile := named.KeyFile
+	if err := checkFileSecure(keyFile); err != nil {
+		return nil, err
+	}
+
+	tpm, err := connectToTPM(params.Retry)
+	if err != nil {
+		return nil, err
+	}
+	defer tpm.Close()
+
+	if tpmCleared(tpm) {
+		return nil, &codedError{code: errorCodeTPMCleared, err: fmt.Errorf("storage root key or PCR policy counter not found")}
+	}
+
+	k, err := readSealedKey(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read sealed key object: %v", err)
+	}
+	var pin string
+	if k.AuthMode2F() != sb.AuthModeNone {
+		if pin, err = askPassword(keyFile, "Please enter the PIN to reveal the "+params.KeyName+" key"); err != nil {
+			return nil, fmt.Errorf("cannot ask for PIN: %v", err)
+		}
+	}
+	var secret []byte
+	err = params.Retry.do(func() error {
+		var err error
+		secret, _, err = k.UnsealFromTPM(tpm, pin)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot unseal key: %v", err)
+	}
+	md, err := readKeyMetadata(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return volumeKeyForDevice(md, secret, params.Device)
+}
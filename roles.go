@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+
+	sb "github.com/snapcore/secboot"
+)
+
+// roles of load chain entries that are boot loaders, named like the snapd
+// boot loader roles
+const (
+	roleShim               = "shim"
+	roleRunModeBootloader  = "run-mode"
+	roleRecoveryBootloader = "recovery"
+)
+
+// boot modes of the load chain paths
+const (
+	chainModeRun      = "run"
+	chainModeRecovery = "recovery"
+)
+
+// load stages of the load chain roles: an entry can't load an entry of an
+// earlier stage
+const (
+	stageBootloader = iota
+	stageKernel
+	stageKernelAsset
+)
+
+// roleStages lists the known load chain roles. Entries without a role are
+// allowed anywhere.
+var roleStages = map[string]int{
+	roleShim:               stageBootloader,
+	roleRunModeBootloader:  stageBootloader,
+	roleRecoveryBootloader: stageBootloader,
+	roleSystemdBoot:        stageBootloader,
+	roleKernel:             stageKernel,
+	roleRecoveryKernel:     stageKernel,
+	roleUKI:                stageKernel,
+	roleInitrd:             stageKernelAsset,
+	roleFDT:                stageKernelAsset,
+}
+
+// roleModes are the boot modes of the roles only booted in one mode.
+var roleModes = map[string]string{
+	roleRunModeBootloader:  chainModeRun,
+	roleKernel:             chainModeRun,
+	roleRecoveryBootloader: chainModeRecovery,
+	roleRecoveryKernel:     chainModeRecovery,
+}
+
+// name returns how the load chain entry is identified in messages. Assets
+// extracted from snaps are named by their path in the snap.
+func (lc *loadChain) name() string {
+	switch {
+	case lc.origin != nil:
+		return lc.origin.name()
+	case lc.Path != "" && lc.Snap != "":
+		return fmt.Sprintf("%s in %s", lc.Path, lc.Snap)
+	case lc.Path != "":
+		return lc.Path
+	case lc.Snap != "":
+		return lc.Snap
+	}
+	return lc.Digest
+}
+
+// validateLoadChains checks the roles of the load chain entries: the roles
+// must be known, boot loaders must come before the kernels they load, and
+// each boot loader must load the kernels of its boot mode.
+func validateLoadChains(chains []*loadChain) error {
+	return validateLoadChainRoles(chains, nil, nil)
+}
+
+func validateLoadChainRoles(chains []*loadChain, parent, bootloader *loadChain) error {
+	for _, lc := range chains {
+		stage, ok := roleStages[lc.Role]
+		if lc.Role != "" && !ok {
+			return fmt.Errorf("load chain entry %s has unknown role %q", lc.name(), lc.Role)
+		}
+		if lc.Role != "" && parent != nil {
+			parentStage := roleStages[parent.Role]
+			switch {
+			case stage < parentStage:
+				// e.g. a kernel before the boot loader
+				return fmt.Errorf("%s %s is loaded after %s %s", lc.Role, lc.name(), parent.Role, parent.name())
+			case stage == parentStage && stage != stageBootloader:
+				return fmt.Errorf("%s %s cannot be loaded by %s %s", lc.Role, lc.name(), parent.Role, parent.name())
+			}
+		}
+		if mode := roleModes[lc.Role]; mode != "" && stage == stageKernel && bootloader != nil {
+			if bmode := roleModes[bootloader.Role]; bmode != "" && bmode != mode {
+				return fmt.Errorf("%s %s is loaded by the %s boot loader %s", lc.Role, lc.name(), bootloader.Role, bootloader.name())
+			}
+		}
+
+		next := parent
+		if lc.Role != "" {
+			next = lc
+		}
+		nextBootloader := bootloader
+		if lc.Role != "" && stage == stageBootloader {
+			nextBootloader = lc
+		}
+		if err := validateLoadChainRoles(lc.Next, next, nextBootloader); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasChainMode returns true if any entry of the load chains is only booted
+// in the given mode.
+func hasChainMode(chains []*loadChain, mode string) bool {
+	for _, lc := range chains {
+		if roleModes[lc.Role] == mode || hasChainMode(lc.Next, mode) {
+			return true
+		}
+	}
+	return false
+}
+
+// chainsForMode returns a copy of the load chains without the paths that
+// include entries of another boot mode.
+func chainsForMode(chains []*loadChain, mode string) []*loadChain {
+	var kept []*loadChain
+	for _, lc := range chains {
+		if m := roleModes[lc.Role]; m != "" && m != mode {
+			continue
+		}
+		c := *lc
+		if len(lc.Next) > 0 {
+			c.Next = chainsForMode(lc.Next, mode)
+			if len(c.Next) == 0 {
+				continue
+			}
+		}
+		kept = append(kept, &c)
+	}
+	return kept
+}
+
+// addRoleBranches adds the profile of the load chains using the given boot
+// chain model. If the roles of the chains separate the run and recovery
+// paths, each gets its own branch, so the run mode command lines are only
+// allowed with the run mode assets and the recovery system command lines
+// with the recovery assets.
+func addRoleBranches(pcrProfile *sb.PCRProtectionProfile, model bootChainModel, bp *bootProfileParams, chains []*loadChain) error {
+	if len(bp.RecoverySystems) == 0 || !hasChainMode(chains, chainModeRun) || !hasChainMode(chains, chainModeRecovery) {
+		return model.addProfile(pcrProfile, bp, chains)
+	}
+
+	runParams := *bp
+	runParams.RecoverySystems = nil
+	runProfile := sb.NewPCRProtectionProfile()
+	if err := model.addProfile(runProfile, &runParams, chainsForMode(chains, chainModeRun)); err != nil {
+		return err
+	}
+
+	recoveryParams := *bp
+	recoveryParams.KernelCmdlines = nil
+	recoveryParams.LoaderEntries = nil
+	recoveryProfile := sb.NewPCRProtectionProfile()
+	if err := model.addProfile(recoveryProfile, &recoveryParams, chainsForMode(chains, chainModeRecovery)); err != nil {
+		return err
+	}
+
+	pcrProfile.AddProfileOR(runProfile, recoveryProfile)
+	return nil
+}
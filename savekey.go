@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+
+	sb "github.com/snapcore/secboot"
+)
+
+// context of the save keys derived from the data key
+const saveKeyInfo = "fde-helper ubuntu-save key"
+
+// default name of the save volume activated after the data volume
+const defaultSaveVolumeName = "ubuntu-save"
+
+// saveKeyDerivation records that the key of the save volume is derived from
+// the data key instead of being sealed, so a single object in the TPM
+// protects both volumes and only the data key is resealed on updates.
+type saveKeyDerivation struct {
+	// UUID is the UUID of the save volume, used as salt.
+	UUID string `json:"uuid"`
+}
+
+// saveKey returns the key of the save volume derived from the data key.
+func (d *saveKeyDerivation) saveKey(dataKey []byte) []byte {
+	return hkdfSHA256(dataKey, []byte(d.UUID), []byte(saveKeyInfo), 64)
+}
+
+// enrollDerivedSaveKey adds the key derived from the data key to the save
+// volume in the device, using its existing key.
+func enrollDerivedSaveKey(existingKey, dataKey []byte, device string) (*saveKeyDerivation, error) {
+	uuid, err := volumeUUID(device)
+	if err != nil {
+		return nil, err
+	}
+	if uuid == "" {
+		return nil, fmt.Errorf("%s has no UUID", device)
+	}
+	d := &saveKeyDerivation{UUID: uuid}
+	if err := cryptsetupWithKeys(existingKey, d.saveKey(dataKey), "luksAddKey", "--key-file=-", device, "/dev/fd/3"); err != nil {
+		return nil, fmt.Errorf("cannot add derived save key to %s: %v", device, err)
+	}
+	return d, nil
+}
+
+// activateDerivedSave activates the save volume with the key derived from
+// the data key, once the data volume is open. Failures are only reported,
+// as the data volume is usable without it, and returns the name of the
+// activated volume.
+func activateDerivedSave(params *unlockParams, md *keyMetadata, dataKey []byte) string {
+	if md.SaveKeyDerivation == nil || dataKey == nil {
+		return ""
+	}
+	name := params.SaveVolumeName
+	if name == "" {
+		name = defaultSaveVolumeName
+	}
+	device := params.SaveDevicePath
+	if device == "" {
+		device = "/dev/disk/by-uuid/" + md.SaveKeyDerivation.UUID
+	}
+	key := md.SaveKeyDerivation.saveKey(dataKey)
+	if err := sb.ActivateVolumeWithKey(name, device, key, params.volumeOptions(nil)); err != nil {
+		warnf("cannot activate save volume %s: %v", device, err)
+		return ""
+	}
+	return name
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+const jsonSchemaVersion = "http://json-schema.org/draft-07/schema#"
+
+// protocolType describes the parameters and response of an operation.
+type protocolType struct {
+	params   interface{}
+	response interface{}
+}
+
+// protocolTypes lists the operations handled in main, with the types of
+// their parameters and response, if any. It must be kept in sync with main.
+var protocolTypes = map[string]protocolType{
+	"supported":                  {},
+	"probe-backends":             {response: probeBackendsResponse{}},
+	"fix-permissions":            {},
+	"first-boot":                 {},
+	"generate-first-boot-unit":   {},
+	"generate-auto-update-units": {},
+	"schema":                     {},
+	"delete-ak":                  {},
+	"lock":                       {},
+	"advance-boot-phase":         {},
+	"completion":                 {},
+	"test-harness":               {params: initialProvisionParams{}, response: []harnessResult{}},
+	"initial-provision":          {params: initialProvisionParams{}, response: provisionResponse{}},
+	"field-finalize":             {params: updateParams{}},
+	"update":                     {params: updateParams{}, response: updateResponse{}},
+	"unlock":                     {params: unlockParams{}, response: unlockResponse{}},
+	"break-glass-unlock":         {params: breakGlassUnlockParams{}, response: unlockResponse{}},
+	"export-policy-update":       {params: exportPolicyUpdateParams{}, response: policyUpdateBundle{}},
+	"apply-policy-update":        {params: policyUpdateBundle{}},
+	"status":                     {response: statusResponse{}},
+	"bench":                      {params: benchParams{}, response: benchResponse{}},
+	"create-ak":                  {response: akResponse{}},
+	"activate-credential":        {params: activateCredentialParams{}, response: activateCredentialResponse{}},
+	"extend-pcr":                 {params: extendPCRParams{}, response: extendPCRResponse{}},
+	"unlock-with-key":            {params: unlockWithKeyParams{}, response: unlockResponse{}},
+	"factory-reset":              {params: factoryResetParams{}},
+	"upgrade-keydata":            {response: upgradeKeyDataResponse{}},
+	"convert":                    {params: convertParams{}, response: convertResponse{}},
+	"unenroll":                   {params: unenrollParams{}},
+	"list":                       {params: listParams{}, response: listResponse{}},
+	"export-systemd-token":       {params: exportSystemdTokenParams{}, response: exportSystemdTokenResponse{}},
+	"features":                   {response: featuresResponse{}},
+	"reveal-key":                 {params: revealKeyParams{}, response: revealKeyResponse{}},
+	"sleep-hook":                 {params: sleepHookParams{}, response: sleepHookResponse{}},
+	"list-handles":               {response: listHandlesResponse{}},
+	"list-compiled-backends":     {response: compiledBackendsResponse{}},
+	"evict-handle":               {params: evictHandleParams{}},
+	"export-eventlog":            {params: exportEventLogParams{}, response: exportEventLogResponse{}},
+	"auto-update":                {response: autoUpdateResponse{}},
+	"export-break-glass":         {params: exportBreakGlassParams{}, response: breakGlassBundle{}},
+	"enroll-recovery-key":        {params: enrollRecoveryKeyParams{}, response: enrollRecoveryKeyResponse{}},
+	"list-recovery-keys":         {params: recoveryKeysParams{}, response: listRecoveryKeysResponse{}},
+	"migrate-policy":             {params: migratePolicyParams{}, response: migratePolicyResponse{}},
+	"trial-policy":               {params: trialPolicyParams{}, response: trialPolicyResponse{}},
+	"send-failure-reports":       {response: sendFailureReportsResponse{}},
+	"revoke-recovery-key":        {params: recoveryKeysParams{}},
+	"remove-token":               {params: removeTokenParams{}, response: removeTokenResponse{}},
+	"update-token":               {params: updateTokenParams{}, response: tokenInfo{}},
+	"validate":                   {response: validateResponse{}},
+}
+
+type jsonSchema map[string]interface{}
+
+// schemaForType creates the JSON schema for values of the given type, as
+// encoded by encoding/json.
+func schemaForType(t reflect.Type) jsonSchema {
+	return typeSchema(t, map[reflect.Type]bool{})
+}
+
+// typeSchema creates the schema for the given type. Structs in seen are
+// being expanded already, and recursive references to them accept any value.
+func typeSchema(t reflect.Type, seen map[reflect.Type]bool) jsonSchema {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem(), seen)
+	case reflect.Bool:
+		return jsonSchema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonSchema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return jsonSchema{"type": "number"}
+	case reflect.String:
+		return jsonSchema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// byte slices are encoded as base64 strings
+			return jsonSchema{"type": "string", "contentEncoding": "base64"}
+		}
+		return jsonSchema{"type": "array", "items": typeSchema(t.Elem(), seen)}
+	case reflect.Map:
+		return jsonSchema{"type": "object", "additionalProperties": typeSchema(t.Elem(), seen)}
+	case reflect.Struct:
+		if t == reflect.TypeOf(time.Time{}) {
+			return jsonSchema{"type": "string", "format": "date-time"}
+		}
+		if seen[t] {
+			return jsonSchema{}
+		}
+		seen[t] = true
+		defer delete(seen, t)
+		properties := jsonSchema{}
+		addStructProperties(properties, t, seen)
+		return jsonSchema{"type": "object", "properties": properties, "additionalProperties": false}
+	}
+	// interfaces and other types can hold any value
+	return jsonSchema{}
+}
+
+// addStructProperties adds the schema of the fields of a struct type to the
+// given properties, including fields promoted from embedded structs.
+func addStructProperties(properties jsonSchema, t reflect.Type, seen map[reflect.Type]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				addStructProperties(properties, ft, seen)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = typeSchema(f.Type, seen)
+	}
+}
+
+// schemas returns the JSON schemas of the parameters and responses of all
+// operations.
+func schemas() map[string]jsonSchema {
+	all := make(map[string]jsonSchema, len(protocolTypes))
+	for op, types := range protocolTypes {
+		s := jsonSchema{}
+		if types.params != nil {
+			params := schemaForType(reflect.TypeOf(types.params))
+			params["$schema"] = jsonSchemaVersion
+			s["params"] = params
+		}
+		if types.response != nil {
+			response := schemaForType(reflect.TypeOf(types.response))
+			response["$schema"] = jsonSchemaVersion
+			s["response"] = response
+		}
+		all[op] = s
+	}
+	return all
+}
+
+// printSchema writes the JSON schemas of all operations to the response
+// output.
+func printSchema() error {
+	enc := json.NewEncoder(responseOutput)
+	enc.SetIndent("", "  ")
+	return enc.Encode(schemas())
+}
+
+// validateValue checks if a decoded JSON value conforms to the schema.
+// Like encoding/json, null is accepted for values of any type.
+func validateValue(path string, v interface{}, s jsonSchema) error {
+	if v == nil {
+		return nil
+	}
+	typ, _ := s["type"].(string)
+	switch typ {
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s: expected boolean", path)
+		}
+	case "integer":
+		n, ok := v.(float64)
+		if !ok || n != float64(int64(n)) {
+			return fmt.Errorf("%s: expected integer", path)
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			return fmt.Errorf("%s: expected number", path)
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			return fmt.Errorf("%s: expected string", path)
+		}
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected array", path)
+		}
+		for i, item := range items {
+			if err := validateValue(fmt.Sprintf("%s[%d]", path, i), item, s["items"].(jsonSchema)); err != nil {
+				return err
+			}
+		}
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected object", path)
+		}
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		properties, _ := s["properties"].(jsonSchema)
+		for _, k := range keys {
+			if ps, ok := properties[k].(jsonSchema); ok {
+				if err := validateValue(path+"."+k, obj[k], ps); err != nil {
+					return err
+				}
+				continue
+			}
+			switch additional := s["additionalProperties"].(type) {
+			case bool:
+				if !additional {
+					return fmt.Errorf("%s: unknown property %q", path, k)
+				}
+			case jsonSchema:
+				if err := validateValue(path+"."+k, obj[k], additional); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+type validateResponse struct {
+	Valid bool `json:"valid"`
+	// Error is why the parameters are not valid.
+	Error string `json:"error,omitempty"`
+}
+
+// validate checks if the parameters are valid for the given operation,
+// without executing it. Operations without parameters accept no input or
+// an empty object.
+func validate(op string, p []byte) error {
+	types, ok := protocolTypes[op]
+	if !ok {
+		return fmt.Errorf("unknown operation %q", op)
+	}
+	schema := jsonSchema{"type": "object", "properties": jsonSchema{}, "additionalProperties": false}
+	if types.params != nil {
+		schema = schemaForType(reflect.TypeOf(types.params))
+	} else if len(bytes.TrimSpace(p)) == 0 {
+		return writeResponse(&validateResponse{Valid: true})
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(p, &v); err != nil {
+		return writeResponse(&validateResponse{Error: fmt.Sprintf("invalid JSON: %v", err)})
+	}
+	if err := validateValue("params", v, schema); err != nil {
+		return writeResponse(&validateResponse{Error: err.Error()})
+	}
+	return writeResponse(&validateResponse{Valid: true})
+}
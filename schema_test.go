@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type schemaTestEmbedded struct {
+	Embedded string `json:"embedded"`
+}
+
+type schemaTestParams struct {
+	schemaTestEmbedded
+
+	Name     string            `json:"name"`
+	Count    int               `json:"count,omitempty"`
+	Ratio    float64           `json:"ratio"`
+	Enabled  bool              `json:"enabled"`
+	Data     []byte            `json:"data"`
+	Items    []string          `json:"items"`
+	Labels   map[string]int    `json:"labels"`
+	When     time.Time         `json:"when"`
+	Next     *schemaTestParams `json:"next"`
+	Skipped  string            `json:"-"`
+	internal string
+}
+
+func TestSchemaForType(t *testing.T) {
+	s := schemaForType(reflect.TypeOf(schemaTestParams{}))
+	if s["type"] != "object" || s["additionalProperties"] != false {
+		t.Fatalf("unexpected schema: %v", s)
+	}
+	properties := s["properties"].(jsonSchema)
+
+	tests := []struct {
+		property string
+		schema   jsonSchema
+	}{
+		{"embedded", jsonSchema{"type": "string"}},
+		{"name", jsonSchema{"type": "string"}},
+		{"count", jsonSchema{"type": "integer"}},
+		{"ratio", jsonSchema{"type": "number"}},
+		{"enabled", jsonSchema{"type": "boolean"}},
+		{"data", jsonSchema{"type": "string", "contentEncoding": "base64"}},
+		{"items", jsonSchema{"type": "array", "items": jsonSchema{"type": "string"}}},
+		{"labels", jsonSchema{"type": "object", "additionalProperties": jsonSchema{"type": "integer"}}},
+		{"when", jsonSchema{"type": "string", "format": "date-time"}},
+		// recursive references accept any value
+		{"next", jsonSchema{}},
+	}
+	for _, tc := range tests {
+		if !reflect.DeepEqual(properties[tc.property], tc.schema) {
+			t.Errorf("%s: expected %v, got %v", tc.property, tc.schema, properties[tc.property])
+		}
+	}
+	for _, name := range []string{"Skipped", "internal", "schemaTestEmbedded"} {
+		if _, ok := properties[name]; ok {
+			t.Errorf("unexpected property %s", name)
+		}
+	}
+	if len(properties) != len(tests) {
+		t.Errorf("expected %d properties, got %d", len(tests), len(properties))
+	}
+}
+
+func TestValidateValue(t *testing.T) {
+	s := schemaForType(reflect.TypeOf(schemaTestParams{}))
+	tests := []struct {
+		params string
+		err    string
+	}{
+		{params: `{}`},
+		{params: `{"name": "x", "count": 3, "ratio": 0.5, "enabled": true, "items": ["a"], "labels": {"a": 1}}`},
+		{params: `{"items": null, "next": {"anything": 1}}`},
+		// null is accepted for any type like encoding/json does
+		{params: `{"name": null, "enabled": null, "count": null, "labels": null, "next": null}`},
+		{params: `{"items": [null]}`},
+		{params: `null`},
+		{params: `{"name": 1}`, err: "params.name: expected string"},
+		{params: `{"count": 1.5}`, err: "params.count: expected integer"},
+		{params: `{"ratio": "1"}`, err: "params.ratio: expected number"},
+		{params: `{"enabled": "yes"}`, err: "params.enabled: expected boolean"},
+		{params: `{"items": "a"}`, err: "params.items: expected array"},
+		{params: `{"items": ["a", 2]}`, err: "params.items[1]: expected string"},
+		{params: `{"labels": {"a": "b"}}`, err: "params.labels.a: expected integer"},
+		{params: `{"unknown": 1}`, err: `params: unknown property "unknown"`},
+		{params: `[]`, err: "params: expected object"},
+	}
+	for _, tc := range tests {
+		var v interface{}
+		if err := json.Unmarshal([]byte(tc.params), &v); err != nil {
+			t.Fatal(err)
+		}
+		err := validateValue("params", v, s)
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tc.params, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tc.err {
+			t.Errorf("%s: expected error %q, got %v", tc.params, tc.err, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		op       string
+		params   string
+		response validateResponse
+		err      string
+	}{
+		{op: "unlock", params: `{"volume-name": "data"}`, response: validateResponse{Valid: true}},
+		{op: "unlock", params: `{"volume-name": 1}`, response: validateResponse{Error: "params.volume-name: expected string"}},
+		{op: "unlock", params: `{`, response: validateResponse{Error: "invalid JSON: unexpected end of JSON input"}},
+		{op: "unlock", params: `{"volume-name": null}`, response: validateResponse{Valid: true}},
+		{op: "advance-boot-phase", params: ``, response: validateResponse{Valid: true}},
+		{op: "advance-boot-phase", params: `{}`, response: validateResponse{Valid: true}},
+		{op: "status", params: `{"volume-name": "data"}`, response: validateResponse{Error: `params: unknown property "volume-name"`}},
+		{op: "unknown", params: `{}`, err: `unknown operation "unknown"`},
+	}
+	for _, tc := range tests {
+		var buf bytes.Buffer
+		output := responseOutput
+		responseOutput = &buf
+		err := validate(tc.op, []byte(tc.params))
+		responseOutput = output
+
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s %s: expected error %q, got %v", tc.op, tc.params, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: unexpected error: %v", tc.op, tc.params, err)
+			continue
+		}
+		var resp validateResponse
+		if err := json.Unmarshal(buf.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp != tc.response {
+			t.Errorf("%s %s: expected %+v, got %+v", tc.op, tc.params, tc.response, resp)
+		}
+	}
+}
+
+func TestProtocolTypesHaveSchemas(t *testing.T) {
+	all := schemas()
+	for op, types := range protocolTypes {
+		s := all[op]
+		if (types.params != nil) != (s["params"] != nil) || (types.response != nil) != (s["response"] != nil) {
+			t.Errorf("%s: schema doesn't match the protocol types", op)
+		}
+		if strings.ToLower(op) != op {
+			t.Errorf("%s: operation names must be lowercase", op)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// role of load chain entries that are the systemd-boot bootloader
+const roleSystemdBoot = "sd-boot"
+
+// loaderEntry is a systemd-boot type #1 boot loader entry.
+type loaderEntry struct {
+	Linux   string
+	Initrds []string
+	Options string
+}
+
+// parseLoaderEntry reads a boot loader entry file as described in the Boot
+// Loader Specification. Multiple options lines are joined.
+func parseLoaderEntry(path string) (*loaderEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entry loaderEntry
+	var options []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		value := ""
+		if len(fields) > 1 {
+			value = strings.TrimSpace(fields[1])
+		}
+		switch fields[0] {
+		case "linux":
+			entry.Linux = value
+		case "initrd":
+			entry.Initrds = append(entry.Initrds, value)
+		case "options":
+			options = append(options, value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read loader entry %s: %v", path, err)
+	}
+	entry.Options = strings.Join(options, " ")
+	return &entry, nil
+}
+
+// loaderEntriesCmdlines returns the kernel command lines that systemd-boot
+// measures when booting the given loader entries.
+func loaderEntriesCmdlines(paths []string) ([]string, error) {
+	cmdlines := make([]string, 0, len(paths))
+	for _, path := range paths {
+		entry, err := parseLoaderEntry(path)
+		if err != nil {
+			return nil, err
+		}
+		if entry.Linux == "" {
+			return nil, fmt.Errorf("loader entry %s has no linux image", path)
+		}
+		cmdline := entry.Options
+		for _, initrd := range entry.Initrds {
+			// systemd-boot passes the initrds in the command line
+			cmdline = strings.TrimSpace(cmdline + " initrd=" + initrd)
+		}
+		cmdlines = append(cmdlines, cmdline)
+	}
+	return cmdlines, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// namedSecret is a sealed secret addressed by name. The data and save keys
+// are built in, other secrets are registered in the volume key index.
+type namedSecret struct {
+	Name    string
+	KeyFile string
+	Backend string
+	// entry is the index entry of registered secrets.
+	entry *volumeKeyEntry
+}
+
+// builtinSecret returns the built-in secret with the given name, if any.
+func builtinSecret(name string) (*namedSecret, bool) {
+	switch name {
+	case keyNameData:
+		return &namedSecret{Name: name, KeyFile: sealedKeyFile, Backend: backendTPM2}, true
+	case keyNameSave:
+		return &namedSecret{Name: name, KeyFile: saveSealedKeyFile, Backend: backendTPM2}, true
+	}
+	return nil, false
+}
+
+func (idx *volumeKeyIndex) secret(name string) (*namedSecret, bool) {
+	e, ok := idx.Keys[name]
+	if !ok {
+		return nil, false
+	}
+	backend := e.Backend
+	if backend == "" {
+		backend = backendTPM2
+	}
+	return &namedSecret{Name: name, KeyFile: volumeKeyFile(name), Backend: backend, entry: e}, true
+}
+
+// lookupSecret returns the secret with the given name.
+func lookupSecret(name string) (*namedSecret, error) {
+	if s, ok := builtinSecret(name); ok {
+		return s, nil
+	}
+	idx, err := readVolumeKeyIndex()
+	if err != nil {
+		return nil, err
+	}
+	s, ok := idx.secret(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown secret %q", name)
+	}
+	if s.Backend != backendTPM2 {
+		return nil, fmt.Errorf("secret %q uses unsupported backend %q", name, s.Backend)
+	}
+	return s, nil
+}
+
+// listSecrets returns the built-in and registered secrets, sorted by name.
+func listSecrets() ([]*namedSecret, error) {
+	idx, err := readVolumeKeyIndex()
+	if err != nil {
+		return nil, err
+	}
+	var secrets []*namedSecret
+	for _, name := range []string{keyNameData, keyNameSave} {
+		s, _ := builtinSecret(name)
+		secrets = append(secrets, s)
+	}
+	names := make([]string, 0, len(idx.Keys))
+	for name := range idx.Keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s, _ := idx.secret(name)
+		secrets = append(secrets, s)
+	}
+	return secrets, nil
+}
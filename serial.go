@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	sb "github.com/snapcore/secboot"
+	"github.com/snapcore/snapd/asserts"
+)
+
+// deviceSerial binds a sealed key to the identity of the device it was
+// provisioned on: the serial from the serial assertion, and the TPM the
+// key was sealed with, identified by the name of its storage root key.
+type deviceSerial struct {
+	BrandID string `json:"brand-id"`
+	Model   string `json:"model"`
+	Serial  string `json:"serial"`
+	SRKName string `json:"srk-name"`
+}
+
+// serialBindingStatus reports whether the device matches the identity the
+// key is bound to.
+type serialBindingStatus struct {
+	Serial *deviceSerial `json:"serial"`
+	// Matches is false if the key was moved to another TPM, e.g. when a
+	// disk image is cloned.
+	Matches bool   `json:"matches"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// verifySerialAssertion returns the serial of the serial assertion in the
+// given stream, after verifying its signature.
+func verifySerialAssertion(stream string) (*deviceSerial, error) {
+	verified, err := verifyAssertions(stream)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range verified {
+		if s, ok := a.(*asserts.Serial); ok {
+			return &deviceSerial{BrandID: s.BrandID(), Model: s.Model(), Serial: s.Serial()}, nil
+		}
+	}
+	return nil, fmt.Errorf("no serial assertion found")
+}
+
+// currentSRKName returns the hex encoded name of the storage root key.
+func currentSRKName(tpm *sb.TPMConnection) (string, error) {
+	srk, err := tpm.CreateResourceContextFromTPM(srkHandle)
+	if err != nil {
+		return "", fmt.Errorf("cannot access storage root key: %v", err)
+	}
+	return hex.EncodeToString(srk.Name()), nil
+}
+
+// bindSerial returns the device identity to record in the metadata of a
+// key sealed for the given models.
+func bindSerial(tpm *sb.TPMConnection, stream string, models []*modelIdentity) (*deviceSerial, error) {
+	serial, err := verifySerialAssertion(stream)
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for _, m := range models {
+		if m.BrandID == serial.BrandID && m.Model == serial.Model {
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("serial assertion is for model %s/%s, which the key is not sealed to", serial.BrandID, serial.Model)
+	}
+	if serial.SRKName, err = currentSRKName(tpm); err != nil {
+		return nil, err
+	}
+	return serial, nil
+}
+
+// check verifies that the key is still on the device it's bound to. If a
+// serial assertion is given, its serial must be the one the key is bound
+// to.
+func (ds *deviceSerial) check(tpm *sb.TPMConnection, stream string) error {
+	if stream != "" {
+		serial, err := verifySerialAssertion(stream)
+		if err != nil {
+			return err
+		}
+		if serial.BrandID != ds.BrandID || serial.Model != ds.Model || serial.Serial != ds.Serial {
+			return fmt.Errorf("key is bound to device %s/%s/%s, not %s/%s/%s",
+				ds.BrandID, ds.Model, ds.Serial, serial.BrandID, serial.Model, serial.Serial)
+		}
+	}
+	name, err := currentSRKName(tpm)
+	if err != nil {
+		return err
+	}
+	if name != ds.SRKName {
+		return fmt.Errorf("key bound to device %s/%s/%s was moved to another TPM", ds.BrandID, ds.Model, ds.Serial)
+	}
+	return nil
+}
+
+// checkSerialBinding refuses to reseal a key bound to a device identity if
+// it was moved to another device.
+func checkSerialBinding(md *keyMetadata, stream string) error {
+	if md.Serial == nil {
+		if stream != "" {
+			return fmt.Errorf("key is not bound to a device serial")
+		}
+		return nil
+	}
+	tpm, err := connectTPM()
+	if err != nil {
+		return fmt.Errorf("cannot connect to TPM: %v", err)
+	}
+	defer tpm.Close()
+	return md.Serial.check(tpm, stream)
+}
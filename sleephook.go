@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	sb "github.com/snapcore/secboot"
+)
+
+// sleep hook phases, as passed by systemd-sleep
+const (
+	sleepPhasePre  = "pre"
+	sleepPhasePost = "post"
+)
+
+// the result of the last check after resume is kept until the next boot
+const defaultResumeCheckFile = "/run/fde-helper/resume-check"
+
+// default time in seconds the TPM has to respond after resume
+const defaultResumeTPMTimeout = 10
+
+type sleepHookParams struct {
+	// Volumes lists the names of the mapped volumes to suspend before
+	// sleeping and resume afterwards, so the volume keys are not in
+	// memory while the system sleeps.
+	Volumes []string `json:"volumes,omitempty"`
+	// TPMTimeout is the time in seconds the TPM has to respond after
+	// resume.
+	TPMTimeout int `json:"tpm-timeout,omitempty"`
+}
+
+// resumeCheck is the result of the TPM check after resume.
+type resumeCheck struct {
+	Time         time.Time `json:"time"`
+	TPMAvailable bool      `json:"tpm-available"`
+	// Error explains why the TPM is not available, in which case the
+	// keys can't be resealed until the next boot.
+	Error string `json:"error,omitempty"`
+}
+
+type sleepHookResponse struct {
+	// ResumeCheck is set after resume.
+	ResumeCheck *resumeCheck `json:"resume-check,omitempty"`
+	// Suspended and Resumed list the volumes suspended or resumed.
+	Suspended []string `json:"suspended,omitempty"`
+	Resumed   []string `json:"resumed,omitempty"`
+}
+
+// volumeDevice returns the source device of a mapped volume.
+func volumeDevice(volume string) (string, error) {
+	output, err := exec.Command("cryptsetup", "status", volume).Output()
+	if err != nil {
+		return "", fmt.Errorf("cannot get status of %s: %v", volume, err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "device:" {
+			return fields[1], nil
+		}
+	}
+	return "", fmt.Errorf("cannot find device of %s", volume)
+}
+
+// checkTPMAfterResume verifies that the TPM responds and still holds the
+// storage root key and the PCR policy counter.
+func checkTPMAfterResume(timeout int) *resumeCheck {
+	check := &resumeCheck{Time: time.Now().UTC()}
+	err := newTPMDeadline(timeout).run(func() error {
+		tpm, err := connectTPM()
+		if err != nil {
+			return err
+		}
+		defer tpm.Close()
+		if _, err := readDAStatus(tpm); err != nil {
+			return err
+		}
+		if tpmCleared(tpm) {
+			return fmt.Errorf("storage root key or PCR policy counter not found")
+		}
+		return nil
+	})
+	if err != nil {
+		check.Error = err.Error()
+	} else {
+		check.TPMAvailable = true
+	}
+	return check
+}
+
+func writeResumeCheck(check *resumeCheck) error {
+	data, err := json.Marshal(check)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(resumeCheckFile), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(resumeCheckFile, data, 0600)
+}
+
+// readResumeCheck returns the result of the last check after resume, if any.
+func readResumeCheck() *resumeCheck {
+	data, err := ioutil.ReadFile(resumeCheckFile)
+	if err != nil {
+		return nil
+	}
+	var check resumeCheck
+	if err := json.Unmarshal(data, &check); err != nil {
+		return nil
+	}
+	return &check
+}
+
+// resumeVolume resumes a suspended volume with the sealed key, or with the
+// recovery key if the sealed key can't be unsealed, e.g. because access to
+// the sealed keys was locked at boot.
+func resumeVolume(volume string) error {
+	device, err := volumeDevice(volume)
+	if err != nil {
+		return err
+	}
+	if key, err := unsealVolumeKey(device); err == nil {
+		if err := cryptsetupWithKeys(key, nil, "luksResume", "--key-file=-", volume); err == nil {
+			return nil
+		}
+	}
+	s, err := askRecoveryKey(device)
+	if err != nil {
+		return err
+	}
+	recoveryKey, err := sb.ParseRecoveryKey(s)
+	if err != nil {
+		return err
+	}
+	return cryptsetupWithKeys(recoveryKey[:], nil, "luksResume", "--key-file=-", volume)
+}
+
+// unsealVolumeKey unseals the sealed key and returns the key of the volume
+// in the given device.
+func unsealVolumeKey(device string) ([]byte, error) {
+	tpm, err := connectTPM()
+	if err != nil {
+		return nil, err
+	}
+	defer tpm.Close()
+	k, err := readSealedKey(sealedKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	secret, _, err := k.UnsealFromTPM(tpm, "")
+	if err != nil {
+		return nil, err
+	}
+	md, err := readKeyMetadata(sealedKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return volumeKeyForDevice(md, secret, device)
+}
+
+// sleepHook runs before the system sleeps and after it resumes. Before
+// sleeping, the volumes are suspended. After resuming, the TPM is checked
+// and the volumes are resumed.
+func sleepHook(phase string, p []byte) error {
+	var params sleepHookParams
+	if err := unmarshalOptionalParams(p, &params); err != nil {
+		return err
+	}
+
+	var resp sleepHookResponse
+	switch phase {
+	case sleepPhasePre:
+		for _, volume := range params.Volumes {
+			output, err := exec.Command("cryptsetup", "luksSuspend", volume).CombinedOutput()
+			if err != nil {
+				return fmt.Errorf("cannot suspend %s: %v: %s", volume, err, bytes.TrimSpace(output))
+			}
+			resp.Suspended = append(resp.Suspended, volume)
+		}
+	case sleepPhasePost:
+		timeout := params.TPMTimeout
+		if timeout <= 0 {
+			timeout = defaultResumeTPMTimeout
+		}
+		resp.ResumeCheck = checkTPMAfterResume(timeout)
+		if err := writeResumeCheck(resp.ResumeCheck); err != nil {
+			warnf("%v", err)
+		}
+		if !resp.ResumeCheck.TPMAvailable {
+			warnf("TPM not available after resume, keys can't be resealed until reboot: %s", resp.ResumeCheck.Error)
+		}
+		for _, volume := range params.Volumes {
+			if err := resumeVolume(volume); err != nil {
+				return fmt.Errorf("cannot resume %s: %v", volume, err)
+			}
+			resp.Resumed = append(resp.Resumed, volume)
+		}
+	default:
+		return fmt.Errorf("invalid sleep hook phase %q", phase)
+	}
+	return writeResponse(&resp)
+}
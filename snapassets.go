@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// snapAssetPath returns the clean path of an asset inside a snap, which
+// must not leave the snap.
+func snapAssetPath(lc *loadChain) (string, error) {
+	if lc.Path == "" {
+		return "", fmt.Errorf("load chain entry in %s without path", lc.Snap)
+	}
+	p := path.Clean("/" + lc.Path)[1:]
+	if p == "" || p != strings.TrimPrefix(lc.Path, "/") {
+		return "", fmt.Errorf("invalid path %q in %s", lc.Path, lc.Snap)
+	}
+	return p, nil
+}
+
+// collectSnapAssets adds the assets of the load chain entries inside snaps
+// to the given map, by snap file.
+func collectSnapAssets(chains []*loadChain, assets map[string][]string) error {
+	for _, lc := range chains {
+		if lc.Snap != "" {
+			p, err := snapAssetPath(lc)
+			if err != nil {
+				return err
+			}
+			assets[lc.Snap] = append(assets[lc.Snap], p)
+		}
+		if err := collectSnapAssets(lc.Next, assets); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceSnapAssets returns a copy of the load chains where the entries
+// inside snaps point to the files extracted to the given directories.
+func replaceSnapAssets(chains []*loadChain, dirs map[string]string) []*loadChain {
+	replaced := make([]*loadChain, 0, len(chains))
+	for _, lc := range chains {
+		c := *lc
+		if lc.Snap != "" {
+			p, _ := snapAssetPath(lc)
+			c.Path = filepath.Join(dirs[lc.Snap], p)
+			c.Snap = ""
+			c.origin = lc
+		}
+		c.Next = replaceSnapAssets(lc.Next, dirs)
+		replaced = append(replaced, &c)
+	}
+	return replaced
+}
+
+// extractSnapAssets extracts the assets of the load chain entries inside
+// snaps, e.g. kernel.efi in the kernel snap or the boot loaders in the
+// gadget snap, so they don't need to be extracted by the caller. The load
+// chains are returned with the entries pointing to the extracted files,
+// which are removed by the returned function.
+func extractSnapAssets(chains []*loadChain) ([]*loadChain, func(), error) {
+	assets := map[string][]string{}
+	if err := collectSnapAssets(chains, assets); err != nil {
+		return nil, nil, err
+	}
+	if len(assets) == 0 {
+		return chains, func() {}, nil
+	}
+
+	tmp, err := ioutil.TempDir("", "fde-helper-snap")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() { os.RemoveAll(tmp) }
+	dirs := map[string]string{}
+	for snap, paths := range assets {
+		dir := filepath.Join(tmp, strconv.Itoa(len(dirs)))
+		args := append([]string{"-n", "-d", dir, snap}, paths...)
+		if output, err := exec.Command("unsquashfs", args...).CombinedOutput(); err != nil {
+			cleanup()
+			return nil, nil, fmt.Errorf("cannot extract boot assets from %s: %v: %s", snap, err, bytes.TrimSpace(output))
+		}
+		for _, p := range paths {
+			if _, err := os.Stat(filepath.Join(dir, p)); err != nil {
+				cleanup()
+				return nil, nil, fmt.Errorf("%s not found in %s", p, snap)
+			}
+		}
+		dirs[snap] = dir
+	}
+	return replaceSnapAssets(chains, dirs), cleanup, nil
+}
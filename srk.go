@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+	sb "github.com/snapcore/secboot"
+)
+
+// storage root key algorithms
+const (
+	srkAlgorithmRSA2048  = "rsa2048"
+	srkAlgorithmECCP256  = "ecc-p256"
+	srkUniqueSizeRSA2048 = 256
+	srkUniqueSizeECCP256 = 32
+)
+
+// srkParams describes the storage root key to use instead of the one
+// created with the default template when the TPM is provisioned.
+type srkParams struct {
+	// Algorithm is the key algorithm of the template, "rsa2048" (the
+	// default) or "ecc-p256".
+	Algorithm string `json:"algorithm,omitempty"`
+	// Unique is the hex encoded unique value of the template. For ECC
+	// keys, it's the X and Y coordinates concatenated.
+	Unique string `json:"unique,omitempty"`
+	// Handle, if set, is the handle of an existing persistent storage
+	// root key whose public area is used as the template, so the key
+	// provisioned according to other standards is kept.
+	Handle *uint32 `json:"handle,omitempty"`
+}
+
+// storageTemplate returns the template of a storage primary key with the
+// given algorithm and unique value.
+func storageTemplate(alg string, unique []byte) (*tpm2.Public, error) {
+	tmpl := &tpm2.Public{
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs: tpm2.AttrFixedTPM | tpm2.AttrFixedParent | tpm2.AttrSensitiveDataOrigin |
+			tpm2.AttrUserWithAuth | tpm2.AttrNoDA | tpm2.AttrRestricted | tpm2.AttrDecrypt,
+	}
+	symmetric := tpm2.SymDefObject{
+		Algorithm: tpm2.SymObjectAlgorithmAES,
+		KeyBits:   &tpm2.SymKeyBitsU{Sym: 128},
+		Mode:      &tpm2.SymModeU{Sym: tpm2.SymModeCFB},
+	}
+
+	switch alg {
+	case "", srkAlgorithmRSA2048:
+		if len(unique) != 0 && len(unique) != srkUniqueSizeRSA2048 {
+			return nil, fmt.Errorf("invalid unique value size %d for %s key", len(unique), srkAlgorithmRSA2048)
+		}
+		tmpl.Type = tpm2.ObjectTypeRSA
+		tmpl.Params = &tpm2.PublicParamsU{
+			RSADetail: &tpm2.RSAParams{
+				Symmetric: symmetric,
+				Scheme:    tpm2.RSAScheme{Scheme: tpm2.RSASchemeNull},
+				KeyBits:   2048,
+			},
+		}
+		rsa := tpm2.PublicKeyRSA(unique)
+		tmpl.Unique = &tpm2.PublicIDU{RSA: &rsa}
+	case srkAlgorithmECCP256:
+		if len(unique) != 0 && len(unique) != 2*srkUniqueSizeECCP256 {
+			return nil, fmt.Errorf("invalid unique value size %d for %s key", len(unique), srkAlgorithmECCP256)
+		}
+		tmpl.Type = tpm2.ObjectTypeECC
+		tmpl.Params = &tpm2.PublicParamsU{
+			ECCDetail: &tpm2.ECCParams{
+				Symmetric: symmetric,
+				Scheme:    tpm2.ECCScheme{Scheme: tpm2.ECCSchemeNull},
+				CurveID:   tpm2.ECCCurveNIST_P256,
+				KDF:       tpm2.KDFScheme{Scheme: uint16(tpm2.HashAlgorithmNull)},
+			},
+		}
+		point := &tpm2.ECCPoint{}
+		if len(unique) > 0 {
+			point.X = tpm2.ECCParameter(unique[:srkUniqueSizeECCP256])
+			point.Y = tpm2.ECCParameter(unique[srkUniqueSizeECCP256:])
+		}
+		tmpl.Unique = &tpm2.PublicIDU{ECC: point}
+	default:
+		return nil, fmt.Errorf("unsupported storage root key algorithm %q", alg)
+	}
+	return tmpl, nil
+}
+
+// template returns the template of the storage root key described by the
+// parameters.
+func (p *srkParams) template() (*tpm2.Public, error) {
+	unique, err := hex.DecodeString(p.Unique)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage root key unique value: %v", err)
+	}
+	return storageTemplate(p.Algorithm, unique)
+}
+
+// existingName returns the name of the existing storage root key specified
+// by the parameters.
+func (p *srkParams) existingName(tpm *sb.TPMConnection) (tpm2.Name, error) {
+	if p.Algorithm != "" || p.Unique != "" {
+		return nil, fmt.Errorf("cannot specify both a storage root key handle and a template")
+	}
+	// the sealed key objects are loaded under the key at this handle,
+	// other handles can't be used
+	if tpm2.Handle(*p.Handle) != srkHandle {
+		return nil, fmt.Errorf("storage root key must be persisted at handle %#x", uint32(srkHandle))
+	}
+	srk, err := tpm.CreateResourceContextFromTPM(srkHandle)
+	if err != nil {
+		return nil, fmt.Errorf("cannot access storage root key: %v", err)
+	}
+	pub, _, _, err := tpm.ReadPublic(srk)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read storage root key: %v", err)
+	}
+	if pub.Attrs&(tpm2.AttrRestricted|tpm2.AttrDecrypt) != tpm2.AttrRestricted|tpm2.AttrDecrypt {
+		return nil, fmt.Errorf("key at handle %#x is not a storage key", uint32(srkHandle))
+	}
+	return srk.Name(), nil
+}
+
+// checkExistingSRK verifies that the storage root key with the given name
+// was kept when the TPM was provisioned.
+func checkExistingSRK(tpm *sb.TPMConnection, name tpm2.Name) error {
+	srk, err := tpm.CreateResourceContextFromTPM(srkHandle)
+	if err != nil || !bytes.Equal(srk.Name(), name) {
+		return fmt.Errorf("existing storage root key was replaced when provisioning the TPM")
+	}
+	return nil
+}
+
+// provisionSRK replaces the storage root key created during the TPM
+// provisioning with one created from the given template, unless it already
+// matches the template. A storage root key that doesn't match is only
+// replaced if allowed, as other software may use it.
+func provisionSRK(tpm *sb.TPMConnection, tmpl *tpm2.Public, replace bool) error {
+	srk, _, _, _, _, err := tpm.CreatePrimary(tpm.OwnerHandleContext(), nil, tmpl, nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("cannot create storage root key: %v", err)
+	}
+	defer tpm.FlushContext(srk)
+
+	if current, err := tpm.CreateResourceContextFromTPM(srkHandle); err == nil {
+		if bytes.Equal(current.Name(), srk.Name()) {
+			return nil
+		}
+		if !replace {
+			return fmt.Errorf("storage root key used by other software doesn't match the template")
+		}
+		if _, err := tpm.EvictControl(tpm.OwnerHandleContext(), current, srkHandle, nil); err != nil {
+			return fmt.Errorf("cannot evict storage root key: %v", err)
+		}
+	}
+
+	if _, err := tpm.EvictControl(tpm.OwnerHandleContext(), srk, srkHandle, nil); err != nil {
+		return fmt.Errorf("cannot persist storage root key: %v", err)
+	}
+	logf("storage root key replaced")
+	return nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+	sb "github.com/snapcore/secboot"
+)
+
+// stateFileMagic starts the state files protected by the TPM. Files without
+// it were written before they were protected and are read as they are.
+const stateFileMagic = "fde-helper-tpm-state-v1\n"
+
+// stateKeySize is the size of the AES key encrypting a state file. The key
+// is sealed instead of the state because sealed objects can only hold a
+// few bytes.
+const stateKeySize = 32
+
+// stateObjectTemplate is the template of the objects holding the state
+// keys. Their only policy is being in the storage hierarchy of the TPM:
+// unlike the disk keys they aren't bound to PCRs, as the state is needed
+// after the early boot, but a copy of the disk is not enough to read them.
+func stateObjectTemplate() *tpm2.Public {
+	return &tpm2.Public{
+		Type:    tpm2.ObjectTypeKeyedHash,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.AttrFixedTPM | tpm2.AttrFixedParent | tpm2.AttrUserWithAuth | tpm2.AttrNoDA,
+		Params: &tpm2.PublicParamsU{
+			KeyedHashDetail: &tpm2.KeyedHashParams{
+				Scheme: tpm2.KeyedHashScheme{Scheme: tpm2.KeyedHashSchemeNull},
+			},
+		},
+	}
+}
+
+// sealState encrypts the state with a new key sealed under the storage root
+// key.
+func sealState(tpm *sb.TPMConnection, state []byte) ([]byte, error) {
+	srk, err := tpm.CreateResourceContextFromTPM(srkHandle)
+	if err != nil {
+		return nil, fmt.Errorf("cannot access storage root key: %v", err)
+	}
+	key := make([]byte, stateKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("cannot create state key: %v", err)
+	}
+	session := tpm.HmacSession().IncludeAttrs(tpm2.AttrCommandEncrypt)
+	priv, pub, _, _, _, err := tpm.Create(srk, &tpm2.SensitiveCreate{Data: key}, stateObjectTemplate(), nil, nil, session)
+	if err != nil {
+		return nil, fmt.Errorf("cannot seal state key: %v", err)
+	}
+	object, err := mu.MarshalToBytes(pub, priv)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := stateCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	b.WriteString(stateFileMagic)
+	binary.Write(&b, binary.BigEndian, uint32(len(object)))
+	b.Write(object)
+	b.Write(nonce)
+	b.Write(aead.Seal(nil, nonce, state, []byte(stateFileMagic)))
+	return b.Bytes(), nil
+}
+
+// unsealState returns the state encrypted by sealState.
+func unsealState(tpm *sb.TPMConnection, data []byte) ([]byte, error) {
+	r := bytes.NewReader(data[len(stateFileMagic):])
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil || int(size) > r.Len() {
+		return nil, fmt.Errorf("invalid sealed state")
+	}
+	object := make([]byte, size)
+	r.Read(object)
+	var pub *tpm2.Public
+	var priv tpm2.Private
+	if _, err := mu.UnmarshalFromBytes(object, &pub, &priv); err != nil {
+		return nil, fmt.Errorf("invalid sealed state: %v", err)
+	}
+
+	srk, err := tpm.CreateResourceContextFromTPM(srkHandle)
+	if err != nil {
+		return nil, fmt.Errorf("cannot access storage root key: %v", err)
+	}
+	item, err := tpm.Load(srk, priv, pub, tpm.HmacSession())
+	if err != nil {
+		return nil, fmt.Errorf("cannot load state key, the storage root key may have changed: %v", err)
+	}
+	defer tpm.FlushContext(item)
+	key, err := tpm.Unseal(item, nil, tpm.HmacSession().IncludeAttrs(tpm2.AttrResponseEncrypt))
+	if err != nil {
+		return nil, fmt.Errorf("cannot unseal state key: %v", err)
+	}
+
+	aead, err := stateCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if r.Len() < aead.NonceSize() {
+		return nil, fmt.Errorf("invalid sealed state")
+	}
+	nonce := make([]byte, aead.NonceSize())
+	r.Read(nonce)
+	ciphertext := make([]byte, r.Len())
+	r.Read(ciphertext)
+	state, err := aead.Open(nil, nonce, ciphertext, []byte(stateFileMagic))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt state: %v", err)
+	}
+	return state, nil
+}
+
+func stateCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// writeStateFile writes the state to the given file, protected by the TPM.
+func writeStateFile(tpm *sb.TPMConnection, path string, state []byte) error {
+	data, err := sealState(tpm, state)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("cannot write %s: %v", path, err)
+	}
+	if err := secureFile(tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readStateFile reads the given state file, unsealing it if it's protected
+// by the TPM.
+func readStateFile(tpm *sb.TPMConnection, path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, []byte(stateFileMagic)) {
+		return data, nil
+	}
+	return unsealState(tpm, data)
+}
+
+// protectStateFiles seals the sensitive state files written in plain text,
+// e.g. the lockout authorization written by the TPM provisioning, once the
+// storage root key exists.
+func protectStateFiles(tpm *sb.TPMConnection) error {
+	for _, path := range []string{lockoutAuthFile, decoyKeyFile} {
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if bytes.HasPrefix(data, []byte(stateFileMagic)) {
+			continue
+		}
+		if err := writeStateFile(tpm, path, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unprotectStateFile writes a sealed state file back in plain text, for
+// readers outside the helper that don't know the sealed format, e.g. the
+// TPM provisioning reading the current lockout authorization. It's sealed
+// again by protectStateFiles.
+func unprotectStateFile(tpm *sb.TPMConnection, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(data, []byte(stateFileMagic)) {
+		return nil
+	}
+	state, err := unsealState(tpm, data)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, state, 0600); err != nil {
+		return fmt.Errorf("cannot write %s: %v", path, err)
+	}
+	if err := secureFile(tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// withTPM runs f with a new TPM connection.
+func withTPM(f func(tpm *sb.TPMConnection) error) error {
+	tpm, err := connectTPM()
+	if err != nil {
+		return fmt.Errorf("cannot connect to TPM: %v", err)
+	}
+	defer tpm.Close()
+	return f(tpm)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/canonical/go-tpm2"
+	sb "github.com/snapcore/secboot"
+)
+
+// daStatus contains the state of the TPM dictionary attack protection.
+type daStatus struct {
+	LockoutCounter  uint32 `json:"lockout-counter"`
+	MaxAuthFail     uint32 `json:"max-auth-fail"`
+	LockoutInterval uint32 `json:"lockout-interval"`
+	LockoutRecovery uint32 `json:"lockout-recovery"`
+	InLockout       bool   `json:"in-lockout"`
+}
+
+// remainingTries returns the number of failed authorizations allowed before
+// the TPM enters lockout mode.
+func (s *daStatus) remainingTries() uint32 {
+	if s.InLockout || s.LockoutCounter >= s.MaxAuthFail {
+		return 0
+	}
+	return s.MaxAuthFail - s.LockoutCounter
+}
+
+// readDAStatus queries the dictionary attack protection state from the TPM.
+func readDAStatus(tpm *sb.TPMConnection) (*daStatus, error) {
+	// the permanent attributes and DA parameters are contiguous
+	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyPermanent, uint32(tpm2.PropertyLockoutRecovery-tpm2.PropertyPermanent+1))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read TPM properties: %v", err)
+	}
+
+	var s daStatus
+	for _, prop := range props {
+		switch prop.Property {
+		case tpm2.PropertyPermanent:
+			s.InLockout = tpm2.PermanentAttributes(prop.Value)&tpm2.AttrInLockout > 0
+		case tpm2.PropertyLockoutCounter:
+			s.LockoutCounter = prop.Value
+		case tpm2.PropertyMaxAuthFail:
+			s.MaxAuthFail = prop.Value
+		case tpm2.PropertyLockoutInterval:
+			s.LockoutInterval = prop.Value
+		case tpm2.PropertyLockoutRecovery:
+			s.LockoutRecovery = prop.Value
+		}
+	}
+	return &s, nil
+}
+
+// statusResponse is the output of the status operation.
+type statusResponse struct {
+	TPMEnabled bool `json:"tpm-enabled"`
+	// OwnerAuthSet is set if other software set the storage hierarchy
+	// authorization.
+	OwnerAuthSet     bool          `json:"owner-auth-set,omitempty"`
+	TPM              *tpmInventory `json:"tpm,omitempty"`
+	DictionaryAttack *daStatus     `json:"dictionary-attack,omitempty"`
+	// SealedKey is the provenance of the sealed key, if there is one.
+	SealedKey *keyProvenance `json:"sealed-key,omitempty"`
+	// ResumeCheck is the result of the TPM check after the last resume.
+	ResumeCheck *resumeCheck `json:"resume-check,omitempty"`
+	// DualBoot reports how other software uses the TPM, if it does.
+	DualBoot *dualBootStatus `json:"dual-boot,omitempty"`
+	// SerialBinding reports whether the sealed key is still on the
+	// device it's bound to, if it's bound to one.
+	SerialBinding *serialBindingStatus `json:"serial-binding,omitempty"`
+}
+
+// status writes the state of the TPM to stdout.
+func status() error {
+	tpm, err := connectTPM()
+	if err != nil {
+		return fmt.Errorf("cannot connect to TPM: %v", err)
+	}
+	defer tpm.Close()
+
+	resp := statusResponse{
+		TPMEnabled:  tpm.IsEnabled(),
+		ResumeCheck: readResumeCheck(),
+	}
+	resp.TPM, err = readTPMInventory(tpm)
+	if err != nil {
+		return err
+	}
+	resp.DictionaryAttack, err = readDAStatus(tpm)
+	if err != nil {
+		return err
+	}
+	resp.OwnerAuthSet, err = ownerAuthSet(tpm)
+	if err != nil {
+		return err
+	}
+	resp.DualBoot, err = readDualBootStatus(tpm)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(sealedKeyFile); err == nil {
+		md, err := readKeyMetadata(sealedKeyFile)
+		if err != nil {
+			return err
+		}
+		resp.SealedKey = &md.keyProvenance
+		if md.Serial != nil {
+			resp.SerialBinding = &serialBindingStatus{Serial: md.Serial, Matches: true}
+			if err := md.Serial.check(tpm, ""); err != nil {
+				resp.SerialBinding.Matches = false
+				resp.SerialBinding.Reason = err.Error()
+			}
+		}
+	}
+
+	return writeResponse(&resp)
+}
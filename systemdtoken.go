@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// systemdTPM2TokenType is the type of the LUKS2 token created by
+// systemd-cryptenroll for TPM2 keyslots.
+const systemdTPM2TokenType = "systemd-tpm2"
+
+// hasToken returns whether the header contains a token of the given type.
+func (h *luksHeader) hasToken(tokenType string) bool {
+	for _, t := range h.Tokens {
+		if t.Type == tokenType {
+			return true
+		}
+	}
+	return false
+}
+
+// activateWithSystemdToken unlocks a volume enrolled by systemd-cryptenroll,
+// letting systemd-cryptsetup unseal the key described in its token.
+func activateWithSystemdToken(params *unlockParams) error {
+	output, err := exec.Command("systemd-cryptsetup", "attach", params.VolumeName, params.SourceDevicePath, "-",
+		params.systemdOptions("tpm2-device=auto,headless=true")).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cannot activate volume with %s token: %v: %s", systemdTPM2TokenType, err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+type exportSystemdTokenParams struct {
+	// Device is the path to the volume to enroll.
+	Device string `json:"device"`
+	// PCRs are the PCRs the systemd-cryptenroll key is bound to.
+	PCRs []int `json:"pcrs"`
+}
+
+type exportSystemdTokenResponse struct {
+	// Keyslot is the LUKS keyslot added by systemd-cryptenroll.
+	Keyslot *int `json:"keyslot,omitempty"`
+	// TokenID is the ID of the token added by systemd-cryptenroll.
+	TokenID *int `json:"token-id,omitempty"`
+}
+
+// exportSystemdToken enrolls a systemd-tpm2 token in the volume, unlocking
+// it with the sealed key, so the volume can also be unlocked by
+// systemd-cryptsetup.
+func exportSystemdToken(p []byte) error {
+	var params exportSystemdTokenParams
+	if err := json.Unmarshal(p, &params); err != nil {
+		return err
+	}
+	if params.Device == "" {
+		return fmt.Errorf("device not specified")
+	}
+	if len(params.PCRs) == 0 {
+		params.PCRs = []int{7}
+	}
+	pcrs := make([]string, len(params.PCRs))
+	for i, pcr := range params.PCRs {
+		pcrs[i] = strconv.Itoa(pcr)
+	}
+
+	if err := checkFileSecure(sealedKeyFile); err != nil {
+		return err
+	}
+	before, err := readLUKSHeader(params.Device)
+	if err != nil {
+		return err
+	}
+	if before.hasToken(systemdTPM2TokenType) {
+		return fmt.Errorf("%s already has a %s token", params.Device, systemdTPM2TokenType)
+	}
+
+	tpm, err := connectTPM()
+	if err != nil {
+		return fmt.Errorf("cannot connect to TPM: %v", err)
+	}
+	k, err := readSealedKey(sealedKeyFile)
+	if err != nil {
+		tpm.Close()
+		return fmt.Errorf("cannot read sealed key object: %v", err)
+	}
+	secret, _, err := k.UnsealFromTPM(tpm, "")
+	// systemd-cryptenroll needs the TPM too
+	tpm.Close()
+	if err != nil {
+		return fmt.Errorf("cannot unseal key: %v", err)
+	}
+	md, err := readKeyMetadata(sealedKeyFile)
+	if err != nil {
+		return err
+	}
+	key, err := volumeKeyForDevice(md, secret, params.Device)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("systemd-cryptenroll", "--unlock-key-file=/dev/stdin", "--tpm2-device=auto",
+		"--tpm2-pcrs="+strings.Join(pcrs, "+"), params.Device)
+	cmd.Stdin = bytes.NewReader(key)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("cannot enroll %s token: %v: %s", systemdTPM2TokenType, err, bytes.TrimSpace(output))
+	}
+
+	var resp exportSystemdTokenResponse
+	after, err := readLUKSHeader(params.Device)
+	if err != nil {
+		return err
+	}
+	for _, t := range after.Tokens {
+		if t.Type == systemdTPM2TokenType && len(t.Keyslots) > 0 {
+			resp.Keyslot = &t.Keyslots[0]
+			resp.TokenID = &t.ID
+		}
+	}
+	return writeResponse(&resp)
+}
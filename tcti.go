@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	sb "github.com/snapcore/secboot"
+)
+
+// defaultTCTI is the TPM device secboot connects to.
+const defaultTCTI = "device:/dev/tpm0"
+
+// tctiString is the TCTI configuration set with --tcti. If not set, the
+// TPM2TOOLS_TCTI environment variable is used, as in tpm2-tools.
+var tctiString string
+
+// tctiConfig is a parsed TCTI configuration string, in the form
+// name:conf.
+type tctiConfig struct {
+	name string
+	conf string
+	// options of the network TCTIs, e.g. host=localhost,port=2321
+	options map[string]string
+}
+
+func parseTCTI(s string) (*tctiConfig, error) {
+	name, conf := s, ""
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		name, conf = s[:i], s[i+1:]
+	}
+	cfg := &tctiConfig{name: name, conf: conf}
+	switch name {
+	case "device":
+		if cfg.conf == "" {
+			cfg.conf = strings.TrimPrefix(defaultTCTI, "device:")
+		}
+	case "swtpm", "mssim":
+		cfg.options = map[string]string{"host": "localhost", "port": "2321"}
+		for _, opt := range strings.Split(conf, ",") {
+			if opt == "" {
+				continue
+			}
+			kv := strings.SplitN(opt, "=", 2)
+			if len(kv) != 2 || (kv[0] != "host" && kv[0] != "port") {
+				return nil, fmt.Errorf("invalid %s TCTI option %q", name, opt)
+			}
+			cfg.options[kv[0]] = kv[1]
+		}
+	default:
+		return nil, fmt.Errorf("unknown TCTI %q", name)
+	}
+	return cfg, nil
+}
+
+// connectTPM connects to the TPM selected by the TCTI configuration.
+func connectTPM() (*sb.TPMConnection, error) {
+	s := tctiString
+	if s == "" {
+		s = os.Getenv("TPM2TOOLS_TCTI")
+	}
+	if s == "" {
+		return sb.ConnectToDefaultTPM()
+	}
+
+	cfg, err := parseTCTI(s)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.name == "device" && "device:"+cfg.conf == defaultTCTI {
+		return sb.ConnectToDefaultTPM()
+	}
+	// XXX: secboot only connects to its default device
+	return nil, fmt.Errorf("TCTI %q is not supported by secboot", s)
+}
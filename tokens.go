@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+)
+
+// helperTokenTypes are the types of the LUKS2 tokens written by the helper,
+// the only ones it removes or updates.
+var helperTokenTypes = map[string]bool{
+	recoveryKeyTokenType: true,
+	keyringTokenType:     true,
+}
+
+// tokenInfo describes a LUKS2 token written by the helper.
+type tokenInfo struct {
+	TokenID  int    `json:"token-id"`
+	Type     string `json:"type"`
+	Keyslots []int  `json:"keyslots,omitempty"`
+}
+
+type removeTokenParams struct {
+	// Device is the volume containing the token.
+	Device  string `json:"device"`
+	TokenID *int   `json:"token-id"`
+	// RemoveKeyslots also removes the keyslots of the token, e.g. of a
+	// recovery key.
+	RemoveKeyslots bool `json:"remove-keyslots,omitempty"`
+}
+
+type removeTokenResponse struct {
+	TokenID         int   `json:"token-id"`
+	RemovedKeyslots []int `json:"removed-keyslots,omitempty"`
+}
+
+type updateTokenParams struct {
+	// Device is the volume containing the token.
+	Device  string `json:"device"`
+	TokenID *int   `json:"token-id"`
+	// Label is the new label of a recovery key token.
+	Label string `json:"label,omitempty"`
+	// KeyDescription is the new description of the key of a keyring
+	// token.
+	KeyDescription string `json:"key-description,omitempty"`
+}
+
+// findToken returns the token with the given ID, if it exists.
+func (h *luksHeader) findToken(id int) *luksToken {
+	for _, t := range h.Tokens {
+		if t.ID == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// tokenOfType returns the first token of the given type, if any.
+func (h *luksHeader) tokenOfType(tokenType string) *luksToken {
+	for _, t := range h.Tokens {
+		if t.Type == tokenType {
+			return t
+		}
+	}
+	return nil
+}
+
+// helperToken returns the token with the given ID of the volume in the
+// device, which must have been written by the helper.
+func helperToken(device string, id *int) (*luksToken, error) {
+	if device == "" || id == nil {
+		return nil, fmt.Errorf("device and token ID must be specified")
+	}
+	h, err := readLUKSHeader(device)
+	if err != nil {
+		return nil, err
+	}
+	t := h.findToken(*id)
+	if t == nil {
+		return nil, fmt.Errorf("%s has no token %d", device, *id)
+	}
+	if !helperTokenTypes[t.Type] {
+		return nil, fmt.Errorf("token %d of %s is a %s token, not written by the helper", t.ID, device, t.Type)
+	}
+	return t, nil
+}
+
+// removeLUKSToken removes the token with the given ID from the device.
+func removeLUKSToken(device string, id int) error {
+	output, err := exec.Command("cryptsetup", "token", "remove", "--token-id", strconv.Itoa(id), device).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cannot remove token %d of %s: %v: %s", id, device, err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+// importLUKSToken writes the token with the given ID to the device.
+func importLUKSToken(device string, id int, token []byte) error {
+	cmd := exec.Command("cryptsetup", "token", "import", "--token-id", strconv.Itoa(id), device)
+	cmd.Stdin = bytes.NewReader(token)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("cannot import token %d to %s: %v: %s", id, device, err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+// removeToken removes a token written by the helper, and optionally its
+// keyslots, so external tooling can reconcile the LUKS header with the
+// state of the helper.
+func removeToken(p []byte) error {
+	var params removeTokenParams
+	if err := json.Unmarshal(p, &params); err != nil {
+		return err
+	}
+	t, err := helperToken(params.Device, params.TokenID)
+	if err != nil {
+		return err
+	}
+	resp := &removeTokenResponse{TokenID: t.ID}
+	if params.RemoveKeyslots {
+		for _, slot := range t.Keyslots {
+			output, err := exec.Command("cryptsetup", "luksKillSlot", "--batch-mode", params.Device, strconv.Itoa(slot)).CombinedOutput()
+			if err != nil {
+				return fmt.Errorf("cannot remove keyslot %d of %s: %v: %s", slot, params.Device, err, bytes.TrimSpace(output))
+			}
+			resp.RemovedKeyslots = append(resp.RemovedKeyslots, slot)
+		}
+	}
+	if err := removeLUKSToken(params.Device, t.ID); err != nil {
+		return err
+	}
+	return writeResponse(resp)
+}
+
+// updateToken changes the data of a token written by the helper, keeping
+// its ID.
+func updateToken(p []byte) error {
+	var params updateTokenParams
+	if err := json.Unmarshal(p, &params); err != nil {
+		return err
+	}
+	t, err := helperToken(params.Device, params.TokenID)
+	if err != nil {
+		return err
+	}
+	output, err := exec.Command("cryptsetup", "token", "export", "--token-id", strconv.Itoa(t.ID), params.Device).Output()
+	if err != nil {
+		return fmt.Errorf("cannot export token %d of %s: %v", t.ID, params.Device, err)
+	}
+	var token map[string]interface{}
+	if err := json.Unmarshal(output, &token); err != nil {
+		return fmt.Errorf("cannot parse token %d of %s: %v", t.ID, params.Device, err)
+	}
+
+	switch t.Type {
+	case recoveryKeyTokenType:
+		if params.KeyDescription != "" {
+			return fmt.Errorf("recovery key tokens have no key description")
+		}
+		if !recoveryKeyLabelRegexp.MatchString(params.Label) {
+			return fmt.Errorf("invalid recovery key label %q", params.Label)
+		}
+		keys, err := labeledRecoveryKeys(params.Device)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if k.Label == params.Label && k.TokenID != t.ID {
+				return fmt.Errorf("%s already has a recovery key labeled %q", params.Device, params.Label)
+			}
+		}
+		token["label"] = params.Label
+	case keyringTokenType:
+		if params.Label != "" {
+			return fmt.Errorf("keyring tokens have no label")
+		}
+		if params.KeyDescription == "" {
+			return fmt.Errorf("key description not specified")
+		}
+		token["key_description"] = params.KeyDescription
+	}
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	// the token is replaced, restore it if the new one can't be written
+	if err := removeLUKSToken(params.Device, t.ID); err != nil {
+		return err
+	}
+	if err := importLUKSToken(params.Device, t.ID, data); err != nil {
+		if rerr := importLUKSToken(params.Device, t.ID, output); rerr != nil {
+			warnf("cannot restore token %d of %s: %v", t.ID, params.Device, rerr)
+		}
+		return err
+	}
+	return writeResponse(&tokenInfo{TokenID: t.ID, Type: t.Type, Keyslots: t.Keyslots})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+	sb "github.com/snapcore/secboot"
+)
+
+// tpmCleared returns true if the TPM was cleared after the key was sealed,
+// which removes the storage root key and the PCR policy counter.
+func tpmCleared(tpm *sb.TPMConnection) bool {
+	for _, handle := range []tpm2.Handle{srkHandle, pcrPolicyCounterHandle} {
+		if _, err := tpm.CreateResourceContextFromTPM(handle); tpm2.IsResourceUnavailableError(err, handle) {
+			return true
+		}
+	}
+	return false
+}
+
+// recoverFromClearedTPM unlocks the volume with the recovery key, replaces
+// the volume key with a new one and provisions the TPM again with the given
+// parameters.
+func recoverFromClearedTPM(params *unlockParams) error {
+	recoveryKey, err := activateWithRecoveryKey(params)
+	if err != nil {
+		return err
+	}
+
+	key := make([]byte, 64)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("cannot create key: %v", err)
+	}
+	if err := sb.ChangeLUKS2KeyUsingRecoveryKey(params.SourceDevicePath, recoveryKey, key); err != nil {
+		return fmt.Errorf("cannot change key of %s: %v", params.SourceDevicePath, err)
+	}
+
+	// remove the stale sealed key before provisioning the TPM again
+	j, err := openJournal(journalFile)
+	if err != nil {
+		return err
+	}
+	j.Steps = nil
+	if err := j.record(stepSealStarted); err != nil {
+		return err
+	}
+	if _, err := provision(params.ReprovisionIfCleared, key, j); err != nil {
+		return fmt.Errorf("cannot provision TPM again: %v", err)
+	}
+	if err := j.finish(); err != nil {
+		return err
+	}
+
+	logf("TPM was cleared, volume unlocked with recovery key and key sealed again")
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+	sb "github.com/snapcore/secboot"
+)
+
+// maximum number of digests in a TPM2_PolicyOR, larger lists are split in
+// a tree of ORs like secboot does
+const maxPolicyORDigests = 8
+
+type trialPolicyParams struct {
+	// ExpectedPCRs are the sets of PCR values to build the policy from,
+	// each set is a branch of the policy.
+	ExpectedPCRs []*expectedPCRValues `json:"expected-pcrs"`
+	// ExpectedDigest is the hex encoded policy digest to compare the
+	// result with, if given.
+	ExpectedDigest string `json:"expected-digest,omitempty"`
+}
+
+type trialPolicyResponse struct {
+	// PCRs are the PCRs of the policy, by bank.
+	PCRs map[string][]int `json:"pcrs"`
+	// Branches are the policy digests of each set of PCR values.
+	Branches []string `json:"branches"`
+	// PolicyDigest is the digest of the PCR policy, combining the
+	// branches. This is the part of the policy of the sealed key that
+	// the policy authorization key signs.
+	PolicyDigest string `json:"policy-digest"`
+	// Match reports whether the policy digest is the expected one, if
+	// given.
+	Match *bool `json:"match,omitempty"`
+}
+
+// trialPolicyDigest runs the given policy commands in a trial session and
+// returns the resulting digest.
+func trialPolicyDigest(tpm *sb.TPMConnection, run func(session tpm2.SessionContext) error) (tpm2.Digest, error) {
+	session, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypeTrial, nil, tpm2.HashAlgorithmSHA256)
+	if err != nil {
+		return nil, fmt.Errorf("cannot start trial session: %v", err)
+	}
+	defer tpm.FlushContext(session)
+	if err := run(session); err != nil {
+		return nil, err
+	}
+	return tpm.PolicyGetDigest(session)
+}
+
+// policyORDigest combines the branch digests with TPM2_PolicyOR.
+func policyORDigest(tpm *sb.TPMConnection, digests tpm2.DigestList) (tpm2.Digest, error) {
+	for len(digests) > maxPolicyORDigests {
+		var next tpm2.DigestList
+		for i := 0; i < len(digests); i += maxPolicyORDigests {
+			end := i + maxPolicyORDigests
+			if end > len(digests) {
+				end = len(digests)
+			}
+			d, err := policyORDigest(tpm, digests[i:end])
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, d)
+		}
+		digests = next
+	}
+	if len(digests) == 1 {
+		return digests[0], nil
+	}
+	return trialPolicyDigest(tpm, func(session tpm2.SessionContext) error {
+		if err := tpm.PolicyOR(session, digests); err != nil {
+			return fmt.Errorf("cannot run TPM2_PolicyOR: %v", err)
+		}
+		return nil
+	})
+}
+
+// trialPolicy builds the PCR policy from the given PCR values in trial
+// sessions and writes the resulting digests, so expected digests can be
+// checked against what the TPM computes.
+func trialPolicy(p []byte) error {
+	var params trialPolicyParams
+	if err := json.Unmarshal(p, &params); err != nil {
+		return err
+	}
+	var expected []byte
+	if params.ExpectedDigest != "" {
+		var err error
+		if expected, err = hex.DecodeString(params.ExpectedDigest); err != nil {
+			return fmt.Errorf("invalid expected digest: %v", err)
+		}
+	}
+	pcrProfile, err := buildExpectedPCRProtectionProfile(params.ExpectedPCRs)
+	if err != nil {
+		return err
+	}
+
+	tpm, err := connectTPM()
+	if err != nil {
+		return fmt.Errorf("cannot connect to TPM: %v", err)
+	}
+	defer tpm.Close()
+
+	pcrs, pcrDigests, err := pcrProfile.ComputePCRDigests(tpm.TPMContext, tpm2.HashAlgorithmSHA256)
+	if err != nil {
+		return fmt.Errorf("cannot compute PCR digests: %v", err)
+	}
+
+	resp := &trialPolicyResponse{PCRs: map[string][]int{}}
+	for _, s := range pcrs {
+		resp.PCRs[digestAlgorithmName(s.Hash)] = s.Select
+	}
+	var branches tpm2.DigestList
+	for _, pcrDigest := range pcrDigests {
+		d, err := trialPolicyDigest(tpm, func(session tpm2.SessionContext) error {
+			if err := tpm.PolicyPCR(session, pcrDigest, pcrs); err != nil {
+				return fmt.Errorf("cannot run TPM2_PolicyPCR: %v", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		branches = append(branches, d)
+		resp.Branches = append(resp.Branches, hex.EncodeToString(d))
+	}
+	digest, err := policyORDigest(tpm, branches)
+	if err != nil {
+		return err
+	}
+	resp.PolicyDigest = hex.EncodeToString(digest)
+	if expected != nil {
+		match := bytes.Equal(digest, expected)
+		resp.Match = &match
+	}
+	return writeResponse(resp)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/sha256"
+	"debug/pe"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/canonical/go-tpm2"
+	sb "github.com/snapcore/secboot"
+)
+
+const (
+	// role of load chain entries that are unified kernel images
+	roleUKI = "uki"
+
+	// PCR where systemd-stub measures the UKI sections
+	ukiPCR = 11
+	// PCR where systemd-stub measures the credentials it passes to the
+	// kernel, after the command line
+	ukiCredentialsPCR = 12
+	// PCR where systemd-stub measures the system extension images it
+	// passes to the kernel
+	ukiSysextsPCR = 13
+)
+
+// ukiSections lists the UKI sections measured by systemd-stub, in the order
+// they are measured.
+var ukiSections = []string{
+	".linux", ".osrel", ".cmdline", ".initrd", ".splash", ".dtb", ".uname", ".sbat", ".pcrpkey",
+}
+
+// computeUKIPCRValue computes the value of the PCR extended by systemd-stub
+// when booting the given unified kernel image. Each section present in the
+// image is measured as its NUL-terminated name followed by its contents.
+// The given boot phases, as measured by systemd-pcrphase, are extended
+// after the sections.
+func computeUKIPCRValue(path string, phases []string) (tpm2.Digest, error) {
+	f, err := pe.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open UKI %s: %v", path, err)
+	}
+	defer f.Close()
+
+	pcr := make([]byte, sha256.Size)
+	extend := func(data []byte) {
+		d := sha256.Sum256(data)
+		h := sha256.New()
+		h.Write(pcr)
+		h.Write(d[:])
+		pcr = h.Sum(nil)
+	}
+
+	found := false
+	for _, name := range ukiSections {
+		s := f.Section(name)
+		if s == nil {
+			continue
+		}
+		data, err := s.Data()
+		if err != nil {
+			return nil, fmt.Errorf("cannot read section %s of %s: %v", name, path, err)
+		}
+		if s.VirtualSize < uint32(len(data)) {
+			data = data[:s.VirtualSize]
+		}
+		extend(append([]byte(name), 0))
+		extend(data)
+		if name == ".linux" {
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%s is not a unified kernel image", path)
+	}
+
+	for _, phase := range phases {
+		extend([]byte(phase))
+	}
+	return pcr, nil
+}
+
+// ukiPaths returns the paths of the unified kernel images in the load chains.
+func ukiPaths(chains []*loadChain) []string {
+	var paths []string
+	for _, lc := range chains {
+		if lc.Role == roleUKI {
+			paths = append(paths, lc.Path)
+		}
+		paths = append(paths, ukiPaths(lc.Next)...)
+	}
+	return paths
+}
+
+// addUKIProfile makes the profile require the UKI measurements of one of
+// the unified kernel images in the load chains, if any.
+func addUKIProfile(pcrProfile *sb.PCRProtectionProfile, chains []*loadChain, phases []string) error {
+	paths := ukiPaths(chains)
+	if len(paths) == 0 {
+		return nil
+	}
+
+	branches := make([]*sb.PCRProtectionProfile, 0, len(paths))
+	for _, path := range paths {
+		if path == "" {
+			return fmt.Errorf("unified kernel images must be specified by path")
+		}
+		value, err := computeUKIPCRValue(path, phases)
+		if err != nil {
+			return err
+		}
+		branches = append(branches, sb.NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, ukiPCR, value))
+	}
+	pcrProfile.AddProfileOR(branches...)
+	return nil
+}
+
+// extendUKIFiles extends the PCR with the measurements of the given files,
+// which systemd-stub measures as their contents.
+func extendUKIFiles(pcrProfile *sb.PCRProtectionProfile, pcr int, paths []string) error {
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		d := sha256.Sum256(data)
+		pcrProfile.ExtendPCR(tpm2.HashAlgorithmSHA256, pcr, d[:])
+	}
+	return nil
+}
+
+// addUKIFilesProfile makes the profile require the measurements of the
+// credentials and system extension images passed by systemd-stub to the
+// kernel of the unified kernel images. The credentials are measured after
+// the command line, if any.
+func addUKIFilesProfile(pcrProfile *sb.PCRProtectionProfile, chains []*loadChain, cmdlineMeasured bool, credentials, sysexts []string) error {
+	if len(credentials) == 0 && len(sysexts) == 0 {
+		return nil
+	}
+	if len(ukiPaths(chains)) == 0 {
+		return fmt.Errorf("credentials and system extensions require a unified kernel image")
+	}
+
+	if len(credentials) > 0 {
+		if !cmdlineMeasured {
+			pcrProfile.AddPCRValue(tpm2.HashAlgorithmSHA256, ukiCredentialsPCR, make(tpm2.Digest, sha256.Size))
+		}
+		if err := extendUKIFiles(pcrProfile, ukiCredentialsPCR, credentials); err != nil {
+			return fmt.Errorf("cannot measure credential: %v", err)
+		}
+	}
+	if len(sysexts) > 0 {
+		pcrProfile.AddPCRValue(tpm2.HashAlgorithmSHA256, ukiSysextsPCR, make(tpm2.Digest, sha256.Size))
+		if err := extendUKIFiles(pcrProfile, ukiSysextsPCR, sysexts); err != nil {
+			return fmt.Errorf("cannot measure system extension: %v", err)
+		}
+	}
+	return nil
+}
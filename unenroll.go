@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+type unenrollParams struct {
+	// Device is the path to the volume to remove the TPM unlock from.
+	Device string `json:"device"`
+	// Keyslot and Passphrase can be used to remove the TPM keyslot if
+	// the key can't be unsealed anymore, e.g. before a hardware swap.
+	Keyslot    *int   `json:"keyslot,omitempty"`
+	Passphrase string `json:"passphrase,omitempty"`
+}
+
+// unenroll removes the keyslot of the sealed key from the volume, deletes
+// the sealed key and releases its TPM resources. The other keyslots are
+// kept, so the volume can still be unlocked with a passphrase.
+func unenroll(p []byte) error {
+	var params unenrollParams
+	if err := json.Unmarshal(p, &params); err != nil {
+		return err
+	}
+	if params.Device == "" {
+		return fmt.Errorf("device not specified")
+	}
+
+	h, err := readLUKSHeader(params.Device)
+	if err != nil {
+		return err
+	}
+	if len(h.Keyslots) < 2 {
+		return fmt.Errorf("cannot remove the only keyslot of %s", params.Device)
+	}
+	if dryRun {
+		return planUnenroll(&params)
+	}
+
+	tpm, err := connectTPM()
+	if err != nil {
+		return fmt.Errorf("cannot connect to TPM: %v", err)
+	}
+	defer tpm.Close()
+
+	if params.Keyslot != nil {
+		if params.Passphrase == "" {
+			return fmt.Errorf("passphrase required to remove keyslot %d", *params.Keyslot)
+		}
+		if err := cryptsetupWithKeys([]byte(params.Passphrase), nil, "luksKillSlot", "--key-file=-",
+			params.Device, strconv.Itoa(*params.Keyslot)); err != nil {
+			return fmt.Errorf("cannot remove keyslot %d: %v", *params.Keyslot, err)
+		}
+	} else {
+		if err := checkFileSecure(sealedKeyFile); err != nil {
+			return err
+		}
+		k, err := readSealedKey(sealedKeyFile)
+		if err != nil {
+			return fmt.Errorf("cannot read sealed key object: %v", err)
+		}
+		secret, _, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			return fmt.Errorf("cannot unseal key: %v", err)
+		}
+		md, err := readKeyMetadata(sealedKeyFile)
+		if err != nil {
+			return err
+		}
+		key, err := volumeKeyForDevice(md, secret, params.Device)
+		if err != nil {
+			return err
+		}
+		if err := cryptsetupWithKeys(key, nil, "luksRemoveKey", "--key-file=-", params.Device); err != nil {
+			return fmt.Errorf("cannot remove sealed key from %s: %v", params.Device, err)
+		}
+	}
+
+	// remove the sealed keys and the PCR policy counter
+	return rollbackSeal(tpm)
+}
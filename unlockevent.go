@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// the log is kept in /run and lives as long as the measurements in the PCR
+const defaultUnlockEventLogFile = "/run/fde-helper/unlock-events.log"
+
+// unlockMeasurement makes unlock extend a PCR with an event recording how
+// the volume was unlocked, so remote attestation can tell whether the
+// measured path or the recovery key was used.
+type unlockMeasurement struct {
+	// PCR defaults to the application support PCR.
+	PCR *int `json:"pcr,omitempty"`
+}
+
+// unlockEvent is an entry of the unlock event log.
+type unlockEvent struct {
+	PCR    int       `json:"pcr"`
+	Digest string    `json:"digest"`
+	Data   string    `json:"data"`
+	Time   time.Time `json:"time"`
+}
+
+// unlockEventData returns the event data measured after unlocking a volume
+// with the given method.
+func unlockEventData(volume, method string) string {
+	return fmt.Sprintf("fde-unlocked %s %s", volume, method)
+}
+
+// measureUnlock extends the PCR with the unlock event and appends it to the
+// unlock event log.
+func measureUnlock(m *unlockMeasurement, volume, method string) (*extendPCRResponse, error) {
+	pcr := applicationPCR
+	if m.PCR != nil {
+		pcr = *m.PCR
+	}
+	if err := checkApplicationPCR(pcr); err != nil {
+		return nil, err
+	}
+
+	data := unlockEventData(volume, method)
+	h := sha256.Sum256([]byte(data))
+
+	tpm, err := connectTPM()
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to TPM: %v", err)
+	}
+	defer tpm.Close()
+	if err := extendApplicationPCR(tpm, pcr, h[:]); err != nil {
+		return nil, err
+	}
+
+	ev := unlockEvent{
+		PCR:    pcr,
+		Digest: hex.EncodeToString(h[:]),
+		Data:   data,
+		Time:   time.Now().UTC(),
+	}
+	if err := appendUnlockEvent(&ev); err != nil {
+		return nil, err
+	}
+	return &extendPCRResponse{PCR: pcr, Digest: ev.Digest}, nil
+}
+
+// appendUnlockEvent adds an event to the unlock event log, one JSON object
+// per line.
+func appendUnlockEvent(ev *unlockEvent) error {
+	if err := os.MkdirAll(filepath.Dir(unlockEventLogFile), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(unlockEventLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot open unlock event log: %v", err)
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(ev)
+}
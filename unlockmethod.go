@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+)
+
+// methods used to unlock a volume
+const (
+	unlockMethodSealedKey    = "sealed-key"
+	unlockMethodSealedKeyPIN = "sealed-key-pin"
+	unlockMethodCachedKey    = "cached-key"
+	unlockMethodRecoveryKey  = "recovery-key"
+	unlockMethodProvidedKey  = "provided-key"
+	unlockMethodSystemdTPM2  = "systemd-tpm2"
+)
+
+type unlockResponse struct {
+	// Method is how the volume was unlocked.
+	Method string `json:"method"`
+	// Keyslot is the LUKS keyslot that matched the key, if reported by
+	// the activation, i.e. with keyring activation.
+	Keyslot *int `json:"keyslot,omitempty"`
+	// Degraded is set if the volume could not be unlocked with the
+	// sealed key, and remediation is needed.
+	Degraded bool `json:"degraded,omitempty"`
+	// Measurement is the event extended to a PCR after unlocking, if
+	// requested.
+	Measurement *extendPCRResponse `json:"measurement,omitempty"`
+	// KeysLocked reports whether access to the sealed keys was locked,
+	// if requested.
+	KeysLocked *bool `json:"keys-locked,omitempty"`
+	// TPMTimeout is set if the TPM didn't respond before the unlock
+	// deadline.
+	TPMTimeout bool `json:"tpm-timeout,omitempty"`
+	// CorruptKey is set if the sealed key couldn't be read.
+	CorruptKey bool `json:"corrupt-key,omitempty"`
+	// BootMode is the boot mode the volume was unlocked in.
+	BootMode string `json:"boot-mode,omitempty"`
+	// KeyringKeys lists the keys added to or used from the kernel
+	// keyring.
+	KeyringKeys []*keyringKey `json:"keyring-keys,omitempty"`
+	// SaveVolume is the name of the save volume opened with the key
+	// derived from the data key, if any.
+	SaveVolume string `json:"save-volume,omitempty"`
+	// KeyringTokenID is the ID of the keyring token the volume was
+	// activated with, if keyring activation was requested.
+	KeyringTokenID *int `json:"keyring-token-id,omitempty"`
+
+	// failure is why the sealed key couldn't be used, for the failure
+	// report.
+	failure string
+}
+
+var keyslotUnlockedRegexp = regexp.MustCompile(`Key slot ([0-9]+) unlocked`)
+
+// keyslotForKey returns the LUKS keyslot of the device that can be unlocked
+// with the given key.
+func keyslotForKey(devicePath string, key []byte) (int, error) {
+	cmd := exec.Command("cryptsetup", "open", "--test-passphrase", "--verbose", "--key-file=-", devicePath)
+	cmd.Stdin = bytes.NewReader(key)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("cannot test key on %s: %v: %s", devicePath, err, bytes.TrimSpace(output))
+	}
+	m := keyslotUnlockedRegexp.FindSubmatch(output)
+	if m == nil {
+		return 0, fmt.Errorf("cannot find keyslot in cryptsetup output")
+	}
+	return strconv.Atoi(string(m[1]))
+}
+
+// newUnlockResponse creates the response for a volume unlocked with the given
+// method.
+func newUnlockResponse(method string) *unlockResponse {
+	return &unlockResponse{
+		Method:   method,
+		Degraded: method == unlockMethodRecoveryKey,
+	}
+}
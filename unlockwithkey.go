@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	sb "github.com/snapcore/secboot"
+)
+
+type unlockWithKeyParams struct {
+	VolumeName       string `json:"volume-name"`
+	SourceDevicePath string `json:"source-device-path"`
+	// Key is the plaintext disk unlock key, encoded in base64 without
+	// padding like the key of the initial provisioning. Alternatively,
+	// the key can be read from KeyFile or from an inherited file
+	// descriptor.
+	Key     string `json:"key,omitempty"`
+	KeyFile string `json:"key-file,omitempty"`
+
+	activationFlags
+}
+
+// unlockWithKey activates the encrypted volume with a key provided by the
+// caller, without using the TPM.
+func unlockWithKey(p []byte, keyFD int) error {
+	var params unlockWithKeyParams
+	if err := json.Unmarshal(p, &params); err != nil {
+		return err
+	}
+
+	if params.VolumeName == "" {
+		return fmt.Errorf("volume name not specified")
+	}
+	if params.SourceDevicePath == "" {
+		return fmt.Errorf("source device path not specified")
+	}
+	if err := params.activationFlags.validate(); err != nil {
+		return err
+	}
+
+	var key []byte
+	switch {
+	case keyFD >= 0:
+		if params.Key != "" || params.KeyFile != "" {
+			return fmt.Errorf("cannot specify key in parameters when reading it from a file descriptor")
+		}
+		var err error
+		if key, err = readKeyFromFD(keyFD); err != nil {
+			return err
+		}
+	case params.KeyFile != "":
+		if params.Key != "" {
+			return fmt.Errorf("cannot specify both key and key file")
+		}
+		var err error
+		if key, err = ioutil.ReadFile(params.KeyFile); err != nil {
+			return fmt.Errorf("cannot read key file: %v", err)
+		}
+	default:
+		var err error
+		if key, err = base64.RawStdEncoding.DecodeString(params.Key); err != nil {
+			return fmt.Errorf("cannot decode key: %v", err)
+		}
+	}
+	if len(key) == 0 {
+		return fmt.Errorf("key not specified")
+	}
+
+	if err := sb.ActivateVolumeWithKey(params.VolumeName, params.SourceDevicePath, key, params.volumeOptions(nil)); err != nil {
+		return err
+	}
+	return writeResponse(newUnlockResponse(unlockMethodProvidedKey))
+}
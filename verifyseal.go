@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+
+	"github.com/canonical/go-tpm2"
+	sb "github.com/snapcore/secboot"
+)
+
+// currentPCRDigest returns the digest of the current values of the selected
+// PCRs, computed like TPM2_PolicyPCR does.
+func currentPCRDigest(tpm *sb.TPMConnection, pcrs tpm2.PCRSelectionList) (tpm2.Digest, error) {
+	_, values, err := tpm.PCRRead(pcrs)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read PCR values: %v", err)
+	}
+	h := sha256.New()
+	for _, s := range pcrs {
+		selected := append([]int(nil), s.Select...)
+		sort.Ints(selected)
+		for _, pcr := range selected {
+			h.Write(values[s.Hash][pcr])
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+// profileMatchesCurrentPCRs returns true if the current PCR values satisfy
+// one of the branches of the profile, so a key sealed to it can be unsealed
+// in this boot.
+func profileMatchesCurrentPCRs(tpm *sb.TPMConnection, pcrProfile *sb.PCRProtectionProfile) (bool, error) {
+	pcrs, digests, err := pcrProfile.ComputePCRDigests(tpm.TPMContext, tpm2.HashAlgorithmSHA256)
+	if err != nil {
+		return false, fmt.Errorf("cannot compute PCR digests: %v", err)
+	}
+	current, err := currentPCRDigest(tpm, pcrs)
+	if err != nil {
+		return false, err
+	}
+	for _, d := range digests {
+		if bytes.Equal(d, current) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// verifySealedKey unseals the key just sealed and checks that it's the
+// given key, so a broken profile is found when provisioning instead of on
+// the next boot. The key can only be unsealed if the profile allows the
+// current PCR values, e.g. not when sealing to the assets of the next boot,
+// and the check is skipped otherwise.
+func verifySealedKey(tpm *sb.TPMConnection, pcrProfile *sb.PCRProtectionProfile, key []byte) error {
+	match, err := profileMatchesCurrentPCRs(tpm, pcrProfile)
+	if err != nil {
+		return err
+	}
+	if !match {
+		logf("the policy doesn't allow the current PCR values, skipping verification unseal")
+		return nil
+	}
+	k, err := readSealedKey(sealedKeyFile)
+	if err != nil {
+		return fmt.Errorf("cannot read sealed key object: %v", err)
+	}
+	if k.AuthMode2F() != sb.AuthModeNone {
+		logf("the sealed key is protected by a PIN, skipping verification unseal")
+		return nil
+	}
+	unsealed, _, err := k.UnsealFromTPM(tpm, "")
+	if err != nil {
+		return fmt.Errorf("verification unseal failed: %v", err)
+	}
+	if !bytes.Equal(unsealed, key) {
+		return fmt.Errorf("verification unseal returned a different key")
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+
+	"github.com/canonical/go-tpm2"
+)
+
+// per-volume sealed keys are kept in the boot partition, together with an
+// index used to find the key of each volume
+const (
+	defaultVolumeKeysDir = "/run/mnt/ubuntu-boot/device/fde"
+	volumeKeyIndexName   = "volume-keys.json"
+)
+
+var volumeKeyNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// volumeKeyEntry describes the sealed key of a volume.
+type volumeKeyEntry struct {
+	// UUID is the UUID of the LUKS volume the key unlocks, if known.
+	UUID string `json:"uuid,omitempty"`
+	// PCRPolicyCounterHandle is the NV index of the PCR policy counter
+	// of the key. Each key needs its own counter.
+	PCRPolicyCounterHandle tpm2.Handle `json:"pcr-policy-counter-handle"`
+	// Backend protects the key, "tpm2" if not set.
+	Backend string `json:"backend,omitempty"`
+}
+
+// volumeKeyIndex maps the names of per-volume sealed keys, e.g. the role of
+// the volume, to the volumes they unlock. It's the registry of the named
+// secrets other than the built-in data and save keys.
+type volumeKeyIndex struct {
+	Keys map[string]*volumeKeyEntry `json:"keys"`
+}
+
+func volumeKeyIndexFile() string {
+	return filepath.Join(volumeKeysDir, volumeKeyIndexName)
+}
+
+// volumeKeyFile returns the path of the sealed key with the given name.
+func volumeKeyFile(name string) string {
+	return filepath.Join(volumeKeysDir, name+".sealed-key")
+}
+
+func readVolumeKeyIndex() (*volumeKeyIndex, error) {
+	idx := &volumeKeyIndex{Keys: map[string]*volumeKeyEntry{}}
+	path := volumeKeyIndexFile()
+	if err := checkFileSecure(path); err != nil {
+		if os.IsNotExist(err) {
+			return idx, nil
+		}
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, idx); err != nil {
+		return nil, fmt.Errorf("cannot parse volume key index: %v", err)
+	}
+	if idx.Keys == nil {
+		idx.Keys = map[string]*volumeKeyEntry{}
+	}
+	return idx, nil
+}
+
+func (idx *volumeKeyIndex) write() error {
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(volumeKeysDir, 0700); err != nil {
+		return err
+	}
+	path := volumeKeyIndexFile()
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("cannot write volume key index: %v", err)
+	}
+	if err := secureFile(tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// entry returns the entry of the named key, allocating a PCR policy counter
+// handle not used by other keys if the entry doesn't exist yet.
+func (idx *volumeKeyIndex) entry(name string) *volumeKeyEntry {
+	if e, ok := idx.Keys[name]; ok {
+		return e
+	}
+	// the default handle is kept for the global sealed key
+	handle := defaultPCRPolicyCounterHandle + 1
+	for _, e := range idx.Keys {
+		if e.PCRPolicyCounterHandle >= handle {
+			handle = e.PCRPolicyCounterHandle + 1
+		}
+	}
+	e := &volumeKeyEntry{PCRPolicyCounterHandle: handle}
+	idx.Keys[name] = e
+	return e
+}
+
+// lookupUUID returns the name of the key of the volume with the given UUID.
+func (idx *volumeKeyIndex) lookupUUID(uuid string) (string, bool) {
+	for name, e := range idx.Keys {
+		if e.UUID != "" && e.UUID == uuid {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// volumeUUID returns the UUID of the LUKS volume in the given device.
+func volumeUUID(device string) (string, error) {
+	output, err := exec.Command("blkid", "-p", "-s", "UUID", "-o", "value", device).Output()
+	if err != nil {
+		return "", fmt.Errorf("cannot probe %s: %v", device, err)
+	}
+	return string(bytes.TrimSpace(output)), nil
+}
+
+// useVolumeKey makes the helper use the sealed key with the given name and
+// its PCR policy counter instead of the global sealed key.
+func useVolumeKey(name string, e *volumeKeyEntry) {
+	sealedKeyFile = volumeKeyFile(name)
+	pcrPolicyCounterHandle = e.PCRPolicyCounterHandle
+}
+
+// selectVolumeKey selects the named secret or, if no name is given, the key
+// recorded for the volume in the given device. The global sealed key is kept
+// if the volume has no key of its own.
+func selectVolumeKey(name, device string) error {
+	if s, ok := builtinSecret(name); ok {
+		sealedKeyFile = s.KeyFile
+		return nil
+	}
+	idx, err := readVolumeKeyIndex()
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		if len(idx.Keys) == 0 || device == "" {
+			return nil
+		}
+		uuid, err := volumeUUID(device)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if name, ok = idx.lookupUUID(uuid); !ok {
+			return nil
+		}
+	}
+	s, ok := idx.secret(name)
+	if !ok {
+		return fmt.Errorf("unknown volume key %q", name)
+	}
+	if s.Backend != backendTPM2 {
+		return fmt.Errorf("volume key %q uses unsupported backend %q", name, s.Backend)
+	}
+	useVolumeKey(name, s.entry)
+	return nil
+}
+
+// prepareVolumeKey selects a per-volume key to be sealed, and returns a
+// function to record it in the index once sealed. The UUID of the volume in
+// the given device, if any, is recorded for lookup.
+func prepareVolumeKey(name, device string) (func() error, error) {
+	switch name {
+	case keyNameData:
+		// the global sealed key
+		return func() error { return nil }, nil
+	case keyNameSave:
+		return nil, fmt.Errorf("the save key is sealed with the data key")
+	}
+	if !volumeKeyNameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("invalid volume key name %q", name)
+	}
+	idx, err := readVolumeKeyIndex()
+	if err != nil {
+		return nil, err
+	}
+	_, exists := idx.Keys[name]
+	e := idx.entry(name)
+	if !exists {
+		// skip counter handles used by other software
+		tpm, err := connectTPM()
+		if err != nil {
+			return nil, fmt.Errorf("cannot connect to TPM: %v", err)
+		}
+		e.PCRPolicyCounterHandle, err = freeHandle(tpm, e.PCRPolicyCounterHandle)
+		tpm.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if device != "" {
+		uuid, err := volumeUUID(device)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := idx.lookupUUID(uuid); ok && other != name {
+			return nil, fmt.Errorf("volume %s already has key %q", device, other)
+		}
+		e.UUID = uuid
+	}
+	if err := os.MkdirAll(volumeKeysDir, 0700); err != nil {
+		return nil, err
+	}
+	useVolumeKey(name, e)
+	return idx.write, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// watchdogs the helper can keep alive during long operations
+const (
+	watchdogNone     = "none"
+	watchdogSystemd  = "systemd"
+	watchdogHardware = "hardware"
+)
+
+// hardware watchdog device, not resolved under the root directory
+const hardwareWatchdogDevice = "/dev/watchdog"
+
+// WDIOC_GETTIMEOUT from linux/watchdog.h
+const wdiocGetTimeout = 0x80045707
+
+// interval used if the watchdog timeout can't be read
+const defaultWatchdogInterval = 5 * time.Second
+
+// watchdog keeps the systemd or hardware watchdog alive while the helper
+// runs, and aborts the helper once its deadline expires.
+type watchdog struct {
+	pet      func() error
+	close    func()
+	interval time.Duration
+	stop     chan struct{}
+	deadline *time.Timer
+}
+
+// activeWatchdog is the watchdog started by startWatchdog, if any.
+var activeWatchdog *watchdog
+
+// systemdWatchdog returns a watchdog notifying the service manager, which
+// must have enabled it for this process.
+func systemdWatchdog() (*watchdog, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if socket == "" || err != nil || usec <= 0 {
+		return nil, fmt.Errorf("systemd watchdog is not enabled for the helper")
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, fmt.Errorf("systemd watchdog is enabled for process %s", pid)
+	}
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to service manager: %v", err)
+	}
+	return &watchdog{
+		pet: func() error {
+			_, err := conn.Write([]byte("WATCHDOG=1"))
+			return err
+		},
+		close:    func() { conn.Close() },
+		interval: time.Duration(usec) * time.Microsecond / 2,
+	}, nil
+}
+
+// hardwareWatchdog returns a watchdog writing to the watchdog device. The
+// device is disarmed when the helper finishes, unless the deadline expired,
+// so a device that can't unlock is reset.
+func hardwareWatchdog() (*watchdog, error) {
+	f, err := os.OpenFile(hardwareWatchdogDevice, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open watchdog: %v", err)
+	}
+	interval := defaultWatchdogInterval
+	var timeout int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), wdiocGetTimeout, uintptr(unsafe.Pointer(&timeout))); errno == 0 && timeout > 0 {
+		interval = time.Duration(timeout) * time.Second / 2
+	}
+	return &watchdog{
+		pet: func() error {
+			_, err := f.Write([]byte{0})
+			return err
+		},
+		close: func() {
+			// the magic close character disarms the watchdog
+			f.Write([]byte("V"))
+			f.Close()
+		},
+		interval: interval,
+	}, nil
+}
+
+// startWatchdog starts keeping the given watchdog alive, and aborts the
+// helper with a reboot-recommended error if it's still running after the
+// deadline in seconds, if set.
+func startWatchdog(kind string, deadline int) error {
+	var w *watchdog
+	var err error
+	switch kind {
+	case "", watchdogNone:
+		w = &watchdog{}
+	case watchdogSystemd:
+		w, err = systemdWatchdog()
+	case watchdogHardware:
+		w, err = hardwareWatchdog()
+	default:
+		err = fmt.Errorf("invalid watchdog %q", kind)
+	}
+	if err != nil {
+		return err
+	}
+	w.stop = make(chan struct{})
+	if w.pet != nil {
+		if err := w.pet(); err != nil {
+			return fmt.Errorf("cannot pet watchdog: %v", err)
+		}
+		go w.run()
+	}
+	if deadline > 0 {
+		w.deadline = time.AfterFunc(time.Duration(deadline)*time.Second, func() {
+			// stop petting so a hardware watchdog resets the device
+			// even if the helper can't exit, e.g. stuck in the TPM
+			// driver
+			close(w.stop)
+			exit(&codedError{
+				code: errorCodeRebootRecommended,
+				err:  fmt.Errorf("operation did not finish in %d seconds", deadline),
+			})
+		})
+	}
+	activeWatchdog = w
+	return nil
+}
+
+func (w *watchdog) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			if err := w.pet(); err != nil {
+				warnf("cannot pet watchdog: %v", err)
+			}
+		}
+	}
+}
+
+// stopWatchdog stops keeping the watchdog alive when the helper finishes,
+// disarming the hardware watchdog unless the deadline expired.
+func stopWatchdog() {
+	w := activeWatchdog
+	if w == nil {
+		return
+	}
+	activeWatchdog = nil
+	if w.deadline != nil && !w.deadline.Stop() {
+		// the deadline expired, leave the watchdog armed
+		return
+	}
+	close(w.stop)
+	if w.close != nil {
+		w.close()
+	}
+}